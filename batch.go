@@ -0,0 +1,230 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/sorcix/irc"
+)
+
+// Common IRCv3 batch types
+const (
+	BatchNetsplit           = "netsplit"
+	BatchNetjoin            = "netjoin"
+	BatchChatHistory        = "chathistory"
+	BatchLabeledResponse    = "labeled-response"
+	BatchChatHistoryTargets = "draft/chathistory-targets"
+)
+
+// Batch is an IRCv3 batch of messages.
+type Batch struct {
+	Reference string
+	Type      string
+	Params    []string
+	Parent    *Batch
+	// Events contains the messages in the batch in the order they were received.
+	// Nested batches are included as BATCH events with the Batch field set.
+	Events []*Event
+}
+
+// Children returns the batches nested directly inside this batch.
+func (b *Batch) Children() (children []*Batch) {
+	for _, evt := range b.Events {
+		if evt.Batch != nil {
+			children = append(children, evt.Batch)
+		}
+	}
+	return
+}
+
+// Flatten returns all the messages in this batch and nested batches in the order they were received.
+func (b *Batch) Flatten() (events []*Event) {
+	for _, evt := range b.Events {
+		if evt.Batch != nil {
+			events = append(events, evt.Batch.Flatten()...)
+		} else {
+			events = append(events, evt)
+		}
+	}
+	return
+}
+
+// handleBatches collects messages that are a part of a batch. The return value tells whether or not the event should
+// be dispatched. When a top-level batch ends, the BATCH event that started it is returned for dispatching, and the
+// messages in the batch are dispatched after it with dispatchBatch.
+func (c *ConnImpl) handleBatches(evt *Event) (*Event, bool) {
+	if evt.Command == "BATCH" && len(evt.Params) > 0 && len(evt.Params[0]) > 1 {
+		ref := evt.Params[0][1:]
+		switch evt.Params[0][0] {
+		case '+':
+			batch := &Batch{Reference: ref}
+			if len(evt.Params) > 1 {
+				batch.Type = evt.Params[1]
+				batch.Params = args(evt.Message)[2:]
+			}
+			evt.Batch = batch
+			c.batches[ref] = batch
+			if parent, ok := c.batches[evt.Tags["batch"]]; ok {
+				batch.Parent = parent
+				evt.InBatch = parent
+				parent.Events = append(parent.Events, evt)
+			} else {
+				c.batchStarts[ref] = evt
+			}
+			return nil, false
+		case '-':
+			batch, ok := c.batches[ref]
+			if !ok {
+				return nil, false
+			}
+			delete(c.batches, ref)
+			start, ok := c.batchStarts[ref]
+			if batch.Parent != nil || !ok {
+				return nil, false
+			}
+			delete(c.batchStarts, ref)
+			return start, true
+		}
+	} else if batch, ok := c.batches[evt.Tags["batch"]]; ok {
+		evt.InBatch = batch
+		batch.Events = append(batch.Events, evt)
+		return nil, false
+	}
+	return evt, true
+}
+
+// dispatchBatch runs handlers for the messages in the given batch in the order they were received. Nested batches
+// are dispatched after the BATCH event that started them, unless a query claimed the nested batch.
+func (c *ConnImpl) dispatchBatch(batch *Batch) {
+	for _, evt := range batch.Events {
+		// Messages in batches are usually old, such as playback, so they aren't used to confirm deliveries.
+		evt.Echo = c.isOwnMessage(evt)
+		claimed := c.runHandlers(evt)
+		if evt.Batch != nil && !claimed {
+			c.dispatchBatch(evt.Batch)
+		}
+	}
+}
+
+// LabeledResponse is a handle for the reply to a request sent with SendLabeled.
+type LabeledResponse struct {
+	Label      string
+	c          *ConnImpl
+	done       chan struct{}
+	events     []*Event
+	batch      *Batch
+	batchEvent *Event
+	err        error
+}
+
+// Wait waits until the labeled reply has been received and returns the messages in it.
+// If the reply was a batch, all the messages in the batch are returned in order. If the reply was an ACK, the returned
+// slice is empty. ErrCalledFromHandler is returned if the reply hasn't been received yet and Wait is called from a
+// handler, since the reply can't be dispatched until the handler returns.
+func (lr *LabeledResponse) Wait(ctx context.Context) ([]*Event, error) {
+	select {
+	case <-lr.done:
+		return lr.events, lr.err
+	default:
+	}
+	var err error
+	if lr.c.inHandler() {
+		err = ErrCalledFromHandler
+	} else {
+		select {
+		case <-lr.done:
+			return lr.events, lr.err
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	lr.c.labelLock.Lock()
+	delete(lr.c.labels, lr.Label)
+	lr.c.labelLock.Unlock()
+	return nil, err
+}
+
+// Batch returns the labeled-response batch of the reply, or nil if the reply was a single message.
+// The return value is only valid after Wait has returned.
+func (lr *LabeledResponse) Batch() *Batch {
+	return lr.batch
+}
+
+// SendLabeled sends the given message with a label tag and returns a handle that collects the reply.
+// If the labeled-response capability is not enabled, the message is not sent and ErrCapNotEnabled is returned.
+func (c *ConnImpl) SendLabeled(msg *irc.Message) (*LabeledResponse, error) {
+	if !c.HasCap("labeled-response") {
+		return nil, ErrCapNotEnabled
+	} else if err := ValidateMessage(msg); err != nil {
+		return nil, err
+	}
+	lr := &LabeledResponse{
+		Label: "lmi" + strconv.FormatUint(atomic.AddUint64(&c.labelCounter, 1), 10),
+		c:     c,
+		done:  make(chan struct{}),
+	}
+	c.labelLock.Lock()
+	c.labels[lr.Label] = lr
+	c.labelLock.Unlock()
+	if err := c.SendTagged(msg, Tags{"label": lr.Label}); err != nil {
+		c.labelLock.Lock()
+		delete(c.labels, lr.Label)
+		c.labelLock.Unlock()
+		return nil, err
+	}
+	return lr, nil
+}
+
+// resolveLabel passes the given event to the labeled response waiting for it. The return value tells whether or not
+// a labeled response was waiting for the event.
+func (c *ConnImpl) resolveLabel(evt *Event) bool {
+	label := evt.Label()
+	if len(label) == 0 {
+		return false
+	}
+	c.labelLock.Lock()
+	lr, ok := c.labels[label]
+	delete(c.labels, label)
+	c.labelLock.Unlock()
+	if !ok {
+		return false
+	}
+	if evt.Batch != nil {
+		lr.batch = evt.Batch
+		lr.batchEvent = evt.Copy()
+		lr.events = evt.Batch.Flatten()
+	} else if evt.Command != "ACK" {
+		lr.events = []*Event{evt.Copy()}
+	}
+	close(lr.done)
+	return true
+}
+
+// failLabels cancels all pending labeled responses with the given error.
+func (c *ConnImpl) failLabels(err error) {
+	c.labelLock.Lock()
+	defer c.labelLock.Unlock()
+	for label, lr := range c.labels {
+		lr.err = err
+		close(lr.done)
+		delete(c.labels, label)
+	}
+}
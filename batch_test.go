@@ -0,0 +1,143 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+func TestParseTags(t *testing.T) {
+	tags := ParseTags(`time=2020-01-01T00:00:00.000Z;msgid=abc;+draft/reply=x\sy\:z\\;flag`)
+	expected := Tags{
+		"time":         "2020-01-01T00:00:00.000Z",
+		"msgid":        "abc",
+		"+draft/reply": `x y;z\`,
+		"flag":         "",
+	}
+	if len(tags) != len(expected) {
+		t.Fatalf("Expected %d tags, got %v", len(expected), tags)
+	}
+	for key, value := range expected {
+		if tags[key] != value {
+			t.Errorf("Tag %s: expected %q, got %q", key, value, tags[key])
+		}
+	}
+	if roundTrip := ParseTags(tags.String()); roundTrip["+draft/reply"] != expected["+draft/reply"] {
+		t.Errorf("Tag value didn't survive escaping: %q", roundTrip["+draft/reply"])
+	}
+}
+
+// newBatchFake creates a fake server that advertises the batch capability and the given other capabilities, and a
+// connection to it that isn't connected yet.
+func newBatchFake(t *testing.T, caps ...string) (*fakeirc.Server, *ConnImpl) {
+	srv := fakeirc.NewServer()
+	t.Cleanup(srv.Close)
+	srv.Caps["batch"] = ""
+	for _, cap := range caps {
+		srv.Caps[cap] = ""
+	}
+	return srv, newFakeConn(t, srv, "tester")
+}
+
+func TestBatchDispatch(t *testing.T) {
+	srv, c := newBatchFake(t)
+	received := make(chan *Event, 10)
+	c.AddHandler("BATCH", func(evt *Event) {
+		received <- evt
+	})
+	c.AddHandler(irc.QUIT, func(evt *Event) {
+		received <- evt
+	})
+	client := connectFake(t, srv, c)
+	client.Send("BATCH +split netsplit irc.hub other.host")
+	client.Send("@batch=split :alice!a@a.example QUIT :irc.hub other.host")
+	client.Send("@batch=split :bob!b@b.example QUIT :irc.hub other.host")
+	client.Send("BATCH -split")
+
+	ctx := testContext(t)
+	var events []*Event
+	for len(events) < 3 {
+		select {
+		case evt := <-received:
+			events = append(events, evt)
+		case <-ctx.Done():
+			t.Fatalf("Only received %d events", len(events))
+		}
+	}
+	if events[0].Command != "BATCH" || events[0].Batch == nil || events[0].Batch.Type != BatchNetsplit {
+		t.Fatalf("Expected the BATCH event first, got %+v", events[0])
+	} else if len(events[0].Batch.Events) != 2 {
+		t.Errorf("Expected 2 events in the batch, got %d", len(events[0].Batch.Events))
+	}
+	for i, nick := range []string{"alice", "bob"} {
+		evt := events[i+1]
+		if evt.Command != irc.QUIT || evt.Name != nick {
+			t.Errorf("Expected QUIT from %s, got %s from %s", nick, evt.Command, evt.Name)
+		} else if evt.InBatch != events[0].Batch {
+			t.Errorf("InBatch of QUIT from %s isn't the netsplit batch", nick)
+		}
+	}
+}
+
+func TestLabeledBatchNotDispatched(t *testing.T) {
+	srv, c := newBatchFake(t, "labeled-response")
+	srv.On(irc.WHOIS, func(client *fakeirc.Client, msg *irc.Message) bool {
+		return true
+	})
+	dispatched := make(chan *Event, 10)
+	c.AddHandler(irc.RPL_WHOISUSER, func(evt *Event) {
+		dispatched <- evt
+	})
+	client := connectFake(t, srv, c)
+	lr, err := c.SendLabeled(&irc.Message{Command: irc.WHOIS, Params: []string{"bob"}})
+	if err != nil {
+		t.Fatal("Failed to send labeled request:", err)
+	}
+	ctx := testContext(t)
+	line, err := srv.Expect(ctx, "WHOIS bob")
+	if err != nil {
+		t.Fatal("Server didn't receive WHOIS:", err)
+	}
+	label := ParseTags(line.Tags)["label"]
+	client.Send("@label=" + label + " BATCH +w labeled-response")
+	client.Send("@batch=w :irc.example.com 311 tester bob ~b b.example * :Bob")
+	client.Send("@batch=w :irc.example.com 318 tester bob :End of WHOIS")
+	client.Send("BATCH -w")
+
+	events, err := lr.Wait(ctx)
+	if err != nil {
+		t.Fatal("Labeled response failed:", err)
+	} else if len(events) != 2 || events[0].Command != irc.RPL_WHOISUSER {
+		t.Fatalf("Unexpected labeled response: %+v", events)
+	} else if lr.Batch() == nil || lr.Batch().Type != BatchLabeledResponse {
+		t.Errorf("Labeled response batch wasn't set")
+	}
+	// Lines are handled in order, so the batch has been fully handled when the PING is answered.
+	client.Send("PING :sync")
+	if _, err = srv.Expect(ctx, "PONG"); err != nil {
+		t.Fatal("Didn't receive PONG:", err)
+	}
+	select {
+	case evt := <-dispatched:
+		t.Errorf("Message in labeled batch was passed to handlers: %s", evt)
+	default:
+	}
+}
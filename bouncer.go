@@ -0,0 +1,281 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// soju bouncer-networks capabilities and batch type
+const (
+	CapBouncerNetworks       = "soju.im/bouncer-networks"
+	CapBouncerNetworksNotify = "soju.im/bouncer-networks-notify"
+	BatchBouncerNetworks     = "soju.im/bouncer-networks"
+)
+
+// BouncerNetwork is a network on a bouncer that supports the soju.im/bouncer-networks extension.
+type BouncerNetwork struct {
+	ID string
+	// Attributes contains the attributes of the network, such as name, host, state and nickname.
+	Attributes Tags
+}
+
+// Name returns the name of the network.
+func (network *BouncerNetwork) Name() string {
+	return network.Attributes["name"]
+}
+
+// State returns the connection state of the network: connected, connecting or disconnected.
+func (network *BouncerNetwork) State() string {
+	return network.Attributes["state"]
+}
+
+// copy returns a copy of the network that doesn't share the attribute map.
+func (network *BouncerNetwork) copy() *BouncerNetwork {
+	attrs := make(Tags, len(network.Attributes))
+	for key, value := range network.Attributes {
+		attrs[key] = value
+	}
+	return &BouncerNetwork{ID: network.ID, Attributes: attrs}
+}
+
+// BouncerClient manages the networks of a bouncer that supports the soju.im/bouncer-networks extension through a
+// control connection, and creates connections bound to single networks.
+type BouncerClient struct {
+	// Conn is the control connection.
+	Conn *ConnImpl
+
+	networks map[string]*BouncerNetwork
+	lock     sync.RWMutex
+}
+
+// NewBouncerClient creates a bouncer client on top of the given control connection. The bouncer-networks
+// capabilities are requested, so this should be called before connecting. Network change notifications are emitted
+// on the control connection as BouncerNetworkEvents.
+func NewBouncerClient(conn *ConnImpl) *BouncerClient {
+	bc := &BouncerClient{
+		Conn:     conn,
+		networks: make(map[string]*BouncerNetwork),
+	}
+	conn.RequestCaps(CapBouncerNetworks, CapBouncerNetworksNotify)
+	conn.AddHandler("BOUNCER", bc.handleBouncer)
+	return bc
+}
+
+// handleBouncer handles network notifications.
+func (bc *BouncerClient) handleBouncer(evt *Event) {
+	params := evt.Args()
+	if len(params) < 3 || params[0] != "NETWORK" {
+		return
+	}
+	id, rawAttrs := params[1], params[2]
+	bouncerEvt := &BouncerNetworkEvent{
+		eventSource: eventSource{evt},
+		ID:          id,
+	}
+	bc.lock.Lock()
+	if rawAttrs == "*" {
+		delete(bc.networks, id)
+		bouncerEvt.Deleted = true
+	} else {
+		bouncerEvt.Changed = ParseTags(rawAttrs)
+		bouncerEvt.Network = bc.applyChanges(id, bouncerEvt.Changed)
+	}
+	bc.lock.Unlock()
+	bc.Conn.emit(bouncerEvt)
+}
+
+// applyChanges applies attribute changes to the cached network and returns a copy of the result. Attributes with an
+// empty value are removed. The lock must be held.
+func (bc *BouncerClient) applyChanges(id string, changes Tags) *BouncerNetwork {
+	network, ok := bc.networks[id]
+	if !ok {
+		network = &BouncerNetwork{ID: id, Attributes: make(Tags)}
+		bc.networks[id] = network
+	}
+	for key, value := range changes {
+		if len(value) == 0 {
+			delete(network.Attributes, key)
+		} else {
+			network.Attributes[key] = value
+		}
+	}
+	return network.copy()
+}
+
+// Networks returns the networks known from the latest ListNetworks call and notifications, sorted by ID.
+func (bc *BouncerClient) Networks() []*BouncerNetwork {
+	bc.lock.RLock()
+	networks := make([]*BouncerNetwork, 0, len(bc.networks))
+	for _, network := range bc.networks {
+		networks = append(networks, network.copy())
+	}
+	bc.lock.RUnlock()
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].ID < networks[j].ID
+	})
+	return networks
+}
+
+// Network returns the network with the given ID, or nil if it's not known.
+func (bc *BouncerClient) Network(id string) *BouncerNetwork {
+	bc.lock.RLock()
+	defer bc.lock.RUnlock()
+	if network, ok := bc.networks[id]; ok {
+		return network.copy()
+	}
+	return nil
+}
+
+// isBouncerFail checks if the given event is a FAIL reply to the given BOUNCER subcommand.
+func isBouncerFail(evt *Event, subcommand string) bool {
+	params := evt.Args()
+	return evt.Command == "FAIL" && len(params) > 2 && params[0] == "BOUNCER" && params[2] == subcommand
+}
+
+// ListNetworks requests the list of networks from the bouncer.
+func (bc *BouncerClient) ListNetworks(ctx context.Context) ([]*BouncerNetwork, error) {
+	if !bc.Conn.HasCap(CapBouncerNetworks) || !bc.Conn.HasCap("batch") {
+		return nil, ErrCapNotEnabled
+	}
+	var result *Batch
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		if evt.Batch != nil {
+			result = findBatch(evt.Batch, BatchBouncerNetworks, "")
+			return result != nil, true
+		} else if isBouncerFail(evt, "LISTNETWORKS") {
+			q.err = standardReplyError(evt.Message)
+			return true, true
+		}
+		return false, false
+	}
+	err := bc.Conn.runQuery(ctx, q, &irc.Message{
+		Command: "BOUNCER",
+		Params:  []string{"LISTNETWORKS"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var networks []*BouncerNetwork
+	fresh := make(map[string]*BouncerNetwork)
+	if result != nil {
+		for _, evt := range result.Flatten() {
+			params := evt.Args()
+			if evt.Command != "BOUNCER" || len(params) < 3 || params[0] != "NETWORK" {
+				continue
+			}
+			network := &BouncerNetwork{ID: params[1], Attributes: ParseTags(params[2])}
+			fresh[network.ID] = network
+			networks = append(networks, network.copy())
+		}
+	}
+	bc.lock.Lock()
+	bc.networks = fresh
+	bc.lock.Unlock()
+	return networks, nil
+}
+
+// bouncerCommand sends a BOUNCER subcommand and waits for the reply with the same subcommand.
+func (bc *BouncerClient) bouncerCommand(ctx context.Context, params ...string) (reply []string, err error) {
+	if !bc.Conn.HasCap(CapBouncerNetworks) {
+		return nil, ErrCapNotEnabled
+	}
+	subcommand := params[0]
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		args := evt.Args()
+		if evt.Command == "BOUNCER" && len(args) > 0 && args[0] == subcommand {
+			reply = args
+			return true, true
+		} else if isBouncerFail(evt, subcommand) {
+			q.err = standardReplyError(evt.Message)
+			return true, true
+		}
+		return false, false
+	}
+	err = bc.Conn.runQuery(ctx, q, &irc.Message{
+		Command: "BOUNCER",
+		Params:  params,
+	})
+	return
+}
+
+// AddNetwork adds a network with the given attributes to the bouncer and returns the ID of the new network.
+// The name or host attribute is required.
+func (bc *BouncerClient) AddNetwork(ctx context.Context, attrs Tags) (string, error) {
+	reply, err := bc.bouncerCommand(ctx, "ADDNETWORK", attrs.String())
+	if err != nil {
+		return "", err
+	} else if len(reply) < 2 {
+		return "", ErrInvalidReply
+	}
+	return reply[1], nil
+}
+
+// ChangeNetwork changes the attributes of the given network. Attributes set to an empty value are removed.
+func (bc *BouncerClient) ChangeNetwork(ctx context.Context, id string, attrs Tags) error {
+	_, err := bc.bouncerCommand(ctx, "CHANGENETWORK", id, attrs.String())
+	return err
+}
+
+// DeleteNetwork deletes the given network from the bouncer.
+func (bc *BouncerClient) DeleteNetwork(ctx context.Context, id string) error {
+	_, err := bc.bouncerCommand(ctx, "DELNETWORK", id)
+	return err
+}
+
+// Bind creates a connection to the bouncer that is bound to the given network. The connection shares the address,
+// credentials and settings of the control connection and sends BOUNCER BIND before completing registration on every
+// connect. It isn't connected yet, so that handlers can be added before calling Connect.
+func (bc *BouncerClient) Bind(id string) Connection {
+	parent := bc.Conn
+	c := Create(parent.PreferredNick, parent.User, parent.Address).(*ConnImpl)
+	c.RealName = parent.RealName
+	c.AltNicks = parent.AltNicks
+	c.Auth = append(c.Auth, parent.Auth...)
+	c.UseTLS = parent.UseTLS
+	c.TLSConfig = parent.TLSConfig
+	c.Dialer = parent.Dialer
+	c.DebugWriter = parent.DebugWriter
+	parent.loggerLock.Lock()
+	c.Logger = parent.Logger
+	parent.loggerLock.Unlock()
+	c.Recorder = parent.Recorder
+	c.Version = parent.Version
+	c.QuitMsg = parent.QuitMsg
+	parent.capLock.RLock()
+	for cap, wanted := range parent.wantedCaps {
+		if wanted && cap != CapBouncerNetworksNotify {
+			c.wantedCaps[cap] = true
+		}
+	}
+	parent.capLock.RUnlock()
+	c.wantedCaps[CapBouncerNetworks] = true
+	c.OnCapEnd(func() {
+		c.Send(&irc.Message{
+			Command: "BOUNCER",
+			Params:  []string{"BIND", id},
+		})
+	})
+	return c
+}
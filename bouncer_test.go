@@ -0,0 +1,131 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+func TestBouncerNetworkNotifications(t *testing.T) {
+	c := newOfflineConn("tester")
+	bc := NewBouncerClient(c)
+	var events []*BouncerNetworkEvent
+	c.AddTypedHandler(func(evt TypedEvent) {
+		if bouncerEvt, ok := evt.(*BouncerNetworkEvent); ok {
+			events = append(events, bouncerEvt)
+		}
+	})
+	feedLines(c,
+		":bouncer BOUNCER NETWORK 1 name=Libera\\sChat;host=irc.libera.chat;state=connecting",
+		":bouncer BOUNCER NETWORK 1 state=connected;host=",
+		":bouncer BOUNCER NETWORK 2 name=oftc",
+		":bouncer BOUNCER NETWORK 2 *",
+		":bouncer BOUNCER ADDNETWORK 3",
+		":bouncer BOUNCER NETWORK")
+	if len(events) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(events))
+	}
+	if events[0].ID != "1" || events[0].Network.Name() != "Libera Chat" || events[0].Network.State() != "connecting" {
+		t.Errorf("Unexpected first event: %+v", events[0])
+	}
+	if changed := events[1].Changed; changed["state"] != "connected" || changed["host"] != "" {
+		t.Errorf("Unexpected changes in second event: %+v", changed)
+	} else if _, ok := events[1].Network.Attributes["host"]; ok {
+		t.Error("Attribute with an empty value wasn't removed")
+	}
+	if !events[3].Deleted || events[3].ID != "2" || events[3].Network != nil {
+		t.Errorf("Unexpected deletion event: %+v", events[3])
+	}
+	networks := bc.Networks()
+	if len(networks) != 1 || networks[0].ID != "1" || networks[0].Name() != "Libera Chat" ||
+		networks[0].State() != "connected" {
+		t.Errorf("Unexpected networks: %+v", networks)
+	}
+	// The returned networks are copies.
+	networks[0].Attributes["name"] = "changed"
+	if bc.Network("1").Name() != "Libera Chat" {
+		t.Error("Changing a returned network changed the cached network")
+	} else if bc.Network("2") != nil {
+		t.Error("Deleted network is still known")
+	}
+}
+
+func TestBouncerListNetworks(t *testing.T) {
+	srv, c := newBatchFake(t, CapBouncerNetworks)
+	srv.On("BOUNCER", func(client *fakeirc.Client, msg *irc.Message) bool {
+		switch msg.Params[0] {
+		case "LISTNETWORKS":
+			client.Send("BATCH +n " + BatchBouncerNetworks)
+			client.Send("@batch=n :bouncer BOUNCER NETWORK 1 name=libera;state=connected")
+			client.Send("@batch=n :bouncer BOUNCER NETWORK 4 name=oftc\\:\\sold;state=disconnected")
+			client.Send("BATCH -n")
+		case "DELNETWORK":
+			client.Send("FAIL BOUNCER INVALID_NETID DELNETWORK " + msg.Params[1] + " :Invalid network ID")
+		}
+		return true
+	})
+	bc := NewBouncerClient(c)
+	connectFake(t, srv, c)
+	ctx := testContext(t)
+	networks, err := bc.ListNetworks(ctx)
+	if err != nil {
+		t.Fatal("ListNetworks failed:", err)
+	} else if len(networks) != 2 {
+		t.Fatalf("Expected 2 networks, got %+v", networks)
+	}
+	if networks[0].ID != "1" || networks[0].Name() != "libera" || networks[0].State() != "connected" {
+		t.Errorf("Unexpected first network: %+v", networks[0])
+	} else if networks[1].ID != "4" || networks[1].Name() != "oftc; old" {
+		t.Errorf("Unexpected second network: %+v", networks[1])
+	}
+	if len(bc.Networks()) != 2 {
+		t.Errorf("Listed networks weren't cached: %+v", bc.Networks())
+	}
+
+	err = bc.DeleteNetwork(ctx, "9")
+	if replyErr, ok := err.(StandardReplyError); !ok || replyErr.Code != "INVALID_NETID" {
+		t.Errorf("Expected an INVALID_NETID error, got %v", err)
+	}
+}
+
+func TestBouncerBind(t *testing.T) {
+	srv, c := newBatchFake(t, CapBouncerNetworks)
+	srv.On("BOUNCER", func(client *fakeirc.Client, msg *irc.Message) bool {
+		return true
+	})
+	bc := NewBouncerClient(c)
+	bound := bc.Bind("3").(*ConnImpl)
+	connectFake(t, srv, bound)
+	bind, capEnd := -1, -1
+	for i, line := range srv.Lines() {
+		if line.Text == "BOUNCER BIND 3" {
+			bind = i
+		} else if strings.HasPrefix(line.Text, "CAP END") {
+			capEnd = i
+		}
+	}
+	if bind < 0 || capEnd < 0 {
+		t.Fatalf("Bound connection didn't send BOUNCER BIND and CAP END: %d, %d", bind, capEnd)
+	} else if bind > capEnd {
+		t.Error("BOUNCER BIND was sent after CAP END")
+	}
+}
@@ -0,0 +1,197 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Capabilities contains functions to manage IRCv3 capabilities
+type Capabilities interface {
+	// RequestCaps adds the given capabilities to the list of capabilities requested from the server.
+	// If the connection is already active, the capabilities are requested immediately if the server supports them.
+	RequestCaps(caps ...string)
+	// HasCap checks if the given capability is enabled.
+	HasCap(cap string) bool
+	// CapValue returns the value the server advertised for the given capability.
+	CapValue(cap string) (value string, ok bool)
+	// OnCapEnd adds a function that's called right before CAP END is sent on every connection. Registration is still
+	// in progress when it's called, so it can send commands that must be sent before registration completes.
+	OnCapEnd(hook func())
+}
+
+// RequestCaps - See Capabilities interface docs
+func (c *ConnImpl) RequestCaps(caps ...string) {
+	c.capLock.Lock()
+	var request []string
+	for _, cap := range caps {
+		if c.wantedCaps[cap] {
+			continue
+		}
+		c.wantedCaps[cap] = true
+		if _, available := c.availableCaps[cap]; available {
+			request = append(request, cap)
+		}
+	}
+	c.capLock.Unlock()
+	if len(request) > 0 && c.Connected() {
+		c.requestCaps(request)
+	}
+}
+
+// HasCap - See Capabilities interface docs
+func (c *ConnImpl) HasCap(cap string) bool {
+	c.capLock.RLock()
+	defer c.capLock.RUnlock()
+	_, ok := c.enabledCaps[cap]
+	return ok
+}
+
+// CapValue - See Capabilities interface docs
+func (c *ConnImpl) CapValue(cap string) (value string, ok bool) {
+	c.capLock.RLock()
+	defer c.capLock.RUnlock()
+	value, ok = c.availableCaps[cap]
+	return
+}
+
+// OnCapEnd - See Capabilities interface docs
+func (c *ConnImpl) OnCapEnd(hook func()) {
+	c.capLock.Lock()
+	c.capEndHooks = append(c.capEndHooks, hook)
+	c.capLock.Unlock()
+}
+
+// resetCaps clears the capabilities negotiated with the previous connection.
+func (c *ConnImpl) resetCaps() {
+	c.capLock.Lock()
+	c.availableCaps = make(map[string]string)
+	c.enabledCaps = make(map[string]string)
+	c.capRequests = 0
+	c.capNegotiating = len(c.wantedCaps) > 0
+	c.capLock.Unlock()
+}
+
+// requestCaps sends a CAP REQ for the given capabilities.
+func (c *ConnImpl) requestCaps(caps []string) {
+	c.capLock.Lock()
+	c.capRequests++
+	c.capLock.Unlock()
+	c.Send(&irc.Message{
+		Command:  "CAP",
+		Params:   []string{"REQ"},
+		Trailing: strings.Join(caps, " "),
+	})
+}
+
+// endCapNegotiation sends CAP END if capability negotiation is in progress and there are no pending requests.
+func (c *ConnImpl) endCapNegotiation() {
+	c.capLock.Lock()
+	end := c.capNegotiating && c.capRequests == 0
+	if end {
+		c.capNegotiating = false
+	}
+	hooks := c.capEndHooks
+	c.capLock.Unlock()
+	if end {
+		for _, hook := range hooks {
+			hook()
+		}
+		c.Send(&irc.Message{
+			Command: "CAP",
+			Params:  []string{"END"},
+		})
+	}
+}
+
+// handleCap handles CAP messages from the server.
+func (c *ConnImpl) handleCap(evt *Event) {
+	params := evt.Args()
+	if len(params) < 3 {
+		return
+	}
+	caps := strings.Fields(params[len(params)-1])
+	switch params[1] {
+	case "LS", "NEW":
+		c.capLock.Lock()
+		var names []string
+		for _, cap := range caps {
+			parts := strings.SplitN(cap, "=", 2)
+			if len(parts) == 1 {
+				parts = append(parts, "")
+			}
+			c.availableCaps[parts[0]] = parts[1]
+			names = append(names, parts[0])
+		}
+		// A * before the capability list means that there are more lines coming.
+		if params[1] == "LS" {
+			if params[2] == "*" {
+				c.capLock.Unlock()
+				return
+			}
+			names = names[:0]
+			for cap := range c.availableCaps {
+				names = append(names, cap)
+			}
+		}
+		var request []string
+		for _, cap := range names {
+			if _, enabled := c.enabledCaps[cap]; c.wantedCaps[cap] && !enabled {
+				request = append(request, cap)
+			}
+		}
+		c.capLock.Unlock()
+		if len(request) > 0 {
+			c.requestCaps(request)
+		}
+		c.endCapNegotiation()
+	case "ACK":
+		c.capLock.Lock()
+		for _, cap := range caps {
+			if strings.HasPrefix(cap, "-") {
+				delete(c.enabledCaps, cap[1:])
+			} else {
+				c.enabledCaps[cap] = c.availableCaps[cap]
+			}
+		}
+		c.capRequests--
+		c.capLock.Unlock()
+		c.endCapNegotiation()
+	case "NAK":
+		c.capLock.Lock()
+		c.capRequests--
+		c.capLock.Unlock()
+		if len(caps) > 1 {
+			// The server rejects the whole request if any of the capabilities are rejected,
+			// so try requesting the capabilities one by one.
+			for _, cap := range caps {
+				c.requestCaps([]string{cap})
+			}
+		}
+		c.endCapNegotiation()
+	case "DEL":
+		c.capLock.Lock()
+		for _, cap := range caps {
+			delete(c.availableCaps, cap)
+			delete(c.enabledCaps, cap)
+		}
+		c.capLock.Unlock()
+	}
+}
@@ -0,0 +1,51 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMultiLineCapLS(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.RunHandlers(ParseEvent(":irc.example.com CAP * LS * :batch sasl=PLAIN"))
+	if lines := sentLines(c); len(lines) > 0 {
+		t.Fatalf("Expected nothing to be sent before the last CAP LS line, got %q", lines)
+	}
+	c.RunHandlers(ParseEvent(":irc.example.com CAP * LS :server-time unknown-cap"))
+	lines := sentLines(c)
+	if len(lines) != 1 || !strings.HasPrefix(lines[0], "CAP REQ :") {
+		t.Fatalf("Expected a single CAP REQ, got %q", lines)
+	}
+	requested := strings.Fields(strings.TrimPrefix(lines[0], "CAP REQ :"))
+	if len(requested) != 2 {
+		t.Errorf("Expected batch and server-time to be requested, got %q", requested)
+	}
+	if value, ok := c.CapValue("sasl"); !ok || value != "PLAIN" {
+		t.Errorf("Expected sasl to be available with the value PLAIN, got %q", value)
+	}
+
+	c.RunHandlers(ParseEvent(":irc.example.com CAP * ACK :" + strings.Join(requested, " ")))
+	if lines = sentLines(c); len(lines) != 1 || lines[0] != "CAP END" {
+		t.Fatalf("Expected CAP END after the ACK, got %q", lines)
+	}
+	if !c.HasCap("batch") || !c.HasCap("server-time") || c.HasCap("sasl") {
+		t.Errorf("Wrong capabilities enabled: %v", c.enabledCaps)
+	}
+}
@@ -0,0 +1,255 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// CaseMapping is a method for comparing nicks and channel names case-insensitively, as advertised by the server
+// in the CASEMAPPING ISUPPORT token.
+type CaseMapping string
+
+// Known case mappings
+const (
+	// CaseMappingASCII only folds the letters A-Z.
+	CaseMappingASCII CaseMapping = "ascii"
+	// CaseMappingRFC1459 folds A-Z and treats {}|~ as the lowercase versions of []\^.
+	CaseMappingRFC1459 CaseMapping = "rfc1459"
+	// CaseMappingRFC1459Strict is like CaseMappingRFC1459, but doesn't fold ~ and ^.
+	CaseMappingRFC1459Strict CaseMapping = "rfc1459-strict"
+	// CaseMappingRFC7613 folds all Unicode letters. Width and normalization mapping aren't done, so names are expected
+	// to already be normalized by the server.
+	CaseMappingRFC7613 CaseMapping = "rfc7613"
+)
+
+// DefaultCaseMapping is the case mapping used when the server doesn't advertise one.
+const DefaultCaseMapping = CaseMappingRFC1459
+
+// FoldRune returns the lowercase version of the given character.
+func (cm CaseMapping) FoldRune(r rune) rune {
+	switch {
+	case r >= 'A' && r <= 'Z':
+		return r + 'a' - 'A'
+	case r < 0x80 && cm != CaseMappingASCII && cm != CaseMappingRFC7613:
+		switch r {
+		case '[', ']', '\\':
+			return r + '{' - '['
+		case '^':
+			if cm != CaseMappingRFC1459Strict {
+				return '~'
+			}
+		}
+	case r >= 0x80 && cm == CaseMappingRFC7613:
+		return unicode.ToLower(r)
+	}
+	return r
+}
+
+// Fold returns the lowercase version of the given name.
+func (cm CaseMapping) Fold(name string) string {
+	return strings.Map(cm.FoldRune, name)
+}
+
+// Equal checks if the given names are equal when case is ignored.
+func (cm CaseMapping) Equal(a, b string) bool {
+	return cm.Fold(a) == cm.Fold(b)
+}
+
+// Match checks if the given string matches the given glob mask case-insensitively.
+// In the mask, * matches any number of characters, ? matches exactly one character, and \ escapes the next character.
+func (cm CaseMapping) Match(mask, str string) bool {
+	type token struct {
+		r        rune
+		wildcard bool
+	}
+	var pattern []token
+	escaped := false
+	for _, r := range mask {
+		if escaped {
+			pattern = append(pattern, token{r: cm.FoldRune(r)})
+			escaped = false
+		} else if r == '\\' {
+			escaped = true
+		} else if r == '*' || r == '?' {
+			pattern = append(pattern, token{r: r, wildcard: true})
+		} else {
+			pattern = append(pattern, token{r: cm.FoldRune(r)})
+		}
+	}
+	if escaped {
+		pattern = append(pattern, token{r: cm.FoldRune('\\')})
+	}
+	text := []rune(cm.Fold(str))
+
+	// Iterative glob matching: on a mismatch, backtrack to the last star and let it consume one more character.
+	p, t := 0, 0
+	star, starText := -1, 0
+	for t < len(text) {
+		if p < len(pattern) && pattern[p].wildcard && pattern[p].r == '*' {
+			star, starText = p, t
+			p++
+		} else if p < len(pattern) && (pattern[p].r == text[t] || (pattern[p].wildcard && pattern[p].r == '?')) {
+			p++
+			t++
+		} else if star >= 0 {
+			starText++
+			p, t = star+1, starText
+		} else {
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p].wildcard && pattern[p].r == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// CaseMap is a map keyed by nicks or channel names that ignores case according to a case mapping.
+// The original case of the most recently set key is preserved. A CaseMap is not safe for concurrent use.
+type CaseMap struct {
+	mapping CaseMapping
+	items   map[string]caseMapItem
+}
+
+type caseMapItem struct {
+	key   string
+	value interface{}
+}
+
+// NewCaseMap creates an empty CaseMap using the given case mapping.
+func NewCaseMap(mapping CaseMapping) *CaseMap {
+	return &CaseMap{mapping: mapping, items: make(map[string]caseMapItem)}
+}
+
+// Get returns the value stored with the given key.
+func (cm *CaseMap) Get(key string) (interface{}, bool) {
+	item, ok := cm.items[cm.mapping.Fold(key)]
+	return item.value, ok
+}
+
+// Has checks if there is a value stored with the given key.
+func (cm *CaseMap) Has(key string) bool {
+	_, ok := cm.items[cm.mapping.Fold(key)]
+	return ok
+}
+
+// Set stores the given value with the given key.
+func (cm *CaseMap) Set(key string, value interface{}) {
+	cm.items[cm.mapping.Fold(key)] = caseMapItem{key: key, value: value}
+}
+
+// Delete removes the value stored with the given key.
+func (cm *CaseMap) Delete(key string) {
+	delete(cm.items, cm.mapping.Fold(key))
+}
+
+// Len returns the number of values in the map.
+func (cm *CaseMap) Len() int {
+	return len(cm.items)
+}
+
+// Keys returns the keys in the map in their original case, sorted.
+func (cm *CaseMap) Keys() []string {
+	keys := make([]string, 0, len(cm.items))
+	for _, item := range cm.items {
+		keys = append(keys, item.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Range calls the given function for each key and value in the map until the function returns false.
+func (cm *CaseMap) Range(fn func(key string, value interface{}) bool) {
+	for _, item := range cm.items {
+		if !fn(item.key, item.value) {
+			return
+		}
+	}
+}
+
+// CaseMapping returns the case mapping the map uses.
+func (cm *CaseMap) CaseMapping() CaseMapping {
+	return cm.mapping
+}
+
+// SetCaseMapping changes the case mapping of the map and refolds the keys.
+// If two keys become equal, only one of them is kept.
+func (cm *CaseMap) SetCaseMapping(mapping CaseMapping) {
+	if mapping == cm.mapping {
+		return
+	}
+	cm.mapping = mapping
+	items := make(map[string]caseMapItem, len(cm.items))
+	for _, item := range cm.items {
+		items[mapping.Fold(item.key)] = item
+	}
+	cm.items = items
+}
+
+// CaseMapping returns the case mapping the server uses.
+func (c *ConnImpl) CaseMapping() CaseMapping {
+	if value, ok := c.GetISupport("CASEMAPPING"); ok {
+		switch mapping := CaseMapping(strings.ToLower(value)); mapping {
+		case CaseMappingASCII, CaseMappingRFC1459, CaseMappingRFC1459Strict, CaseMappingRFC7613:
+			return mapping
+		}
+	}
+	return DefaultCaseMapping
+}
+
+// equalName checks if the given nicks or channel names are equal according to the case mapping of the server.
+func (c *ConnImpl) equalName(a, b string) bool {
+	return c.CaseMapping().Equal(a, b)
+}
+
+// refoldNames refolds the keys of the internal nick and channel maps after the case mapping changes.
+func (c *ConnImpl) refoldNames() {
+	c.stateLock.Lock()
+	users := make(map[string]*User, len(c.users))
+	for _, user := range c.users {
+		users[c.foldName(user.Nick)] = user
+	}
+	channels := make(map[string]*channelState, len(c.channels))
+	for _, ch := range c.channels {
+		members := make(map[string]string, len(ch.members))
+		for key, prefixes := range ch.members {
+			if user, ok := c.users[key]; ok {
+				members[c.foldName(user.Nick)] = prefixes
+			}
+		}
+		ch.members = members
+		channels[c.foldName(ch.name)] = ch
+	}
+	c.users, c.channels = users, channels
+	c.stateLock.Unlock()
+
+	c.presenceLock.Lock()
+	presence := make(map[string]*presenceTarget, len(c.presence))
+	for _, target := range c.presence {
+		presence[c.foldName(target.nick)] = target
+	}
+	c.presence = presence
+	c.presenceLock.Unlock()
+
+	c.charsetLock.Lock()
+	c.channelCharsets.SetCaseMapping(c.CaseMapping())
+	c.charsetLock.Unlock()
+}
@@ -0,0 +1,132 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+)
+
+func TestCaseMappingEqual(t *testing.T) {
+	tests := []struct {
+		mapping CaseMapping
+		a, b    string
+		equal   bool
+	}{
+		{CaseMappingASCII, "Nick", "nICK", true},
+		{CaseMappingASCII, "[nick]", "{nick}", false},
+		{CaseMappingRFC1459, `[Nick]\^`, "{nick}|~", true},
+		{CaseMappingRFC1459Strict, `[Nick]\`, "{nick}|", true},
+		{CaseMappingRFC1459Strict, "nick^", "nick~", false},
+		{CaseMappingRFC7613, "ÄäNick", "ääNICK", true},
+		{CaseMappingRFC7613, "[nick]", "{nick}", false},
+		{CaseMappingRFC1459, "Äbc", "äbc", false},
+	}
+	for _, test := range tests {
+		if equal := test.mapping.Equal(test.a, test.b); equal != test.equal {
+			t.Errorf("%s: expected Equal(%q, %q) to be %t", test.mapping, test.a, test.b, test.equal)
+		}
+	}
+}
+
+func TestCaseMappingMatch(t *testing.T) {
+	tests := []struct {
+		mask, str string
+		match     bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"nick*", "NickServ", true},
+		{"n?ck", "nick", true},
+		{"n?ck", "nck", false},
+		{"*serv", "NickServ", true},
+		{"*a*b*c", "xaybzc", true},
+		{"*a*b*c", "xaybzcd", false},
+		{"{bot}*", "[BOT]_", true},
+		{`\*literal`, "*literal", true},
+		{`\*literal`, "xliteral", false},
+		{`trailing\`, `trailing\`, true},
+	}
+	for _, test := range tests {
+		if match := CaseMappingRFC1459.Match(test.mask, test.str); match != test.match {
+			t.Errorf("Expected Match(%q, %q) to be %t", test.mask, test.str, test.match)
+		}
+	}
+}
+
+func TestHostmask(t *testing.T) {
+	hm := ParseHostmask("Nick!~user@host.example")
+	if hm != (Hostmask{Nick: "Nick", User: "~user", Host: "host.example"}) {
+		t.Fatalf("Unexpected hostmask: %+v", hm)
+	}
+	if partial := ParseHostmask("nick@host"); partial.String() != "nick!*@host" {
+		t.Errorf("Expected missing parts to be stars, got %s", partial)
+	}
+	tests := map[string]bool{
+		"nick":              true,
+		"NICK*":             true,
+		"*!*@*.example":     true,
+		"*!~user@*":         true,
+		"*!user@*":          false,
+		"other!*@*":         false,
+		"*!*@host.example2": false,
+	}
+	for mask, match := range tests {
+		if hm.Matches(mask, CaseMappingASCII) != match {
+			t.Errorf("Expected Matches(%q) to be %t", mask, match)
+		}
+	}
+}
+
+func TestCaseMap(t *testing.T) {
+	cm := NewCaseMap(CaseMappingRFC1459)
+	cm.Set("[Bot]", 1)
+	cm.Set("{bot}", 2)
+	cm.Set("Alice", 3)
+	if value, ok := cm.Get("[BOT]"); !ok || value != 2 || cm.Len() != 2 {
+		t.Errorf("Expected [Bot] and {bot} to be the same key, got %v with %d keys", value, cm.Len())
+	}
+	if keys := cm.Keys(); len(keys) != 2 || keys[0] != "Alice" || keys[1] != "{bot}" {
+		t.Errorf("Expected the most recently set case to be kept, got %v", keys)
+	}
+	cm.SetCaseMapping(CaseMappingASCII)
+	if cm.Has("[bot]") || !cm.Has("{BOT}") {
+		t.Error("Keys weren't refolded after changing the case mapping")
+	}
+	cm.Delete("alice")
+	if cm.Has("Alice") {
+		t.Error("Key wasn't deleted")
+	}
+}
+
+func TestRefoldNames(t *testing.T) {
+	c := newOfflineConn("tester")
+	feedLines(c,
+		":tester!t@me.example JOIN #chan",
+		":irc.example.com 353 tester = #chan :tester [Bot]")
+	if c.GetUser("{bot}") == nil {
+		t.Fatal("Expected {bot} to match [Bot] with the default case mapping")
+	}
+	feedLines(c, ":irc.example.com 005 tester CASEMAPPING=ascii :are supported by this server")
+	if c.GetUser("{bot}") != nil {
+		t.Error("Expected {bot} not to match [Bot] with the ascii case mapping")
+	} else if c.GetUser("[BOT]") == nil {
+		t.Error("User wasn't found after refolding")
+	} else if _, ok := c.GetChannel("#CHAN").Members["[Bot]"]; !ok {
+		t.Errorf("Member wasn't refolded: %v", c.GetChannel("#chan").Members)
+	}
+}
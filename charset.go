@@ -0,0 +1,224 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sorcix/irc"
+)
+
+// Charsets contains functions to configure the character encodings used on networks that don't use UTF-8.
+// Incoming messages that are valid UTF-8 are always read as UTF-8. Invalid bytes are decoded with the fallback
+// charset. If the server advertises UTF8ONLY, outgoing messages are always sent as UTF-8.
+type Charsets interface {
+	// SetCharsets sets the fallback charset for decoding incoming messages and the charset for encoding outgoing
+	// messages.
+	SetCharsets(fallback, outgoing Charset)
+	// SetChannelCharsets overrides the fallback and outgoing charsets for messages to and from the given channel.
+	SetChannelCharsets(channel string, fallback, outgoing Charset)
+	// RemoveChannelCharsets removes the charset overrides of the given channel.
+	RemoveChannelCharsets(channel string)
+}
+
+// Charset is a character encoding.
+type Charset string
+
+// Supported charsets
+const (
+	CharsetUTF8   Charset = "UTF-8"
+	CharsetLatin1 Charset = "ISO-8859-1"
+	CharsetCP1252 Charset = "windows-1252"
+)
+
+// ParseCharset finds the charset with the given name. Common aliases, such as latin1 and cp1252, are accepted.
+func ParseCharset(name string) (Charset, bool) {
+	switch strings.Replace(strings.Replace(strings.ToLower(name), "-", "", -1), "_", "", -1) {
+	case "utf8":
+		return CharsetUTF8, true
+	case "iso88591", "latin1", "l1":
+		return CharsetLatin1, true
+	case "windows1252", "cp1252":
+		return CharsetCP1252, true
+	}
+	return "", false
+}
+
+// cp1252High contains the characters of the bytes 0x80-0x9F in windows-1252. The bytes that windows-1252 doesn't
+// define are mapped to the control characters with the same value, like in ISO-8859-1.
+var cp1252High = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+// cp1252Reverse maps the characters in cp1252High back to bytes.
+var cp1252Reverse = make(map[rune]byte, len(cp1252High))
+
+func init() {
+	for i, r := range cp1252High {
+		cp1252Reverse[r] = byte(0x80 + i)
+	}
+}
+
+// decodeByte decodes a single byte in a single-byte charset.
+func (cs Charset) decodeByte(b byte) rune {
+	if cs == CharsetCP1252 && b >= 0x80 && b < 0xA0 {
+		return cp1252High[b-0x80]
+	}
+	return rune(b)
+}
+
+// encodeRune encodes a single character in a single-byte charset. ok is false if the charset can't represent it.
+func (cs Charset) encodeRune(r rune) (byte, bool) {
+	if cs == CharsetCP1252 {
+		if b, ok := cp1252Reverse[r]; ok {
+			return b, true
+		} else if r >= 0x80 && r < 0xA0 {
+			return 0, false
+		}
+	}
+	if r < 0x100 {
+		return byte(r), true
+	}
+	return 0, false
+}
+
+// Decode decodes the given bytes into a string.
+func (cs Charset) Decode(data []byte) string {
+	if cs == CharsetUTF8 || len(cs) == 0 {
+		return string(data)
+	}
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = cs.decodeByte(b)
+	}
+	return string(runes)
+}
+
+// Encode encodes the given string. Characters that the charset can't represent are replaced with question marks.
+func (cs Charset) Encode(text string) []byte {
+	if cs == CharsetUTF8 || len(cs) == 0 {
+		return []byte(text)
+	}
+	data := make([]byte, 0, len(text))
+	for _, r := range text {
+		if b, ok := cs.encodeRune(r); ok {
+			data = append(data, b)
+		} else {
+			data = append(data, '?')
+		}
+	}
+	return data
+}
+
+// DecodeFallback decodes the given bytes as UTF-8, but decodes the bytes that aren't a part of a valid UTF-8
+// sequence with the charset.
+func (cs Charset) DecodeFallback(data []byte) string {
+	if utf8.Valid(data) || cs == CharsetUTF8 || len(cs) == 0 {
+		return string(data)
+	}
+	var buf strings.Builder
+	buf.Grow(len(data) + len(data)/2)
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size <= 1 {
+			r, size = cs.decodeByte(data[0]), 1
+		}
+		buf.WriteRune(r)
+		data = data[size:]
+	}
+	return buf.String()
+}
+
+// channelCharsets contains the charset overrides of a channel.
+type channelCharsets struct {
+	fallback Charset
+	outgoing Charset
+}
+
+// SetCharsets - See Charsets interface docs
+func (c *ConnImpl) SetCharsets(fallback, outgoing Charset) {
+	c.charsetLock.Lock()
+	c.FallbackCharset, c.OutgoingCharset = fallback, outgoing
+	c.charsetLock.Unlock()
+}
+
+// SetChannelCharsets - See Charsets interface docs
+func (c *ConnImpl) SetChannelCharsets(channel string, fallback, outgoing Charset) {
+	c.charsetLock.Lock()
+	c.channelCharsets.Set(channel, channelCharsets{fallback: fallback, outgoing: outgoing})
+	c.charsetLock.Unlock()
+}
+
+// RemoveChannelCharsets - See Charsets interface docs
+func (c *ConnImpl) RemoveChannelCharsets(channel string) {
+	c.charsetLock.Lock()
+	c.channelCharsets.Delete(channel)
+	c.charsetLock.Unlock()
+}
+
+// charsetsFor returns the fallback and outgoing charsets for the given message, which depend on the first channel
+// in the parameters.
+func (c *ConnImpl) charsetsFor(msg *irc.Message) (fallback, outgoing Charset) {
+	c.charsetLock.RLock()
+	defer c.charsetLock.RUnlock()
+	fallback, outgoing = c.FallbackCharset, c.OutgoingCharset
+	if msg == nil || c.channelCharsets.Len() == 0 {
+		return
+	}
+	for _, param := range msg.Params {
+		if !c.isChannel(param) {
+			continue
+		} else if val, ok := c.channelCharsets.Get(param); ok {
+			override := val.(channelCharsets)
+			fallback, outgoing = override.fallback, override.outgoing
+		}
+		break
+	}
+	return
+}
+
+// decodeLine decodes a line received from the server. The line is parsed with the tags, since the channel that
+// decides the charset comes after them.
+func (c *ConnImpl) decodeLine(data []byte) string {
+	if utf8.Valid(data) {
+		return string(data)
+	}
+	var msg *irc.Message
+	if evt := ParseEvent(string(data)); evt != nil {
+		msg = evt.Message
+	}
+	fallback, _ := c.charsetsFor(msg)
+	return fallback.DecodeFallback(data)
+}
+
+// encodeLine encodes a line to be sent to the server. If the server advertises UTF8ONLY, lines are always sent as
+// UTF-8 and lines that aren't valid UTF-8 are refused.
+func (c *ConnImpl) encodeLine(msg *irc.Message, line string) ([]byte, error) {
+	if _, utf8Only := c.GetISupport("UTF8ONLY"); utf8Only {
+		if !utf8.ValidString(line) {
+			return nil, ErrNotUTF8
+		}
+		return []byte(line), nil
+	}
+	_, outgoing := c.charsetsFor(msg)
+	return outgoing.Encode(line), nil
+}
@@ -0,0 +1,87 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestParseCharset(t *testing.T) {
+	tests := map[string]Charset{
+		"UTF-8":        CharsetUTF8,
+		"latin1":       CharsetLatin1,
+		"ISO_8859-1":   CharsetLatin1,
+		"Windows-1252": CharsetCP1252,
+		"cp1252":       CharsetCP1252,
+	}
+	for name, expected := range tests {
+		if charset, ok := ParseCharset(name); !ok || charset != expected {
+			t.Errorf("%s: expected %s, got %q", name, expected, charset)
+		}
+	}
+	if _, ok := ParseCharset("koi8-r"); ok {
+		t.Error("Unsupported charset was parsed")
+	}
+}
+
+func TestCharsetEncoding(t *testing.T) {
+	if text := CharsetCP1252.Decode([]byte("\x80 caf\xe9 \x93q\x94")); text != "€ café “q”" {
+		t.Errorf("Unexpected windows-1252 decoding: %q", text)
+	} else if text = CharsetLatin1.Decode([]byte("\x80\xe9")); text != "\u0080é" {
+		t.Errorf("Unexpected ISO-8859-1 decoding: %q", text)
+	}
+	if data := CharsetCP1252.Encode("€ café ☃"); string(data) != "\x80 caf\xe9 ?" {
+		t.Errorf("Unexpected windows-1252 encoding: %q", data)
+	} else if data = CharsetLatin1.Encode("€é"); string(data) != "?\xe9" {
+		t.Errorf("Unexpected ISO-8859-1 encoding: %q", data)
+	}
+	if text := CharsetCP1252.DecodeFallback([]byte("ünïcode and caf\xe9")); text != "ünïcode and café" {
+		t.Errorf("Valid UTF-8 wasn't kept in mixed input: %q", text)
+	}
+}
+
+func TestDecodeLineChannelCharset(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.SetCharsets(CharsetCP1252, CharsetUTF8)
+	c.SetChannelCharsets("#Latin", CharsetLatin1, CharsetLatin1)
+	tests := map[string]string{
+		":a!a@a PRIVMSG #latin :\x80":                                "\u0080",
+		"@time=2020-01-01T00:00:00.000Z :a!a@a PRIVMSG #latin :\x80": "\u0080",
+		":a!a@a PRIVMSG #other :\x80":                                "€",
+		"@msgid=x :a!a@a PRIVMSG #other :\x80":                       "€",
+	}
+	for line, text := range tests {
+		evt := ParseEvent(c.decodeLine([]byte(line)))
+		if evt == nil || evt.Trailing != text {
+			t.Errorf("%q: expected %q, got %+v", line, text, evt)
+		}
+	}
+
+	msg := &irc.Message{Command: irc.PRIVMSG, Params: []string{"#latin"}, Trailing: "é€"}
+	if data, err := c.encodeLine(msg, msg.String()); err != nil || string(data) != "PRIVMSG #latin :\xe9?" {
+		t.Errorf("Unexpected encoding for #latin: %q, %v", data, err)
+	}
+	c.isupport["UTF8ONLY"] = ""
+	if data, _ := c.encodeLine(msg, msg.String()); string(data) != msg.String() {
+		t.Errorf("Line wasn't sent as UTF-8 with UTF8ONLY: %q", data)
+	} else if _, err := c.encodeLine(msg, "PRIVMSG #latin :\xe9"); err != ErrNotUTF8 {
+		t.Errorf("Expected ErrNotUTF8 for invalid UTF-8 with UTF8ONLY, got %v", err)
+	}
+}
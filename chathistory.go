@@ -0,0 +1,195 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// defaultHistoryLimit is the number of messages requested when neither the caller nor the server specify a limit.
+const defaultHistoryLimit = 100
+
+// ChatHistory contains functions to fetch message history using the IRCv3 CHATHISTORY extension.
+// All the functions return the messages in the order they were originally sent.
+type ChatHistory interface {
+	// HistoryLatest fetches the latest messages in the given target sent after the given selector.
+	// Use HistoryAny to fetch the latest messages without a lower bound.
+	HistoryLatest(ctx context.Context, target string, after HistorySelector, limit int) ([]*Event, error)
+	// HistoryBefore fetches messages sent before the given selector.
+	HistoryBefore(ctx context.Context, target string, before HistorySelector, limit int) ([]*Event, error)
+	// HistoryAfter fetches messages sent after the given selector.
+	HistoryAfter(ctx context.Context, target string, after HistorySelector, limit int) ([]*Event, error)
+	// HistoryAround fetches messages sent around the given selector.
+	HistoryAround(ctx context.Context, target string, around HistorySelector, limit int) ([]*Event, error)
+	// HistoryBetween fetches messages sent between the given selectors.
+	HistoryBetween(ctx context.Context, target string, start, end HistorySelector, limit int) ([]*Event, error)
+	// HistoryTargets fetches the list of targets that have messages between the given times.
+	HistoryTargets(ctx context.Context, start, end time.Time, limit int) ([]*HistoryTarget, error)
+}
+
+// HistorySelector selects the point in history used as a bound in CHATHISTORY requests.
+type HistorySelector string
+
+// HistoryAny is the selector for not setting a bound. It can only be used with HistoryLatest.
+const HistoryAny HistorySelector = "*"
+
+// HistoryTimestamp creates a selector for the given time.
+func HistoryTimestamp(t time.Time) HistorySelector {
+	return HistorySelector("timestamp=" + t.UTC().Format(serverTimeFormat))
+}
+
+// HistoryMsgID creates a selector for the message with the given ID.
+func HistoryMsgID(id string) HistorySelector {
+	return HistorySelector("msgid=" + id)
+}
+
+// HistoryTarget is a single target in a reply to a CHATHISTORY TARGETS request.
+type HistoryTarget struct {
+	Name          string
+	LatestMessage time.Time
+}
+
+// serverTimeFormat is the timestamp format used by the IRCv3 server-time extension.
+const serverTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// chatHistoryCap returns the name of the enabled chathistory capability.
+func (c *ConnImpl) chatHistoryCap() (string, bool) {
+	for _, cap := range []string{"chathistory", "draft/chathistory"} {
+		if c.HasCap(cap) {
+			return cap, true
+		}
+	}
+	return "", false
+}
+
+// historyLimit clamps the given limit to the maximum advertised by the server in ISUPPORT.
+func (c *ConnImpl) historyLimit(limit int) string {
+	max := c.getISupportInt("CHATHISTORY", 0)
+	if max > 0 && (limit <= 0 || limit > max) {
+		limit = max
+	} else if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	return strconv.Itoa(limit)
+}
+
+// findBatch finds the batch with the given type and first parameter from the given batch or its children.
+func findBatch(batch *Batch, batchType, target string) *Batch {
+	if batch.Type == batchType && (len(target) == 0 || (len(batch.Params) > 0 && strings.EqualFold(batch.Params[0], target))) {
+		return batch
+	}
+	for _, child := range batch.Children() {
+		if found := findBatch(child, batchType, target); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// requestHistory sends a CHATHISTORY request and waits for the batch containing the reply.
+func (c *ConnImpl) requestHistory(ctx context.Context, batchType, target string, params ...string) (*Batch, error) {
+	if _, ok := c.chatHistoryCap(); !ok || !c.HasCap("batch") {
+		return nil, ErrCapNotEnabled
+	}
+	var result *Batch
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		if evt.Batch != nil {
+			result = findBatch(evt.Batch, batchType, target)
+			return result != nil, true
+		} else if evt.Command == "FAIL" && len(evt.Params) > 0 && evt.Params[0] == "CHATHISTORY" {
+			q.err = standardReplyError(evt.Message)
+			return true, true
+		}
+		return false, false
+	}
+	err := c.runQuery(ctx, q, &irc.Message{
+		Command: "CHATHISTORY",
+		Params:  params,
+	})
+	if err != nil {
+		return nil, err
+	} else if result == nil {
+		// The server replied with an empty labeled response.
+		return &Batch{Type: batchType}, nil
+	}
+	return result, nil
+}
+
+func (c *ConnImpl) fetchHistory(ctx context.Context, subcommand, target string, selectors []HistorySelector, limit int) ([]*Event, error) {
+	params := []string{subcommand, target}
+	for _, selector := range selectors {
+		params = append(params, string(selector))
+	}
+	params = append(params, c.historyLimit(limit))
+	batch, err := c.requestHistory(ctx, BatchChatHistory, target, params...)
+	if err != nil {
+		return nil, err
+	}
+	return batch.Flatten(), nil
+}
+
+// HistoryLatest - See ChatHistory interface docs
+func (c *ConnImpl) HistoryLatest(ctx context.Context, target string, after HistorySelector, limit int) ([]*Event, error) {
+	return c.fetchHistory(ctx, "LATEST", target, []HistorySelector{after}, limit)
+}
+
+// HistoryBefore - See ChatHistory interface docs
+func (c *ConnImpl) HistoryBefore(ctx context.Context, target string, before HistorySelector, limit int) ([]*Event, error) {
+	return c.fetchHistory(ctx, "BEFORE", target, []HistorySelector{before}, limit)
+}
+
+// HistoryAfter - See ChatHistory interface docs
+func (c *ConnImpl) HistoryAfter(ctx context.Context, target string, after HistorySelector, limit int) ([]*Event, error) {
+	return c.fetchHistory(ctx, "AFTER", target, []HistorySelector{after}, limit)
+}
+
+// HistoryAround - See ChatHistory interface docs
+func (c *ConnImpl) HistoryAround(ctx context.Context, target string, around HistorySelector, limit int) ([]*Event, error) {
+	return c.fetchHistory(ctx, "AROUND", target, []HistorySelector{around}, limit)
+}
+
+// HistoryBetween - See ChatHistory interface docs
+func (c *ConnImpl) HistoryBetween(ctx context.Context, target string, start, end HistorySelector, limit int) ([]*Event, error) {
+	return c.fetchHistory(ctx, "BETWEEN", target, []HistorySelector{start, end}, limit)
+}
+
+// HistoryTargets - See ChatHistory interface docs
+func (c *ConnImpl) HistoryTargets(ctx context.Context, start, end time.Time, limit int) ([]*HistoryTarget, error) {
+	batch, err := c.requestHistory(ctx, BatchChatHistoryTargets, "",
+		"TARGETS", string(HistoryTimestamp(start)), string(HistoryTimestamp(end)), c.historyLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	var targets []*HistoryTarget
+	for _, evt := range batch.Flatten() {
+		params := evt.Args()
+		if evt.Command != "CHATHISTORY" || len(params) < 3 || params[0] != "TARGETS" {
+			continue
+		}
+		target := &HistoryTarget{Name: params[1]}
+		target.LatestMessage, _ = time.Parse(time.RFC3339Nano, params[2])
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
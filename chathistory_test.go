@@ -0,0 +1,176 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+func TestHistoryLimit(t *testing.T) {
+	c := newOfflineConn("tester")
+	tests := []struct {
+		isupport string
+		limit    int
+		expected string
+	}{
+		{"", 0, "100"},
+		{"", 20, "20"},
+		{"", 500, "500"},
+		{"50", 0, "50"},
+		{"50", 20, "20"},
+		{"50", 500, "50"},
+		{"invalid", 0, "100"},
+	}
+	for _, test := range tests {
+		c.isupport = map[string]string{}
+		if len(test.isupport) > 0 {
+			c.isupport["CHATHISTORY"] = test.isupport
+		}
+		if limit := c.historyLimit(test.limit); limit != test.expected {
+			t.Errorf("Limit %d with CHATHISTORY=%s: expected %s, got %s", test.limit, test.isupport, test.expected, limit)
+		}
+	}
+}
+
+// newHistoryFake creates a fake server that supports chathistory with the given extra capabilities and a history
+// limit of 50, and a connection to it.
+func newHistoryFake(t *testing.T, caps ...string) (*fakeirc.Server, *ConnImpl) {
+	srv, c := newBatchFake(t, append(caps, "draft/chathistory")...)
+	srv.ISupport = append(srv.ISupport, "CHATHISTORY=50")
+	return srv, c
+}
+
+// expectHistory checks that the given history contains the two messages sent by sendHistory.
+func expectHistory(t *testing.T, events []*Event) {
+	t.Helper()
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(events))
+	} else if events[0].Trailing != "first" || events[1].Trailing != "second" {
+		t.Errorf("Unexpected messages: %q, %q", events[0].Trailing, events[1].Trailing)
+	} else if !events[0].Time.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Server time of message wasn't parsed: %v", events[0].Time)
+	}
+}
+
+// sendHistory sends a chathistory batch for #chan with two messages.
+func sendHistory(client *fakeirc.Client, startTags string) {
+	client.Send(startTags + "BATCH +h chathistory #chan")
+	client.Send("@batch=h;time=2020-01-01T00:00:00.000Z :alice!a@a.example PRIVMSG #chan :first")
+	client.Send("@batch=h;time=2020-01-01T00:00:01.000Z :bob!b@b.example PRIVMSG #chan :second")
+	client.Send("BATCH -h")
+}
+
+func TestHistoryBefore(t *testing.T) {
+	srv, c := newHistoryFake(t)
+	srv.On("CHATHISTORY", func(client *fakeirc.Client, msg *irc.Message) bool {
+		sendHistory(client, "")
+		return true
+	})
+	connectFake(t, srv, c)
+	ctx := testContext(t)
+	events, err := c.HistoryBefore(ctx, "#chan", HistoryMsgID("abc"), 0)
+	if err != nil {
+		t.Fatal("HistoryBefore failed:", err)
+	}
+	expectHistory(t, events)
+	if _, err = srv.Expect(ctx, "CHATHISTORY BEFORE #chan msgid=abc 50"); err != nil {
+		t.Error("Request wasn't sent with the clamped limit:", err)
+	}
+}
+
+func TestHistoryBeforeLabeled(t *testing.T) {
+	srv, c := newHistoryFake(t, "labeled-response")
+	srv.On("CHATHISTORY", func(client *fakeirc.Client, msg *irc.Message) bool {
+		return true
+	})
+	client := connectFake(t, srv, c)
+	ctx := testContext(t)
+	go func() {
+		line, err := srv.Expect(ctx, "CHATHISTORY BEFORE #chan")
+		if err != nil {
+			return
+		}
+		label := ParseTags(line.Tags)["label"]
+		// An unrelated batch for the same target must not be mistaken for the reply.
+		sendHistory(client, "")
+		client.Send("@label=" + label + " BATCH +l labeled-response")
+		client.Send("@batch=l BATCH +h chathistory #chan")
+		client.Send("@batch=h;time=2020-01-01T00:00:00.000Z :alice!a@a.example PRIVMSG #chan :first")
+		client.Send("@batch=h;time=2020-01-01T00:00:01.000Z :bob!b@b.example PRIVMSG #chan :second")
+		client.Send("BATCH -h")
+		client.Send("BATCH -l")
+	}()
+	events, err := c.HistoryBefore(ctx, "#chan", HistoryTimestamp(time.Now()), 10)
+	if err != nil {
+		t.Fatal("HistoryBefore failed:", err)
+	}
+	expectHistory(t, events)
+}
+
+func TestHistoryFail(t *testing.T) {
+	srv, c := newHistoryFake(t)
+	srv.On("CHATHISTORY", func(client *fakeirc.Client, msg *irc.Message) bool {
+		client.Send("FAIL CHATHISTORY INVALID_TARGET " + strings.Join(msg.Params[:2], " ") + " :Messages could not be retrieved")
+		return true
+	})
+	connectFake(t, srv, c)
+	_, err := c.HistoryLatest(testContext(t), "#secret", HistoryAny, 10)
+	if replyErr, ok := err.(StandardReplyError); !ok || replyErr.Code != "INVALID_TARGET" {
+		t.Errorf("Expected an INVALID_TARGET error, got %v", err)
+	}
+}
+
+func TestHistoryTargets(t *testing.T) {
+	srv, c := newHistoryFake(t)
+	srv.On("CHATHISTORY", func(client *fakeirc.Client, msg *irc.Message) bool {
+		client.Send("BATCH +t draft/chathistory-targets")
+		client.Send("@batch=t CHATHISTORY TARGETS #chan 2020-01-01T00:00:00.000Z")
+		client.Send("@batch=t CHATHISTORY TARGETS bob 2020-01-02T00:00:00.000Z")
+		client.Send("BATCH -t")
+		return true
+	})
+	connectFake(t, srv, c)
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	targets, err := c.HistoryTargets(testContext(t), start, start.AddDate(2, 0, 0), 100)
+	if err != nil {
+		t.Fatal("HistoryTargets failed:", err)
+	} else if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %+v", targets)
+	}
+	if targets[0].Name != "#chan" || !targets[0].LatestMessage.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected first target: %+v", targets[0])
+	} else if targets[1].Name != "bob" {
+		t.Errorf("Unexpected second target: %+v", targets[1])
+	}
+	if _, err = srv.Expect(testContext(t), "CHATHISTORY TARGETS timestamp=2019-01-01T00:00:00.000Z "+
+		"timestamp=2021-01-01T00:00:00.000Z 50"); err != nil {
+		t.Error("Request wasn't sent with the clamped limit:", err)
+	}
+}
+
+func TestHistoryRequiresCap(t *testing.T) {
+	_, c, _ := startFake(t)
+	if _, err := c.HistoryLatest(testContext(t), "#chan", HistoryAny, 10); err != ErrCapNotEnabled {
+		t.Errorf("Expected ErrCapNotEnabled, got %v", err)
+	}
+}
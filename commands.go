@@ -18,109 +18,154 @@
 package libmauirc
 
 import (
-	"strconv"
-	"time"
+	"strings"
 
 	"github.com/sorcix/irc"
 	"github.com/sorcix/irc/ctcp"
 )
 
-// Tunnel contains functions to wrap IRC commands
+// Tunnel contains functions to wrap IRC commands.
+// The functions return an InvalidMessageError if the parameters contain line breaks, NUL characters, or spaces, a
+// leading colon or an empty value where they're not allowed, and ErrDisconnected if the client isn't connected.
+// Privmsg, Notice and Action send each line of a multi-line message as a separate message instead.
 type Tunnel interface {
 	// Send the given irc.Message
-	Send(msg *irc.Message)
+	Send(msg *irc.Message) error
+	// SendTagged sends the given irc.Message with the given IRCv3 message tags
+	SendTagged(msg *irc.Message, tags Tags) error
+	// SendLabeled sends the given irc.Message with a labeled-response label and returns a handle for the reply
+	SendLabeled(msg *irc.Message) (*LabeledResponse, error)
 	// Action sends the given message to the given channel as a CTCP action message
-	Action(channel, msg string)
+	Action(channel, msg string) error
 	// Privmsg sends the given message to the given channel
-	Privmsg(channel, msg string)
+	Privmsg(channel, msg string) error
 	// Notice sends the given message to the given channel as a NOTICE
-	Notice(channel, msg string)
+	Notice(channel, msg string) error
+	// PrivmsgTracked sends the given message to the given channel and returns a handle for confirming delivery
+	PrivmsgTracked(channel, msg string) *Delivery
+	// NoticeTracked sends the given message to the given channel as a NOTICE and returns a handle for confirming delivery
+	NoticeTracked(channel, msg string) *Delivery
+	// ActionTracked sends the given message to the given channel as a CTCP action and returns a handle for confirming delivery
+	ActionTracked(channel, msg string) *Delivery
 	// Away sets the away message
-	Away(msg string)
+	Away(msg string) error
 	// RemoveAway removes the away status
-	RemoveAway()
+	RemoveAway() error
 	// Invite the given user to the given channel
-	Invite(user, ch string)
+	Invite(user, ch string) error
 	// Kick the given user from the given channel with the given message
-	Kick(ch, user, msg string)
-	// Mode changes channel and user modes
-	Mode(target, flags, args string)
+	Kick(ch, user, msg string) error
+	// Mode changes channel and user modes. The arguments are separated by spaces.
+	Mode(target, flags, args string) error
 	// Oper authenticates the user as a server operator
-	Oper(username, password string)
-	// SetNick updates the nick locally and sends a nick change request to the server
-	SetNick(nick string)
+	Oper(username, password string) error
+	// SetNick changes the preferred nick and sends a nick change request to the server.
+	// The current nick is updated when the server confirms the change.
+	SetNick(nick string) error
+	// SetName changes the real name on the server. This requires the setname capability.
+	SetName(realname string) error
 	// Join a channel
-	Join(chs, keys string)
+	Join(chs, keys string) error
 	// Part a channel
-	Part(ch, msg string)
+	Part(ch, msg string) error
 	// List requests the server for a list of channels
-	List()
+	List() error
 	// Topic sets the topic of the given channel
-	Topic(ch, topic string)
+	Topic(ch, topic string) error
 	// Whois sends a WHOIS request on the given name
-	Whois(name string)
+	Whois(name string) error
 	// Whowas sends a WHOWAS request on the given name
-	Whowas(name string)
+	Whowas(name string) error
 	// Who sends a WHO request with the given name
-	Who(name string, op bool)
+	Who(name string, op bool) error
 	// Quit from the server
-	Quit()
+	Quit() error
 }
 
 // Send - See Tunnel interface docs
-func (c *ConnImpl) Send(msg *irc.Message) {
-	c.output <- msg
+func (c *ConnImpl) Send(msg *irc.Message) error {
+	if err := ValidateMessage(msg); err != nil {
+		return err
+	}
+	return c.enqueue(&Event{Message: msg})
+}
+
+// SendTagged - See Tunnel interface docs
+func (c *ConnImpl) SendTagged(msg *irc.Message, tags Tags) error {
+	if err := ValidateMessage(msg); err != nil {
+		return err
+	} else if err := validateTags(msg.Command, tags); err != nil {
+		return err
+	}
+	return c.enqueue(&Event{Message: msg, Tags: tags})
 }
 
 // Action - See Tunnel interface docs
-// Action - See Tunnel interface docs
-func (c *ConnImpl) Action(channel, msg string) {
-	c.Privmsg(channel, ctcp.Action(msg))
+func (c *ConnImpl) Action(channel, msg string) error {
+	for _, line := range splitLines(msg) {
+		if err := c.Privmsg(channel, ctcp.Action(line)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Privmsg - See Tunnel interface docs
-// Privmsg - See Tunnel interface docs
-func (c *ConnImpl) Privmsg(channel, msg string) {
-	c.Send(&irc.Message{
-		Command:  irc.PRIVMSG,
-		Params:   []string{channel},
-		Trailing: msg,
-	})
+func (c *ConnImpl) Privmsg(channel, msg string) error {
+	return c.sendLines(irc.PRIVMSG, channel, msg)
 }
 
 // Notice - See Tunnel interface docs
-func (c *ConnImpl) Notice(channel, msg string) {
-	c.Send(&irc.Message{
-		Command:  irc.NOTICE,
-		Params:   []string{channel},
-		Trailing: msg,
-	})
+func (c *ConnImpl) Notice(channel, msg string) error {
+	return c.sendLines(irc.NOTICE, channel, msg)
+}
+
+// sendLines sends each line of the given text as a separate message.
+func (c *ConnImpl) sendLines(command, target, text string) error {
+	lines := splitLines(text)
+	// Validate all the lines first, so that an invalid message isn't sent partially.
+	for _, line := range lines {
+		if err := ValidateMessage(&irc.Message{Command: command, Params: []string{target}, Trailing: line}); err != nil {
+			return err
+		}
+	}
+	for _, line := range lines {
+		err := c.Send(&irc.Message{
+			Command:  command,
+			Params:   []string{target},
+			Trailing: line,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Away - See Tunnel interface docs
-func (c *ConnImpl) Away(msg string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Away(msg string) error {
+	return c.Send(&irc.Message{
 		Command:  irc.AWAY,
 		Trailing: msg,
 	})
 }
 
 // RemoveAway - See Tunnel interface docs
-func (c *ConnImpl) RemoveAway() {
-	c.Away("")
+func (c *ConnImpl) RemoveAway() error {
+	return c.Away("")
 }
 
 // Invite - See Tunnel interface docs
-func (c *ConnImpl) Invite(user, ch string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Invite(user, ch string) error {
+	return c.Send(&irc.Message{
 		Command: irc.INVITE,
 		Params:  []string{user, ch},
 	})
 }
 
 // Kick - See Tunnel interface docs
-func (c *ConnImpl) Kick(ch, user, msg string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Kick(ch, user, msg string) error {
+	return c.Send(&irc.Message{
 		Command:  irc.KICK,
 		Params:   []string{ch, user},
 		Trailing: msg,
@@ -128,42 +173,68 @@ func (c *ConnImpl) Kick(ch, user, msg string) {
 }
 
 // Mode - See Tunnel interface docs
-func (c *ConnImpl) Mode(target, flags, args string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Mode(target, flags, args string) error {
+	params := []string{target}
+	if len(flags) > 0 {
+		params = append(params, flags)
+	}
+	return c.Send(&irc.Message{
 		Command: irc.MODE,
-		Params:  []string{target, flags, args},
+		Params:  append(params, strings.Fields(args)...),
 	})
 }
 
 // Oper - See Tunnel interface docs
-func (c *ConnImpl) Oper(username, password string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Oper(username, password string) error {
+	return c.Send(&irc.Message{
 		Command: irc.OPER,
 		Params:  []string{username, password},
 	})
 }
 
 // SetNick - See Tunnel interface docs
-func (c *ConnImpl) SetNick(nick string) {
+func (c *ConnImpl) SetNick(nick string) error {
+	if err := ValidateMessage(&irc.Message{Command: irc.NICK, Params: []string{nick}}); err != nil {
+		return err
+	}
+	if c.nickMonitored && !c.equalName(c.PreferredNick, nick) {
+		// The old preferred nick doesn't need to be taken back anymore.
+		c.nickMonitored = false
+		c.Unmonitor(c.PreferredNick)
+	}
 	c.PreferredNick = nick
-	c.Nick = nick
-	c.Send(&irc.Message{
-		Command: irc.NICK,
-		Params:  []string{nick},
+	c.nickRecoverySent = false
+	c.nickGhostSent = false
+	if !c.registered {
+		c.Nick = nick
+		c.nickAttempt = 0
+	}
+	return c.sendNick(nick)
+}
+
+// SetName - See Tunnel interface docs
+func (c *ConnImpl) SetName(realname string) error {
+	return c.Send(&irc.Message{
+		Command:  "SETNAME",
+		Trailing: realname,
 	})
 }
 
 // Join - See Tunnel interface docs
-func (c *ConnImpl) Join(chs string, keys string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Join(chs string, keys string) error {
+	params := []string{chs}
+	if len(keys) > 0 {
+		params = append(params, keys)
+	}
+	return c.Send(&irc.Message{
 		Command: irc.JOIN,
-		Params:  []string{chs, keys},
+		Params:  params,
 	})
 }
 
 // Part - See Tunnel interface docs
-func (c *ConnImpl) Part(ch, msg string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Part(ch, msg string) error {
+	return c.Send(&irc.Message{
 		Command:  irc.PART,
 		Params:   []string{ch},
 		Trailing: msg,
@@ -171,15 +242,15 @@ func (c *ConnImpl) Part(ch, msg string) {
 }
 
 // List - See Tunnel interface docs
-func (c *ConnImpl) List() {
-	c.Send(&irc.Message{
+func (c *ConnImpl) List() error {
+	return c.Send(&irc.Message{
 		Command: irc.LIST,
 	})
 }
 
 // Topic - See Tunnel interface docs
-func (c *ConnImpl) Topic(ch, topic string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Topic(ch, topic string) error {
+	return c.Send(&irc.Message{
 		Command:  irc.TOPIC,
 		Params:   []string{ch},
 		Trailing: topic,
@@ -187,45 +258,49 @@ func (c *ConnImpl) Topic(ch, topic string) {
 }
 
 // Whois - See Tunnel interface docs
-func (c *ConnImpl) Whois(name string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Whois(name string) error {
+	return c.Send(&irc.Message{
 		Command: irc.WHOIS,
 		Params:  []string{name},
 	})
 }
 
 // Whowas - See Tunnel interface docs
-func (c *ConnImpl) Whowas(name string) {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Whowas(name string) error {
+	return c.Send(&irc.Message{
 		Command: irc.WHOWAS,
 		Params:  []string{name},
 	})
 }
 
 // Who - See Tunnel interface docs
-func (c *ConnImpl) Who(name string, op bool) {
+func (c *ConnImpl) Who(name string, op bool) error {
 	if op {
-		c.Send(&irc.Message{
+		return c.Send(&irc.Message{
 			Command: irc.WHO,
 			Params:  []string{name, "o"},
 		})
-	} else {
-		c.Send(&irc.Message{
-			Command: irc.WHO,
-			Params:  []string{name},
-		})
 	}
+	return c.Send(&irc.Message{
+		Command: irc.WHO,
+		Params:  []string{name},
+	})
 }
 
 // Quit - See Tunnel interface docs
-func (c *ConnImpl) Quit() {
-	c.Send(&irc.Message{
+func (c *ConnImpl) Quit() error {
+	err := c.Send(&irc.Message{
 		Command:  irc.QUIT,
 		Trailing: c.QuitMsg,
 	})
+	if err != nil {
+		// Quit even if the quit message is invalid.
+		c.Send(&irc.Message{Command: irc.QUIT})
+	}
 	c.Lock()
 	c.quit = true
 	c.Unlock()
+	return err
 }
 
 // SendUser sends the USER message to the server
@@ -243,7 +318,7 @@ func (c *ConnImpl) SendUser() {
 func (c *ConnImpl) Ping() {
 	c.Send(&irc.Message{
 		Command: irc.PING,
-		Params:  []string{strconv.FormatInt(time.Now().UnixNano(), 10)},
+		Params:  []string{c.newPingToken()},
 	})
 }
 
@@ -0,0 +1,163 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/sorcix/irc/ctcp"
+)
+
+// CTCPResponders contains functions to manage the automatic replies to CTCP requests and to send CTCP requests.
+type CTCPResponders interface {
+	// AddCTCPResponder sets the responder for the given CTCP command, replacing any previous responder.
+	AddCTCPResponder(command string, responder CTCPResponder)
+	// RemoveCTCPResponder removes the responder for the given CTCP command, so requests with it are no longer replied to.
+	RemoveCTCPResponder(command string)
+	// GetCTCPCommands returns the CTCP commands that have a responder, sorted.
+	GetCTCPCommands() []string
+	// CTCPRequest sends a CTCP request to the given target and waits for the matching reply.
+	CTCPRequest(ctx context.Context, target, command, args string) (*CTCPReply, error)
+}
+
+// CTCPResponder generates the reply to a CTCP request. The text of the request is in the Trailing field of the event.
+// If ok is false, no reply is sent.
+type CTCPResponder func(evt *Event) (reply string, ok bool)
+
+// CTCPReply is a reply to a CTCP request sent with CTCPRequest.
+type CTCPReply struct {
+	Source  Hostmask
+	Command string
+	Text    string
+	// RoundTrip is the time between sending the request and receiving the reply.
+	RoundTrip time.Duration
+}
+
+// AddCTCPResponder - See CTCPResponders interface docs
+func (c *ConnImpl) AddCTCPResponder(command string, responder CTCPResponder) {
+	c.ctcpLock.Lock()
+	c.ctcpResponders[strings.ToUpper(command)] = responder
+	c.ctcpLock.Unlock()
+}
+
+// RemoveCTCPResponder - See CTCPResponders interface docs
+func (c *ConnImpl) RemoveCTCPResponder(command string) {
+	c.ctcpLock.Lock()
+	delete(c.ctcpResponders, strings.ToUpper(command))
+	c.ctcpLock.Unlock()
+}
+
+// GetCTCPCommands - See CTCPResponders interface docs
+func (c *ConnImpl) GetCTCPCommands() []string {
+	c.ctcpLock.RLock()
+	commands := make([]string, 0, len(c.ctcpResponders))
+	for command := range c.ctcpResponders {
+		commands = append(commands, command)
+	}
+	c.ctcpLock.RUnlock()
+	sort.Strings(commands)
+	return commands
+}
+
+// respondCTCP replies to CTCP requests using the registered responders.
+func (c *ConnImpl) respondCTCP(evt *Event) {
+	if !strings.HasPrefix(evt.Command, "CTCP_") {
+		return
+	}
+	command := strings.TrimPrefix(evt.Command, "CTCP_")
+	c.ctcpLock.RLock()
+	responder, ok := c.ctcpResponders[command]
+	c.ctcpLock.RUnlock()
+	if !ok {
+		return
+	}
+	if reply, ok := responder(evt); ok {
+		c.replyCTCP(evt, ctcp.Encode(command, reply))
+	}
+}
+
+// addStdCTCPResponders adds the responders for the standard CTCP commands.
+func (c *ConnImpl) addStdCTCPResponders() {
+	c.AddCTCPResponder("VERSION", func(evt *Event) (string, bool) {
+		return c.Version, true
+	})
+	c.AddCTCPResponder("USERINFO", func(evt *Event) (string, bool) {
+		return c.User, true
+	})
+	c.AddCTCPResponder("CLIENTINFO", func(evt *Event) (string, bool) {
+		commands := c.GetCTCPCommands()
+		// ACTION doesn't have a responder, since it isn't a request, but it's still supported.
+		commands = append(commands, "ACTION")
+		sort.Strings(commands)
+		return strings.Join(commands, " "), true
+	})
+	c.AddCTCPResponder("TIME", func(evt *Event) (string, bool) {
+		return time.Now().Format(time.RFC1123Z), true
+	})
+	c.AddCTCPResponder("PING", func(evt *Event) (string, bool) {
+		return evt.Trailing, true
+	})
+}
+
+// CTCPRequest - See CTCPResponders interface docs
+func (c *ConnImpl) CTCPRequest(ctx context.Context, target, command, args string) (*CTCPReply, error) {
+	command = strings.ToUpper(command)
+	var reply *CTCPReply
+	sent := time.Now()
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		params := evt.Args()
+		switch evt.Command {
+		case irc.NOTICE:
+			if evt.Prefix == nil || !c.equalName(evt.Name, target) {
+				return false, false
+			}
+			tag, text, ok := ctcp.Decode(evt.Trailing)
+			if !ok || strings.ToUpper(tag) != command {
+				return false, false
+			}
+			reply = &CTCPReply{
+				Source:    HostmaskFromPrefix(evt.Prefix),
+				Command:   tag,
+				Text:      text,
+				RoundTrip: time.Since(sent),
+			}
+			return true, true
+		case irc.ERR_NOSUCHNICK, irc.ERR_CANNOTSENDTOCHAN:
+			if len(params) > 1 && c.equalName(params[1], target) {
+				q.err = queryError(evt.Message)
+				return true, true
+			}
+		}
+		return false, false
+	}
+	// The reply is a separate NOTICE, so it can't be matched with labeled-response.
+	err := c.waitQuery(ctx, q, &irc.Message{
+		Command:  irc.PRIVMSG,
+		Params:   []string{target},
+		Trailing: ctcp.Encode(command, args),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
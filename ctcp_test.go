@@ -0,0 +1,116 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestCTCPResponders(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.Version = "libmauirc test"
+	// All the requests come from the same user.
+	c.FloodCTCPs = 0
+	feedLines(c, ":alice!a@a.example PRIVMSG tester :\x01VERSION\x01")
+	expectSent(t, c, "NOTICE alice :\x01VERSION libmauirc test\x01")
+
+	c.AddCTCPResponder("source", func(evt *Event) (string, bool) {
+		return "https://example.com " + evt.Trailing, true
+	})
+	c.AddCTCPResponder("SILENT", func(evt *Event) (string, bool) {
+		return "", false
+	})
+	c.RemoveCTCPResponder("time")
+	expected := []string{"CLIENTINFO", "PING", "SILENT", "SOURCE", "USERINFO", "VERSION"}
+	if commands := c.GetCTCPCommands(); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("Expected commands %q, got %q", expected, commands)
+	}
+	feedLines(c,
+		":alice!a@a.example PRIVMSG tester :\x01SOURCE code\x01",
+		":alice!a@a.example PRIVMSG tester :\x01SILENT\x01",
+		":alice!a@a.example PRIVMSG tester :\x01TIME\x01",
+		":alice!a@a.example PRIVMSG tester :\x01CLIENTINFO\x01")
+	expectSent(t, c,
+		"NOTICE alice :\x01SOURCE https://example.com code\x01",
+		"NOTICE alice :\x01CLIENTINFO ACTION CLIENTINFO PING SILENT SOURCE USERINFO VERSION\x01")
+
+	// Echoes of our own requests aren't replied to.
+	feedLines(c, ":tester!t@me.example PRIVMSG alice :\x01VERSION\x01")
+	expectSent(t, c)
+}
+
+func TestCTCPReplyLimit(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.CTCPReplyLimit = 3
+	c.FloodMessages = 0
+	c.FloodCTCPs = 0
+	for i := 0; i < 5; i++ {
+		feedLines(c, fmt.Sprintf(":user%d!u@host%d.example PRIVMSG tester :\x01PING %d\x01", i, i, i))
+	}
+	expectSent(t, c,
+		"NOTICE user0 :\x01PING 0\x01",
+		"NOTICE user1 :\x01PING 1\x01",
+		"NOTICE user2 :\x01PING 2\x01")
+}
+
+// requestCTCP sends a CTCP request with the given offline connection and answers it with the given lines.
+func requestCTCP(t *testing.T, c *ConnImpl, target string, lines ...string) (*CTCPReply, error) {
+	t.Helper()
+	type result struct {
+		reply *CTCPReply
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		reply, err := c.CTCPRequest(context.Background(), target, "version", "")
+		done <- result{reply, err}
+	}()
+	if sent := waitSent(t, c); sent.String() != "PRIVMSG "+target+" :\x01VERSION\x01" {
+		t.Fatalf("Unexpected request %q", sent.String())
+	}
+	feedLines(c, lines...)
+	res := <-done
+	return res.reply, res.err
+}
+
+func TestCTCPRequest(t *testing.T) {
+	c := newOfflineConn("tester")
+	reply, err := requestCTCP(t, c, "Alice",
+		":bob!b@b.example NOTICE tester :\x01VERSION not this one\x01",
+		":alice!a@a.example NOTICE tester :\x01PING 123\x01",
+		":alice!a@a.example NOTICE tester :\x01VERSION irssi 1.2\x01")
+	if err != nil {
+		t.Fatal("CTCPRequest failed:", err)
+	} else if reply.Command != "VERSION" || reply.Text != "irssi 1.2" || reply.Source.Nick != "alice" {
+		t.Errorf("Unexpected reply %+v", reply)
+	} else if reply.RoundTrip <= 0 {
+		t.Error("Round trip time wasn't set")
+	}
+
+	_, err = requestCTCP(t, c, "nobody",
+		":irc.example.com 401 tester someone :No such nick",
+		":irc.example.com 401 tester nobody :No such nick")
+	if queryErr, ok := err.(QueryError); !ok || queryErr.Code != irc.ERR_NOSUCHNICK || queryErr.Target != "nobody" {
+		t.Errorf("Expected a no such nick error, got %v", err)
+	}
+}
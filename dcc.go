@@ -0,0 +1,349 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc/ctcp"
+)
+
+// DCC contains functions to establish direct client-to-client connections.
+// Incoming offers are only accepted if a policy callback is set and it approves the offer.
+type DCC interface {
+	// OfferChat offers a DCC CHAT to the given user and waits until the user connects.
+	// The listener is bound to the local address of the IRC connection.
+	// Call Start on the returned chat after adding handlers to it.
+	OfferChat(ctx context.Context, nick string) (*DCCChat, error)
+	// OfferChatPassive offers a passive DCC CHAT to the given user and waits until the user replies with the address
+	// to connect to. Use this if the local address isn't reachable by the other user.
+	OfferChatPassive(ctx context.Context, nick string) (*DCCChat, error)
+	// SetDCCChatPolicy sets the function that decides whether incoming DCC CHAT offers are accepted.
+	SetDCCChatPolicy(policy DCCPolicy)
+	// SendFile offers the given file to the given user with DCC SEND. The transfer runs in the background after the
+	// user connects; use Wait on the returned transfer to find out when it's done.
+	SendFile(ctx context.Context, nick, file string) (*DCCTransfer, error)
+	// SendFilePassive offers the given file to the given user with a passive DCC SEND, where the user listens and
+	// the file is sent after connecting to the address in their reply.
+	SendFilePassive(ctx context.Context, nick, file string) (*DCCTransfer, error)
+	// SetDCCSendPolicy sets the function that decides whether incoming DCC SEND offers are accepted.
+	// Files are only accepted if DCCDownloadDir is set as well.
+	SetDCCSendPolicy(policy DCCPolicy)
+}
+
+// DCCPolicy decides whether an incoming DCC offer is accepted.
+type DCCPolicy func(req *DCCRequest) bool
+
+// DCCRequest is a parsed DCC CTCP request.
+type DCCRequest struct {
+	Source Hostmask
+	// Type is the DCC type, such as CHAT or SEND.
+	Type string
+	// Argument is the first parameter of the request. For DCC SEND, it's the file name.
+	Argument string
+	IP       net.IP
+	Port     int
+	// Size is the size of the file for DCC SEND, or -1 if it wasn't given.
+	Size int64
+	// Token identifies a passive DCC offer. Passive offers have the port set to zero.
+	Token string
+	// Position is the position to resume from in DCC RESUME and ACCEPT requests.
+	Position int64
+}
+
+// Passive checks if the request is a passive (reverse) DCC offer, where the receiver listens instead of the sender.
+func (req *DCCRequest) Passive() bool {
+	return req.Port == 0 && len(req.Token) > 0
+}
+
+// ParseDCCRequest parses the text of a DCC CTCP request, excluding the DCC command itself.
+func ParseDCCRequest(text string) (*DCCRequest, error) {
+	fields := splitDCCFields(text)
+	if len(fields) < 2 {
+		return nil, ErrInvalidDCC
+	}
+	req := &DCCRequest{Type: strings.ToUpper(fields[0]), Argument: fields[1], Size: -1}
+	fields = fields[2:]
+	switch req.Type {
+	case "RESUME", "ACCEPT":
+		// DCC RESUME <filename> <port> <position> [token]
+		if len(fields) < 2 {
+			return nil, ErrInvalidDCC
+		}
+		var err error
+		if req.Port, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, ErrInvalidDCC
+		} else if req.Position, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, ErrInvalidDCC
+		}
+		if len(fields) > 2 {
+			req.Token = fields[2]
+		}
+		return req, nil
+	}
+
+	// DCC <type> <argument> <ip> <port> [size] [token]
+	if len(fields) < 2 {
+		return nil, ErrInvalidDCC
+	}
+	req.IP = parseDCCAddress(fields[0])
+	port, err := strconv.Atoi(fields[1])
+	if req.IP == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidDCC
+	}
+	req.Port = port
+	fields = fields[2:]
+	if req.Type == "SEND" && len(fields) > 0 {
+		if req.Size, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+			return nil, ErrInvalidDCC
+		}
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		req.Token = fields[0]
+	}
+	return req, nil
+}
+
+// String formats the request in the format used in the DCC CTCP request.
+func (req *DCCRequest) String() string {
+	argument := req.Argument
+	if strings.ContainsAny(argument, " \"") {
+		argument = "\"" + strings.Replace(argument, "\"", "", -1) + "\""
+	}
+	parts := []string{req.Type, argument}
+	switch req.Type {
+	case "RESUME", "ACCEPT":
+		parts = append(parts, strconv.Itoa(req.Port), strconv.FormatInt(req.Position, 10))
+	default:
+		parts = append(parts, formatDCCAddress(req.IP), strconv.Itoa(req.Port))
+		if req.Type == "SEND" && req.Size >= 0 {
+			parts = append(parts, strconv.FormatInt(req.Size, 10))
+		}
+	}
+	if len(req.Token) > 0 {
+		parts = append(parts, req.Token)
+	}
+	return strings.Join(parts, " ")
+}
+
+// splitDCCFields splits the DCC request text into fields. The argument may be quoted if it contains spaces.
+func splitDCCFields(text string) []string {
+	var fields []string
+	for text = strings.TrimSpace(text); len(text) > 0; text = strings.TrimSpace(text) {
+		if text[0] == '"' {
+			if end := strings.IndexByte(text[1:], '"'); end >= 0 {
+				fields = append(fields, text[1:end+1])
+				text = text[end+2:]
+				continue
+			}
+		}
+		end := strings.IndexByte(text, ' ')
+		if end < 0 {
+			end = len(text)
+		}
+		fields = append(fields, text[:end])
+		text = text[end:]
+	}
+	return fields
+}
+
+// parseDCCAddress parses an IPv4 address as a 32-bit integer, or an IPv6 address in the normal textual format.
+func parseDCCAddress(addr string) net.IP {
+	if num, err := strconv.ParseUint(addr, 10, 32); err == nil {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(num))
+		return ip
+	}
+	return net.ParseIP(addr)
+}
+
+// formatDCCAddress formats the given address in the format used in DCC requests.
+func formatDCCAddress(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	}
+	return ip.String()
+}
+
+// newDCCToken generates a random token for passive DCC offers.
+func newDCCToken() string {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return strconv.FormatUint(uint64(binary.BigEndian.Uint32(buf[:])), 10)
+}
+
+// dccLocalIP returns the local IP address of the IRC connection, or nil if the connection isn't a TCP connection.
+// DCC offers can't be made without an IRC connection, so ErrDisconnected is returned if the client isn't connected.
+func (c *ConnImpl) dccLocalIP() (net.IP, error) {
+	addr := c.LocalAddr()
+	if addr == nil {
+		return nil, ErrDisconnected
+	} else if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP, nil
+	}
+	return nil, nil
+}
+
+// dccListen opens a listener for an outgoing DCC connection on the local address of the IRC connection.
+// It returns the listener and the address to advertise in the DCC request.
+func (c *ConnImpl) dccListen() (net.Listener, net.IP, error) {
+	localIP, err := c.dccLocalIP()
+	if err != nil {
+		return nil, nil, err
+	}
+	host := ""
+	if localIP != nil {
+		host = localIP.String()
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, nil, err
+	}
+	advertised := c.DCCAddress
+	if advertised == nil {
+		advertised = localIP
+	}
+	return listener, advertised, nil
+}
+
+// dccAccept waits for a single connection to the given listener until the context is done. The listener is closed
+// afterwards.
+func dccAccept(ctx context.Context, listener net.Listener) (net.Conn, error) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		listener.Close()
+	}()
+	conn, err := listener.Accept()
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return conn, err
+}
+
+// dccDial connects to the address in the given DCC request.
+func (c *ConnImpl) dccDial(ctx context.Context, req *DCCRequest) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.DCCTimeout}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(req.IP.String(), strconv.Itoa(req.Port)))
+}
+
+// sendDCC sends the given DCC request to the given user.
+func (c *ConnImpl) sendDCC(nick string, req *DCCRequest) {
+	c.Privmsg(nick, ctcp.Encode("DCC", req.String()))
+}
+
+// dccTransferKey identifies a DCC offer by its port, or by its token if it's a passive offer.
+func dccTransferKey(port int, token string) string {
+	if port == 0 && len(token) > 0 {
+		return "token:" + token
+	}
+	return "port:" + strconv.Itoa(port)
+}
+
+// dccAcceptKey identifies the wait for a DCC ACCEPT from the given user. The nick is included, so that other users
+// can't answer resume requests by guessing the port.
+func (c *ConnImpl) dccAcceptKey(nick string, port int, token string) string {
+	return "accept:" + c.foldName(nick) + ":" + dccTransferKey(port, token)
+}
+
+// registerDCCReply registers a wait for a DCC request with the given key, such as the reply to a passive offer.
+// The reply is sent to the returned channel.
+func (c *ConnImpl) registerDCCReply(key string) <-chan *DCCRequest {
+	reply := make(chan *DCCRequest, 1)
+	c.dccLock.Lock()
+	c.dccReplies[key] = reply
+	c.dccLock.Unlock()
+	return reply
+}
+
+// unregisterDCCReply removes the wait for a DCC request with the given key.
+func (c *ConnImpl) unregisterDCCReply(key string) {
+	c.dccLock.Lock()
+	delete(c.dccReplies, key)
+	c.dccLock.Unlock()
+}
+
+// deliverDCCReply passes the given request to the wait registered with the given key.
+func (c *ConnImpl) deliverDCCReply(key string, req *DCCRequest) bool {
+	c.dccLock.Lock()
+	reply, ok := c.dccReplies[key]
+	c.dccLock.Unlock()
+	if ok {
+		select {
+		case reply <- req:
+		default:
+		}
+	}
+	return ok
+}
+
+// waitDCCReply waits for a DCC request on the given channel until the context is done.
+func waitDCCReply(ctx context.Context, reply <-chan *DCCRequest) (*DCCRequest, error) {
+	select {
+	case req := <-reply:
+		return req, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// handleDCC parses incoming DCC requests and passes them to the handler for the DCC type.
+func (c *ConnImpl) handleDCC(evt *Event) {
+	if evt.Echo || evt.Prefix == nil {
+		return
+	}
+	req, err := ParseDCCRequest(evt.Trailing)
+	if err != nil {
+		c.log(slog.LevelDebug, CategoryDCC, "Invalid DCC request", slog.String("nick", evt.Name), errAttr(err))
+		return
+	}
+	req.Source = HostmaskFromPrefix(evt.Prefix)
+
+	// Replies to our passive offers contain the token of the offer and the address to connect to.
+	if !req.Passive() && len(req.Token) > 0 && c.deliverDCCReply("passive:"+req.Token, req) {
+		return
+	}
+
+	switch req.Type {
+	case "CHAT":
+		c.handleDCCChat(evt, req)
+	case "SEND":
+		c.handleDCCSend(evt, req)
+	case "RESUME":
+		c.handleDCCResume(req)
+	case "ACCEPT":
+		c.deliverDCCReply(c.dccAcceptKey(req.Source.Nick, req.Port, req.Token), req)
+	}
+}
+
+// dccPortAllowed checks if the port in an incoming active DCC offer can be connected to.
+// Privileged ports are rejected, so that offers can't be used to make the client connect to system services.
+func dccPortAllowed(req *DCCRequest) bool {
+	return req.Passive() || req.Port >= 1024
+}
@@ -0,0 +1,318 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+func TestParseDCCRequest(t *testing.T) {
+	tests := []struct {
+		text     string
+		expected DCCRequest
+	}{
+		{"SEND file.txt 2130706433 5000 1234", DCCRequest{Type: "SEND", Argument: "file.txt",
+			IP: net.IPv4(127, 0, 0, 1).To4(), Port: 5000, Size: 1234}},
+		{`SEND "my file.txt" ::1 0 42 token`, DCCRequest{Type: "SEND", Argument: "my file.txt", IP: net.ParseIP("::1"),
+			Size: 42, Token: "token"}},
+		{"CHAT chat 2130706433 6000", DCCRequest{Type: "CHAT", Argument: "chat", IP: net.IPv4(127, 0, 0, 1).To4(),
+			Port: 6000, Size: -1}},
+		{"ACCEPT file.txt 5000 100", DCCRequest{Type: "ACCEPT", Argument: "file.txt", Port: 5000, Position: 100,
+			Size: -1}},
+	}
+	for _, test := range tests {
+		req, err := ParseDCCRequest(test.text)
+		if err != nil {
+			t.Errorf("%s: %v", test.text, err)
+			continue
+		}
+		if req.Type != test.expected.Type || req.Argument != test.expected.Argument || !req.IP.Equal(test.expected.IP) ||
+			req.Port != test.expected.Port || req.Size != test.expected.Size || req.Token != test.expected.Token ||
+			req.Position != test.expected.Position {
+			t.Errorf("%s: expected %+v, got %+v", test.text, test.expected, *req)
+		}
+		if roundTrip, err := ParseDCCRequest(req.String()); err != nil || roundTrip.String() != req.String() {
+			t.Errorf("%s: request didn't survive formatting: %q", test.text, req.String())
+		}
+	}
+	for _, invalid := range []string{"SEND", "SEND file", "SEND file notanip 5000", "SEND file 1 70000",
+		"SEND file 1 5000 size", "RESUME file 5000"} {
+		if _, err := ParseDCCRequest(invalid); err != ErrInvalidDCC {
+			t.Errorf("%s: expected ErrInvalidDCC, got %v", invalid, err)
+		}
+	}
+}
+
+func TestSanitizeDCCFilename(t *testing.T) {
+	tests := map[string]string{
+		"file.txt":          "file.txt",
+		"../../etc/passwd":  "passwd",
+		`C:\Windows\system`: "system",
+		".hidden":           "hidden",
+		"bad\x01name\n":     "badname",
+		"/":                 "",
+		"..":                "",
+	}
+	for input, expected := range tests {
+		if actual := sanitizeDCCFilename(input); actual != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestDCCAcceptRequiresNick(t *testing.T) {
+	c := newOfflineConn("tester")
+	reply := c.registerDCCReply(c.dccAcceptKey("Bob", 5000, ""))
+	c.RunHandlers(ParseEvent(":mallory!m@evil.example PRIVMSG tester :\x01DCC ACCEPT file.txt 5000 100\x01"))
+	select {
+	case req := <-reply:
+		t.Fatalf("ACCEPT from another user was delivered: %+v", req)
+	default:
+	}
+	c.RunHandlers(ParseEvent(":bob!b@b.example PRIVMSG tester :\x01DCC ACCEPT file.txt 5000 100\x01"))
+	select {
+	case req := <-reply:
+		if req.Position != 100 {
+			t.Errorf("Unexpected ACCEPT: %+v", req)
+		}
+	default:
+		t.Fatal("ACCEPT from the receiver wasn't delivered")
+	}
+}
+
+// newDCCPair connects a sender and a receiver to a fake server. The receiver accepts all files into a temporary
+// directory, and DCCSendEvents it receives are sent to the returned channel.
+func newDCCPair(t *testing.T) (sender, receiver *ConnImpl, events <-chan *DCCSendEvent) {
+	srv := fakeirc.NewServer()
+	t.Cleanup(srv.Close)
+	sender, receiver = newFakeConn(t, srv, "alice"), newFakeConn(t, srv, "bob")
+	for _, c := range []*ConnImpl{sender, receiver} {
+		c.DCCAddress = net.IPv4(127, 0, 0, 1)
+		c.DCCTimeout = testTimeout
+	}
+	receiver.DCCDownloadDir = t.TempDir()
+	receiver.SetDCCSendPolicy(func(req *DCCRequest) bool {
+		return true
+	})
+	sendEvents := make(chan *DCCSendEvent, 1)
+	receiver.AddTypedHandler(func(evt TypedEvent) {
+		if send, ok := evt.(*DCCSendEvent); ok {
+			// Read the path while the transfer is running to make sure it doesn't change anymore.
+			_ = send.Transfer.Path
+			sendEvents <- send
+		}
+	})
+	connectFake(t, srv, sender)
+	connectFake(t, srv, receiver)
+	return sender, receiver, sendEvents
+}
+
+// writeTestFile writes a file with random content and returns the path and the content.
+func writeTestFile(t *testing.T, name string, size int) (string, []byte) {
+	data := make([]byte, size)
+	rand.Read(data)
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		t.Fatal("Failed to write test file:", err)
+	}
+	return file, data
+}
+
+// waitTransfers waits for both ends of a transfer to finish and checks that the received file has the given content.
+func waitTransfers(t *testing.T, sent *DCCTransfer, events <-chan *DCCSendEvent, data []byte) *DCCTransfer {
+	t.Helper()
+	ctx := testContext(t)
+	var received *DCCTransfer
+	select {
+	case evt := <-events:
+		received = evt.Transfer
+	case <-ctx.Done():
+		t.Fatal("Receiver didn't accept the file")
+	}
+	if err := received.Wait(ctx); err != nil {
+		t.Fatal("Receiving failed:", err)
+	} else if err = sent.Wait(ctx); err != nil {
+		t.Fatal("Sending failed:", err)
+	}
+	content, err := os.ReadFile(received.Path)
+	if err != nil {
+		t.Fatal("Failed to read received file:", err)
+	} else if !bytes.Equal(content, data) {
+		t.Errorf("Received file differs: got %d bytes, expected %d", len(content), len(data))
+	}
+	return received
+}
+
+func TestDCCSendLoopback(t *testing.T) {
+	sender, receiver, events := newDCCPair(t)
+	file, data := writeTestFile(t, "test.bin", 3*dccBufferSize+123)
+	// A file with the same name exists, so the download goes to a new file.
+	existing := filepath.Join(receiver.DCCDownloadDir, "test.bin")
+	os.WriteFile(existing, data, 0644)
+	sent, err := sender.SendFile(testContext(t), "bob", file)
+	if err != nil {
+		t.Fatal("Failed to offer file:", err)
+	}
+	received := waitTransfers(t, sent, events, data)
+	if received.Path != filepath.Join(receiver.DCCDownloadDir, "test (1).bin") {
+		t.Errorf("Unexpected download path %s", received.Path)
+	} else if received.Position() != int64(len(data)) {
+		t.Errorf("Expected position %d, got %d", len(data), received.Position())
+	}
+}
+
+func TestDCCSendPassiveLoopback(t *testing.T) {
+	sender, _, events := newDCCPair(t)
+	file, data := writeTestFile(t, "passive.bin", dccBufferSize+1)
+	sent, err := sender.SendFilePassive(testContext(t), "bob", file)
+	if err != nil {
+		t.Fatal("Failed to offer file:", err)
+	}
+	waitTransfers(t, sent, events, data)
+}
+
+func TestDCCResumeLoopback(t *testing.T) {
+	sender, receiver, events := newDCCPair(t)
+	file, data := writeTestFile(t, "resume.bin", 2*dccBufferSize)
+	partial := filepath.Join(receiver.DCCDownloadDir, "resume.bin")
+	os.WriteFile(partial, data[:dccBufferSize/2], 0644)
+	sent, err := sender.SendFile(testContext(t), "bob", file)
+	if err != nil {
+		t.Fatal("Failed to offer file:", err)
+	}
+	received := waitTransfers(t, sent, events, data)
+	if received.Path != partial {
+		t.Errorf("Expected the partial file to be resumed, got %s", received.Path)
+	} else if transferred := atomic.LoadInt64(&received.transferred); transferred != int64(len(data)-dccBufferSize/2) {
+		t.Errorf("Expected only the rest of the file to be transferred, got %d bytes", transferred)
+	} else if sent.Position() != int64(len(data)) {
+		t.Errorf("Expected the sender to end at %d, got %d", len(data), sent.Position())
+	}
+}
+
+func TestDCCOfferWhileDisconnected(t *testing.T) {
+	c := Create("tester", "tester", IPv4Address{IP: "127.0.0.1", Port: 6667}).(*ConnImpl)
+	c.DCCAddress = net.IPv4(127, 0, 0, 1)
+	file, _ := writeTestFile(t, "file.txt", 16)
+	if addr := c.LocalAddr(); addr != nil {
+		t.Errorf("Expected no local address before connecting, got %v", addr)
+	}
+	ctx := testContext(t)
+	if _, err := c.OfferChat(ctx, "bob"); err != ErrDisconnected {
+		t.Errorf("OfferChat: expected ErrDisconnected, got %v", err)
+	}
+	if _, err := c.OfferChatPassive(ctx, "bob"); err != ErrDisconnected {
+		t.Errorf("OfferChatPassive: expected ErrDisconnected, got %v", err)
+	}
+	if _, err := c.SendFile(ctx, "bob", file); err != ErrDisconnected {
+		t.Errorf("SendFile: expected ErrDisconnected, got %v", err)
+	}
+	if _, err := c.SendFilePassive(ctx, "bob", file); err != ErrDisconnected {
+		t.Errorf("SendFilePassive: expected ErrDisconnected, got %v", err)
+	}
+}
+
+func TestDCCChatHandlerPanic(t *testing.T) {
+	c, buf := newLoggedConn()
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		remote.Close()
+	})
+	chat := newDCCChat(c, Hostmask{Nick: "bob"}, local)
+	received := make(chan *Event, 1)
+	chat.AddHandler(irc.PRIVMSG, func(evt *Event) {
+		panic("broken chat handler")
+	})
+	chat.AddHandler(irc.PRIVMSG, func(evt *Event) {
+		received <- evt
+	})
+	chat.Start()
+	if _, err := remote.Write([]byte("hello\n")); err != nil {
+		t.Fatal("Failed to write to chat:", err)
+	}
+	select {
+	case evt := <-received:
+		if evt.Trailing != "hello" {
+			t.Errorf("Unexpected message %q", evt.Trailing)
+		}
+	case <-testContext(t).Done():
+		t.Fatal("Handler after the panicking one didn't run")
+	}
+	if !strings.Contains(buf.String(), "broken chat handler") {
+		t.Errorf("Panic wasn't logged: %s", buf.String())
+	}
+}
+
+func TestDCCSendAcknowledgements(t *testing.T) {
+	tests := []struct {
+		name  string
+		acks  []uint32
+		close bool
+		err   error
+	}{
+		{"Complete", []uint32{8, 16}, false, nil},
+		{"EarlyClose", []uint32{8}, true, io.ErrUnexpectedEOF},
+		{"NoAcks", nil, true, io.ErrUnexpectedEOF},
+		{"Timeout", []uint32{8}, false, ErrDCCNotAcknowledged},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c := newOfflineConn("tester")
+			c.DCCTimeout = 100 * time.Millisecond
+			path, data := writeTestFile(t, "file.txt", 16)
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			local, remote := net.Pipe()
+			defer remote.Close()
+			go func() {
+				if _, err := io.ReadFull(remote, make([]byte, len(data))); err != nil {
+					return
+				}
+				var ack [4]byte
+				for _, position := range test.acks {
+					binary.BigEndian.PutUint32(ack[:], position)
+					remote.Write(ack[:])
+				}
+				if test.close {
+					remote.Close()
+				}
+			}()
+			transfer := newDCCTransfer(Hostmask{Nick: "bob"}, "file.txt", path, int64(len(data)), false)
+			if err := c.sendFileData(transfer, f, local); err != test.err {
+				t.Errorf("Expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
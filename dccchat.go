@@ -0,0 +1,256 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/sorcix/irc/ctcp"
+)
+
+// DCCClose is the command of the event passed to DCC CHAT handlers when the chat is closed.
+const DCCClose = "DCC_CLOSE"
+
+// DCCChat is a DCC CHAT session.
+// Lines from the other user are passed to handlers as PRIVMSG events, or CTCP_ACTION events for actions,
+// like messages received through the IRC server.
+type DCCChat struct {
+	Peer Hostmask
+
+	// c is the IRC connection the chat was negotiated on. Panics in the chat handlers are logged to its logger.
+	c         *ConnImpl
+	nick      string
+	conn      net.Conn
+	handlers  map[string][]Handler
+	lock      sync.Mutex
+	writeLock sync.Mutex
+	started   bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newDCCChat(c *ConnImpl, peer Hostmask, conn net.Conn) *DCCChat {
+	return &DCCChat{
+		Peer:     peer,
+		c:        c,
+		nick:     c.Nick,
+		conn:     conn,
+		handlers: make(map[string][]Handler),
+		closed:   make(chan struct{}),
+	}
+}
+
+// AddHandler adds the given handler for all events with the given code and returns the handler index.
+func (chat *DCCChat) AddHandler(code string, handler Handler) int {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	code = strings.ToUpper(code)
+	chat.handlers[code] = append(chat.handlers[code], handler)
+	return len(chat.handlers[code]) - 1
+}
+
+// Start starts reading lines from the other user. Handlers should be added before calling Start.
+func (chat *DCCChat) Start() {
+	chat.lock.Lock()
+	defer chat.lock.Unlock()
+	if !chat.started {
+		chat.started = true
+		go chat.readLoop()
+	}
+}
+
+// Send sends the given text to the other user. Each line of the text is sent as a separate message.
+func (chat *DCCChat) Send(text string) error {
+	chat.writeLock.Lock()
+	defer chat.writeLock.Unlock()
+	for _, line := range strings.Split(strings.Replace(text, "\r", "", -1), "\n") {
+		if _, err := fmt.Fprintf(chat.conn, "%s\n", line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Action sends the given text to the other user as a CTCP action.
+func (chat *DCCChat) Action(text string) error {
+	return chat.Send(ctcp.Action(strings.Replace(text, "\n", " ", -1)))
+}
+
+// Close closes the chat.
+func (chat *DCCChat) Close() error {
+	err := chat.conn.Close()
+	chat.closeOnce.Do(func() {
+		close(chat.closed)
+	})
+	return err
+}
+
+// Done returns a channel that's closed when the chat is closed.
+func (chat *DCCChat) Done() <-chan struct{} {
+	return chat.closed
+}
+
+// runHandlers runs the handlers for the given event.
+func (chat *DCCChat) runHandlers(evt *Event) {
+	chat.lock.Lock()
+	handlers := append(append([]Handler(nil), chat.handlers[evt.Command]...), chat.handlers["*"]...)
+	chat.lock.Unlock()
+	for _, handle := range handlers {
+		chat.c.callHandler(evt, handle)
+	}
+}
+
+func (chat *DCCChat) readLoop() {
+	prefix := &irc.Prefix{Name: chat.Peer.Nick, User: chat.Peer.User, Host: chat.Peer.Host}
+	scanner := bufio.NewScanner(chat.conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		evt := &Event{Message: &irc.Message{
+			Prefix:   prefix,
+			Command:  irc.PRIVMSG,
+			Params:   []string{chat.nick},
+			Trailing: line,
+		}}
+		evt.received(time.Now())
+		evt.Args()
+		if tag, text, ok := ctcp.Decode(line); ok {
+			evt.Command = "CTCP_" + tag
+			evt.Trailing = text
+		}
+		chat.runHandlers(evt)
+	}
+	chat.Close()
+	chat.runHandlers(&Event{Message: &irc.Message{Prefix: prefix, Command: DCCClose}})
+}
+
+// SetDCCChatPolicy - See DCC interface docs
+func (c *ConnImpl) SetDCCChatPolicy(policy DCCPolicy) {
+	c.DCCChatPolicy = policy
+}
+
+// OfferChat - See DCC interface docs
+func (c *ConnImpl) OfferChat(ctx context.Context, nick string) (*DCCChat, error) {
+	listener, ip, err := c.dccListen()
+	if err != nil {
+		return nil, err
+	}
+	c.sendDCC(nick, &DCCRequest{
+		Type:     "CHAT",
+		Argument: "chat",
+		IP:       ip,
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+	})
+	conn, err := dccAccept(ctx, listener)
+	if err != nil {
+		return nil, err
+	}
+	return newDCCChat(c, Hostmask{Nick: nick}, conn), nil
+}
+
+// OfferChatPassive - See DCC interface docs
+func (c *ConnImpl) OfferChatPassive(ctx context.Context, nick string) (*DCCChat, error) {
+	ip, err := c.dccAdvertisedIP()
+	if err != nil {
+		return nil, err
+	}
+	token := newDCCToken()
+	reply := c.registerDCCReply("passive:" + token)
+	defer c.unregisterDCCReply("passive:" + token)
+	c.sendDCC(nick, &DCCRequest{
+		Type:     "CHAT",
+		Argument: "chat",
+		IP:       ip,
+		Port:     0,
+		Token:    token,
+	})
+	req, err := waitDCCReply(ctx, reply)
+	if err != nil {
+		return nil, err
+	} else if req.Type != "CHAT" || !dccPortAllowed(req) {
+		return nil, ErrInvalidDCC
+	}
+	conn, err := c.dccDial(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return newDCCChat(c, req.Source, conn), nil
+}
+
+// dccAdvertisedIP returns the address to put in passive DCC offers. Passive offers don't need a reachable address,
+// but some clients refuse to parse offers without a valid one.
+func (c *ConnImpl) dccAdvertisedIP() (net.IP, error) {
+	localIP, err := c.dccLocalIP()
+	if err != nil {
+		return nil, err
+	} else if c.DCCAddress != nil {
+		return c.DCCAddress, nil
+	} else if localIP != nil {
+		return localIP, nil
+	}
+	return net.IPv4zero, nil
+}
+
+// handleDCCChat accepts incoming DCC CHAT offers if the policy allows it.
+// A DCCChatEvent is emitted once the connection is established.
+func (c *ConnImpl) handleDCCChat(evt *Event, req *DCCRequest) {
+	if c.DCCChatPolicy == nil || !dccPortAllowed(req) || !c.DCCChatPolicy(req) {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.DCCTimeout)
+		defer cancel()
+		var conn net.Conn
+		var err error
+		if req.Passive() {
+			var listener net.Listener
+			var ip net.IP
+			listener, ip, err = c.dccListen()
+			if err == nil {
+				c.sendDCC(req.Source.Nick, &DCCRequest{
+					Type:     "CHAT",
+					Argument: req.Argument,
+					IP:       ip,
+					Port:     listener.Addr().(*net.TCPAddr).Port,
+					Token:    req.Token,
+				})
+				conn, err = dccAccept(ctx, listener)
+			}
+		} else {
+			conn, err = c.dccDial(ctx, req)
+		}
+		if err != nil {
+			c.log(slog.LevelWarn, CategoryDCC, "Failed to establish DCC CHAT", slog.String("nick", req.Source.Nick), errAttr(err))
+			return
+		}
+		c.dispatch(func() {
+			c.emit(&DCCChatEvent{
+				eventSource: eventSource{evt},
+				Request:     req,
+				Chat:        newDCCChat(c, req.Source, conn),
+			})
+		})
+	}()
+}
@@ -0,0 +1,508 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dccBufferSize is the size of the chunks files are transferred in.
+const dccBufferSize = 32 * 1024
+
+// DCCTransfer is a DCC SEND file transfer.
+type DCCTransfer struct {
+	Peer Hostmask
+	// Name is the file name sent in the DCC offer.
+	Name string
+	// Path is the local path of the file. For incoming transfers, a number is added to the file name before the
+	// DCCSendEvent is emitted if a file with the same name exists and the transfer isn't resumed.
+	Path string
+	// Size is the size of the file, or -1 if the sender didn't tell it.
+	Size     int64
+	Incoming bool
+
+	offset      int64
+	started     bool
+	transferred int64
+	lock        sync.Mutex
+	done        chan struct{}
+	err         error
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func newDCCTransfer(peer Hostmask, name, path string, size int64, incoming bool) *DCCTransfer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DCCTransfer{
+		Peer:     peer,
+		Name:     name,
+		Path:     path,
+		Size:     size,
+		Incoming: incoming,
+		done:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+// Position returns the number of bytes of the file that have been transferred, including the part skipped by
+// resuming.
+func (t *DCCTransfer) Position() int64 {
+	t.lock.Lock()
+	offset := t.offset
+	t.lock.Unlock()
+	return offset + atomic.LoadInt64(&t.transferred)
+}
+
+// Wait waits until the transfer is finished.
+func (t *DCCTransfer) Wait(ctx context.Context) error {
+	select {
+	case <-t.done:
+		return t.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cancel cancels the transfer.
+func (t *DCCTransfer) Cancel() {
+	t.cancel()
+}
+
+func (t *DCCTransfer) finish(err error) {
+	t.err = err
+	t.cancel()
+	close(t.done)
+}
+
+// start marks the transfer as started and returns the position to start from. Resume requests are ignored after this.
+func (t *DCCTransfer) start() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.started = true
+	return t.offset
+}
+
+// closeOnCancel closes the given connection if the transfer is canceled.
+func (t *DCCTransfer) closeOnCancel(conn io.Closer) {
+	go func() {
+		<-t.ctx.Done()
+		conn.Close()
+	}()
+}
+
+// sanitizeDCCFilename removes directories, control characters and leading dots from the given file name.
+// An empty string is returned if nothing is left.
+func sanitizeDCCFilename(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(name, ".")
+	if name == "/" {
+		return ""
+	}
+	return name
+}
+
+// uniquePath adds a number to the given path if a file with the same name already exists.
+func uniquePath(file string) string {
+	ext := filepath.Ext(file)
+	base := strings.TrimSuffix(file, ext)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return file
+		}
+		file = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+}
+
+// SetDCCSendPolicy - See DCC interface docs
+func (c *ConnImpl) SetDCCSendPolicy(policy DCCPolicy) {
+	c.DCCSendPolicy = policy
+}
+
+// progress calls the progress callback of the connection.
+func (c *ConnImpl) progress(t *DCCTransfer) {
+	if c.DCCProgress != nil {
+		c.DCCProgress(t)
+	}
+}
+
+// handleDCCSend accepts incoming DCC SEND offers if the download directory is set, the file isn't too large and the
+// policy allows it. A DCCSendEvent is emitted once the local file has been chosen.
+func (c *ConnImpl) handleDCCSend(evt *Event, req *DCCRequest) {
+	name := sanitizeDCCFilename(req.Argument)
+	if len(c.DCCDownloadDir) == 0 || c.DCCSendPolicy == nil || len(name) == 0 || !dccPortAllowed(req) {
+		return
+	} else if c.DCCMaxSize > 0 && req.Size > c.DCCMaxSize {
+		return
+	} else if !c.DCCSendPolicy(req) {
+		return
+	}
+	t := newDCCTransfer(req.Source, req.Argument, filepath.Join(c.DCCDownloadDir, name), req.Size, true)
+	go func() {
+		file, err := c.openDownload(t, req)
+		// The event is only emitted after the local path is final, so that handlers never see it change.
+		c.dispatch(func() {
+			c.emit(&DCCSendEvent{
+				eventSource: eventSource{evt},
+				Request:     req,
+				Transfer:    t,
+			})
+		})
+		if err != nil {
+			t.finish(err)
+			return
+		}
+		t.finish(c.receiveFile(t, req, file))
+	}()
+}
+
+// resumeOffset asks the sender to resume the transfer if a part of the file already exists.
+// It returns the position to resume from, or zero if the file should be downloaded from the start.
+func (c *ConnImpl) resumeOffset(t *DCCTransfer, req *DCCRequest) int64 {
+	info, err := os.Stat(t.Path)
+	if err != nil || !c.DCCResume || req.Size <= 0 || info.Size() <= 0 || info.Size() >= req.Size {
+		return 0
+	}
+	key := c.dccAcceptKey(req.Source.Nick, req.Port, req.Token)
+	reply := c.registerDCCReply(key)
+	defer c.unregisterDCCReply(key)
+	c.sendDCC(req.Source.Nick, &DCCRequest{
+		Type:     "RESUME",
+		Argument: req.Argument,
+		Port:     req.Port,
+		Position: info.Size(),
+		Token:    req.Token,
+	})
+	ctx, cancel := context.WithTimeout(t.ctx, c.DCCTimeout)
+	defer cancel()
+	accept, err := waitDCCReply(ctx, reply)
+	if err != nil || accept.Position < 0 || accept.Position > info.Size() {
+		return 0
+	}
+	return accept.Position
+}
+
+// openDownload opens the local file for the given incoming transfer. If a part of the file exists and the sender
+// agrees to resume, the file is opened at the end of the part. Otherwise a new file is created with a unique name.
+func (c *ConnImpl) openDownload(t *DCCTransfer, req *DCCRequest) (*os.File, error) {
+	offset := c.resumeOffset(t, req)
+	var file *os.File
+	var err error
+	if offset > 0 {
+		file, err = os.OpenFile(t.Path, os.O_WRONLY, 0644)
+		if err == nil {
+			err = file.Truncate(offset)
+		}
+		if err == nil {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+	} else {
+		t.Path = uniquePath(t.Path)
+		file, err = os.OpenFile(t.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		return nil, err
+	}
+	t.lock.Lock()
+	t.offset = offset
+	t.lock.Unlock()
+	return file, nil
+}
+
+// receiveFile downloads the file offered in the given request into the given file.
+func (c *ConnImpl) receiveFile(t *DCCTransfer, req *DCCRequest, file *os.File) error {
+	defer file.Close()
+	ctx, cancel := context.WithTimeout(t.ctx, c.DCCTimeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if req.Passive() {
+		var listener net.Listener
+		var ip net.IP
+		listener, ip, err = c.dccListen()
+		if err != nil {
+			return err
+		}
+		c.sendDCC(req.Source.Nick, &DCCRequest{
+			Type:     "SEND",
+			Argument: req.Argument,
+			IP:       ip,
+			Port:     listener.Addr().(*net.TCPAddr).Port,
+			Size:     req.Size,
+			Token:    req.Token,
+		})
+		conn, err = dccAccept(ctx, listener)
+	} else {
+		conn, err = c.dccDial(ctx, req)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	t.closeOnCancel(conn)
+	t.start()
+
+	buf := make([]byte, dccBufferSize)
+	var ack [4]byte
+	for t.Size < 0 || t.Position() < t.Size {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if c.DCCMaxSize > 0 && t.Position()+int64(n) > c.DCCMaxSize {
+				return ErrDCCTooLarge
+			} else if _, werr := file.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			atomic.AddInt64(&t.transferred, int64(n))
+			// Acknowledge the received bytes. The acknowledgement only contains the lowest 32 bits of the position.
+			binary.BigEndian.PutUint32(ack[:], uint32(t.Position()))
+			conn.Write(ack[:])
+			c.progress(t)
+		}
+		if err == io.EOF && t.Size < 0 {
+			return nil
+		} else if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			if t.ctx.Err() != nil {
+				return t.ctx.Err()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// SendFile - See DCC interface docs
+func (c *ConnImpl) SendFile(ctx context.Context, nick, file string) (*DCCTransfer, error) {
+	f, info, err := openDCCFile(file)
+	if err != nil {
+		return nil, err
+	}
+	listener, ip, err := c.dccListen()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	t := newDCCTransfer(Hostmask{Nick: nick}, filepath.Base(file), file, info.Size(), false)
+	key := dccTransferKey(port, "")
+	c.addOutgoingTransfer(key, t)
+	c.sendDCC(nick, &DCCRequest{
+		Type:     "SEND",
+		Argument: t.Name,
+		IP:       ip,
+		Port:     port,
+		Size:     t.Size,
+	})
+	go func() {
+		defer f.Close()
+		defer c.removeOutgoingTransfer(key)
+		conn, err := dccAccept(ctx, listener)
+		if err != nil {
+			t.finish(err)
+			return
+		}
+		t.finish(c.sendFileData(t, f, conn))
+	}()
+	return t, nil
+}
+
+// SendFilePassive - See DCC interface docs
+func (c *ConnImpl) SendFilePassive(ctx context.Context, nick, file string) (*DCCTransfer, error) {
+	ip, err := c.dccAdvertisedIP()
+	if err != nil {
+		return nil, err
+	}
+	f, info, err := openDCCFile(file)
+	if err != nil {
+		return nil, err
+	}
+	token := newDCCToken()
+	t := newDCCTransfer(Hostmask{Nick: nick}, filepath.Base(file), file, info.Size(), false)
+	key := dccTransferKey(0, token)
+	c.addOutgoingTransfer(key, t)
+	reply := c.registerDCCReply("passive:" + token)
+	c.sendDCC(nick, &DCCRequest{
+		Type:     "SEND",
+		Argument: t.Name,
+		IP:       ip,
+		Port:     0,
+		Size:     t.Size,
+		Token:    token,
+	})
+	go func() {
+		defer f.Close()
+		defer c.removeOutgoingTransfer(key)
+		defer c.unregisterDCCReply("passive:" + token)
+		req, err := waitDCCReply(ctx, reply)
+		if err != nil {
+			t.finish(err)
+			return
+		} else if req.Type != "SEND" || !dccPortAllowed(req) {
+			t.finish(ErrInvalidDCC)
+			return
+		}
+		t.Peer = req.Source
+		conn, err := c.dccDial(ctx, req)
+		if err != nil {
+			t.finish(err)
+			return
+		}
+		t.finish(c.sendFileData(t, f, conn))
+	}()
+	return t, nil
+}
+
+// openDCCFile opens the given file for sending.
+func openDCCFile(file string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	} else if info.IsDir() {
+		f.Close()
+		return nil, nil, ErrInvalidDCC
+	}
+	return f, info, nil
+}
+
+func (c *ConnImpl) addOutgoingTransfer(key string, t *DCCTransfer) {
+	c.dccLock.Lock()
+	c.dccSends[key] = t
+	c.dccLock.Unlock()
+}
+
+func (c *ConnImpl) removeOutgoingTransfer(key string) {
+	c.dccLock.Lock()
+	delete(c.dccSends, key)
+	c.dccLock.Unlock()
+}
+
+// handleDCCResume accepts resume requests for outgoing transfers that haven't started yet.
+func (c *ConnImpl) handleDCCResume(req *DCCRequest) {
+	c.dccLock.Lock()
+	t, ok := c.dccSends[dccTransferKey(req.Port, req.Token)]
+	c.dccLock.Unlock()
+	if !ok || !c.equalName(t.Peer.Nick, req.Source.Nick) || req.Position < 0 || req.Position > t.Size {
+		return
+	}
+	t.lock.Lock()
+	if t.started {
+		t.lock.Unlock()
+		return
+	}
+	t.offset = req.Position
+	t.lock.Unlock()
+	c.sendDCC(req.Source.Nick, &DCCRequest{
+		Type:     "ACCEPT",
+		Argument: req.Argument,
+		Port:     req.Port,
+		Position: req.Position,
+		Token:    req.Token,
+	})
+}
+
+// sendFileData sends the file over the given connection and waits for the receiver to acknowledge all of it.
+func (c *ConnImpl) sendFileData(t *DCCTransfer, f *os.File, conn net.Conn) error {
+	defer conn.Close()
+	t.closeOnCancel(conn)
+	offset := t.start()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	// The receiver acknowledges the data it has received. The transfer is complete when all of it is acknowledged.
+	// Like the acknowledgements, lastAck only contains the lowest 32 bits of the position.
+	lastAck := uint32(offset)
+	acked := make(chan struct{})
+	go func() {
+		defer close(acked)
+		var ack [4]byte
+		for {
+			if _, err := io.ReadFull(conn, ack[:]); err != nil {
+				return
+			}
+			position := binary.BigEndian.Uint32(ack[:])
+			atomic.StoreUint32(&lastAck, position)
+			if position == uint32(t.Size) {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, dccBufferSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, werr := conn.Write(buf[:n]); werr != nil {
+				if t.ctx.Err() != nil {
+					return t.ctx.Err()
+				}
+				return werr
+			}
+			atomic.AddInt64(&t.transferred, int64(n))
+			c.progress(t)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-acked:
+		if atomic.LoadUint32(&lastAck) != uint32(t.Size) {
+			if t.ctx.Err() != nil {
+				return t.ctx.Err()
+			}
+			return io.ErrUnexpectedEOF
+		}
+	case <-time.After(c.DCCTimeout):
+		if atomic.LoadUint32(&lastAck) != uint32(t.Size) {
+			return ErrDCCNotAcknowledged
+		}
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+	return nil
+}
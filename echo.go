@@ -0,0 +1,251 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"sync"
+
+	"github.com/sorcix/irc"
+	"github.com/sorcix/irc/ctcp"
+)
+
+// Delivery is a handle for confirming the delivery of a message sent with PrivmsgTracked, NoticeTracked or
+// ActionTracked.
+type Delivery struct {
+	lr *LabeledResponse
+	// conn is the connection whose handlers resolve the delivery when the echo is received, or nil if the delivery
+	// is resolved by the writer.
+	conn *ConnImpl
+	done chan struct{}
+	once sync.Once
+	evt  *Event
+	err  error
+}
+
+// Wait waits until the server echoes the message back and returns the echo, which contains the msgid and server time
+// of the message. If the server doesn't support echo-message, the returned event is a local echo created when the
+// message was written to the socket. Like the Querier functions, Wait can't wait for an echo from the server in a
+// handler.
+func (d *Delivery) Wait(ctx context.Context) (*Event, error) {
+	if d.lr != nil {
+		events, err := d.lr.Wait(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, evt := range events {
+			if evt.Command == irc.PRIVMSG || evt.Command == irc.NOTICE {
+				return evt, nil
+			} else if isErrorNumeric(evt.Command) {
+				return nil, queryError(evt.Message)
+			}
+		}
+		return nil, ErrNoEcho
+	}
+	select {
+	case <-d.done:
+		return d.evt, d.err
+	default:
+	}
+	if d.conn != nil && d.conn.inHandler() {
+		return nil, ErrCalledFromHandler
+	}
+	select {
+	case <-d.done:
+		return d.evt, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve sets the result of the delivery. Only the first result is used.
+func (d *Delivery) resolve(evt *Event, err error) {
+	d.once.Do(func() {
+		d.evt, d.err = evt, err
+		close(d.done)
+	})
+}
+
+// pendingEcho is a message waiting to be echoed back by the server.
+type pendingEcho struct {
+	command  string
+	target   string
+	delivery *Delivery
+}
+
+// isErrorNumeric checks if the given command is an error numeric.
+func isErrorNumeric(command string) bool {
+	return len(command) == 3 && (command[0] == '4' || command[0] == '5')
+}
+
+// PrivmsgTracked - See Tunnel interface docs
+func (c *ConnImpl) PrivmsgTracked(channel, msg string) *Delivery {
+	return c.sendTracked(irc.PRIVMSG, channel, msg)
+}
+
+// NoticeTracked - See Tunnel interface docs
+func (c *ConnImpl) NoticeTracked(channel, msg string) *Delivery {
+	return c.sendTracked(irc.NOTICE, channel, msg)
+}
+
+// ActionTracked - See Tunnel interface docs
+func (c *ConnImpl) ActionTracked(channel, msg string) *Delivery {
+	return c.sendTracked(irc.PRIVMSG, channel, ctcp.Action(msg))
+}
+
+func (c *ConnImpl) sendTracked(command, target, text string) *Delivery {
+	msg := &irc.Message{
+		Command:  command,
+		Params:   []string{target},
+		Trailing: text,
+	}
+	delivery := &Delivery{done: make(chan struct{})}
+	if err := ValidateMessage(msg); err != nil {
+		// Multi-line messages are rejected too, since a delivery can only track a single message.
+		delivery.resolve(nil, err)
+		return delivery
+	} else if !c.HasCap("echo-message") {
+		// The writer will resolve the delivery with a local echo.
+		c.enqueue(&Event{Message: msg, delivery: delivery})
+		return delivery
+	} else if lr, err := c.SendLabeled(msg); err == nil {
+		delivery.lr = lr
+		return delivery
+	}
+	delivery.conn = c
+	pending := &pendingEcho{command: command, target: target, delivery: delivery}
+	c.echoLock.Lock()
+	c.pendingEchoes = append(c.pendingEchoes, pending)
+	c.echoLock.Unlock()
+	if err := c.Send(msg); err != nil {
+		c.removePendingEcho(pending)
+		delivery.resolve(nil, err)
+	}
+	return delivery
+}
+
+// removePendingEcho stops waiting for the echo of the given message.
+func (c *ConnImpl) removePendingEcho(pending *pendingEcho) {
+	c.echoLock.Lock()
+	defer c.echoLock.Unlock()
+	for i, other := range c.pendingEchoes {
+		if other == pending {
+			c.pendingEchoes = append(c.pendingEchoes[:i], c.pendingEchoes[i+1:]...)
+			return
+		}
+	}
+}
+
+// isOwnMessage checks if the given event is a PRIVMSG or NOTICE sent by this client.
+func (c *ConnImpl) isOwnMessage(evt *Event) bool {
+	return (evt.Command == irc.PRIVMSG || evt.Command == irc.NOTICE) &&
+		evt.Prefix != nil && c.equalName(evt.Name, c.Nick)
+}
+
+// matchEcho marks echoed messages and resolves the oldest pending delivery for the target of the echo.
+// Errors about the target of a pending delivery fail the delivery.
+func (c *ConnImpl) matchEcho(evt *Event) {
+	var target string
+	var err error
+	if c.isOwnMessage(evt) {
+		evt.Echo = true
+		if len(evt.Label()) > 0 || len(evt.Params) == 0 {
+			return
+		}
+		target = evt.Params[0]
+	} else if evt.Command == irc.ERR_CANNOTSENDTOCHAN || evt.Command == irc.ERR_NOSUCHNICK ||
+		evt.Command == irc.ERR_NOSUCHCHANNEL {
+		params := evt.Args()
+		if len(evt.Label()) > 0 || len(params) < 2 {
+			return
+		}
+		target = params[1]
+		err = queryError(evt.Message)
+	} else {
+		return
+	}
+
+	c.echoLock.Lock()
+	defer c.echoLock.Unlock()
+	for i, pending := range c.pendingEchoes {
+		if c.equalName(pending.target, target) && (err != nil || pending.command == evt.Command) {
+			c.pendingEchoes = append(c.pendingEchoes[:i], c.pendingEchoes[i+1:]...)
+			if err != nil {
+				pending.delivery.resolve(nil, err)
+			} else {
+				pending.delivery.resolve(evt.Copy(), nil)
+			}
+			return
+		}
+	}
+}
+
+// failEchoes cancels all pending deliveries with the given error.
+func (c *ConnImpl) failEchoes(err error) {
+	c.echoLock.Lock()
+	defer c.echoLock.Unlock()
+	for _, pending := range c.pendingEchoes {
+		pending.delivery.resolve(nil, err)
+	}
+	c.pendingEchoes = nil
+}
+
+// localEcho creates a local echo of the given sent message if the server doesn't echo messages.
+// The echo is passed to handlers if LocalEcho is enabled and used to resolve the delivery of the message.
+func (c *ConnImpl) localEcho(sent *Event) {
+	if (sent.Command != irc.PRIVMSG && sent.Command != irc.NOTICE) || c.HasCap("echo-message") {
+		return
+	}
+	msg := *sent.Message
+	msg.Prefix = &irc.Prefix{Name: c.Nick, User: c.User}
+	msg.Params = append([]string(nil), msg.Params...)
+	echo := &Event{
+		Message:  &msg,
+		Time:     sent.Time,
+		Received: sent.Time,
+		Echo:     true,
+	}
+	if sent.delivery != nil {
+		sent.delivery.resolve(echo.Copy(), nil)
+	}
+	if c.LocalEcho {
+		c.echoLock.Lock()
+		c.localEchoes = append(c.localEchoes, echo)
+		c.echoLock.Unlock()
+		select {
+		case c.echoSignal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// echoLoop passes local echoes to handlers. Handlers can't be called directly from the writer, because the writer
+// would deadlock if a handler tried to send a message while the output buffer is full.
+func (c *ConnImpl) echoLoop(signal <-chan struct{}) {
+	for range signal {
+		c.echoLock.Lock()
+		echoes := c.localEchoes
+		c.localEchoes = nil
+		c.echoLock.Unlock()
+		for _, evt := range echoes {
+			c.dispatch(func() {
+				c.handleEvent(evt)
+			})
+		}
+	}
+}
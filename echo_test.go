@@ -0,0 +1,104 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+func TestDeliveryLocalEcho(t *testing.T) {
+	srv := fakeirc.NewServer()
+	t.Cleanup(srv.Close)
+	delete(srv.Caps, "echo-message")
+	c := newFakeConn(t, srv, "tester")
+	connectFake(t, srv, c)
+
+	evt, err := c.PrivmsgTracked("#test", "hello").Wait(testContext(t))
+	if err != nil {
+		t.Fatal("Delivery failed:", err)
+	} else if !evt.Echo || evt.Name != "tester" || evt.Trailing != "hello" {
+		t.Errorf("Unexpected local echo: %+v", evt)
+	}
+}
+
+func TestDeliveryEchoMessage(t *testing.T) {
+	srv, c, _ := startFake(t)
+	evt, err := c.PrivmsgTracked("tester", "hello").Wait(testContext(t))
+	if err != nil {
+		t.Fatal("Delivery failed:", err)
+	} else if !evt.Echo || evt.Trailing != "hello" || evt.Time.IsZero() {
+		t.Errorf("Unexpected echo: %+v", evt)
+	}
+	_, err = c.PrivmsgTracked("#nowhere", "hello").Wait(testContext(t))
+	if queryErr, ok := err.(QueryError); !ok || queryErr.Code != irc.ERR_NOSUCHCHANNEL {
+		t.Errorf("Expected ERR_NOSUCHCHANNEL, got %v", err)
+	}
+
+	// Swallow the next message, so that the delivery is waiting for the echo when the connection drops.
+	srv.On(irc.PRIVMSG, func(client *fakeirc.Client, msg *irc.Message) bool {
+		return true
+	})
+	delivery := c.PrivmsgTracked("tester", "lost")
+	if _, err = srv.Expect(testContext(t), "PRIVMSG tester :lost"); err != nil {
+		t.Fatal("Server didn't receive the message:", err)
+	}
+	srv.Client("tester").Close()
+	if _, err = delivery.Wait(testContext(t)); err != ErrDisconnected {
+		t.Errorf("Expected ErrDisconnected, got %v", err)
+	}
+}
+
+func TestDeliveryWriteFailure(t *testing.T) {
+	c := Create("tester", "tester", IPv4Address{IP: "127.0.0.1", Port: 6667}).(*ConnImpl)
+	c.Timeout = 200 * time.Millisecond
+	c.SetDialer(func(network, address string) (net.Conn, error) {
+		server, client := net.Pipe()
+		t.Cleanup(func() {
+			server.Close()
+		})
+		// Read the registration lines and then stop reading, so that the next write blocks until it times out.
+		go func() {
+			reader := bufio.NewReader(server)
+			for i := 0; i < 3; i++ {
+				if _, err := reader.ReadString('\n'); err != nil {
+					return
+				}
+			}
+		}()
+		return client, nil
+	})
+	if err := c.Connect(); err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	inFlight := c.PrivmsgTracked("#test", "in flight")
+	queued := c.PrivmsgTracked("#test", "queued")
+
+	ctx := testContext(t)
+	if _, err := inFlight.Wait(ctx); err == nil || err == ErrDisconnected || err == ctx.Err() {
+		t.Errorf("Expected the write error for the message being written, got %v", err)
+	}
+	if _, err := queued.Wait(ctx); err != ErrDisconnected {
+		t.Errorf("Expected ErrDisconnected for the queued message, got %v", err)
+	}
+}
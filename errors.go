@@ -20,6 +20,9 @@ package libmauirc
 import (
 	"errors"
 	"fmt"
+	"strings"
+
+	"github.com/sorcix/irc"
 )
 
 // PreConnError is an error that happened berfore connecting to the server
@@ -43,3 +46,105 @@ var (
 
 // ErrDisconnected is given when the client disconnects
 var ErrDisconnected = errors.New("Disconnected")
+
+// ErrNoFreeNick is given when the preferred nick, the alternate nicks and all the generated nicks are taken
+var ErrNoFreeNick = errors.New("No free nick found")
+
+// ErrCalledFromHandler is given when a function that waits for a reply from the server is called from a handler.
+// Replies are dispatched by the goroutine running the handler, so the function would wait forever.
+var ErrCalledFromHandler = errors.New("Can't wait for a reply from the server in a handler")
+
+// ErrNoEcho is given when the server acknowledges a tracked message without echoing it back
+var ErrNoEcho = errors.New("Message was not echoed back")
+
+// ErrCapNotEnabled is given when trying to use a feature that requires an IRCv3 capability that isn't enabled
+var ErrCapNotEnabled = errors.New("Capability not enabled")
+
+// ErrModeNotSupported is given when trying to use a channel mode the server doesn't support
+var ErrModeNotSupported = errors.New("Mode not supported by server")
+
+// ErrInvalidDCC is given when a DCC request can't be parsed or contains invalid values
+var ErrInvalidDCC = errors.New("Invalid DCC request")
+
+// ErrDCCTooLarge is given when an incoming DCC SEND transfer exceeds the maximum size
+var ErrDCCTooLarge = errors.New("DCC transfer exceeds maximum size")
+
+// ErrDCCNotAcknowledged is given when the receiver of an outgoing DCC SEND transfer doesn't acknowledge all of the data
+// within the DCC timeout
+var ErrDCCNotAcknowledged = errors.New("DCC transfer was not acknowledged")
+
+// ErrInvalidReply is given when the server replies to a command with a message that's missing parameters
+var ErrInvalidReply = errors.New("Invalid reply from server")
+
+// ErrNotUTF8 is given when trying to send a message that isn't valid UTF-8 to a server that only accepts UTF-8
+var ErrNotUTF8 = errors.New("Message is not valid UTF-8")
+
+// InvalidReason is the reason why a message can't be sent.
+type InvalidReason string
+
+// Reasons for InvalidMessageError
+const (
+	InvalidCommand   InvalidReason = "invalid command"
+	InvalidLineBreak InvalidReason = "parameter contains a line break"
+	InvalidNUL       InvalidReason = "parameter contains a NUL character"
+	InvalidSpace     InvalidReason = "middle parameter contains a space"
+	InvalidColon     InvalidReason = "middle parameter starts with a colon"
+	InvalidEmpty     InvalidReason = "middle parameter is empty"
+	InvalidTag       InvalidReason = "invalid tag key"
+)
+
+// InvalidMessageError is returned when trying to send a message that the server would misinterpret, such as a message
+// with a line break that would let the rest of the text be read as another command.
+type InvalidMessageError struct {
+	Command string
+	// Value is the invalid command or parameter.
+	Value  string
+	Reason InvalidReason
+}
+
+func (err InvalidMessageError) Error() string {
+	return fmt.Sprintf("Invalid %s message: %s: %q", err.Command, err.Reason, err.Value)
+}
+
+// QueryError is returned by the synchronous query functions when the server replies with an error numeric.
+type QueryError struct {
+	Code    string
+	Target  string
+	Message string
+}
+
+func (err QueryError) Error() string {
+	return fmt.Sprintf("%s %s: %s", err.Code, err.Target, err.Message)
+}
+
+// StandardReplyError is an IRCv3 FAIL standard reply received as a response to a command.
+type StandardReplyError struct {
+	Command     string
+	Code        string
+	Context     []string
+	Description string
+}
+
+func (err StandardReplyError) Error() string {
+	if len(err.Context) > 0 {
+		return fmt.Sprintf("%s %s %s: %s", err.Command, err.Code, strings.Join(err.Context, " "), err.Description)
+	}
+	return fmt.Sprintf("%s %s: %s", err.Command, err.Code, err.Description)
+}
+
+// standardReplyError creates a StandardReplyError from the given FAIL message.
+func standardReplyError(msg *irc.Message) error {
+	params := args(msg)
+	err := StandardReplyError{}
+	if len(params) > 0 {
+		err.Command = params[0]
+	}
+	if len(params) > 1 {
+		err.Code = params[1]
+	}
+	if len(params) > 2 {
+		err.Context = params[2 : len(params)-1]
+		err.Description = params[len(params)-1]
+	}
+	return err
+}
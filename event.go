@@ -0,0 +1,119 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Event is an IRC message with the IRCv3 information attached to it.
+type Event struct {
+	*irc.Message
+	// Tags contains the IRCv3 message tags of the message.
+	Tags Tags
+	// Batch is the batch started by this message if the message is a BATCH start.
+	// Batches are delivered to handlers after they have been fully received: first the BATCH event, then the messages
+	// in the batch in order. If the batch is the reply to a query or a labeled request, only the BATCH event is.
+	Batch *Batch
+	// InBatch is the batch this message was received in, or nil if the message wasn't a part of a batch.
+	InBatch *Batch
+	// Time is the time the message was sent. For incoming messages, it's taken from the server-time tag and falls
+	// back to the time the message was received. For outgoing messages, it's the time the message was written.
+	Time time.Time
+	// Received is the local time when an incoming message was received.
+	Received time.Time
+	// MsgID is the IRCv3 message ID of the message, or an empty string if the server didn't send one.
+	MsgID string
+	// Echo is true if the event is a message sent by this client that was echoed back by the server or created
+	// locally because the server doesn't support echo-message.
+	Echo bool
+
+	args     []string
+	delivery *Delivery
+}
+
+// ParseEvent parses a raw IRC line that may include IRCv3 message tags.
+func ParseEvent(raw string) *Event {
+	evt := &Event{}
+	if strings.HasPrefix(raw, "@") {
+		i := strings.IndexByte(raw, ' ')
+		if i < 0 {
+			return nil
+		}
+		evt.Tags = ParseTags(raw[1:i])
+		raw = strings.TrimLeft(raw[i+1:], " ")
+	}
+	evt.Message = irc.ParseMessage(raw)
+	if evt.Message == nil {
+		return nil
+	}
+	evt.MsgID = evt.Tags["msgid"]
+	if serverTime, ok := evt.Tags["time"]; ok {
+		evt.Time, _ = time.Parse(time.RFC3339Nano, serverTime)
+	}
+	return evt
+}
+
+// received sets the receive time of the event and uses it as the event time if the server didn't send one.
+func (evt *Event) received(now time.Time) {
+	evt.Received = now
+	if evt.Time.IsZero() {
+		evt.Time = now
+	}
+}
+
+// fail fails the delivery of the event if it's tracked.
+func (evt *Event) fail(err error) {
+	if evt.delivery != nil {
+		evt.delivery.resolve(nil, err)
+	}
+}
+
+// Args returns the parameters of the message as they were received, including the trailing parameter.
+// Unlike Params, the result isn't affected by RunHandlers splitting the trailing parameter into words.
+func (evt *Event) Args() []string {
+	if evt.args == nil {
+		evt.args = args(evt.Message)
+	}
+	return evt.args
+}
+
+// Label returns the labeled-response label of the event or an empty string if there is no label.
+func (evt *Event) Label() string {
+	return evt.Tags["label"]
+}
+
+// Copy creates a shallow copy of the event that can be modified without affecting the original event.
+func (evt *Event) Copy() *Event {
+	msg := *evt.Message
+	msg.Params = append([]string(nil), msg.Params...)
+	cp := *evt
+	cp.Message = &msg
+	return &cp
+}
+
+// String turns the event into the IRC wire format.
+func (evt *Event) String() string {
+	if len(evt.Tags) == 0 {
+		return evt.Message.String()
+	}
+	return "@" + evt.Tags.String() + " " + evt.Message.String()
+}
@@ -0,0 +1,85 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEvent(t *testing.T) {
+	received := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		line    string
+		command string
+		time    time.Time
+		msgID   string
+	}{
+		{":a!b@c PRIVMSG #chan :hi", "PRIVMSG", received, ""},
+		{"@time=2020-01-01T00:00:00.000Z :a!b@c PRIVMSG #chan :hi", "PRIVMSG",
+			time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), ""},
+		{"@time=2020-01-01T00:00:00.123456Z;msgid=abc :a!b@c PRIVMSG #chan :hi", "PRIVMSG",
+			time.Date(2020, 1, 1, 0, 0, 0, 123456000, time.UTC), "abc"},
+		{"@time=2020-01-01T02:00:00+02:00 PING :x", "PING", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), ""},
+		{"@time=yesterday;msgid=def :a!b@c PRIVMSG #chan :hi", "PRIVMSG", received, "def"},
+		{"@time= :a!b@c PRIVMSG #chan :hi", "PRIVMSG", received, ""},
+		{"@msgid=a\\sb   :a!b@c NOTICE #chan :spaces", "NOTICE", received, "a b"},
+	}
+	for _, test := range tests {
+		evt := ParseEvent(test.line)
+		if evt == nil {
+			t.Errorf("Failed to parse %q", test.line)
+			continue
+		}
+		evt.received(received)
+		if evt.Command != test.command {
+			t.Errorf("%q: expected command %s, got %s", test.line, test.command, evt.Command)
+		}
+		if !evt.Time.Equal(test.time) {
+			t.Errorf("%q: expected time %v, got %v", test.line, test.time, evt.Time)
+		}
+		if !evt.Received.Equal(received) {
+			t.Errorf("%q: receive time wasn't set", test.line)
+		}
+		if evt.MsgID != test.msgID {
+			t.Errorf("%q: expected msgid %q, got %q", test.line, test.msgID, evt.MsgID)
+		}
+	}
+}
+
+func TestParseEventInvalid(t *testing.T) {
+	for _, line := range []string{"", "@time=2020-01-01T00:00:00.000Z", "@tags-only"} {
+		if evt := ParseEvent(line); evt != nil {
+			t.Errorf("Expected %q not to parse, got %+v", line, evt)
+		}
+	}
+}
+
+func TestEventArgs(t *testing.T) {
+	evt := ParseEvent(":a!b@c PRIVMSG #chan :hello world")
+	c := newOfflineConn("tester")
+	c.RunHandlers(evt)
+	if args := evt.Args(); len(args) != 2 || args[1] != "hello world" {
+		t.Errorf("Args changed after running handlers: %q", args)
+	}
+	cp := evt.Copy()
+	cp.Params[0] = "#other"
+	if evt.Params[0] != "#chan" {
+		t.Error("Changing a copy changed the original event")
+	}
+}
@@ -0,0 +1,186 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package fakeirc contains a scriptable in-process IRC server for testing IRC clients.
+package fakeirc
+
+import (
+	"bufio"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is a client connected to the server. The fields are set by the server while handling messages from the
+// client and should only be read after the client has registered.
+type Client struct {
+	Nick     string
+	User     string
+	Host     string
+	RealName string
+	Password string
+	Account  string
+	Caps     map[string]bool
+
+	server         *Server
+	conn           net.Conn
+	out            chan string
+	closed         chan struct{}
+	closeOnce      sync.Once
+	registered     bool
+	capNegotiating bool
+	saslMechanism  string
+}
+
+func newClient(server *Server, conn net.Conn) *Client {
+	return &Client{
+		Host:   "localhost",
+		Caps:   make(map[string]bool),
+		server: server,
+		conn:   conn,
+		out:    make(chan string, 1024),
+		closed: make(chan struct{}),
+	}
+}
+
+// Prefix returns the nick!user@host of the client.
+func (client *Client) Prefix() string {
+	return client.Nick + "!" + client.User + "@" + client.Host
+}
+
+// nickOrStar returns the nick of the client, or * if the client hasn't sent a nick yet.
+func (client *Client) nickOrStar() string {
+	if len(client.Nick) == 0 {
+		return "*"
+	}
+	return client.Nick
+}
+
+// Send sends the given raw line to the client. If the client enabled server-time, a time tag is added.
+func (client *Client) Send(line string) {
+	if client.Caps["server-time"] && !strings.HasPrefix(line, "@") {
+		line = "@time=" + time.Now().UTC().Format("2006-01-02T15:04:05.000Z") + " " + line
+	}
+	select {
+	case client.out <- line:
+	case <-client.closed:
+	}
+}
+
+// Close disconnects the client without sending anything.
+func (client *Client) Close() {
+	client.closeOnce.Do(func() {
+		close(client.closed)
+		client.conn.Close()
+	})
+}
+
+// Done returns a channel that's closed when the client is disconnected.
+func (client *Client) Done() <-chan struct{} {
+	return client.closed
+}
+
+func (client *Client) writeLoop() {
+	for {
+		select {
+		case line := <-client.out:
+			client.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if _, err := client.conn.Write([]byte(line + "\r\n")); err != nil {
+				client.Close()
+				return
+			}
+		case <-client.closed:
+			return
+		}
+	}
+}
+
+// flush waits until the lines queued for the client have been written, so that the connection can be closed
+// without losing them.
+func (client *Client) flush() {
+	for i := 0; i < 100 && len(client.out) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (client *Client) readLoop() {
+	scanner := bufio.NewScanner(client.conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 {
+			client.server.handleLine(client, line)
+		}
+	}
+	client.Close()
+	client.server.removeClient(client, "Connection closed")
+}
+
+// numeric sends a numeric reply to the client. The last parameter is sent as the trailing parameter.
+func (client *Client) numeric(code string, params ...string) {
+	line := ":" + client.server.Name + " " + code + " " + client.nickOrStar()
+	for i, param := range params {
+		if i == len(params)-1 {
+			line += " :" + param
+		} else {
+			line += " " + param
+		}
+	}
+	client.Send(line)
+}
+
+// Channel is a channel on the server.
+type Channel struct {
+	Name string
+
+	topic   string
+	members map[*Client]string
+	server  *Server
+}
+
+// Topic returns the topic of the channel.
+func (ch *Channel) Topic() string {
+	ch.server.lock.Lock()
+	defer ch.server.lock.Unlock()
+	return ch.topic
+}
+
+// Members returns the nicks of the members of the channel with their prefixes, sorted.
+func (ch *Channel) Members() []string {
+	ch.server.lock.Lock()
+	defer ch.server.lock.Unlock()
+	return ch.names()
+}
+
+// names returns the nicks of the members with their prefixes. The lock must be held.
+func (ch *Channel) names() []string {
+	names := make([]string, 0, len(ch.members))
+	for member, prefix := range ch.members {
+		names = append(names, prefix+member.Nick)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// send sends the given line to all members of the channel except the given client. The lock must be held.
+func (ch *Channel) send(line string, except *Client) {
+	for member := range ch.members {
+		if member != except {
+			member.Send(line)
+		}
+	}
+}
@@ -0,0 +1,486 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package fakeirc contains a scriptable in-process IRC server for testing IRC clients.
+package fakeirc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Numerics that sorcix/irc doesn't have constants for
+const (
+	rplLoggedIn    = "900"
+	rplSASLSuccess = "903"
+	errSASLFail    = "904"
+	errSASLAborted = "906"
+	rplSASLMechs   = "908"
+)
+
+// params returns all the parameters of the given message, including the trailing parameter.
+func params(msg *irc.Message) []string {
+	if len(msg.Trailing) > 0 || msg.EmptyTrailing {
+		return append(append([]string(nil), msg.Params...), msg.Trailing)
+	}
+	return msg.Params
+}
+
+// handleCommand runs the built-in handling of the given message. The lock must be held.
+func (s *Server) handleCommand(client *Client, msg *irc.Message) {
+	args := params(msg)
+	switch msg.Command {
+	case "CAP":
+		s.handleCap(client, args)
+		return
+	case "AUTHENTICATE":
+		s.handleAuthenticate(client, args)
+		return
+	case irc.PASS:
+		if len(args) > 0 {
+			client.Password = args[0]
+		}
+		return
+	case irc.NICK:
+		s.handleNick(client, args)
+		return
+	case irc.USER:
+		if client.registered {
+			return
+		} else if len(args) < 4 {
+			client.numeric(irc.ERR_NEEDMOREPARAMS, irc.USER, "Not enough parameters")
+			return
+		}
+		client.User, client.RealName = args[0], args[3]
+		s.tryRegister(client)
+		return
+	case irc.PING:
+		if s.RespondToPing {
+			client.Send(":" + s.Name + " PONG " + s.Name + " :" + strings.Join(args, " "))
+		}
+		return
+	case irc.PONG:
+		return
+	case irc.QUIT:
+		reason := "Quit"
+		if len(args) > 0 {
+			reason = "Quit: " + args[0]
+		}
+		client.Send("ERROR :Closing link (" + reason + ")")
+		go func() {
+			client.flush()
+			client.Close()
+		}()
+		// removeClient takes the lock, so the peers are notified here.
+		if client.registered && s.clients[fold(client.Nick)] == client {
+			s.sendToPeers(client, ":"+client.Prefix()+" QUIT :"+reason, false)
+			delete(s.clients, fold(client.Nick))
+			s.removeMemberships(client)
+		}
+		delete(s.conns, client)
+		return
+	}
+
+	if !client.registered {
+		client.numeric(irc.ERR_NOTREGISTERED, "You have not registered")
+		return
+	}
+	switch msg.Command {
+	case irc.JOIN:
+		s.handleJoin(client, args)
+	case irc.PART:
+		s.handlePart(client, args)
+	case irc.NAMES:
+		if len(args) > 0 {
+			for _, name := range strings.Split(args[0], ",") {
+				s.sendNames(client, name)
+			}
+		}
+	case irc.TOPIC:
+		s.handleTopic(client, args)
+	case irc.PRIVMSG, irc.NOTICE:
+		s.handleMessage(client, msg.Command, args)
+	case irc.MODE:
+		s.handleMode(client, args)
+	case irc.WHO:
+		mask := "*"
+		if len(args) > 0 {
+			mask = args[0]
+		}
+		client.numeric(irc.RPL_ENDOFWHO, mask, "End of WHO list")
+	default:
+		client.numeric(irc.ERR_UNKNOWNCOMMAND, msg.Command, "Unknown command")
+	}
+}
+
+func (s *Server) handleCap(client *Client, args []string) {
+	if len(args) == 0 {
+		return
+	}
+	switch strings.ToUpper(args[0]) {
+	case "LS":
+		if !client.registered {
+			client.capNegotiating = true
+		}
+		withValues := len(args) > 1 && args[1] >= "302"
+		caps := make([]string, 0, len(s.Caps))
+		for name, value := range s.Caps {
+			if withValues && len(value) > 0 {
+				name += "=" + value
+			}
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+		client.Send(":" + s.Name + " CAP " + client.nickOrStar() + " LS :" + strings.Join(caps, " "))
+	case "LIST":
+		caps := make([]string, 0, len(client.Caps))
+		for name := range client.Caps {
+			caps = append(caps, name)
+		}
+		sort.Strings(caps)
+		client.Send(":" + s.Name + " CAP " + client.nickOrStar() + " LIST :" + strings.Join(caps, " "))
+	case "REQ":
+		if !client.registered {
+			client.capNegotiating = true
+		}
+		if len(args) < 2 {
+			return
+		}
+		requested := strings.Fields(args[1])
+		for _, name := range requested {
+			if _, ok := s.Caps[strings.TrimPrefix(name, "-")]; !ok {
+				client.Send(":" + s.Name + " CAP " + client.nickOrStar() + " NAK :" + args[1])
+				return
+			}
+		}
+		for _, name := range requested {
+			if strings.HasPrefix(name, "-") {
+				delete(client.Caps, name[1:])
+			} else {
+				client.Caps[name] = true
+			}
+		}
+		client.Send(":" + s.Name + " CAP " + client.nickOrStar() + " ACK :" + args[1])
+	case "END":
+		client.capNegotiating = false
+		s.tryRegister(client)
+	}
+}
+
+func (s *Server) handleAuthenticate(client *Client, args []string) {
+	if len(args) == 0 {
+		return
+	} else if !client.Caps["sasl"] || client.registered {
+		client.numeric(errSASLFail, "SASL authentication failed")
+		return
+	}
+	if len(client.saslMechanism) == 0 {
+		if strings.ToUpper(args[0]) != "PLAIN" {
+			client.numeric(rplSASLMechs, "PLAIN", "are available SASL mechanisms")
+			client.numeric(errSASLFail, "SASL authentication failed")
+			return
+		}
+		client.saslMechanism = "PLAIN"
+		client.Send("AUTHENTICATE +")
+		return
+	}
+	client.saslMechanism = ""
+	if args[0] == "*" {
+		client.numeric(errSASLAborted, "SASL authentication aborted")
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(args[0])
+	parts := bytes.Split(data, []byte{0})
+	if err != nil || len(parts) != 3 {
+		client.numeric(errSASLFail, "SASL authentication failed")
+		return
+	}
+	account, password := string(parts[1]), string(parts[2])
+	if expected, ok := s.Accounts[account]; !ok || expected != password {
+		client.numeric(errSASLFail, "SASL authentication failed")
+		return
+	}
+	client.Account = account
+	client.numeric(rplLoggedIn, client.Prefix(), account, "You are now logged in as "+account)
+	client.numeric(rplSASLSuccess, "SASL authentication successful")
+}
+
+func (s *Server) handleNick(client *Client, args []string) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		client.numeric(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
+		return
+	}
+	nick := args[0]
+	if strings.ContainsAny(nick, " ,*?!@#:") {
+		client.numeric(irc.ERR_ERRONEUSNICKNAME, nick, "Erroneous nickname")
+		return
+	} else if existing, ok := s.clients[fold(nick)]; ok && existing != client {
+		client.numeric(irc.ERR_NICKNAMEINUSE, nick, "Nickname is already in use")
+		return
+	}
+	if !client.registered {
+		client.Nick = nick
+		s.tryRegister(client)
+		return
+	}
+	s.sendToPeers(client, ":"+client.Prefix()+" NICK :"+nick, true)
+	delete(s.clients, fold(client.Nick))
+	client.Nick = nick
+	s.clients[fold(nick)] = client
+}
+
+// tryRegister completes the registration of the client if it has sent NICK and USER and capability negotiation
+// isn't in progress.
+func (s *Server) tryRegister(client *Client) {
+	if client.registered || client.capNegotiating || len(client.Nick) == 0 || len(client.User) == 0 {
+		return
+	} else if _, ok := s.clients[fold(client.Nick)]; ok {
+		client.numeric(irc.ERR_NICKNAMEINUSE, client.Nick, "Nickname is already in use")
+		client.Nick = ""
+		return
+	}
+	client.registered = true
+	s.clients[fold(client.Nick)] = client
+	client.numeric(irc.RPL_WELCOME, "Welcome to the fake IRC network "+client.Prefix())
+	client.numeric(irc.RPL_YOURHOST, "Your host is "+s.Name)
+	client.numeric(irc.RPL_CREATED, "This server was created for testing")
+	client.numeric(irc.RPL_MYINFO, s.Name, "fakeirc", "iow", "beIklimnopstv")
+	for i := 0; i < len(s.ISupport); i += 12 {
+		end := i + 12
+		if end > len(s.ISupport) {
+			end = len(s.ISupport)
+		}
+		client.numeric(irc.RPL_BOUNCE, append(s.ISupport[i:end:end], "are supported by this server")...)
+	}
+	if len(s.MOTD) == 0 {
+		client.numeric(irc.ERR_NOMOTD, "MOTD File is missing")
+	} else {
+		client.numeric(irc.RPL_MOTDSTART, "- "+s.Name+" Message of the day -")
+		for _, line := range s.MOTD {
+			client.numeric(irc.RPL_MOTD, "- "+line)
+		}
+		client.numeric(irc.RPL_ENDOFMOTD, "End of /MOTD command.")
+	}
+	select {
+	case s.registered <- client:
+	default:
+	}
+}
+
+func (s *Server) handleJoin(client *Client, args []string) {
+	if len(args) == 0 {
+		client.numeric(irc.ERR_NEEDMOREPARAMS, irc.JOIN, "Not enough parameters")
+		return
+	}
+	for _, name := range strings.Split(args[0], ",") {
+		if !strings.HasPrefix(name, "#") || strings.ContainsAny(name, " \x07") {
+			client.numeric(irc.ERR_NOSUCHCHANNEL, name, "No such channel")
+			continue
+		}
+		ch, ok := s.channels[fold(name)]
+		if !ok {
+			ch = &Channel{Name: name, members: make(map[*Client]string), server: s}
+			s.channels[fold(name)] = ch
+		}
+		if _, joined := ch.members[client]; joined {
+			continue
+		}
+		// The first member of a channel gets operator status.
+		prefix := ""
+		if len(ch.members) == 0 {
+			prefix = "@"
+		}
+		ch.members[client] = prefix
+		for member := range ch.members {
+			if member.Caps["extended-join"] {
+				account := client.Account
+				if len(account) == 0 {
+					account = "*"
+				}
+				member.Send(":" + client.Prefix() + " JOIN " + ch.Name + " " + account + " :" + client.RealName)
+			} else {
+				member.Send(":" + client.Prefix() + " JOIN " + ch.Name)
+			}
+		}
+		if len(ch.topic) > 0 {
+			client.numeric(irc.RPL_TOPIC, ch.Name, ch.topic)
+		}
+		s.sendNames(client, ch.Name)
+	}
+}
+
+func (s *Server) handlePart(client *Client, args []string) {
+	if len(args) == 0 {
+		client.numeric(irc.ERR_NEEDMOREPARAMS, irc.PART, "Not enough parameters")
+		return
+	}
+	reason := ""
+	if len(args) > 1 {
+		reason = " :" + args[1]
+	}
+	for _, name := range strings.Split(args[0], ",") {
+		ch, ok := s.channels[fold(name)]
+		if !ok {
+			client.numeric(irc.ERR_NOSUCHCHANNEL, name, "No such channel")
+			continue
+		} else if _, joined := ch.members[client]; !joined {
+			client.numeric(irc.ERR_NOTONCHANNEL, ch.Name, "You're not on that channel")
+			continue
+		}
+		ch.send(":"+client.Prefix()+" PART "+ch.Name+reason, nil)
+		delete(ch.members, client)
+		if len(ch.members) == 0 {
+			delete(s.channels, fold(name))
+		}
+	}
+}
+
+// removeMemberships removes the client from all channels. The lock must be held.
+func (s *Server) removeMemberships(client *Client) {
+	for key, ch := range s.channels {
+		delete(ch.members, client)
+		if len(ch.members) == 0 {
+			delete(s.channels, key)
+		}
+	}
+}
+
+// sendNames sends the member list of the given channel to the client.
+func (s *Server) sendNames(client *Client, name string) {
+	if ch, ok := s.channels[fold(name)]; ok {
+		client.numeric(irc.RPL_NAMREPLY, "=", ch.Name, strings.Join(ch.names(), " "))
+		name = ch.Name
+	}
+	client.numeric(irc.RPL_ENDOFNAMES, name, "End of /NAMES list.")
+}
+
+func (s *Server) handleTopic(client *Client, args []string) {
+	if len(args) == 0 {
+		client.numeric(irc.ERR_NEEDMOREPARAMS, irc.TOPIC, "Not enough parameters")
+		return
+	}
+	ch, ok := s.channels[fold(args[0])]
+	if !ok {
+		client.numeric(irc.ERR_NOSUCHCHANNEL, args[0], "No such channel")
+		return
+	} else if len(args) == 1 {
+		if len(ch.topic) == 0 {
+			client.numeric(irc.RPL_NOTOPIC, ch.Name, "No topic is set")
+		} else {
+			client.numeric(irc.RPL_TOPIC, ch.Name, ch.topic)
+		}
+		return
+	} else if _, joined := ch.members[client]; !joined {
+		client.numeric(irc.ERR_NOTONCHANNEL, ch.Name, "You're not on that channel")
+		return
+	}
+	ch.topic = args[1]
+	ch.send(":"+client.Prefix()+" TOPIC "+ch.Name+" :"+ch.topic, nil)
+}
+
+func (s *Server) handleMessage(client *Client, command string, args []string) {
+	if len(args) < 2 {
+		client.numeric(irc.ERR_NEEDMOREPARAMS, command, "Not enough parameters")
+		return
+	}
+	for _, target := range strings.Split(args[0], ",") {
+		line := ":" + client.Prefix() + " " + command + " " + target + " :" + args[1]
+		if strings.HasPrefix(target, "#") {
+			ch, ok := s.channels[fold(target)]
+			if !ok {
+				client.numeric(irc.ERR_NOSUCHCHANNEL, target, "No such channel")
+				continue
+			} else if _, joined := ch.members[client]; !joined {
+				client.numeric(irc.ERR_CANNOTSENDTOCHAN, ch.Name, "Cannot send to channel")
+				continue
+			}
+			ch.send(line, client)
+		} else if recipient, ok := s.clients[fold(target)]; ok {
+			if recipient != client {
+				recipient.Send(line)
+			}
+		} else {
+			client.numeric(irc.ERR_NOSUCHNICK, target, "No such nick/channel")
+			continue
+		}
+		if client.Caps["echo-message"] {
+			client.Send(line)
+		}
+	}
+}
+
+func (s *Server) handleMode(client *Client, args []string) {
+	if len(args) == 0 {
+		client.numeric(irc.ERR_NEEDMOREPARAMS, irc.MODE, "Not enough parameters")
+		return
+	} else if !strings.HasPrefix(args[0], "#") {
+		if fold(args[0]) == fold(client.Nick) && len(args) == 1 {
+			client.numeric("221", "+")
+		}
+		return
+	}
+	ch, ok := s.channels[fold(args[0])]
+	if !ok {
+		client.numeric(irc.ERR_NOSUCHCHANNEL, args[0], "No such channel")
+		return
+	} else if len(args) == 1 {
+		client.numeric(irc.RPL_CHANNELMODEIS, ch.Name, "+")
+		return
+	} else if prefix, joined := ch.members[client]; !joined || prefix != "@" {
+		client.numeric(irc.ERR_CHANOPRIVSNEEDED, ch.Name, "You're not channel operator")
+		return
+	}
+	// Only operator and voice changes are tracked. Other modes are just passed on to the members.
+	add := true
+	argIndex := 2
+	for _, mode := range args[1] {
+		switch mode {
+		case '+', '-':
+			add = mode == '+'
+		case 'o', 'v':
+			if argIndex >= len(args) {
+				continue
+			}
+			target, ok := s.clients[fold(args[argIndex])]
+			argIndex++
+			if _, member := ch.members[target]; !ok || !member {
+				continue
+			}
+			symbol := map[rune]string{'o': "@", 'v': "+"}[mode]
+			current := ch.members[target]
+			if add && !strings.Contains(current, symbol) {
+				ch.members[target] = sortPrefix(current + symbol)
+			} else if !add {
+				ch.members[target] = strings.Replace(current, symbol, "", -1)
+			}
+		case 'b', 'k', 'l':
+			argIndex++
+		}
+	}
+	ch.send(":"+client.Prefix()+" MODE "+ch.Name+" "+strings.Join(args[1:], " "), nil)
+}
+
+// sortPrefix sorts the given membership prefixes by rank.
+func sortPrefix(prefix string) string {
+	if strings.Contains(prefix, "@") {
+		return "@" + strings.Replace(prefix, "@", "", -1)
+	}
+	return prefix
+}
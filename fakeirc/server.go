@@ -0,0 +1,343 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package fakeirc contains a scriptable in-process IRC server for testing IRC clients.
+package fakeirc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sorcix/irc"
+)
+
+// Handler handles a message from a client. If it returns true, the built-in handling of the message is skipped.
+type Handler func(client *Client, msg *irc.Message) bool
+
+// Line is a line received from a client.
+type Line struct {
+	Client *Client
+	// Tags are the raw IRCv3 message tags of the line without the leading @.
+	Tags string
+	// Text is the line without the tags.
+	Text    string
+	Message *irc.Message
+}
+
+// reply is a scripted reply added with Reply.
+type reply struct {
+	prefix string
+	lines  []string
+}
+
+// Server is an in-process IRC server. It handles registration, capability negotiation, SASL PLAIN, joining and
+// parting channels, NAMES, TOPIC and routing of PRIVMSGs and NOTICEs. The settings should be changed before clients
+// connect.
+type Server struct {
+	// Name is the name of the server, used as the prefix of server messages.
+	Name string
+	// Caps are the capabilities advertised to clients and their values.
+	Caps map[string]string
+	// ISupport are the tokens sent in RPL_ISUPPORT.
+	ISupport []string
+	// Accounts are the accounts and passwords accepted in SASL PLAIN authentication.
+	Accounts map[string]string
+	// MOTD is the message of the day. If empty, ERR_NOMOTD is sent instead.
+	MOTD []string
+	// RespondToPing controls whether PINGs from clients are answered.
+	RespondToPing bool
+
+	listener   net.Listener
+	conns      map[*Client]bool
+	clients    map[string]*Client
+	channels   map[string]*Channel
+	handlers   map[string][]Handler
+	replies    []*reply
+	lines      []*Line
+	cursor     int
+	newLine    chan struct{}
+	registered chan *Client
+	lock       sync.Mutex
+}
+
+// NewServer creates a new server with default settings.
+func NewServer() *Server {
+	return &Server{
+		Name: "irc.example.com",
+		Caps: map[string]string{
+			"echo-message":  "",
+			"message-tags":  "",
+			"server-time":   "",
+			"extended-join": "",
+			"sasl":          "PLAIN",
+		},
+		ISupport: []string{
+			"CASEMAPPING=ascii", "CHANTYPES=#", "PREFIX=(ov)@+", "CHANMODES=b,k,l,imnpst", "NETWORK=FakeNet",
+			"NICKLEN=30",
+		},
+		Accounts:      make(map[string]string),
+		RespondToPing: true,
+		conns:         make(map[*Client]bool),
+		clients:       make(map[string]*Client),
+		channels:      make(map[string]*Channel),
+		handlers:      make(map[string][]Handler),
+		newLine:       make(chan struct{}),
+		registered:    make(chan *Client, 64),
+	}
+}
+
+// fold returns the lowercase form of a nick or channel name. The server uses the ascii case mapping.
+func fold(name string) string {
+	return strings.ToLower(name)
+}
+
+// Listen starts accepting connections on the given TCP address, such as 127.0.0.1:0.
+func (s *Server) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.listener = listener
+	s.lock.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.serve(conn)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil if Listen hasn't been called.
+func (s *Server) Addr() net.Addr {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Pipe connects a new client to the server through an in-memory pipe and returns the client end of the pipe.
+func (s *Server) Pipe() net.Conn {
+	server, client := net.Pipe()
+	s.serve(server)
+	return client
+}
+
+// Dial connects to the server through an in-memory pipe. The network and address are ignored.
+// It can be used as the Dialer of a libmauirc connection.
+func (s *Server) Dial(network, address string) (net.Conn, error) {
+	return s.Pipe(), nil
+}
+
+// Close stops listening and disconnects all clients.
+func (s *Server) Close() {
+	s.lock.Lock()
+	listener := s.listener
+	conns := make([]*Client, 0, len(s.conns))
+	for client := range s.conns {
+		conns = append(conns, client)
+	}
+	s.lock.Unlock()
+	if listener != nil {
+		listener.Close()
+	}
+	for _, client := range conns {
+		client.Close()
+	}
+}
+
+// On adds a handler for the given command. Handlers are called in the order they were added, before the built-in
+// handling of the command. Use * as the command to handle all commands.
+func (s *Server) On(command string, handler Handler) {
+	s.lock.Lock()
+	command = strings.ToUpper(command)
+	s.handlers[command] = append(s.handlers[command], handler)
+	s.lock.Unlock()
+}
+
+// Reply makes the server reply to the next line that starts with the given prefix with the given lines instead of
+// handling it normally. $nick and $server in the lines are replaced with the nick of the client and the server name.
+func (s *Server) Reply(prefix string, lines ...string) {
+	s.lock.Lock()
+	s.replies = append(s.replies, &reply{prefix: prefix, lines: lines})
+	s.lock.Unlock()
+}
+
+// Expect waits for a line that starts with the given prefix. Lines are matched in the order they were received, and
+// lines before the matched line are skipped, so that each line can only be matched once.
+func (s *Server) Expect(ctx context.Context, prefix string) (*Line, error) {
+	for {
+		s.lock.Lock()
+		for s.cursor < len(s.lines) {
+			line := s.lines[s.cursor]
+			s.cursor++
+			if strings.HasPrefix(line.Text, prefix) {
+				s.lock.Unlock()
+				return line, nil
+			}
+		}
+		wait := s.newLine
+		s.lock.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Lines returns all the lines received from clients.
+func (s *Server) Lines() []*Line {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Line(nil), s.lines...)
+}
+
+// WaitRegistered waits until a client completes registration and returns it. Each client is returned once.
+func (s *Server) WaitRegistered(ctx context.Context) (*Client, error) {
+	select {
+	case client := <-s.registered:
+		return client, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Client returns the registered client with the given nick.
+func (s *Server) Client(nick string) *Client {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.clients[fold(nick)]
+}
+
+// Channel returns the channel with the given name.
+func (s *Server) Channel(name string) *Channel {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.channels[fold(name)]
+}
+
+// SendAll sends the given raw line to all registered clients.
+func (s *Server) SendAll(line string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, client := range s.clients {
+		client.Send(line)
+	}
+}
+
+// serve starts handling the given connection.
+func (s *Server) serve(conn net.Conn) {
+	client := newClient(s, conn)
+	s.lock.Lock()
+	s.conns[client] = true
+	s.lock.Unlock()
+	go client.writeLoop()
+	go client.readLoop()
+}
+
+// handleLine handles a single line from the given client.
+func (s *Server) handleLine(client *Client, raw string) {
+	line := &Line{Client: client, Text: raw}
+	if strings.HasPrefix(raw, "@") {
+		end := strings.IndexByte(raw, ' ')
+		if end < 0 {
+			return
+		}
+		line.Tags, line.Text = raw[1:end], strings.TrimLeft(raw[end:], " ")
+	}
+	line.Message = irc.ParseMessage(line.Text)
+	if line.Message == nil {
+		return
+	}
+	line.Message.Command = strings.ToUpper(line.Message.Command)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lines = append(s.lines, line)
+	close(s.newLine)
+	s.newLine = make(chan struct{})
+
+	for i, rep := range s.replies {
+		if strings.HasPrefix(line.Text, rep.prefix) {
+			s.replies = append(s.replies[:i], s.replies[i+1:]...)
+			replacer := strings.NewReplacer("$nick", client.nickOrStar(), "$server", s.Name)
+			for _, reply := range rep.lines {
+				client.Send(replacer.Replace(reply))
+			}
+			return
+		}
+	}
+	handlers := append(append([]Handler(nil), s.handlers[line.Message.Command]...), s.handlers["*"]...)
+	for _, handler := range handlers {
+		// Handlers may call server functions, so the lock is released while they run.
+		s.lock.Unlock()
+		handled := handler(client, line.Message)
+		s.lock.Lock()
+		if handled {
+			return
+		}
+	}
+	s.handleCommand(client, line.Message)
+}
+
+// removeClient removes a disconnected client from the server and its channels.
+func (s *Server) removeClient(client *Client, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.conns[client] {
+		return
+	}
+	delete(s.conns, client)
+	if client.registered && s.clients[fold(client.Nick)] == client {
+		delete(s.clients, fold(client.Nick))
+		s.sendToPeers(client, ":"+client.Prefix()+" QUIT :"+reason, false)
+		for key, ch := range s.channels {
+			delete(ch.members, client)
+			if len(ch.members) == 0 {
+				delete(s.channels, key)
+			}
+		}
+	}
+}
+
+// sendToPeers sends the given line once to each client that shares a channel with the given client.
+// The lock must be held.
+func (s *Server) sendToPeers(client *Client, line string, includeSelf bool) {
+	sent := map[*Client]bool{client: true}
+	if includeSelf {
+		client.Send(line)
+	}
+	for _, ch := range s.channels {
+		if _, ok := ch.members[client]; !ok {
+			continue
+		}
+		for member := range ch.members {
+			if !sent[member] {
+				sent[member] = true
+				member.Send(line)
+			}
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package fakeirc_test tests the fake server with the libmauirc client.
+package fakeirc_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+// testTimeout is how long tests wait for something to happen.
+const testTimeout = 5 * time.Second
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func newServer(t *testing.T) *fakeirc.Server {
+	srv := fakeirc.NewServer()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// newConn creates a libmauirc connection that dials the given server. Handlers should be added before connecting.
+func newConn(srv *fakeirc.Server, nick string) *libmauirc.ConnImpl {
+	c := libmauirc.Create(nick, nick, libmauirc.IPv4Address{IP: "127.0.0.1", Port: 6667}).(*libmauirc.ConnImpl)
+	c.SetDialer(srv.Dial)
+	return c
+}
+
+// connect connects the given connection and waits until the server has registered it.
+func connect(t *testing.T, srv *fakeirc.Server, c *libmauirc.ConnImpl) *fakeirc.Client {
+	t.Helper()
+	if err := c.Connect(); err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	t.Cleanup(func() {
+		c.Quit()
+		c.Disconnect()
+	})
+	client, err := srv.WaitRegistered(testContext(t))
+	if err != nil {
+		t.Fatal("Client didn't register:", err)
+	}
+	return client
+}
+
+// receive waits for an event on the given channel.
+func receive(t *testing.T, events <-chan *libmauirc.Event, what string) *libmauirc.Event {
+	t.Helper()
+	select {
+	case evt := <-events:
+		return evt
+	case <-time.After(testTimeout):
+		t.Fatal("Didn't receive", what)
+		return nil
+	}
+}
+
+func TestCapRegistration(t *testing.T) {
+	srv := newServer(t)
+	c := newConn(srv, "tester")
+	client := connect(t, srv, c)
+	if _, err := srv.Expect(testContext(t), "CAP END"); err != nil {
+		t.Fatal("Capability negotiation didn't end:", err)
+	}
+	for _, cap := range []string{"echo-message", "message-tags", "server-time", "extended-join"} {
+		if !client.Caps[cap] {
+			t.Errorf("Server didn't enable %s", cap)
+		} else if !c.HasCap(cap) {
+			t.Errorf("Client didn't enable %s", cap)
+		}
+	}
+	if client.Caps["sasl"] {
+		t.Error("Server enabled sasl, which wasn't requested")
+	}
+	if client.Nick != "tester" || client.User != "tester" {
+		t.Errorf("Unexpected registration: nick %q, user %q", client.Nick, client.User)
+	}
+}
+
+// rawClient is a client that speaks raw IRC to the server through a pipe.
+type rawClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newRawClient(t *testing.T, srv *fakeirc.Server) *rawClient {
+	conn := srv.Pipe()
+	t.Cleanup(func() { conn.Close() })
+	return &rawClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (raw *rawClient) send(t *testing.T, lines ...string) {
+	t.Helper()
+	raw.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	for _, line := range lines {
+		if _, err := raw.conn.Write([]byte(line + "\r\n")); err != nil {
+			t.Fatal("Failed to send line:", err)
+		}
+	}
+}
+
+// expect reads lines until it finds one with the given command and returns it.
+func (raw *rawClient) expect(t *testing.T, command string) *irc.Message {
+	t.Helper()
+	raw.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		line, err := raw.reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Didn't receive %s: %v", command, err)
+		}
+		if strings.HasPrefix(line, "@") {
+			line = line[strings.IndexByte(line, ' ')+1:]
+		}
+		if msg := irc.ParseMessage(line); msg != nil && msg.Command == command {
+			return msg
+		}
+	}
+}
+
+func saslPlain(account, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(account + "\x00" + account + "\x00" + password))
+}
+
+func TestSASLRegistration(t *testing.T) {
+	srv := newServer(t)
+	srv.Accounts["bob"] = "hunter2"
+	raw := newRawClient(t, srv)
+	raw.send(t, "CAP LS 302", "NICK bob", "USER bob 0 * :Bob", "CAP REQ :sasl", "AUTHENTICATE PLAIN")
+	raw.expect(t, "AUTHENTICATE")
+	raw.send(t, "AUTHENTICATE "+saslPlain("bob", "wrong"))
+	raw.expect(t, "904")
+	raw.send(t, "AUTHENTICATE PLAIN")
+	raw.expect(t, "AUTHENTICATE")
+	raw.send(t, "AUTHENTICATE "+saslPlain("bob", "hunter2"))
+	if loggedIn := raw.expect(t, "900"); len(loggedIn.Params) < 3 || loggedIn.Params[2] != "bob" {
+		t.Errorf("Unexpected RPL_LOGGEDIN: %s", loggedIn)
+	}
+	raw.expect(t, "903")
+	raw.send(t, "CAP END")
+	raw.expect(t, irc.RPL_WELCOME)
+	client, err := srv.WaitRegistered(testContext(t))
+	if err != nil {
+		t.Fatal("Client didn't register:", err)
+	} else if client.Account != "bob" {
+		t.Errorf("Expected account bob, got %q", client.Account)
+	}
+}
+
+func TestReconnectAfterClose(t *testing.T) {
+	srv := newServer(t)
+	c := newConn(srv, "tester")
+	client := connect(t, srv, c)
+	go c.Loop()
+	for i := 0; i < 2; i++ {
+		client.Close()
+		reconnected, err := srv.WaitRegistered(testContext(t))
+		if err != nil {
+			t.Fatal("Didn't reconnect:", err)
+		} else if reconnected == client || reconnected.Nick != "tester" {
+			t.Fatalf("Unexpected client after reconnecting: %+v", reconnected)
+		}
+		client = reconnected
+	}
+}
+
+func TestPongDeadlineReconnect(t *testing.T) {
+	srv := newServer(t)
+	srv.RespondToPing = false
+	c := newConn(srv, "tester")
+	c.PingFreq = 50 * time.Millisecond
+	c.PongDeadline = 100 * time.Millisecond
+	timeouts := make(chan *libmauirc.PingTimeoutEvent, 10)
+	c.AddTypedHandler(func(evt libmauirc.TypedEvent) {
+		if timeout, ok := evt.(*libmauirc.PingTimeoutEvent); ok {
+			select {
+			case timeouts <- timeout:
+			default:
+			}
+		}
+	})
+	client := connect(t, srv, c)
+	go c.Loop()
+	select {
+	case timeout := <-timeouts:
+		if !timeout.Disconnect {
+			t.Error("Ping timeout didn't disconnect")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("Ping timeout wasn't detected")
+	}
+	select {
+	case <-client.Done():
+	case <-time.After(testTimeout):
+		t.Fatal("Connection wasn't dropped after the ping timeout")
+	}
+	if _, err := srv.WaitRegistered(testContext(t)); err != nil {
+		t.Fatal("Didn't reconnect after the ping timeout:", err)
+	}
+}
+
+func TestMessageRouting(t *testing.T) {
+	srv := newServer(t)
+	alice, bob := newConn(srv, "alice"), newConn(srv, "bob")
+	joins := make(chan *libmauirc.Event, 10)
+	alice.AddHandler(irc.JOIN, func(evt *libmauirc.Event) {
+		joins <- evt
+	})
+	messages := make(chan *libmauirc.Event, 10)
+	bob.AddHandler(irc.PRIVMSG, func(evt *libmauirc.Event) {
+		if !evt.Echo {
+			messages <- evt
+		}
+	})
+	connect(t, srv, alice)
+	connect(t, srv, bob)
+
+	alice.Join("#chan", "")
+	if join := receive(t, joins, "own JOIN"); join.Name != "alice" {
+		t.Fatalf("Expected own JOIN first, got JOIN from %s", join.Name)
+	}
+	bob.Join("#chan", "")
+	if join := receive(t, joins, "JOIN from bob"); join.Name != "bob" || join.Args()[0] != "#chan" {
+		t.Fatalf("Unexpected JOIN: %s", join)
+	}
+
+	alice.Privmsg("#chan", "hello channel")
+	alice.Privmsg("bob", "hello bob")
+	for _, expected := range []struct{ target, text string }{{"#chan", "hello channel"}, {"bob", "hello bob"}} {
+		msg := receive(t, messages, "PRIVMSG to "+expected.target)
+		if msg.Name != "alice" || msg.Args()[0] != expected.target || msg.Trailing != expected.text {
+			t.Errorf("Expected %q to %s from alice, got %s", expected.text, expected.target, msg)
+		}
+	}
+	if members := srv.Channel("#chan").Members(); len(members) != 2 {
+		t.Errorf("Expected 2 members in #chan, got %v", members)
+	}
+}
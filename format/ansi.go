@@ -0,0 +1,76 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package format parses, strips and converts mIRC formatting codes.
+package format
+
+import (
+	"strconv"
+	"strings"
+)
+
+// ansiReset resets all ANSI text attributes.
+const ansiReset = "\x1b[0m"
+
+// ToANSI converts the formatting codes in the given text into ANSI escape sequences for terminals.
+// Colors are written as 24-bit colors. Monospace has no ANSI equivalent and is ignored.
+func ToANSI(text string) string {
+	var buf strings.Builder
+	styled := false
+	for _, span := range Parse(text) {
+		if span.IsPlain() {
+			if styled {
+				buf.WriteString(ansiReset)
+				styled = false
+			}
+		} else {
+			buf.WriteString(ansiSequence(span.Style))
+			styled = true
+		}
+		buf.WriteString(span.Text)
+	}
+	if styled {
+		buf.WriteString(ansiReset)
+	}
+	return buf.String()
+}
+
+// ansiSequence returns the escape sequence that resets the previous attributes and sets the given style.
+func ansiSequence(style Style) string {
+	params := []string{"0"}
+	if style.Bold {
+		params = append(params, "1")
+	}
+	if style.Italic {
+		params = append(params, "3")
+	}
+	if style.Underline {
+		params = append(params, "4")
+	}
+	if style.Reverse {
+		params = append(params, "7")
+	}
+	if style.Strikethrough {
+		params = append(params, "9")
+	}
+	if r, g, b, ok := style.Foreground.RGB(); ok {
+		params = append(params, "38", "2", strconv.Itoa(int(r)), strconv.Itoa(int(g)), strconv.Itoa(int(b)))
+	}
+	if r, g, b, ok := style.Background.RGB(); ok {
+		params = append(params, "48", "2", strconv.Itoa(int(r)), strconv.Itoa(int(g)), strconv.Itoa(int(b)))
+	}
+	return "\x1b[" + strings.Join(params, ";") + "m"
+}
@@ -0,0 +1,107 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package format parses, strips and converts mIRC formatting codes.
+package format
+
+// Builder builds formatted text for outgoing messages. The style functions change the style of the text added after
+// them. Parsing the built text with Parse gives back the same spans as Spans.
+type Builder struct {
+	spans []Span
+	style Style
+}
+
+// NewBuilder creates a new Builder with the plain style.
+func NewBuilder() *Builder {
+	return &Builder{style: Plain}
+}
+
+// Bold toggles bold text.
+func (b *Builder) Bold() *Builder {
+	b.style.Bold = !b.style.Bold
+	return b
+}
+
+// Italic toggles italic text.
+func (b *Builder) Italic() *Builder {
+	b.style.Italic = !b.style.Italic
+	return b
+}
+
+// Underline toggles underlined text.
+func (b *Builder) Underline() *Builder {
+	b.style.Underline = !b.style.Underline
+	return b
+}
+
+// Strikethrough toggles strikethrough text.
+func (b *Builder) Strikethrough() *Builder {
+	b.style.Strikethrough = !b.style.Strikethrough
+	return b
+}
+
+// Monospace toggles monospace text.
+func (b *Builder) Monospace() *Builder {
+	b.style.Monospace = !b.style.Monospace
+	return b
+}
+
+// Reverse toggles swapping the foreground and background colors.
+func (b *Builder) Reverse() *Builder {
+	b.style.Reverse = !b.style.Reverse
+	return b
+}
+
+// Color sets the foreground and background colors. Use ColorNone for the default colors.
+func (b *Builder) Color(fg, bg Color) *Builder {
+	b.style.Foreground, b.style.Background = fg, bg
+	return b
+}
+
+// Style sets the whole style.
+func (b *Builder) Style(style Style) *Builder {
+	b.style = style
+	return b
+}
+
+// Reset resets the style to plain text.
+func (b *Builder) Reset() *Builder {
+	b.style = Plain
+	return b
+}
+
+// Text adds text with the current style. Formatting codes in the text are removed.
+func (b *Builder) Text(text string) *Builder {
+	text = Strip(text)
+	if len(text) == 0 {
+		return b
+	} else if len(b.spans) > 0 && b.spans[len(b.spans)-1].Style == b.style {
+		b.spans[len(b.spans)-1].Text += text
+	} else {
+		b.spans = append(b.spans, Span{Style: b.style, Text: text})
+	}
+	return b
+}
+
+// Spans returns the spans added to the builder.
+func (b *Builder) Spans() []Span {
+	return append([]Span(nil), b.spans...)
+}
+
+// String returns the built text with mIRC formatting codes.
+func (b *Builder) String() string {
+	return Format(b.spans)
+}
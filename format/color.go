@@ -0,0 +1,175 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package format parses, strips and converts mIRC formatting codes.
+package format
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Color is a text color. The zero value is the default color of the client. Palette colors are created with Palette
+// and hex colors with RGB.
+type Color int32
+
+// ColorNone is the default color of the client. It's sent as the mIRC color 99.
+const ColorNone Color = 0
+
+// The standard mIRC colors
+const (
+	White Color = colorPalette + iota
+	Black
+	Blue
+	Green
+	Red
+	Brown
+	Magenta
+	Orange
+	Yellow
+	LightGreen
+	Cyan
+	LightCyan
+	LightBlue
+	Pink
+	Grey
+	LightGrey
+)
+
+// colorDefault is the mIRC color number of ColorNone.
+const colorDefault = 99
+
+// colorHex is set in hex colors to separate them from palette colors.
+const colorHex = 1 << 24
+
+// colorPalette is set in palette colors, so that the zero value of Color isn't a palette color.
+const colorPalette = 1 << 25
+
+// palette contains the RGB values of the mIRC palette colors.
+var palette = [99]uint32{
+	0xffffff, 0x000000, 0x00007f, 0x009300, 0xff0000, 0x7f0000, 0x9c009c, 0xfc7f00,
+	0xffff00, 0x00fc00, 0x009393, 0x00ffff, 0x0000fc, 0xff00ff, 0x7f7f7f, 0xd2d2d2,
+	0x470000, 0x472100, 0x474700, 0x324700, 0x004700, 0x00472c, 0x004747, 0x002747,
+	0x000047, 0x2e0047, 0x470047, 0x47002a, 0x740000, 0x743a00, 0x747400, 0x517400,
+	0x007400, 0x007449, 0x007474, 0x004074, 0x000074, 0x4b0074, 0x740074, 0x740045,
+	0xb50000, 0xb56300, 0xb5b500, 0x7db500, 0x00b500, 0x00b571, 0x00b5b5, 0x0063b5,
+	0x0000b5, 0x7500b5, 0xb500b5, 0xb5006b, 0xff0000, 0xff8c00, 0xffff00, 0xb2ff00,
+	0x00ff00, 0x00ffa0, 0x00ffff, 0x008cff, 0x0000ff, 0xa500ff, 0xff00ff, 0xff0098,
+	0xff5959, 0xffb459, 0xffff71, 0xcfff60, 0x6fff6f, 0x65ffc9, 0x6dffff, 0x59b4ff,
+	0x5959ff, 0xc459ff, 0xff66ff, 0xff59bc, 0xff9c9c, 0xffd39c, 0xffff9c, 0xe2ff9c,
+	0x9cff9c, 0x9cffdb, 0x9cffff, 0x9cd3ff, 0x9c9cff, 0xdc9cff, 0xff9cff, 0xff94d3,
+	0x000000, 0x131313, 0x282828, 0x363636, 0x4d4d4d, 0x656565, 0x818181, 0x9f9f9f,
+	0xbcbcbc, 0xe2e2e2, 0xffffff,
+}
+
+// Palette returns the mIRC palette color with the given number, or ColorNone if the number isn't in the palette.
+func Palette(num int) Color {
+	if num < 0 || num >= len(palette) {
+		return ColorNone
+	}
+	return Color(colorPalette | num)
+}
+
+// RGB creates a hex color from the given red, green and blue values.
+func RGB(r, g, b uint8) Color {
+	return Color(colorHex | uint32(r)<<16 | uint32(g)<<8 | uint32(b))
+}
+
+// ParseHex parses a hex color in the #rrggbb or #rgb format. The # is optional.
+func ParseHex(hex string) (Color, bool) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return ColorNone, false
+	}
+	val, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return ColorNone, false
+	}
+	return Color(colorHex | uint32(val)), true
+}
+
+// IsHex checks if the color is a hex color rather than a palette color.
+func (c Color) IsHex() bool {
+	return c&colorHex != 0
+}
+
+// IsPalette checks if the color is a mIRC palette color.
+func (c Color) IsPalette() bool {
+	return c&colorPalette != 0
+}
+
+// Number returns the mIRC color number of a palette color, or -1 for other colors.
+func (c Color) Number() int {
+	if !c.IsPalette() {
+		return -1
+	}
+	return int(c &^ colorPalette)
+}
+
+// RGB returns the red, green and blue values of the color. ok is false for ColorNone.
+func (c Color) RGB() (r, g, b uint8, ok bool) {
+	var val uint32
+	switch {
+	case c.IsHex():
+		val = uint32(c) &^ colorHex
+	case c.IsPalette():
+		val = palette[c.Number()]
+	default:
+		return 0, 0, 0, false
+	}
+	return uint8(val >> 16), uint8(val >> 8), uint8(val), true
+}
+
+// Hex returns the color in the #rrggbb format, or an empty string for ColorNone.
+func (c Color) Hex() string {
+	r, g, b, ok := c.RGB()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
+
+// code returns the mIRC color number of a palette color or ColorNone.
+func (c Color) code() string {
+	if !c.IsPalette() {
+		return strconv.Itoa(colorDefault)
+	}
+	return fmt.Sprintf("%02d", c.Number())
+}
+
+// hexCode returns the color in the format used by the hex color code.
+func (c Color) hexCode() string {
+	return strings.ToUpper(strings.TrimPrefix(c.Hex(), "#"))
+}
+
+// nearestPalette returns the palette color matching the given hex color exactly, or the hex color itself.
+// Palette colors are preferred since not all clients support hex colors.
+func nearestPalette(c Color) Color {
+	if !c.IsHex() {
+		return c
+	}
+	val := uint32(c) &^ colorHex
+	for i, p := range palette {
+		if p == val {
+			return Palette(i)
+		}
+	}
+	return c
+}
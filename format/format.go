@@ -0,0 +1,276 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package format parses, strips and converts mIRC formatting codes.
+package format
+
+import (
+	"strings"
+)
+
+// The mIRC formatting control codes
+const (
+	CodeBold          = '\x02'
+	CodeColor         = '\x03'
+	CodeHexColor      = '\x04'
+	CodeReset         = '\x0F'
+	CodeMonospace     = '\x11'
+	CodeReverse       = '\x16'
+	CodeItalic        = '\x1D'
+	CodeStrikethrough = '\x1E'
+	CodeUnderline     = '\x1F'
+)
+
+// Style is the formatting of a piece of text.
+type Style struct {
+	Bold          bool
+	Italic        bool
+	Underline     bool
+	Strikethrough bool
+	Monospace     bool
+	Reverse       bool
+	Foreground    Color
+	Background    Color
+}
+
+// Plain is the style of unformatted text. It's the zero value of Style.
+var Plain = Style{}
+
+// IsPlain checks if the style has no formatting.
+func (s Style) IsPlain() bool {
+	return s == Plain
+}
+
+// Span is a piece of text with a single style.
+type Span struct {
+	Style
+	Text string
+}
+
+// isCode checks if the given byte is a formatting control code.
+func isCode(b byte) bool {
+	switch b {
+	case CodeBold, CodeColor, CodeHexColor, CodeReset, CodeMonospace, CodeReverse, CodeItalic, CodeStrikethrough,
+		CodeUnderline:
+		return true
+	}
+	return false
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func isHexDigit(b byte) bool {
+	return isDigit(b) || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+// parseColorNumber reads a mIRC color number of one or two digits from the start of the text.
+func parseColorNumber(text string) (Color, int) {
+	n := 0
+	for n < 2 && n < len(text) && isDigit(text[n]) {
+		n++
+	}
+	if n == 0 {
+		return ColorNone, 0
+	}
+	num := int(text[0] - '0')
+	if n == 2 {
+		num = num*10 + int(text[1]-'0')
+	}
+	return Palette(num), n
+}
+
+// parseHexColor reads a six-digit hex color from the start of the text.
+func parseHexColor(text string) (Color, int) {
+	if len(text) < 6 {
+		return ColorNone, 0
+	}
+	for i := 0; i < 6; i++ {
+		if !isHexDigit(text[i]) {
+			return ColorNone, 0
+		}
+	}
+	color, _ := ParseHex(text[:6])
+	return color, 6
+}
+
+// parseColors reads the parameters of a color code from the start of the text and applies them to the style.
+// It returns the number of bytes read.
+func parseColors(text string, style *Style, parse func(string) (Color, int)) int {
+	fg, n := parse(text)
+	if n == 0 {
+		// A color code without a color resets the colors.
+		style.Foreground, style.Background = ColorNone, ColorNone
+		return 0
+	}
+	style.Foreground = fg
+	if n < len(text) && text[n] == ',' {
+		if bg, m := parse(text[n+1:]); m > 0 {
+			style.Background = bg
+			n += m + 1
+		}
+	}
+	return n
+}
+
+// Parse parses the formatting codes in the given text into spans. Adjacent text with the same style is merged into
+// a single span and empty spans are omitted.
+func Parse(text string) []Span {
+	var spans []Span
+	style := Plain
+	start := 0
+	add := func(end int) {
+		if end <= start {
+			return
+		} else if len(spans) > 0 && spans[len(spans)-1].Style == style {
+			spans[len(spans)-1].Text += text[start:end]
+		} else {
+			spans = append(spans, Span{Style: style, Text: text[start:end]})
+		}
+	}
+	for i := 0; i < len(text); {
+		if !isCode(text[i]) {
+			i++
+			continue
+		}
+		add(i)
+		code := text[i]
+		i++
+		switch code {
+		case CodeBold:
+			style.Bold = !style.Bold
+		case CodeItalic:
+			style.Italic = !style.Italic
+		case CodeUnderline:
+			style.Underline = !style.Underline
+		case CodeStrikethrough:
+			style.Strikethrough = !style.Strikethrough
+		case CodeMonospace:
+			style.Monospace = !style.Monospace
+		case CodeReverse:
+			style.Reverse = !style.Reverse
+		case CodeReset:
+			style = Plain
+		case CodeColor:
+			i += parseColors(text[i:], &style, parseColorNumber)
+		case CodeHexColor:
+			i += parseColors(text[i:], &style, parseHexColor)
+		}
+		start = i
+	}
+	add(len(text))
+	return spans
+}
+
+// Strip removes all formatting codes from the given text.
+func Strip(text string) string {
+	if strings.IndexFunc(text, func(r rune) bool { return r < 0x20 && isCode(byte(r)) }) < 0 {
+		return text
+	}
+	var buf strings.Builder
+	for _, span := range Parse(text) {
+		buf.WriteString(span.Text)
+	}
+	return buf.String()
+}
+
+// Format converts the given spans into text with mIRC formatting codes. Parsing the result with Parse gives back
+// the same spans, apart from merging adjacent spans with the same style, as long as the text of the spans doesn't
+// contain formatting codes.
+func Format(spans []Span) string {
+	var buf strings.Builder
+	current := Plain
+	for _, span := range spans {
+		if len(span.Text) == 0 {
+			continue
+		}
+		colorChanged := writeStyleChange(&buf, current, span.Style)
+		// Text starting with a digit or comma could be read as a part of the preceding color code.
+		if colorChanged && (isDigit(span.Text[0]) || span.Text[0] == ',') {
+			buf.WriteString("\x02\x02")
+		}
+		buf.WriteString(span.Text)
+		current = span.Style
+	}
+	return buf.String()
+}
+
+// writeStyleChange writes the formatting codes to change the style from the given current style to the target style.
+// It returns true if the last code written was a color code.
+func writeStyleChange(buf *strings.Builder, current, target Style) bool {
+	if target.IsPlain() && !current.IsPlain() {
+		buf.WriteByte(CodeReset)
+		return false
+	}
+	toggle := func(cur, tgt bool, code byte) {
+		if cur != tgt {
+			buf.WriteByte(code)
+		}
+	}
+	toggle(current.Bold, target.Bold, CodeBold)
+	toggle(current.Italic, target.Italic, CodeItalic)
+	toggle(current.Underline, target.Underline, CodeUnderline)
+	toggle(current.Strikethrough, target.Strikethrough, CodeStrikethrough)
+	toggle(current.Monospace, target.Monospace, CodeMonospace)
+	toggle(current.Reverse, target.Reverse, CodeReverse)
+	return writeColorChange(buf, current.Foreground, current.Background, target.Foreground, target.Background)
+}
+
+// writeColorChange writes the color codes to change the colors from the current colors to the target colors.
+// A color code with only a foreground keeps the background, but the background can't be set without a foreground,
+// so changing the background may take two codes when palette and hex colors are mixed.
+func writeColorChange(buf *strings.Builder, fg, bg, targetFg, targetBg Color) bool {
+	switch {
+	case fg == targetFg && bg == targetBg:
+		return false
+	case targetFg == ColorNone && targetBg == ColorNone:
+		buf.WriteByte(CodeColor)
+	case bg == targetBg && targetFg.IsHex():
+		buf.WriteByte(CodeHexColor)
+		buf.WriteString(targetFg.hexCode())
+	case bg == targetBg:
+		buf.WriteByte(CodeColor)
+		buf.WriteString(targetFg.code())
+	case targetBg.IsHex():
+		buf.WriteByte(CodeHexColor)
+		if targetFg.IsHex() {
+			buf.WriteString(targetFg.hexCode())
+		} else {
+			buf.WriteString("000000")
+		}
+		buf.WriteByte(',')
+		buf.WriteString(targetBg.hexCode())
+		if !targetFg.IsHex() {
+			buf.WriteByte(CodeColor)
+			buf.WriteString(targetFg.code())
+		}
+	default:
+		buf.WriteByte(CodeColor)
+		if targetFg.IsHex() {
+			buf.WriteString(ColorNone.code())
+		} else {
+			buf.WriteString(targetFg.code())
+		}
+		buf.WriteByte(',')
+		buf.WriteString(targetBg.code())
+		if targetFg.IsHex() {
+			buf.WriteByte(CodeHexColor)
+			buf.WriteString(targetFg.hexCode())
+		}
+	}
+	return true
+}
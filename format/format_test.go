@@ -0,0 +1,133 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package format parses, strips and converts mIRC formatting codes.
+package format
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZeroStyleIsPlain(t *testing.T) {
+	var style Style
+	if !style.IsPlain() || style.Foreground != ColorNone || style.Background != ColorNone {
+		t.Errorf("The zero value of Style isn't plain: %+v", style)
+	}
+	if White == ColorNone || !White.IsPalette() || White.Number() != 0 {
+		t.Errorf("White isn't palette color 0: %#x", int32(White))
+	}
+	if text := Format([]Span{{Text: "plain"}, {Style: Style{Bold: true}, Text: "bold"}}); text != "plain\x02bold" {
+		t.Errorf("Spans with zero styles were formatted with colors: %q", text)
+	}
+	if text := NewBuilder().Style(Style{Italic: true}).Text("x").String(); text != "\x1dx" {
+		t.Errorf("Builder added colors for a style without colors: %q", text)
+	}
+}
+
+func TestParse(t *testing.T) {
+	spans := Parse("plain \x02bold\x02 \x0304,12red on blue\x03 \x1d\x1fboth\x0f \x04FF8000orange \x0399default")
+	expected := []Span{
+		{Text: "plain "},
+		{Style: Style{Bold: true}, Text: "bold"},
+		{Text: " "},
+		{Style: Style{Foreground: Red, Background: LightBlue}, Text: "red on blue"},
+		{Text: " "},
+		{Style: Style{Italic: true, Underline: true}, Text: "both"},
+		{Text: " "},
+		{Style: Style{Foreground: RGB(0xff, 0x80, 0x00)}, Text: "orange "},
+		{Text: "default"},
+	}
+	if !reflect.DeepEqual(spans, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, spans)
+	}
+	if colors := Parse("\x035,text"); len(colors) != 1 || colors[0].Foreground != Brown || colors[0].Text != ",text" {
+		t.Errorf("A comma without a background color wasn't kept as text: %+v", colors)
+	}
+}
+
+func TestStrip(t *testing.T) {
+	tests := map[string]string{
+		"no formatting":                   "no formatting",
+		"\x02bold\x02 and \x0304red\x03":  "bold and red",
+		"\x0312,01colored\x0f reset":      "colored reset",
+		"\x04FFFFFF,000000hex\x04 colors": "hex colors",
+		"\x0310,not a background":         ",not a background",
+	}
+	for input, expected := range tests {
+		if actual := Strip(input); actual != expected {
+			t.Errorf("%q: expected %q, got %q", input, expected, actual)
+		}
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	spans := []Span{
+		{Text: "plain "},
+		{Style: Style{Bold: true, Foreground: Red}, Text: "bold red "},
+		{Style: Style{Foreground: Red, Background: Blue}, Text: "red on blue "},
+		{Style: Style{Foreground: Red, Background: RGB(1, 2, 3)}, Text: "hex background "},
+		{Style: Style{Foreground: RGB(4, 5, 6), Background: Blue}, Text: "hex foreground "},
+		{Style: Style{Background: Blue}, Text: "default on blue"},
+		{Style: Style{Foreground: Green}, Text: "12 starts with digits"},
+		{Style: Style{Italic: true, Strikethrough: true, Monospace: true, Reverse: true}, Text: "flags"},
+		{Text: "plain again"},
+	}
+	text := Format(spans)
+	if parsed := Parse(text); !reflect.DeepEqual(parsed, spans) {
+		t.Errorf("Round trip of %q changed the spans:\nexpected %+v\ngot      %+v", text, spans, parsed)
+	}
+}
+
+func TestColors(t *testing.T) {
+	if color, ok := ParseHex("#f80"); !ok || color != RGB(0xff, 0x88, 0x00) {
+		t.Errorf("Short hex color wasn't parsed: %#x", int32(color))
+	} else if _, ok = ParseHex("#12345"); ok {
+		t.Error("Invalid hex color was parsed")
+	}
+	if hex := Red.Hex(); hex != "#ff0000" {
+		t.Errorf("Expected #ff0000 for red, got %s", hex)
+	} else if hex = ColorNone.Hex(); hex != "" {
+		t.Errorf("Expected no hex value for ColorNone, got %s", hex)
+	}
+	if Palette(99) != ColorNone || Palette(-1) != ColorNone || Palette(4) != Red {
+		t.Error("Palette numbers weren't converted correctly")
+	}
+	if nearest := nearestPalette(RGB(0xff, 0, 0)); nearest != Red {
+		t.Errorf("Expected red to be found in the palette, got %#x", int32(nearest))
+	}
+}
+
+func TestConversions(t *testing.T) {
+	text := "\x02bold\x02 \x0304red\x03 <tag>"
+	if html := ToHTML(text); html != `<b>bold</b> <span style="color: #ff0000">red</span> &lt;tag&gt;` {
+		t.Errorf("Unexpected HTML: %s", html)
+	}
+	back := FromHTML(`<b>bold</b> <span style="color: #ff0000">red</span>`)
+	if expected := Parse("\x02bold\x02 \x0304red"); !reflect.DeepEqual(Parse(back), expected) {
+		t.Errorf("Unexpected HTML conversion: %q", back)
+	}
+	if ansi := ToANSI("\x02bold"); ansi != "\x1b[0;1mbold\x1b[0m" {
+		t.Errorf("Unexpected ANSI: %q", ansi)
+	}
+	if md := ToMarkdown("\x02bold\x02 \x1ditalic"); md != "**bold** _italic_" {
+		t.Errorf("Unexpected Markdown: %q", md)
+	}
+	back = FromMarkdown("**bold** *italic*")
+	if expected := Parse("\x02bold\x02 \x1ditalic"); !reflect.DeepEqual(Parse(back), expected) {
+		t.Errorf("Unexpected Markdown conversion: %q", back)
+	}
+}
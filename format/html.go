@@ -0,0 +1,216 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package format parses, strips and converts mIRC formatting codes.
+package format
+
+import (
+	"html"
+	"strings"
+)
+
+// ToHTML converts the formatting codes in the given text into HTML. The text itself is escaped.
+func ToHTML(text string) string {
+	var buf strings.Builder
+	for _, span := range Parse(text) {
+		writeHTMLSpan(&buf, span)
+	}
+	return buf.String()
+}
+
+// writeHTMLSpan writes a single span as HTML.
+func writeHTMLSpan(buf *strings.Builder, span Span) {
+	var closers []string
+	open := func(tag, attrs string) {
+		buf.WriteString("<" + tag + attrs + ">")
+		closers = append(closers, "</"+tag+">")
+	}
+	fg, bg := span.Foreground, span.Background
+	if span.Reverse {
+		fg, bg = bg, fg
+	}
+	var styles []string
+	if hex := fg.Hex(); len(hex) > 0 {
+		styles = append(styles, "color: "+hex)
+	}
+	if hex := bg.Hex(); len(hex) > 0 {
+		styles = append(styles, "background-color: "+hex)
+	}
+	if len(styles) > 0 {
+		open("span", ` style="`+strings.Join(styles, "; ")+`"`)
+	}
+	if span.Bold {
+		open("b", "")
+	}
+	if span.Italic {
+		open("i", "")
+	}
+	if span.Underline {
+		open("u", "")
+	}
+	if span.Strikethrough {
+		open("s", "")
+	}
+	if span.Monospace {
+		open("code", "")
+	}
+	buf.WriteString(html.EscapeString(span.Text))
+	for i := len(closers) - 1; i >= 0; i-- {
+		buf.WriteString(closers[i])
+	}
+}
+
+// htmlElement is an open element in FromHTML.
+type htmlElement struct {
+	tag   string
+	style Style
+}
+
+// FromHTML converts basic HTML formatting into mIRC formatting codes. Supported elements are b, strong, i, em, u,
+// ins, s, del, strike, code, tt, pre, font with a color attribute and any element with color and background-color
+// in the style attribute. Line breaks and paragraphs are converted into newlines. Other elements are ignored, but
+// their content is kept.
+func FromHTML(input string) string {
+	var spans []Span
+	stack := []htmlElement{{style: Plain}}
+	addText := func(text string) {
+		// Formatting codes in the text would be mixed up with the converted formatting.
+		text = Strip(text)
+		if len(text) > 0 {
+			spans = append(spans, Span{Style: stack[len(stack)-1].style, Text: text})
+		}
+	}
+	for len(input) > 0 {
+		start := strings.IndexByte(input, '<')
+		if start < 0 {
+			addText(html.UnescapeString(input))
+			break
+		}
+		addText(html.UnescapeString(input[:start]))
+		end := strings.IndexByte(input[start:], '>')
+		if end < 0 {
+			addText(html.UnescapeString(input[start:]))
+			break
+		}
+		tag := input[start+1 : start+end]
+		input = input[start+end+1:]
+
+		if strings.HasPrefix(tag, "/") {
+			name := strings.ToLower(strings.TrimSpace(tag[1:]))
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].tag == name {
+					stack = stack[:i]
+					break
+				}
+			}
+			if name == "p" || name == "div" {
+				addText("\n")
+			}
+			continue
+		} else if strings.HasPrefix(tag, "!") {
+			// Comments and doctypes
+			continue
+		}
+		selfClosing := strings.HasSuffix(tag, "/")
+		name, attrs := splitHTMLTag(strings.TrimSuffix(tag, "/"))
+		if name == "br" {
+			addText("\n")
+			continue
+		}
+		style := applyHTMLTag(stack[len(stack)-1].style, name, attrs)
+		if !selfClosing {
+			stack = append(stack, htmlElement{tag: name, style: style})
+		}
+	}
+	return Format(spans)
+}
+
+// splitHTMLTag splits the contents of a HTML tag into the lowercased tag name and the attributes.
+func splitHTMLTag(tag string) (string, map[string]string) {
+	tag = strings.TrimSpace(tag)
+	end := strings.IndexAny(tag, " \t\r\n")
+	if end < 0 {
+		return strings.ToLower(tag), nil
+	}
+	name := strings.ToLower(tag[:end])
+	attrs := make(map[string]string)
+	rest := strings.TrimSpace(tag[end:])
+	for len(rest) > 0 {
+		eq := strings.IndexAny(rest, "= \t\r\n")
+		if eq < 0 {
+			attrs[strings.ToLower(rest)] = ""
+			break
+		} else if rest[eq] != '=' {
+			attrs[strings.ToLower(rest[:eq])] = ""
+			rest = strings.TrimSpace(rest[eq:])
+			continue
+		}
+		key := strings.ToLower(rest[:eq])
+		rest = rest[eq+1:]
+		var value string
+		if len(rest) > 0 && (rest[0] == '"' || rest[0] == '\'') {
+			if close := strings.IndexByte(rest[1:], rest[0]); close >= 0 {
+				value, rest = rest[1:close+1], rest[close+2:]
+			} else {
+				value, rest = rest[1:], ""
+			}
+		} else if space := strings.IndexAny(rest, " \t\r\n"); space >= 0 {
+			value, rest = rest[:space], rest[space:]
+		} else {
+			value, rest = rest, ""
+		}
+		attrs[key] = html.UnescapeString(value)
+		rest = strings.TrimSpace(rest)
+	}
+	return name, attrs
+}
+
+// applyHTMLTag returns the style of the content of the given element.
+func applyHTMLTag(style Style, name string, attrs map[string]string) Style {
+	switch name {
+	case "b", "strong":
+		style.Bold = true
+	case "i", "em":
+		style.Italic = true
+	case "u", "ins":
+		style.Underline = true
+	case "s", "del", "strike":
+		style.Strikethrough = true
+	case "code", "tt", "pre":
+		style.Monospace = true
+	case "font":
+		if color, ok := ParseHex(attrs["color"]); ok {
+			style.Foreground = nearestPalette(color)
+		}
+	}
+	for _, decl := range strings.Split(attrs["style"], ";") {
+		colon := strings.IndexByte(decl, ':')
+		if colon < 0 {
+			continue
+		}
+		color, ok := ParseHex(strings.TrimSpace(decl[colon+1:]))
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(decl[:colon])) {
+		case "color":
+			style.Foreground = nearestPalette(color)
+		case "background-color", "background":
+			style.Background = nearestPalette(color)
+		}
+	}
+	return style
+}
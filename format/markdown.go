@@ -0,0 +1,196 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package format parses, strips and converts mIRC formatting codes.
+package format
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// markdownEscaper escapes the characters that have a meaning in inline Markdown.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `~`, `\~`, `[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`,
+)
+
+// markdownMarker is a Markdown delimiter and the style it stands for.
+type markdownMarker struct {
+	delim string
+	has   func(style Style) bool
+}
+
+// markdownMarkers are the delimiters used by ToMarkdown, from the outermost to the innermost.
+var markdownMarkers = []markdownMarker{
+	{"**", func(style Style) bool { return style.Bold }},
+	{"_", func(style Style) bool { return style.Italic }},
+	{"~~", func(style Style) bool { return style.Strikethrough }},
+}
+
+// ToMarkdown converts the formatting codes in the given text into Markdown. Bold, italic, strikethrough and
+// monospace are converted; underline and colors have no Markdown equivalent and are dropped.
+func ToMarkdown(text string) string {
+	var buf strings.Builder
+	var open []markdownMarker
+	// Delimiters must be next to the text they format, so whitespace at the edges of spans is written outside them.
+	var pending string
+	for _, span := range Parse(text) {
+		trimmed := strings.TrimLeftFunc(span.Text, unicode.IsSpace)
+		leading := span.Text[:len(span.Text)-len(trimmed)]
+		core := strings.TrimRightFunc(trimmed, unicode.IsSpace)
+		trailing := trimmed[len(core):]
+		if len(core) == 0 {
+			pending += span.Text
+			continue
+		}
+
+		// Close the delimiters that aren't in the new style, and everything opened after them.
+		keep := 0
+		for keep < len(open) && open[keep].has(span.Style) {
+			keep++
+		}
+		for i := len(open) - 1; i >= keep; i-- {
+			buf.WriteString(open[i].delim)
+		}
+		open = open[:keep]
+		buf.WriteString(pending + leading)
+		for _, marker := range markdownMarkers {
+			if marker.has(span.Style) && !markdownOpen(open, marker) {
+				buf.WriteString(marker.delim)
+				open = append(open, marker)
+			}
+		}
+
+		if span.Monospace {
+			writeMarkdownCode(&buf, core)
+		} else {
+			buf.WriteString(markdownEscaper.Replace(core))
+		}
+		pending = trailing
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString(open[i].delim)
+	}
+	buf.WriteString(pending)
+	return buf.String()
+}
+
+func markdownOpen(open []markdownMarker, marker markdownMarker) bool {
+	for _, m := range open {
+		if m.delim == marker.delim {
+			return true
+		}
+	}
+	return false
+}
+
+// writeMarkdownCode writes the given text as a Markdown code span. The delimiter is made longer than any run of
+// backticks in the text.
+func writeMarkdownCode(buf *strings.Builder, text string) {
+	longest, run := 0, 0
+	for i := 0; i < len(text); i++ {
+		if text[i] == '`' {
+			run++
+			if run > longest {
+				longest = run
+			}
+		} else {
+			run = 0
+		}
+	}
+	delim := strings.Repeat("`", longest+1)
+	if strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") {
+		text = " " + text + " "
+	}
+	buf.WriteString(delim + text + delim)
+}
+
+// FromMarkdown converts basic inline Markdown into mIRC formatting codes. Supported syntax is **bold**, __bold__,
+// *italic*, _italic_, ~~strikethrough~~, `code` and backslash escapes. Delimiters without a matching closing
+// delimiter are kept as text.
+func FromMarkdown(input string) string {
+	var spans []Span
+	style := Plain
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			spans = append(spans, Span{Style: style, Text: Strip(text.String())})
+			text.Reset()
+		}
+	}
+	toggle := func(i int, delim string, field *bool) bool {
+		if !strings.HasPrefix(input[i:], delim) {
+			return false
+		} else if !*field && !strings.Contains(input[i+len(delim):], delim) {
+			return false
+		} else if delim == "_" && isWordCharBefore(input, i) && isWordCharAt(input, i+1) {
+			// Underscores inside words, like in snake_case, aren't delimiters.
+			return false
+		}
+		flush()
+		*field = !*field
+		return true
+	}
+	for i := 0; i < len(input); {
+		switch {
+		case input[i] == '\\' && i+1 < len(input) && strings.IndexByte("\\`*_~[]<>#+-.!{}()|", input[i+1]) >= 0:
+			text.WriteByte(input[i+1])
+			i += 2
+		case input[i] == '`':
+			run := 1
+			for i+run < len(input) && input[i+run] == '`' {
+				run++
+			}
+			delim := input[i : i+run]
+			end := strings.Index(input[i+run:], delim)
+			if end < 0 {
+				text.WriteString(delim)
+				i += run
+				continue
+			}
+			code := input[i+run : i+run+end]
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+			flush()
+			style.Monospace = true
+			text.WriteString(code)
+			flush()
+			style.Monospace = false
+			i += run*2 + end
+		case toggle(i, "**", &style.Bold), toggle(i, "__", &style.Bold), toggle(i, "~~", &style.Strikethrough):
+			i += 2
+		case toggle(i, "*", &style.Italic), toggle(i, "_", &style.Italic):
+			i++
+		default:
+			text.WriteByte(input[i])
+			i++
+		}
+	}
+	flush()
+	return Format(spans)
+}
+
+func isWordCharBefore(text string, i int) bool {
+	r, _ := utf8.DecodeLastRuneInString(text[:i])
+	return i > 0 && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
+
+func isWordCharAt(text string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(text[i:])
+	return i < len(text) && (unicode.IsLetter(r) || unicode.IsDigit(r))
+}
@@ -18,10 +18,14 @@
 package libmauirc
 
 import (
+	"bytes"
 	"fmt"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
-	"time"
+	"sync/atomic"
 
 	"github.com/sorcix/irc"
 	"github.com/sorcix/irc/ctcp"
@@ -34,11 +38,15 @@ type HandlerHandler interface {
 	// GetHandlers gets all the handlers for the given code
 	GetHandlers(code string) (handlers []Handler, ok bool)
 	// RunHandlers runs the handlers for the given code with the given event
-	RunHandlers(evt *irc.Message)
+	RunHandlers(evt *Event)
+	// AddTypedHandler adds the given handler for typed events and returns the handler index
+	AddTypedHandler(handler TypedHandler) int
+	// RemoveTypedHandler removes the typed event handler with the given index
+	RemoveTypedHandler(index int)
 }
 
-// Handler is an IRC event handler
-type Handler func(evt *irc.Message)
+// Handler is an IRC event handler. Panics in handlers are recovered and logged in the handlers category.
+type Handler func(evt *Event)
 
 // AddHandler adds the given handler for all messages with the given code.
 func (c *ConnImpl) AddHandler(code string, handler Handler) int {
@@ -79,97 +87,137 @@ func (c *ConnImpl) GetHandlers(code string) (handlers []Handler, ok bool) {
 	return
 }
 
+// handleEvent collects batches and labeled responses and runs handlers for the given incoming event.
+func (c *ConnImpl) handleEvent(evt *Event) {
+	c.trackPlayback(evt)
+	evt, ok := c.handleBatches(evt)
+	if !ok {
+		return
+	}
+	c.matchEcho(evt)
+	labeled := c.resolveLabel(evt)
+	claimed := c.runHandlers(evt)
+	// Batches that are the reply to a query or a labeled request belong to the request. The messages in other
+	// batches are passed to handlers too, so that netsplits and playback aren't lost.
+	if evt.Batch != nil && !labeled && !claimed {
+		c.dispatchBatch(evt.Batch)
+	}
+}
+
+// dispatch runs the given function with the dispatch lock held. The goroutine is recorded, so that functions that wait
+// for replies can refuse to run in handlers instead of blocking the dispatching of the replies.
+func (c *ConnImpl) dispatch(fn func()) {
+	c.dispatchLock.Lock()
+	defer c.dispatchLock.Unlock()
+	atomic.StoreUint64(&c.dispatcher, goroutineID())
+	defer atomic.StoreUint64(&c.dispatcher, 0)
+	fn()
+}
+
+// inHandler checks if the calling goroutine is dispatching an event.
+func (c *ConnImpl) inHandler() bool {
+	dispatcher := atomic.LoadUint64(&c.dispatcher)
+	return dispatcher != 0 && dispatcher == goroutineID()
+}
+
+// goroutineID returns the ID of the calling goroutine, which is the second word of the stack trace header.
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	fields := bytes.Fields(buf[:runtime.Stack(buf, false)])
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
+
 // RunHandlers runs handlers for the given irc message.
-func (c *ConnImpl) RunHandlers(evt *irc.Message) {
+func (c *ConnImpl) RunHandlers(evt *Event) {
+	c.runHandlers(evt)
+}
+
+// runHandlers runs handlers for the given message and returns whether or not a pending query claimed the message.
+func (c *ConnImpl) runHandlers(evt *Event) (claimed bool) {
+	// Store the original parameters before the trailing parameter is split into Params.
+	evt.Args()
+	claimed = c.dispatchQueries(evt)
 	if tag, text, ok := ctcp.Decode(evt.Trailing); ok && evt.Command == irc.PRIVMSG {
 		evt.Command = fmt.Sprintf("CTCP_%s", tag)
 		evt.Trailing = text
 	}
+	if c.shouldDrop(evt) {
+		c.log(slog.LevelDebug, CategoryHandlers, "Dropped ignored event", slog.String("command", evt.Command),
+			slog.String("source", evt.Prefix.String()))
+		return
+	}
 	evt.Params = append(evt.Params, strings.Split(evt.Trailing, " ")...)
 	for _, handle := range c.handlers[evt.Command] {
-		handle(evt)
+		c.callHandler(evt, handle)
 	}
 	for _, handle := range c.handlers["*"] {
-		handle(evt)
+		c.callHandler(evt, handle)
 	}
+	return
 }
 
-// AddStdHandlers add standard IRC handlers for this connection
-// The standard handlers include an IRC ERROR handler, ping and pong handler, CTCP version, userinfo, clientinfo,
-// time and ping handlers and a nick change handler.
-func (c *ConnImpl) AddStdHandlers() {
-	c.AddHandler("ERROR", func(evt *irc.Message) {
-		c.Disconnect()
-	})
-
-	c.AddHandler("PING", func(evt *irc.Message) {
-		c.Pong(evt.Trailing)
-	})
-
-	c.AddHandler("PONG", func(evt *irc.Message) {
-		ns, _ := strconv.ParseInt(evt.Trailing, 10, 64)
-		delta := time.Duration(time.Now().UnixNano() - ns)
-		c.Debugfln("Lag: %v", delta)
-		c.Lag = delta.Nanoseconds()
-	})
+// callHandler runs the given handler. A panicking handler is logged and doesn't stop the other handlers or the
+// connection.
+func (c *ConnImpl) callHandler(evt *Event, handle Handler) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.log(slog.LevelError, CategoryHandlers, "Handler panicked", slog.String("command", evt.Command),
+				slog.Any("panic", err), slog.String("stack", string(debug.Stack())))
+		}
+	}()
+	handle(evt)
+}
 
-	c.AddHandler("CTCP_VERSION", func(evt *irc.Message) {
-		c.Send(&irc.Message{
-			Command:  "NOTICE",
-			Params:   []string{evt.Name},
-			Trailing: ctcp.Version(c.Version),
-		})
+// replyCTCP sends the given CTCP reply to the sender of the given event.
+// Echoes of our own CTCP requests are ignored, and replies are dropped if the global CTCP reply limit is reached.
+func (c *ConnImpl) replyCTCP(evt *Event, reply string) {
+	if evt.Echo || evt.Prefix == nil || !c.allowCTCPReply() {
+		return
+	}
+	c.Send(&irc.Message{
+		Command:  "NOTICE",
+		Params:   []string{evt.Name},
+		Trailing: reply,
 	})
+}
 
-	c.AddHandler("CTCP_USERINFO", func(evt *irc.Message) {
-		c.Send(&irc.Message{
-			Command:  "NOTICE",
-			Params:   []string{evt.Name},
-			Trailing: ctcp.UserInfo(c.User),
-		})
+// AddStdHandlers add standard IRC handlers for this connection
+// The standard handlers include an IRC ERROR handler, ping and pong handler, the CTCP responder dispatcher with
+// version, userinfo, clientinfo, time and ping responders and a nick change handler.
+func (c *ConnImpl) AddStdHandlers() {
+	c.AddHandler("ERROR", func(evt *Event) {
+		// Disconnect waits for the read loop, so it can't be called from the handler directly.
+		go c.Disconnect()
 	})
 
-	c.AddHandler("CTCP_CLIENTINFO", func(evt *irc.Message) {
-		c.Send(&irc.Message{
-			Command:  "NOTICE",
-			Params:   []string{evt.Name},
-			Trailing: ctcp.ClientInfo("CLIENTINFO PING VERSION TIME USERINFO CLIENTINFO"),
-		})
-	})
+	c.AddHandler("CAP", c.handleCap)
+	c.AddHandler(rplISupport, c.handleISupport)
 
-	c.AddHandler("CTCP_TIME", func(evt *irc.Message) {
-		c.Send(&irc.Message{
-			Command:  "NOTICE",
-			Params:   []string{evt.Name},
-			Trailing: ctcp.TimeReply(),
-		})
+	c.AddHandler("PING", func(evt *Event) {
+		c.Pong(evt.Trailing)
 	})
 
-	c.AddHandler("CTCP_PING", func(evt *irc.Message) {
-		c.Send(&irc.Message{
-			Command:  "NOTICE",
-			Params:   []string{evt.Name},
-			Trailing: ctcp.Ping(evt.Trailing),
-		})
-	})
+	c.AddHandler("PONG", c.handlePong)
 
-	nickused := func(evt *irc.Message) {
-		if len(c.Nick) >= 9 {
-			c.SetNick("_" + c.Nick)
-		} else {
-			c.SetNick(c.Nick + "_")
-		}
-	}
-	c.AddHandler("437", nickused)
-	c.AddHandler("433", nickused)
+	c.addStdCTCPResponders()
+	c.AddHandler("*", c.respondCTCP)
+	c.AddHandler("CTCP_DCC", c.handleDCC)
 
-	c.AddHandler("NICK", func(evt *irc.Message) {
-		if evt.Name == c.PreferredNick {
-			c.Nick = evt.Trailing
-		}
-	})
+	c.addNickHandlers()
+	c.addStateHandlers()
+	c.addPresenceHandlers()
+	c.addZNCHandlers()
 
-	c.AddHandler("001", func(evt *irc.Message) {
+	c.AddHandler("001", func(evt *Event) {
 		c.Nick = evt.Params[0]
+		c.registered = true
+		c.capLock.Lock()
+		c.capNegotiating = false
+		c.capLock.Unlock()
+		c.recoverNick()
 	})
 }
@@ -0,0 +1,75 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Hostmask is a nick!user@host triple identifying a user.
+type Hostmask struct {
+	Nick string
+	User string
+	Host string
+}
+
+// ParseHostmask parses a nick!user@host string. Missing parts are left empty.
+func ParseHostmask(mask string) Hostmask {
+	var hm Hostmask
+	if at := strings.LastIndexByte(mask, '@'); at >= 0 {
+		hm.Host = mask[at+1:]
+		mask = mask[:at]
+	}
+	if excl := strings.IndexByte(mask, '!'); excl >= 0 {
+		hm.User = mask[excl+1:]
+		mask = mask[:excl]
+	}
+	hm.Nick = mask
+	return hm
+}
+
+// HostmaskFromPrefix creates a Hostmask from the prefix of a message. A nil prefix gives an empty Hostmask.
+func HostmaskFromPrefix(prefix *irc.Prefix) Hostmask {
+	if prefix == nil {
+		return Hostmask{}
+	}
+	return Hostmask{Nick: prefix.Name, User: prefix.User, Host: prefix.Host}
+}
+
+// String returns the hostmask in the nick!user@host format. Missing parts are replaced with *.
+func (hm Hostmask) String() string {
+	return orStar(hm.Nick) + "!" + orStar(hm.User) + "@" + orStar(hm.Host)
+}
+
+func orStar(part string) string {
+	if len(part) == 0 {
+		return "*"
+	}
+	return part
+}
+
+// Matches checks if the hostmask matches the given glob mask using the given case mapping.
+// Masks that only contain a nick, such as "foo*", are treated as "foo*!*@*".
+func (hm Hostmask) Matches(mask string, mapping CaseMapping) bool {
+	pattern := ParseHostmask(mask)
+	return mapping.Match(orStar(pattern.Nick), hm.Nick) &&
+		mapping.Match(orStar(pattern.User), hm.User) &&
+		mapping.Match(orStar(pattern.Host), hm.Host)
+}
@@ -0,0 +1,259 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+	"github.com/sorcix/irc/ctcp"
+)
+
+// Ignorer contains functions to ignore messages from users.
+// Ignored messages are dropped before they reach handlers, and CTCP requests from ignored users aren't replied to.
+type Ignorer interface {
+	// Ignore ignores the given message types from users matching the given hostmask glob.
+	// If duration is zero or negative, the ignore doesn't expire.
+	Ignore(mask string, types IgnoreType, duration time.Duration)
+	// Unignore removes the ignore with the given mask.
+	Unignore(mask string)
+	// GetIgnores returns the list of active ignores.
+	GetIgnores() []IgnoreEntry
+	// IsIgnored checks if the given message types from the given user are ignored.
+	IsIgnored(source Hostmask, types IgnoreType) bool
+}
+
+// IgnoreType is a bitmask of message types to ignore.
+type IgnoreType int
+
+// Ignorable message types
+const (
+	IgnorePrivmsg IgnoreType = 1 << iota
+	IgnoreNotice
+	IgnoreCTCP
+	IgnoreInvite
+	IgnoreAll = IgnorePrivmsg | IgnoreNotice | IgnoreCTCP | IgnoreInvite
+)
+
+// IgnoreEntry is a single entry in the ignore list.
+type IgnoreEntry struct {
+	Mask  string
+	Types IgnoreType
+	// Expires is the time when the ignore is removed, or zero if it doesn't expire.
+	Expires time.Time
+}
+
+// floodCounter contains the times of recent messages from a single source.
+type floodCounter struct {
+	messages []time.Time
+	ctcps    []time.Time
+}
+
+// Ignore - See Ignorer interface docs
+func (c *ConnImpl) Ignore(mask string, types IgnoreType, duration time.Duration) {
+	entry := IgnoreEntry{Mask: mask, Types: types}
+	if duration > 0 {
+		entry.Expires = time.Now().Add(duration)
+	}
+	c.ignoreLock.Lock()
+	defer c.ignoreLock.Unlock()
+	for i, existing := range c.ignores {
+		if existing.Mask == mask {
+			c.ignores[i] = entry
+			return
+		}
+	}
+	c.ignores = append(c.ignores, entry)
+}
+
+// Unignore - See Ignorer interface docs
+func (c *ConnImpl) Unignore(mask string) {
+	c.ignoreLock.Lock()
+	defer c.ignoreLock.Unlock()
+	for i, entry := range c.ignores {
+		if entry.Mask == mask {
+			c.ignores = append(c.ignores[:i], c.ignores[i+1:]...)
+			return
+		}
+	}
+}
+
+// GetIgnores - See Ignorer interface docs
+func (c *ConnImpl) GetIgnores() []IgnoreEntry {
+	c.ignoreLock.Lock()
+	defer c.ignoreLock.Unlock()
+	c.pruneIgnores(time.Now())
+	return append([]IgnoreEntry(nil), c.ignores...)
+}
+
+// IsIgnored - See Ignorer interface docs
+func (c *ConnImpl) IsIgnored(source Hostmask, types IgnoreType) bool {
+	mapping := c.CaseMapping()
+	c.ignoreLock.Lock()
+	defer c.ignoreLock.Unlock()
+	c.pruneIgnores(time.Now())
+	for _, entry := range c.ignores {
+		if entry.Types&types != 0 && source.Matches(entry.Mask, mapping) {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneIgnores removes expired ignores. The caller must hold the ignore lock.
+func (c *ConnImpl) pruneIgnores(now time.Time) {
+	active := c.ignores[:0]
+	for _, entry := range c.ignores {
+		if entry.Expires.IsZero() || entry.Expires.After(now) {
+			active = append(active, entry)
+		}
+	}
+	c.ignores = active
+}
+
+// ignoreType returns the ignorable type of the given event, or zero if the event can't be ignored.
+// It must be called after the CTCP command of the event has been decoded.
+func ignoreType(evt *Event) IgnoreType {
+	switch {
+	case evt.Command == "CTCP_ACTION":
+		return IgnorePrivmsg
+	case strings.HasPrefix(evt.Command, "CTCP_"):
+		return IgnoreCTCP
+	case evt.Command == irc.PRIVMSG:
+		return IgnorePrivmsg
+	case evt.Command == irc.NOTICE:
+		if _, _, ok := ctcp.Decode(evt.Trailing); ok {
+			return IgnoreCTCP
+		}
+		return IgnoreNotice
+	case evt.Command == irc.INVITE:
+		return IgnoreInvite
+	}
+	return 0
+}
+
+// recentCount removes the times older than the given cutoff and returns the number of remaining times.
+func recentCount(times *[]time.Time, cutoff time.Time) int {
+	i := 0
+	for i < len(*times) && (*times)[i].Before(cutoff) {
+		i++
+	}
+	*times = (*times)[i:]
+	return len(*times)
+}
+
+// countsAsFlood checks if the given event counts towards the flood limits of its source. Only private messages and
+// CTCPs count, so that talking in a busy channel doesn't get a user ignored. Echoes of our own messages, messages in
+// batches and messages older than the flood window, such as bouncer playback, don't count either. Neither do the
+// replies of ZNC modules, which can be dozens of lines long.
+func (c *ConnImpl) countsAsFlood(evt *Event, types IgnoreType, now time.Time) bool {
+	if evt.Echo || evt.InBatch != nil || (!evt.Time.IsZero() && now.Sub(evt.Time) > c.FloodWindow) {
+		return false
+	} else if strings.HasPrefix(evt.Name, ZNCStatusPrefix) && c.isZNC() {
+		return false
+	} else if types == IgnoreCTCP {
+		return true
+	}
+	params := evt.Args()
+	return len(params) > 0 && !c.isChannel(params[0])
+}
+
+// shouldDrop checks if the given event is ignored or if its source is flooding. Sources that exceed the flood limits
+// are automatically ignored for AutoIgnoreDuration and an AutoIgnoreEvent is emitted.
+func (c *ConnImpl) shouldDrop(evt *Event) bool {
+	types := ignoreType(evt)
+	// Only messages from users can be ignored. Server notices and our own echoes always pass.
+	if types == 0 || evt.Echo || evt.Prefix == nil || len(evt.User) == 0 {
+		return false
+	}
+	source := HostmaskFromPrefix(evt.Prefix)
+	now := time.Now()
+	if c.IsIgnored(source, types) {
+		return true
+	} else if c.FloodWindow <= 0 || !c.countsAsFlood(evt, types, now) {
+		return false
+	}
+
+	cutoff := now.Add(-c.FloodWindow)
+	key := c.foldName(source.User + "@" + source.Host)
+	c.ignoreLock.Lock()
+	counter, ok := c.floodCounters[key]
+	if !ok {
+		c.pruneFloodCounters(cutoff)
+		counter = &floodCounter{}
+		c.floodCounters[key] = counter
+	}
+	var flooding IgnoreType
+	counter.messages = append(counter.messages, now)
+	if c.FloodMessages > 0 && recentCount(&counter.messages, cutoff) > c.FloodMessages {
+		flooding = IgnoreAll
+	} else if types == IgnoreCTCP {
+		counter.ctcps = append(counter.ctcps, now)
+		if c.FloodCTCPs > 0 && recentCount(&counter.ctcps, cutoff) > c.FloodCTCPs {
+			flooding = IgnoreCTCP
+		}
+	}
+	if flooding != 0 {
+		delete(c.floodCounters, key)
+	}
+	c.ignoreLock.Unlock()
+
+	if flooding == 0 {
+		return false
+	}
+	mask := "*!*@" + source.Host
+	c.Ignore(mask, flooding, c.AutoIgnoreDuration)
+	c.log(slog.LevelInfo, CategoryHandlers, "Automatically ignoring flooding source", slog.String("mask", mask),
+		slog.Duration("duration", c.AutoIgnoreDuration))
+	c.emit(&AutoIgnoreEvent{
+		eventSource: eventSource{evt},
+		Mask:        mask,
+		Sender:      source,
+		Types:       flooding,
+		Duration:    c.AutoIgnoreDuration,
+	})
+	return true
+}
+
+// pruneFloodCounters removes the counters of sources that haven't sent anything since the given cutoff.
+// The caller must hold the ignore lock.
+func (c *ConnImpl) pruneFloodCounters(cutoff time.Time) {
+	for key, counter := range c.floodCounters {
+		if recentCount(&counter.messages, cutoff) == 0 {
+			delete(c.floodCounters, key)
+		}
+	}
+}
+
+// allowCTCPReply checks if a CTCP reply can be sent without exceeding the global CTCP reply limit.
+// The limit prevents the client from being used as a flood amplifier by many sources at once.
+func (c *ConnImpl) allowCTCPReply() bool {
+	if c.CTCPReplyLimit <= 0 || c.FloodWindow <= 0 {
+		return true
+	}
+	now := time.Now()
+	c.ignoreLock.Lock()
+	defer c.ignoreLock.Unlock()
+	if recentCount(&c.ctcpReplies, now.Add(-c.FloodWindow)) >= c.CTCPReplyLimit {
+		return false
+	}
+	c.ctcpReplies = append(c.ctcpReplies, now)
+	return true
+}
@@ -0,0 +1,109 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// floodTest feeds the given line to a new offline connection the given number of times, optionally marked as an
+// echo, and returns the number of times it reached handlers and the auto-ignores that were emitted.
+func floodTest(line string, times int, echo bool) (handled int, ignores []*AutoIgnoreEvent) {
+	c := newOfflineConn("tester")
+	c.AddHandler("*", func(evt *Event) {
+		if evt.Command == irc.PRIVMSG || evt.Command == "CTCP_VERSION" {
+			handled++
+		}
+	})
+	c.AddTypedHandler(func(evt TypedEvent) {
+		if ignore, ok := evt.(*AutoIgnoreEvent); ok {
+			ignores = append(ignores, ignore)
+		}
+	})
+	for i := 0; i < times; i++ {
+		evt := ParseEvent(line)
+		evt.received(time.Now())
+		evt.Echo = echo
+		c.RunHandlers(evt)
+	}
+	return
+}
+
+func TestFloodPrivateMessages(t *testing.T) {
+	handled, ignores := floodTest(":spammer!s@spam.example PRIVMSG tester :hi", 25, false)
+	if handled != 20 {
+		t.Errorf("Expected 20 messages to be handled, got %d", handled)
+	}
+	if len(ignores) != 1 || ignores[0].Mask != "*!*@spam.example" || ignores[0].Types != IgnoreAll {
+		t.Fatalf("Expected a single auto-ignore of the host, got %+v", ignores)
+	}
+}
+
+func TestFloodCTCP(t *testing.T) {
+	handled, ignores := floodTest(":spammer!s@spam.example PRIVMSG #chan :\x01VERSION\x01", 10, false)
+	if handled != 4 {
+		t.Errorf("Expected 4 CTCPs to be handled, got %d", handled)
+	}
+	if len(ignores) != 1 || ignores[0].Types != IgnoreCTCP {
+		t.Fatalf("Expected a single CTCP auto-ignore, got %+v", ignores)
+	}
+}
+
+func TestFloodIgnoresChannelMessages(t *testing.T) {
+	handled, ignores := floodTest(":talker!t@talk.example PRIVMSG #busy :hello everyone", 50, false)
+	if handled != 50 || len(ignores) > 0 {
+		t.Errorf("Channel messages were counted as a flood: %d handled, ignores %+v", handled, ignores)
+	}
+}
+
+func TestFloodIgnoresPlayback(t *testing.T) {
+	old := time.Now().Add(-time.Hour).UTC().Format("2006-01-02T15:04:05.000Z")
+	handled, ignores := floodTest("@time="+old+" :friend!f@friend.example PRIVMSG tester :old message", 50, false)
+	if handled != 50 || len(ignores) > 0 {
+		t.Errorf("Playback was counted as a flood: %d handled, ignores %+v", handled, ignores)
+	}
+}
+
+func TestFloodIgnoresEchoes(t *testing.T) {
+	handled, ignores := floodTest(":tester!tester@me.example PRIVMSG friend :hi", 50, true)
+	if handled != 50 || len(ignores) > 0 {
+		t.Errorf("Own messages were counted as a flood: %d handled, ignores %+v", handled, ignores)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.Ignore("*!*@*.example", IgnorePrivmsg, 0)
+	c.Ignore("temp!*@*", IgnoreAll, -time.Second)
+	source := Hostmask{Nick: "someone", User: "s", Host: "host.example"}
+	if !c.IsIgnored(source, IgnorePrivmsg) || c.IsIgnored(source, IgnoreNotice) {
+		t.Error("Ignore types weren't matched correctly")
+	}
+	c.Ignore("temp!*@*", IgnoreAll, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if c.IsIgnored(Hostmask{Nick: "temp", User: "t", Host: "t.net"}, IgnoreAll) {
+		t.Error("Expired ignore still matched")
+	}
+	c.Unignore("*!*@*.example")
+	if len(c.GetIgnores()) != 0 {
+		t.Errorf("Expected no ignores to be left, got %+v", c.GetIgnores())
+	}
+}
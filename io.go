@@ -20,7 +20,9 @@ package libmauirc
 import (
 	"bufio"
 	"bytes"
+	"log/slog"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sorcix/irc"
@@ -28,96 +30,162 @@ import (
 
 func (c *ConnImpl) readLoop() {
 	defer c.Done()
+	end := c.end
 	br := bufio.NewReaderSize(c.socket, 512)
 
 	for {
 		select {
-		case <-c.end:
+		case <-end:
 			return
 		default:
 			if c.socket != nil {
 				c.socket.SetReadDeadline(time.Now().Add(c.Timeout + c.PingFreq))
 			}
 
-			msg, err := br.ReadString('\n')
+			data, err := br.ReadBytes('\n')
 			if c.socket != nil {
 				var zero time.Time
 				c.socket.SetReadDeadline(zero)
 			}
 
 			if err != nil {
-				c.errors <- err
+				c.connectionLost(end, err)
 				return
 			}
 
-			msg = strings.TrimSpace(msg)
-			c.Debugln("<--", msg)
+			msg := c.decodeLine(bytes.TrimSpace(data))
+			c.record(DirectionIn, msg)
+			c.logLine("<--", msg)
+			// prevMsg is only used for keepalive, so it must always be the local time instead of server-time.
+			now := time.Now()
 			c.Lock()
-			c.prevMsg = time.Now()
+			c.prevMsg = now
 			c.Unlock()
-			if strings.HasPrefix(msg, "ERROR") {
-				go c.Disconnect()
+			evt := ParseEvent(msg)
+			if evt == nil {
+				c.countLine(DirectionIn, "", len(data))
+				continue
+			}
+			c.countLine(DirectionIn, evt.Command, len(data))
+			evt.received(now)
+			if evt.Command == irc.ERROR {
+				go c.disconnect(end)
 				return
 			}
-			c.RunHandlers(irc.ParseMessage(msg))
+			c.dispatch(func() {
+				c.handleEvent(evt)
+			})
+		}
+	}
+}
+
+// enqueue adds the given event to the output queue of the current connection. If there's no active connection or the
+// connection is dropped while waiting for room in the queue, the delivery of the event is failed and ErrDisconnected
+// is returned.
+func (c *ConnImpl) enqueue(evt *Event) error {
+	c.outputLock.RLock()
+	defer c.outputLock.RUnlock()
+	c.Lock()
+	output, end := c.output, c.end
+	c.Unlock()
+	if output == nil {
+		evt.fail(ErrDisconnected)
+		return ErrDisconnected
+	}
+	select {
+	case <-end:
+		evt.fail(ErrDisconnected)
+		return ErrDisconnected
+	default:
+	}
+	atomic.AddInt64(&c.queued, 1)
+	select {
+	case output <- evt:
+		return nil
+	case <-end:
+		atomic.AddInt64(&c.queued, -1)
+		evt.fail(ErrDisconnected)
+		return ErrDisconnected
+	}
+}
+
+// drainOutput removes the events left in the output queue after the writer has stopped and fails their deliveries.
+// It waits for senders that are still adding events to the queue, so that no event is left behind.
+func (c *ConnImpl) drainOutput(output chan *Event) {
+	c.outputLock.Lock()
+	defer c.outputLock.Unlock()
+	for {
+		select {
+		case evt := <-output:
+			atomic.AddInt64(&c.queued, -1)
+			evt.fail(ErrDisconnected)
+		default:
+			return
 		}
 	}
 }
 
 func (c *ConnImpl) writeLoop() {
 	defer c.Done()
+	end, output := c.end, c.output
+	defer close(c.echoSignal)
 	for {
 		select {
-		case b, ok := <-c.output:
-			if !ok || b == nil || c.socket == nil {
+		case evt := <-output:
+			atomic.AddInt64(&c.queued, -1)
+			if c.socket == nil {
+				evt.fail(ErrDisconnected)
 				return
 			}
 
-			c.Debugln("-->", strings.TrimSpace(b.String()))
-			c.socket.SetWriteDeadline(time.Now().Add(c.Timeout))
+			line := evt.String()
+			data, err := c.encodeLine(evt.Message, line)
+			if err != nil {
+				c.log(slog.LevelWarn, CategoryIO, "Not sending", slog.String(LogKeyLine, RedactLine(strings.TrimSpace(line))), errAttr(err))
+				evt.fail(err)
+				select {
+				case c.errors <- err:
+				default:
+				}
+				continue
+			}
+			c.logLine("-->", strings.TrimSpace(line))
+			c.record(DirectionOut, strings.TrimSpace(line))
+			evt.Time = time.Now()
+			c.socket.SetWriteDeadline(evt.Time.Add(c.Timeout))
 			var buf bytes.Buffer
-			buf.Write(b.Bytes())
+			buf.Write(data)
 			buf.WriteRune('\r')
 			buf.WriteRune('\n')
-			_, err := c.socket.Write(buf.Bytes())
+			_, err = c.socket.Write(buf.Bytes())
 
 			var zero time.Time
 			c.socket.SetWriteDeadline(zero)
 
 			if err != nil {
-				c.errors <- err
+				evt.fail(err)
+				c.connectionLost(end, err)
 				return
 			}
-		case <-c.end:
+			c.countLine(DirectionOut, evt.Command, buf.Len())
+			c.localEcho(evt)
+		case <-end:
 			return
 		}
 	}
 }
 
-func (c *ConnImpl) pingLoop() {
-	defer c.Done()
-	mins := time.NewTicker(1 * time.Minute)
-	pingfreq := time.NewTicker(c.PingFreq)
-	defer mins.Stop()
-	defer pingfreq.Stop()
-	for {
-		select {
-		case <-mins.C:
-			c.Lock()
-			if time.Since(c.prevMsg) >= c.KeepAlive {
-				c.Ping()
-			}
-			c.Unlock()
-		case <-pingfreq.C:
-			c.Ping()
-			c.Lock()
-			if c.Nick != c.PreferredNick {
-				c.Nick = c.PreferredNick
-				c.SetNick(c.PreferredNick)
-			}
-			c.Unlock()
-		case <-c.end:
-			return
-		}
+// connectionLost reports a read or write error and drops the connection so that Loop reconnects. Errors caused by
+// disconnecting on purpose aren't reported.
+func (c *ConnImpl) connectionLost(end chan interface{}, err error) {
+	select {
+	case <-end:
+		return
+	default:
+	}
+	select {
+	case c.errors <- err:
+	default:
 	}
+	go c.disconnect(end)
 }
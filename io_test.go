@@ -0,0 +1,72 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSendDuringReconnect(t *testing.T) {
+	srv, c, client := startFake(t)
+	go c.Loop()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				err := c.Privmsg("#test", "hello")
+				if err != nil && err != ErrDisconnected {
+					t.Error("Unexpected error from Privmsg:", err)
+					return
+				}
+			}
+		}()
+	}
+
+	ctx := testContext(t)
+	for i := 0; i < 3; i++ {
+		client.Close()
+		var err error
+		client, err = srv.WaitRegistered(ctx)
+		if err != nil {
+			t.Fatal("Didn't reconnect:", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSendWhileDisconnected(t *testing.T) {
+	c := Create("tester", "tester", nil).(*ConnImpl)
+	if err := c.Privmsg("#test", "hello"); err != ErrDisconnected {
+		t.Errorf("Expected ErrDisconnected before connecting, got %v", err)
+	}
+	delivery := c.PrivmsgTracked("#test", "hello")
+	if _, err := delivery.Wait(testContext(t)); err != ErrDisconnected {
+		t.Errorf("Expected the delivery to fail with ErrDisconnected, got %v", err)
+	}
+}
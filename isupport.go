@@ -0,0 +1,96 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strconv"
+	"strings"
+)
+
+// rplISupport is the numeric servers use to advertise supported features.
+const rplISupport = "005"
+
+// GetISupport - See Data interface docs
+func (c *ConnImpl) GetISupport(key string) (value string, ok bool) {
+	c.isupportLock.RLock()
+	defer c.isupportLock.RUnlock()
+	value, ok = c.isupport[key]
+	return
+}
+
+// getISupportInt returns the value of the given ISUPPORT token as an integer, or the given default if the token
+// isn't set or isn't a valid integer.
+func (c *ConnImpl) getISupportInt(key string, def int) int {
+	value, ok := c.GetISupport(key)
+	if !ok {
+		return def
+	}
+	num, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return num
+}
+
+// handleISupport parses RPL_ISUPPORT messages.
+func (c *ConnImpl) handleISupport(evt *Event) {
+	params := evt.Args()
+	if len(params) < 3 {
+		return
+	}
+	mapping := c.CaseMapping()
+	c.isupportLock.Lock()
+	// The first parameter is our nick and the last one is the "are supported by this server" text.
+	for _, token := range params[1 : len(params)-1] {
+		if strings.HasPrefix(token, "-") {
+			delete(c.isupport, token[1:])
+			continue
+		}
+		parts := strings.SplitN(token, "=", 2)
+		if len(parts) == 1 {
+			c.isupport[parts[0]] = ""
+		} else {
+			c.isupport[parts[0]] = unescapeISupportValue(parts[1])
+		}
+	}
+	c.isupportLock.Unlock()
+	// The network name is a part of the cached logger.
+	c.resetLogger()
+	if c.CaseMapping() != mapping {
+		c.refoldNames()
+	}
+}
+
+// unescapeISupportValue decodes the \xHH escapes allowed in ISUPPORT values.
+func unescapeISupportValue(value string) string {
+	if !strings.Contains(value, "\\x") {
+		return value
+	}
+	var out []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+			if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, value[i])
+	}
+	return string(out)
+}
@@ -0,0 +1,73 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+)
+
+func TestHandleISupport(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.RunHandlers(ParseEvent(`:irc.example.com 005 tester CASEMAPPING=rfc1459 NICKLEN=20 NETWORK=Fake\x20Net ` +
+		`EXCEPTS MODES=x :are supported by this server`))
+	expected := map[string]string{
+		"CASEMAPPING": "rfc1459",
+		"NICKLEN":     "20",
+		"NETWORK":     "Fake Net",
+		"EXCEPTS":     "",
+		"MODES":       "x",
+	}
+	for key, value := range expected {
+		if actual, ok := c.GetISupport(key); !ok || actual != value {
+			t.Errorf("%s: expected %q, got %q (set: %t)", key, value, actual, ok)
+		}
+	}
+	if _, ok := c.GetISupport("are supported by this server"); ok {
+		t.Error("The trailing text was parsed as a token")
+	}
+	if nicklen := c.getISupportInt("NICKLEN", 0); nicklen != 20 {
+		t.Errorf("Expected NICKLEN 20, got %d", nicklen)
+	} else if modes := c.getISupportInt("MODES", 3); modes != 3 {
+		t.Errorf("Expected the default for an invalid integer, got %d", modes)
+	}
+	if mapping := c.CaseMapping(); mapping != CaseMappingRFC1459 {
+		t.Errorf("Expected rfc1459 case mapping, got %s", mapping)
+	}
+
+	c.RunHandlers(ParseEvent(":irc.example.com 005 tester -EXCEPTS -CASEMAPPING :are supported by this server"))
+	if _, ok := c.GetISupport("EXCEPTS"); ok {
+		t.Error("Negated token wasn't removed")
+	} else if mapping := c.CaseMapping(); mapping != DefaultCaseMapping {
+		t.Errorf("Expected the default case mapping after CASEMAPPING was removed, got %s", mapping)
+	}
+}
+
+func TestUnescapeISupportValue(t *testing.T) {
+	tests := map[string]string{
+		`plain`:          "plain",
+		`a\x20b`:         "a b",
+		`\x3D\x5c`:       `=\`,
+		`trailing\x2`:    `trailing\x2`,
+		`invalid\xZZend`: `invalid\xZZend`,
+	}
+	for input, expected := range tests {
+		if actual := unescapeISupportValue(input); actual != expected {
+			t.Errorf("%s: expected %q, got %q", input, expected, actual)
+		}
+	}
+}
@@ -21,15 +21,26 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sorcix/irc"
 )
 
 // Version is the IRC client version string
-var Version = "libmauirc 0.2"
+var Version = "libmauirc 0.3"
+
+// DefaultCaps is the list of IRCv3 capabilities requested by connections made with Create.
+var DefaultCaps = []string{
+	"batch", "labeled-response", "message-tags", "server-time",
+	"draft/chathistory", "chathistory",
+	"echo-message",
+	"away-notify", "account-notify", "extended-join", "chghost", "setname", "multi-prefix", "userhost-in-names",
+	CapZNCPlayback, CapZNCSelfMessage, CapZNCServerTimeISO,
+}
 
 // Debugger is something to send debug messages to
 type Debugger interface {
@@ -49,12 +60,26 @@ type Debugger interface {
 type Data interface {
 	GetNick() string
 	GetPreferredNick() string
+	// SetAltNicks sets the nicks to try in order if the preferred nick is taken while connecting.
+	SetAltNicks(nicks ...string)
+	// SetNickGenerator sets the function used to generate nicks after all the alternate nicks are taken.
+	SetNickGenerator(generator NickGenerator)
 	SetQuitMessage(msg string)
 	SetRealName(realname string)
 	SetVersion(version string)
 	SetUseTLS(tls bool)
+	SetLocalEcho(echo bool)
 	AddAuth(auth AuthHandler)
 	SetAddress(addr Address)
+	// SetDialer sets the function used to open the connection to the server instead of dialing TCP, such as an
+	// in-memory pipe for testing. TLS is still applied on top of the connection if enabled.
+	SetDialer(dialer Dialer)
+	// SetRecorder sets the recorder that every line sent and received is written to. Use nil to stop recording.
+	SetRecorder(recorder *Recorder)
+	// GetISupport returns the value of the given ISUPPORT token sent by the server.
+	GetISupport(key string) (value string, ok bool)
+	// CaseMapping returns the case mapping the server uses for nicks and channel names.
+	CaseMapping() CaseMapping
 }
 
 // Connectable contains functions to connect and disconnect
@@ -68,7 +93,7 @@ type Connectable interface {
 	Disconnect()
 	// Connected checks if the connection is active.
 	Connected() bool
-	// LocalAddr gets the local address of a connection
+	// LocalAddr gets the local address of a connection, or nil if the client isn't connected
 	LocalAddr() net.Addr
 }
 
@@ -77,12 +102,28 @@ type ErrorStream interface {
 	Errors() chan error
 }
 
+// Dialer opens a connection to the given address.
+type Dialer func(network, address string) (net.Conn, error)
+
 // Connection contains all the necessary interfaces for an IRC connection.
 // The default implementation is ConnImpl.
 type Connection interface {
 	Debugger
 	HandlerHandler
 	Tunnel
+	Querier
+	ChatHistory
+	StateTracker
+	Modes
+	Ignorer
+	CTCPResponders
+	DCC
+	Charsets
+	Logging
+	Metrics
+	ZNC
+	Presence
+	Capabilities
 	Data
 	Connectable
 	ErrorStream
@@ -100,27 +141,133 @@ type ConnImpl struct {
 	AutoreconnectTimeout time.Duration
 	prevMsg              time.Time
 
+	PongDeadline            time.Duration
+	DisconnectOnPingTimeout bool
+	pendingPings            []pendingPing
+	pingCounter             uint64
+	pingLock                sync.Mutex
+
 	Version       string
 	PreferredNick string
 	Nick          string
 	User          string
 	RealName      string
 	QuitMsg       string
-	Lag           int64
+
+	AltNicks             []string
+	NickGenerator        NickGenerator
+	MaxNickAttempts      int
+	NickRecovery         NickRecovery
+	MonitorPreferredNick bool
+	nickAttempt          int
+	nickMonitored        bool
+	nickRecoverySent     bool
+	nickGhostSent        bool
+	registered           bool
+	identified           bool
 
 	handlers map[string][]Handler
 	Auth     []AuthHandler
 	Address  Address
 
+	queries   []*query
+	queryLock sync.Mutex
+
+	wantedCaps     map[string]bool
+	availableCaps  map[string]string
+	enabledCaps    map[string]string
+	capRequests    int
+	capNegotiating bool
+	capEndHooks    []func()
+	capLock        sync.RWMutex
+
+	isupport     map[string]string
+	isupportLock sync.RWMutex
+
+	batches      map[string]*Batch
+	batchStarts  map[string]*Event
+	labels       map[string]*LabeledResponse
+	labelCounter uint64
+	labelLock    sync.Mutex
+
+	LocalEcho     bool
+	pendingEchoes []*pendingEcho
+	localEchoes   []*Event
+	echoSignal    chan struct{}
+	echoLock      sync.Mutex
+	dispatchLock  sync.Mutex
+	dispatcher    uint64
+
+	TrackState    bool
+	users         map[string]*User
+	channels      map[string]*channelState
+	stateLock     sync.RWMutex
+	typedHandlers []TypedHandler
+
+	FloodWindow        time.Duration
+	FloodMessages      int
+	FloodCTCPs         int
+	CTCPReplyLimit     int
+	AutoIgnoreDuration time.Duration
+	ignores            []IgnoreEntry
+	floodCounters      map[string]*floodCounter
+	ctcpReplies        []time.Time
+	ignoreLock         sync.Mutex
+
+	ctcpResponders map[string]CTCPResponder
+	ctcpLock       sync.RWMutex
+
+	FallbackCharset Charset
+	OutgoingCharset Charset
+	channelCharsets *CaseMap
+	charsetLock     sync.RWMutex
+
+	DCCChatPolicy  DCCPolicy
+	DCCAddress     net.IP
+	DCCTimeout     time.Duration
+	DCCSendPolicy  DCCPolicy
+	DCCDownloadDir string
+	DCCMaxSize     int64
+	DCCResume      bool
+	DCCProgress    func(transfer *DCCTransfer)
+	dccReplies     map[string]chan *DCCRequest
+	dccSends       map[string]*DCCTransfer
+	dccLock        sync.Mutex
+
+	playbackTime time.Time
+	zncLock      sync.Mutex
+
+	PresencePollInterval time.Duration
+	presence             map[string]*presenceTarget
+	presenceMethod       presenceMethod
+	presenceLimit        int
+	presenceStop         chan struct{}
+	presenceLock         sync.Mutex
+
+	LagHistorySize int
+	metrics        metrics
+	queued         int64
+	metricsLock    sync.Mutex
+
 	DebugWriter      io.Writer
 	reconnectAttempt int
 	stopped          bool
+	disconnecting    bool
 	quit             bool
 	UseTLS           bool
 	Autoreconnect    bool
 	TLSConfig        *tls.Config
+	Dialer           Dialer
+	Recorder         *Recorder
+	Logger           *slog.Logger
+	cachedLogger     *slog.Logger
+	cachedLoggerBase *slog.Logger
+	cachedLoggerConn uint64
+	loggerLock       sync.Mutex
+	connID           uint64
 	socket           net.Conn
-	output           chan *irc.Message
+	output           chan *Event
+	outputLock       sync.RWMutex
 	errors           chan error
 	disconnected     chan error
 	end              chan interface{}
@@ -130,21 +277,49 @@ type ConnImpl struct {
 // By default, RealName is set to the same value as user.
 func Create(nick, user string, addr Address) Connection {
 	c := &ConnImpl{
-		Nick:                 nick,
-		PreferredNick:        nick,
-		User:                 user,
-		RealName:             user,
-		Address:              addr,
-		Auth:                 make([]AuthHandler, 0),
-		handlers:             make(map[string][]Handler),
-		Version:              Version,
-		KeepAlive:            4 * time.Minute,
-		AutoreconnectTimeout: 7 * time.Minute,
-		Autoreconnect:        true,
-		Timeout:              1 * time.Minute,
-		PingFreq:             15 * time.Minute,
-		reconnectAttempt:     1,
-		QuitMsg:              Version,
+		Nick:                    nick,
+		PreferredNick:           nick,
+		User:                    user,
+		RealName:                user,
+		Address:                 addr,
+		Auth:                    make([]AuthHandler, 0),
+		handlers:                make(map[string][]Handler),
+		wantedCaps:              make(map[string]bool),
+		labels:                  make(map[string]*LabeledResponse),
+		Version:                 Version,
+		KeepAlive:               4 * time.Minute,
+		AutoreconnectTimeout:    7 * time.Minute,
+		Autoreconnect:           true,
+		Timeout:                 1 * time.Minute,
+		PingFreq:                15 * time.Minute,
+		PongDeadline:            2 * time.Minute,
+		DisconnectOnPingTimeout: true,
+		LagHistorySize:          60,
+		reconnectAttempt:        1,
+		QuitMsg:                 Version,
+		LocalEcho:               true,
+		TrackState:              true,
+		PresencePollInterval:    1 * time.Minute,
+		MaxNickAttempts:         10,
+		FloodWindow:             10 * time.Second,
+		FloodMessages:           20,
+		FloodCTCPs:              4,
+		CTCPReplyLimit:          10,
+		AutoIgnoreDuration:      5 * time.Minute,
+		floodCounters:           make(map[string]*floodCounter),
+		ctcpResponders:          make(map[string]CTCPResponder),
+		DCCTimeout:              2 * time.Minute,
+		DCCResume:               true,
+		dccReplies:              make(map[string]chan *DCCRequest),
+		dccSends:                make(map[string]*DCCTransfer),
+		FallbackCharset:         CharsetCP1252,
+		OutgoingCharset:         CharsetUTF8,
+		channelCharsets:         NewCaseMap(DefaultCaseMapping),
+		MonitorPreferredNick:    true,
+		presence:                make(map[string]*presenceTarget),
+	}
+	for _, cap := range DefaultCaps {
+		c.wantedCaps[cap] = true
 	}
 	c.AddStdHandlers()
 	return c
@@ -157,7 +332,7 @@ func (c *ConnImpl) Connect() error {
 
 	if c.Address == nil {
 		return ErrInvalidAddress
-	} else if len(c.Nick) == 0 {
+	} else if len(c.PreferredNick) == 0 {
 		return ErrInvalidNick
 	} else if len(c.User) == 0 {
 		return ErrInvalidUser
@@ -165,36 +340,77 @@ func (c *ConnImpl) Connect() error {
 		c.RealName = c.User
 	}
 
+	var socket net.Conn
 	var err error
-	if c.UseTLS {
+	if c.Dialer != nil {
+		socket, err = c.Dialer("tcp", c.Address.String())
+		if err == nil && c.UseTLS {
+			config := c.TLSConfig
+			if config == nil {
+				host, _, _ := net.SplitHostPort(c.Address.String())
+				config = &tls.Config{ServerName: host}
+			}
+			socket = tls.Client(socket, config)
+		}
+	} else if c.UseTLS {
 		dialer := &net.Dialer{Timeout: c.Timeout}
-		c.socket, err = tls.DialWithDialer(dialer, "tcp", c.Address.String(), c.TLSConfig)
+		socket, err = tls.DialWithDialer(dialer, "tcp", c.Address.String(), c.TLSConfig)
 	} else {
-		c.socket, err = net.DialTimeout("tcp", c.Address.String(), c.Timeout)
+		socket, err = net.DialTimeout("tcp", c.Address.String(), c.Timeout)
 	}
 	if err != nil {
-		c.Debugfln("Failed to connect to %s: %v", c.Address.String(), err)
+		c.log(slog.LevelError, CategoryReconnect, "Failed to connect to", slog.String("address", c.Address.String()), errAttr(err))
 		return ConnectionError{Cause: err}
 	}
-	c.Debugfln("Successfully connected to %s (%s)", c.Address.String(), c.socket.RemoteAddr().String())
+	c.log(slog.LevelInfo, CategoryReconnect, "Successfully connected to", slog.String("address", c.Address.String()),
+		slog.String("remote", socket.RemoteAddr().String()))
+	c.connID = atomic.AddUint64(&connectionCounter, 1)
+	atomic.StoreInt64(&c.queued, 0)
+	c.markConnected()
 
+	c.Lock()
+	c.socket = socket
 	c.stopped = false
-
 	c.end = make(chan interface{})
-	c.output = make(chan *irc.Message, 10)
+	c.output = make(chan *Event, 10)
+	c.Unlock()
+
 	c.errors = make(chan error, 2)
 	c.disconnected = make(chan error, 2)
+	c.echoSignal = make(chan struct{}, 1)
+	c.batches = make(map[string]*Batch)
+	c.batchStarts = make(map[string]*Event)
+	c.registered = false
+	c.identified = false
+	c.nickAttempt = 0
+	c.nickRecoverySent = false
+	c.nickGhostSent = false
+	c.resetCaps()
+	c.resetPings()
+	c.resetState()
+	c.isupportLock.Lock()
+	c.isupport = make(map[string]string)
+	c.isupportLock.Unlock()
 	c.Add(3)
 
 	go c.readLoop()
 	go c.writeLoop()
 	go c.pingLoop()
+	go c.echoLoop(c.echoSignal)
+
+	if c.capNegotiating {
+		c.Send(&irc.Message{
+			Command: "CAP",
+			Params:  []string{"LS", "302"},
+		})
+	}
 
 	for _, auth := range c.Auth {
 		auth.Do(c)
 	}
 
-	c.SetNick(c.Nick)
+	c.Nick = c.PreferredNick
+	c.sendNick(c.Nick)
 	c.SendUser()
 	return nil
 }
@@ -203,17 +419,14 @@ func (c *ConnImpl) Connect() error {
 func (c *ConnImpl) Loop() {
 	for !c.isQuitting() {
 		<-c.disconnected
-		if c.end != nil {
-			close(c.end)
-		}
 		c.Wait()
-		c.Debugfln("Disconnected from server")
+		c.log(slog.LevelInfo, CategoryReconnect, "Disconnected from server")
 		for !c.isQuitting() && !c.Connected() {
-			c.Debugln("Trying to reconnect...")
+			c.log(slog.LevelInfo, CategoryReconnect, "Trying to reconnect...")
 			if err := c.Connect(); err != nil {
 				c.Lock()
 				nextTime := time.Duration(15*c.reconnectAttempt) * time.Second
-				c.Debugfln("Trying again in %v", nextTime)
+				c.log(slog.LevelInfo, CategoryReconnect, "Trying again in", slog.Duration("delay", nextTime))
 				if c.reconnectAttempt < 20 {
 					c.reconnectAttempt++
 				}
@@ -221,30 +434,59 @@ func (c *ConnImpl) Loop() {
 				time.Sleep(nextTime)
 			} else {
 				c.reconnectAttempt = 1
+				c.markReconnected()
 				break
 			}
 		}
 	}
-	c.Debugln("Bye!")
+	c.log(slog.LevelInfo, CategoryReconnect, "Bye!")
 }
 
 // LocalAddr - see Connection interface docs
 func (c *ConnImpl) LocalAddr() net.Addr {
+	c.Lock()
+	defer c.Unlock()
+	if c.socket == nil || c.stopped {
+		return nil
+	}
 	return c.socket.LocalAddr()
 }
 
 // Disconnect - see Connection interface docs
 func (c *ConnImpl) Disconnect() {
-	defer recover()
-	c.end <- true
-	if c.output != nil {
-		close(c.output)
+	c.Lock()
+	end := c.end
+	c.Unlock()
+	c.disconnect(end)
+}
+
+// disconnect disconnects if the connection that the given end channel belongs to is still active. The read, write
+// and ping loops use this to drop their own connection without affecting a connection made after it.
+func (c *ConnImpl) disconnect(end chan interface{}) {
+	c.Lock()
+	if end == nil || end != c.end || c.stopped || c.disconnecting {
+		c.Unlock()
+		return
 	}
+	c.disconnecting = true
+	output := c.output
+	c.Unlock()
+
+	c.stopPresence()
+	close(end)
 	if c.socket != nil {
 		c.socket.Close()
 	}
 	c.Wait()
+	c.drainOutput(output)
+	c.Lock()
 	c.stopped = true
+	c.disconnecting = false
+	c.Unlock()
+	c.markDisconnected()
+	c.failQueries(ErrDisconnected)
+	c.failLabels(ErrDisconnected)
+	c.failEchoes(ErrDisconnected)
 	c.disconnected <- ErrDisconnected
 }
 
@@ -281,6 +523,11 @@ func (c *ConnImpl) SetUseTLS(tls bool) {
 	c.UseTLS = tls
 }
 
+// SetLocalEcho - see Data interface docs
+func (c *ConnImpl) SetLocalEcho(echo bool) {
+	c.LocalEcho = echo
+}
+
 // SetRealName - see Data interface docs
 func (c *ConnImpl) SetRealName(realname string) {
 	c.RealName = realname
@@ -306,6 +553,11 @@ func (c *ConnImpl) SetAddress(addr Address) {
 	c.Address = addr
 }
 
+// SetDialer - see Data interface docs
+func (c *ConnImpl) SetDialer(dialer Dialer) {
+	c.Dialer = dialer
+}
+
 // SetDebugWriter - see Debugger interface docs
 func (c *ConnImpl) SetDebugWriter(writer io.Writer) {
 	c.DebugWriter = writer
@@ -0,0 +1,113 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+// testTimeout is how long tests wait for something to happen on a fake server.
+const testTimeout = 5 * time.Second
+
+// testContext returns a context that's cancelled after testTimeout or when the test ends.
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// newFakeConn creates a connection that connects to the given fake server. The connection isn't connected yet, so
+// that handlers can be added and settings changed first.
+func newFakeConn(t *testing.T, srv *fakeirc.Server, nick string) *ConnImpl {
+	c := Create(nick, nick, IPv4Address{IP: "127.0.0.1", Port: 6667}).(*ConnImpl)
+	c.SetDialer(srv.Dial)
+	return c
+}
+
+// connectFake connects the given connection and waits until registration has completed on both ends.
+func connectFake(t *testing.T, srv *fakeirc.Server, c *ConnImpl) *fakeirc.Client {
+	t.Helper()
+	registered := make(chan struct{}, 1)
+	motd := func(evt *Event) {
+		select {
+		case registered <- struct{}{}:
+		default:
+		}
+	}
+	c.AddHandler(irc.RPL_ENDOFMOTD, motd)
+	c.AddHandler(irc.ERR_NOMOTD, motd)
+	if err := c.Connect(); err != nil {
+		t.Fatal("Failed to connect:", err)
+	}
+	t.Cleanup(func() {
+		c.Quit()
+		c.Disconnect()
+	})
+	ctx := testContext(t)
+	client, err := srv.WaitRegistered(ctx)
+	if err != nil {
+		t.Fatal("Client didn't register:", err)
+	}
+	select {
+	case <-registered:
+	case <-ctx.Done():
+		t.Fatal("Client didn't receive the end of the MOTD")
+	}
+	return client
+}
+
+// startFake creates a fake server and a connection to it, and waits until the connection has registered.
+func startFake(t *testing.T) (*fakeirc.Server, *ConnImpl, *fakeirc.Client) {
+	srv := fakeirc.NewServer()
+	t.Cleanup(srv.Close)
+	c := newFakeConn(t, srv, "tester")
+	client := connectFake(t, srv, c)
+	return srv, c, client
+}
+
+// newOfflineConn creates a connection whose output is collected by the test instead of being sent anywhere. Incoming
+// lines can be fed to it with RunHandlers, or with handleEvent if they may be part of a batch.
+func newOfflineConn(nick string) *ConnImpl {
+	c := Create(nick, nick, nil).(*ConnImpl)
+	c.resetCaps()
+	c.resetState()
+	c.isupport = make(map[string]string)
+	c.batches = make(map[string]*Batch)
+	c.batchStarts = make(map[string]*Event)
+	c.output = make(chan *Event, 100)
+	c.end = make(chan interface{})
+	return c
+}
+
+// sentLines returns the lines the given offline connection has sent since the last call.
+func sentLines(c *ConnImpl) (lines []string) {
+	for {
+		select {
+		case evt := <-c.output:
+			lines = append(lines, strings.TrimSpace(evt.String()))
+		default:
+			return
+		}
+	}
+}
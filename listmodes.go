@@ -0,0 +1,201 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Quiet list numerics
+const (
+	rplQuietList      = "728"
+	rplEndOfQuietList = "729"
+)
+
+// ListEntry is a single entry in a channel list mode such as the ban list.
+type ListEntry struct {
+	Mask   string
+	Setter string
+	Time   time.Time
+}
+
+// listNumerics are the reply numerics for each list mode.
+var listNumerics = map[byte][2]string{
+	'b': {irc.RPL_BANLIST, irc.RPL_ENDOFBANLIST},
+	'e': {irc.RPL_EXCEPTLIST, irc.RPL_ENDOFEXCEPTLIST},
+	'I': {irc.RPL_INVITELIST, irc.RPL_ENDOFINVITELIST},
+	'q': {rplQuietList, rplEndOfQuietList},
+}
+
+// ListModeSync - See Modes interface docs
+func (c *ConnImpl) ListModeSync(ctx context.Context, ch string, mode byte) ([]*ListEntry, error) {
+	numerics, ok := listNumerics[mode]
+	if !ok {
+		return nil, ErrModeNotSupported
+	}
+	var entries []*ListEntry
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		params := evt.Args()
+		if len(params) < 2 || !c.equalName(params[1], ch) {
+			return false, false
+		}
+		switch evt.Command {
+		case numerics[0]:
+			params = params[2:]
+			if evt.Command == rplQuietList && len(params) > 0 {
+				// The quiet list reply contains the mode letter before the mask.
+				params = params[1:]
+			}
+			if len(params) > 0 {
+				entries = append(entries, parseListEntry(params))
+			}
+			return true, false
+		case numerics[1]:
+			return true, true
+		case irc.ERR_CHANOPRIVSNEEDED, irc.ERR_NOSUCHCHANNEL, irc.ERR_NOTONCHANNEL:
+			q.err = queryError(evt.Message)
+			return true, true
+		}
+		return false, false
+	}
+	err := c.runQuery(ctx, q, &irc.Message{
+		Command: irc.MODE,
+		Params:  []string{ch, string(mode)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.setModeList(ch, mode, entries)
+	return entries, nil
+}
+
+// parseListEntry parses the mask, setter and timestamp parameters of a list mode reply.
+func parseListEntry(params []string) *ListEntry {
+	entry := &ListEntry{Mask: params[0]}
+	if len(params) > 1 {
+		entry.Setter = params[1]
+	}
+	if len(params) > 2 {
+		if ts, err := strconv.ParseInt(params[2], 10, 64); err == nil {
+			entry.Time = time.Unix(ts, 0)
+		}
+	}
+	return entry
+}
+
+// BanListSync - See Modes interface docs
+func (c *ConnImpl) BanListSync(ctx context.Context, ch string) ([]*ListEntry, error) {
+	return c.ListModeSync(ctx, ch, 'b')
+}
+
+// ExceptListSync - See Modes interface docs
+func (c *ConnImpl) ExceptListSync(ctx context.Context, ch string) ([]*ListEntry, error) {
+	return c.ListModeSync(ctx, ch, 'e')
+}
+
+// InviteListSync - See Modes interface docs
+func (c *ConnImpl) InviteListSync(ctx context.Context, ch string) ([]*ListEntry, error) {
+	return c.ListModeSync(ctx, ch, 'I')
+}
+
+// QuietListSync - See Modes interface docs
+func (c *ConnImpl) QuietListSync(ctx context.Context, ch string) ([]*ListEntry, error) {
+	mode, prefix, err := c.quietMode()
+	if err != nil {
+		return nil, err
+	} else if len(prefix) == 0 {
+		return c.ListModeSync(ctx, ch, mode)
+	}
+	// Quiets are stored in the ban list as extbans.
+	bans, err := c.ListModeSync(ctx, ch, mode)
+	if err != nil {
+		return nil, err
+	}
+	var quiets []*ListEntry
+	for _, ban := range bans {
+		if strings.HasPrefix(ban.Mask, prefix) {
+			quiet := *ban
+			quiet.Mask = ban.Mask[len(prefix):]
+			quiets = append(quiets, &quiet)
+		}
+	}
+	return quiets, nil
+}
+
+// GetModeList - See StateTracker interface docs
+func (c *ConnImpl) GetModeList(ch string, mode byte) ([]*ListEntry, bool) {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	channel, ok := c.channels[c.foldName(ch)]
+	if !ok {
+		return nil, false
+	}
+	list, ok := channel.lists[mode]
+	if !ok {
+		return nil, false
+	}
+	entries := make([]*ListEntry, len(list))
+	for i, entry := range list {
+		cp := *entry
+		entries[i] = &cp
+	}
+	return entries, true
+}
+
+// setModeList stores the fetched list in the tracked state of the channel, so it can be kept up to date from MODE
+// changes.
+func (c *ConnImpl) setModeList(ch string, mode byte, entries []*ListEntry) {
+	if !c.TrackState {
+		return
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if channel, ok := c.channels[c.foldName(ch)]; ok {
+		list := make([]*ListEntry, len(entries))
+		for i, entry := range entries {
+			cp := *entry
+			list[i] = &cp
+		}
+		channel.lists[mode] = list
+	}
+}
+
+// updateModeList applies a list mode change to the tracked list if the list has been fetched. Masks are compared with
+// the case mapping of the server. The caller must hold the state lock.
+func (c *ConnImpl) updateModeList(ch *channelState, change ModeChange, setter string, at time.Time) {
+	list, ok := ch.lists[change.Mode]
+	if !ok || len(change.Arg) == 0 {
+		return
+	}
+	for i, entry := range list {
+		if c.equalName(entry.Mask, change.Arg) {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if change.Add {
+		list = append(list, &ListEntry{Mask: change.Arg, Setter: setter, Time: at})
+	}
+	ch.lists[change.Mode] = list
+}
@@ -0,0 +1,149 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newListModeConn creates an offline connection that has joined #chan on a server with the given CHANMODES.
+func newListModeConn(chanmodes string) *ConnImpl {
+	c := newOfflineConn("tester")
+	c.isupport["CHANMODES"] = chanmodes
+	feedLines(c,
+		":tester!t@me.example JOIN #chan",
+		":irc.example.com 353 tester = #chan :@tester")
+	return c
+}
+
+// fetchModeList runs the given list fetching function and answers the request with the given lines.
+func fetchModeList(t *testing.T, c *ConnImpl, request string, fetch func() ([]*ListEntry, error),
+	lines ...string) ([]*ListEntry, error) {
+	t.Helper()
+	type result struct {
+		entries []*ListEntry
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		entries, err := fetch()
+		done <- result{entries, err}
+	}()
+	if sent := waitSent(t, c); sent.String() != request {
+		t.Fatalf("Expected %q to be sent, got %q", request, sent.String())
+	}
+	feedLines(c, lines...)
+	res := <-done
+	return res.entries, res.err
+}
+
+func TestListModeSync(t *testing.T) {
+	tests := []struct {
+		mode  byte
+		entry string
+		end   string
+	}{
+		{'b', "367 tester #chan", "368 tester #chan :End of channel ban list"},
+		{'e', "348 tester #chan", "349 tester #chan :End of channel exception list"},
+		{'I', "346 tester #chan", "347 tester #chan :End of channel invite list"},
+		{'q', "728 tester #chan q", "729 tester #chan q :End of channel quiet list"},
+	}
+	for _, test := range tests {
+		c := newListModeConn("beIq,k,l,imnpst")
+		entries, err := fetchModeList(t, c, "MODE #chan "+string(test.mode), func() ([]*ListEntry, error) {
+			return c.ListModeSync(context.Background(), "#chan", test.mode)
+		},
+			":irc.example.com "+test.entry+" *!*@spam.example op!o@o.example 1577836800",
+			":irc.example.com 367 tester #other *!*@other.example",
+			":irc.example.com "+test.entry+" nick!*@*",
+			":irc.example.com "+test.end)
+		if err != nil {
+			t.Errorf("Mode %c: %v", test.mode, err)
+			continue
+		} else if len(entries) != 2 {
+			t.Errorf("Mode %c: expected 2 entries, got %d", test.mode, len(entries))
+			continue
+		}
+		first := entries[0]
+		if first.Mask != "*!*@spam.example" || first.Setter != "op!o@o.example" || first.Time.Unix() != 1577836800 {
+			t.Errorf("Mode %c: unexpected first entry %+v", test.mode, first)
+		} else if entries[1].Mask != "nick!*@*" || len(entries[1].Setter) != 0 || !entries[1].Time.IsZero() {
+			t.Errorf("Mode %c: unexpected second entry %+v", test.mode, entries[1])
+		}
+		if cached, ok := c.GetModeList("#chan", test.mode); !ok || len(cached) != 2 {
+			t.Errorf("Mode %c: list wasn't cached: %+v", test.mode, cached)
+		}
+	}
+}
+
+func TestListModeSyncErrors(t *testing.T) {
+	c := newListModeConn("beI,k,l,imnpst")
+	_, err := fetchModeList(t, c, "MODE #chan e", func() ([]*ListEntry, error) {
+		return c.ExceptListSync(context.Background(), "#chan")
+	}, ":irc.example.com 482 tester #chan :You're not a channel operator")
+	if err == nil {
+		t.Error("Expected an error when the list can't be viewed")
+	}
+	if _, err = c.ListModeSync(context.Background(), "#chan", 'x'); err != ErrModeNotSupported {
+		t.Errorf("Expected ErrModeNotSupported for an unknown list, got %v", err)
+	}
+}
+
+func TestQuietListExtban(t *testing.T) {
+	c := newListModeConn("beI,k,l,imnpst")
+	c.isupport["EXTBAN"] = "$,qa"
+	quiets, err := fetchModeList(t, c, "MODE #chan b", func() ([]*ListEntry, error) {
+		return c.QuietListSync(context.Background(), "#chan")
+	},
+		":irc.example.com 367 tester #chan $q:*!*@noisy.example op 1577836800",
+		":irc.example.com 367 tester #chan *!*@banned.example op 1577836800",
+		":irc.example.com 368 tester #chan :End of channel ban list")
+	if err != nil {
+		t.Fatal("QuietListSync failed:", err)
+	} else if len(quiets) != 1 || quiets[0].Mask != "*!*@noisy.example" {
+		t.Errorf("Unexpected quiets: %+v", quiets)
+	}
+}
+
+func TestModeListUpdates(t *testing.T) {
+	c := newListModeConn("beI,k,l,imnpst")
+	if _, ok := c.GetModeList("#chan", 'b'); ok {
+		t.Error("Ban list is known before fetching it")
+	}
+	_, err := fetchModeList(t, c, "MODE #chan b", func() ([]*ListEntry, error) {
+		return c.BanListSync(context.Background(), "#chan")
+	},
+		":irc.example.com 367 tester #chan *!*@host.example op 1577836800",
+		":irc.example.com 367 tester #chan spammer!*@* op 1577836800",
+		":irc.example.com 368 tester #chan :End of channel ban list")
+	if err != nil {
+		t.Fatal("BanListSync failed:", err)
+	}
+	at := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	feedLines(c,
+		"@time=2020-01-01T00:00:00.000Z :op!o@o.example MODE #chan -b+b *!*@Host.Example new!*@*",
+		":op!o@o.example MODE #chan -b SPAMMER!*@*")
+	bans, _ := c.GetModeList("#chan", 'b')
+	if len(bans) != 1 {
+		t.Fatalf("Expected 1 ban after the changes, got %+v", bans)
+	} else if bans[0].Mask != "new!*@*" || bans[0].Setter != "op" || !bans[0].Time.Equal(at) {
+		t.Errorf("Unexpected ban %+v", bans[0])
+	}
+}
@@ -18,25 +18,36 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 
 	msg "github.com/sorcix/irc"
 	"github.com/sorcix/irc/ctcp"
 	irc "maunium.net/go/libmauirc"
+	"maunium.net/go/libmauirc/fakeirc"
+	"maunium.net/go/libmauirc/format"
+	"maunium.net/go/libmauirc/prometheus"
 	flag "maunium.net/go/mauflag"
 )
 
 var ip = flag.Make().ShortKey("a").LongKey("address").Usage("The address to connect to.").String()
 var port = flag.Make().ShortKey("p").LongKey("port").Usage("The port to connect to.").Uint16()
 var tls = flag.Make().ShortKey("s").LongKey("ssl").LongKey("tls").Usage("Whether or not to enable TLS.").Bool()
+var serve = flag.Make().ShortKey("S").LongKey("serve").Usage("Whether or not to start a fake IRC server on the address and connect to it.").Bool()
+var record = flag.Make().ShortKey("r").LongKey("record").Usage("The file to record the traffic to as JSON lines.").String()
+var metrics = flag.Make().ShortKey("m").LongKey("metrics").Usage("The address to serve Prometheus metrics on.").String()
+var ansi = flag.Make().ShortKey("f").LongKey("format").Usage("Whether or not to render IRC formatting with ANSI escape codes.").Bool()
 var wantHelp, _ = flag.MakeHelpFlag()
 
 func main() {
 	err := flag.Parse()
-	flag.SetHelpTitles("lmitest - A simple program to test libmauirc.", "lmitest [-h] [-s] [-a IP ADDRESS] [-p PORT]")
+	flag.SetHelpTitles("lmitest - A simple program to test libmauirc.", "lmitest [-h] [-s] [-S] [-f] [-r FILE] [-m METRICS ADDRESS] [-a IP ADDRESS] [-p PORT]")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		flag.PrintHelp()
@@ -46,10 +57,36 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *serve {
+		startServer()
+	}
+
 	c := irc.Create("lmitest", "lmitest", irc.IPv4Address{IP: *ip, Port: *port})
 	c.SetRealName("libmauirc tester")
-	c.SetDebugWriter(os.Stdout)
+	if *ansi {
+		c.SetDebugWriter(ansiWriter{os.Stdout})
+	} else {
+		c.SetDebugWriter(os.Stdout)
+	}
 	c.SetUseTLS(*tls)
+	if len(*record) > 0 {
+		file, err := os.OpenFile(*record, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to open recording file:", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		c.SetRecorder(irc.NewRecorder(file))
+	}
+
+	if len(*metrics) > 0 {
+		exporter := prometheus.NewExporter()
+		exporter.Add("lmitest", c)
+		go func() {
+			err := http.ListenAndServe(*metrics, exporter)
+			fmt.Fprintln(os.Stderr, "Failed to serve metrics:", err)
+		}()
+	}
 
 	err = c.Connect()
 	if err != nil {
@@ -91,10 +128,41 @@ func main() {
 	for {
 		text, _ := reader.ReadString('\n')
 		send := msg.ParseMessage(text)
-		if strings.HasPrefix(send.Command, "CTCP_") {
+		if send == nil {
+			continue
+		} else if strings.HasPrefix(send.Command, "CTCP_") {
 			send.Trailing = ctcp.Encode(send.Command[len("CTCP_"):], send.Trailing)
 			send.Command = msg.PRIVMSG
 		}
-		c.Send(send)
+		if err := c.Send(send); err != nil {
+			fmt.Fprintln(os.Stderr, "[Error]", err)
+		}
+	}
+}
+
+// startServer starts a fake IRC server on the address given in the flags and points the flags at it. If the port is
+// zero, a random free port is used.
+func startServer() {
+	if len(*ip) == 0 {
+		*ip = "127.0.0.1"
+	}
+	srv := fakeirc.NewServer()
+	err := srv.Listen(net.JoinHostPort(*ip, strconv.Itoa(int(*port))))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start server:", err)
+		os.Exit(1)
 	}
+	*port = uint16(srv.Addr().(*net.TCPAddr).Port)
+	*tls = false
+	fmt.Println("Fake IRC server listening on", srv.Addr())
+}
+
+// ansiWriter converts IRC formatting codes into ANSI escape codes before writing to the terminal.
+type ansiWriter struct {
+	io.Writer
+}
+
+func (w ansiWriter) Write(data []byte) (int, error) {
+	_, err := io.WriteString(w.Writer, format.ToANSI(string(data)))
+	return len(data), err
 }
@@ -0,0 +1,178 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Logging contains functions to configure the structured logging of the connection.
+//
+// Every record has a category attribute and the conn and network attributes of the connection. Raw lines are logged
+// at LevelTrace with secrets redacted by RedactLine. If no logger is set, the records are written to the debug writer
+// in the old plain text format.
+type Logging interface {
+	// SetLogger sets the logger to write the logs of the connection to.
+	SetLogger(logger *slog.Logger)
+	// GetLogger returns the logger of the connection with the connection attributes added.
+	GetLogger() *slog.Logger
+}
+
+// LevelTrace is the log level of raw lines sent and received.
+const LevelTrace = slog.LevelDebug - 4
+
+// Log categories
+const (
+	CategoryIO        = "io"
+	CategoryHandlers  = "handlers"
+	CategoryReconnect = "reconnect"
+	CategoryDCC       = "dcc"
+)
+
+// Log attribute keys
+const (
+	LogKeyCategory = "category"
+	LogKeyConn     = "conn"
+	LogKeyNetwork  = "network"
+	LogKeyLine     = "line"
+)
+
+// SetLogger - see Logging interface docs
+func (c *ConnImpl) SetLogger(logger *slog.Logger) {
+	c.loggerLock.Lock()
+	c.Logger = logger
+	c.cachedLogger = nil
+	c.loggerLock.Unlock()
+}
+
+// GetLogger - see Logging interface docs
+func (c *ConnImpl) GetLogger() *slog.Logger {
+	c.loggerLock.Lock()
+	defer c.loggerLock.Unlock()
+	return c.attributedLogger()
+}
+
+// attributedLogger returns the logger with the connection attributes. The logger is cached until the logger, the
+// connection ID or the network name changes. The caller must hold the logger lock.
+func (c *ConnImpl) attributedLogger() *slog.Logger {
+	if c.cachedLogger == nil || c.cachedLoggerBase != c.Logger || c.cachedLoggerConn != c.connID {
+		base := c.Logger
+		if base == nil {
+			base = slog.New(&debugHandler{conn: c})
+		}
+		c.cachedLogger = base.With(slog.Uint64(LogKeyConn, c.connID), slog.String(LogKeyNetwork, c.networkName()))
+		c.cachedLoggerBase, c.cachedLoggerConn = c.Logger, c.connID
+	}
+	return c.cachedLogger
+}
+
+// resetLogger makes the attributed logger be rebuilt, e.g. after the network name changes.
+func (c *ConnImpl) resetLogger() {
+	c.loggerLock.Lock()
+	c.cachedLogger = nil
+	c.loggerLock.Unlock()
+}
+
+// networkName returns the name of the network from ISUPPORT, or the address if the server hasn't sent it.
+func (c *ConnImpl) networkName() string {
+	if network, ok := c.GetISupport("NETWORK"); ok && len(network) > 0 {
+		return network
+	} else if c.Address != nil {
+		return c.Address.String()
+	}
+	return ""
+}
+
+// enabledLogger returns the logger of the connection if it logs records at the given level.
+func (c *ConnImpl) enabledLogger(level slog.Level) (*slog.Logger, bool) {
+	c.loggerLock.Lock()
+	if c.Logger == nil && c.DebugWriter == nil {
+		c.loggerLock.Unlock()
+		return nil, false
+	}
+	logger := c.attributedLogger()
+	c.loggerLock.Unlock()
+	return logger, logger.Enabled(context.Background(), level)
+}
+
+// log writes a log record in the given category. The arguments are key-value pairs or slog.Attrs like in slog.
+func (c *ConnImpl) log(level slog.Level, category, msg string, args ...interface{}) {
+	if logger, ok := c.enabledLogger(level); ok {
+		logger.Log(context.Background(), level, msg, append([]interface{}{slog.String(LogKeyCategory, category)}, args...)...)
+	}
+}
+
+// logLine writes a raw line sent or received to the log with secrets redacted. Lines are only redacted if the trace
+// level is enabled.
+func (c *ConnImpl) logLine(dir, line string) {
+	if logger, ok := c.enabledLogger(LevelTrace); ok {
+		logger.Log(context.Background(), LevelTrace, dir, slog.String(LogKeyCategory, CategoryIO),
+			slog.String(LogKeyLine, RedactLine(line)))
+	}
+}
+
+// debugHandler is a slog.Handler that writes records to the debug writer of a connection in the plain text format
+// used before structured logging: the message followed by the attribute values. The connection attributes are left
+// out.
+type debugHandler struct {
+	conn  *ConnImpl
+	attrs []slog.Attr
+}
+
+func (h *debugHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.conn.DebugWriter != nil
+}
+
+func (h *debugHandler) Handle(ctx context.Context, record slog.Record) error {
+	writer := h.conn.DebugWriter
+	if writer == nil {
+		return nil
+	}
+	parts := []string{record.Message}
+	addAttr := func(attr slog.Attr) bool {
+		switch attr.Key {
+		case LogKeyCategory, LogKeyConn, LogKeyNetwork:
+		default:
+			parts = append(parts, attr.Value.String())
+		}
+		return true
+	}
+	for _, attr := range h.attrs {
+		addAttr(attr)
+	}
+	record.Attrs(addAttr)
+	_, err := io.WriteString(writer, strings.Join(parts, " ")+"\n")
+	return err
+}
+
+func (h *debugHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &debugHandler{conn: h.conn, attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...)}
+}
+
+func (h *debugHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// errAttr returns an attribute for the given error.
+func errAttr(err error) slog.Attr {
+	return slog.String("error", fmt.Sprint(err))
+}
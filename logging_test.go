@@ -0,0 +1,136 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// countingHandler is a slog.Handler that counts the records it's asked to handle.
+type countingHandler struct {
+	level   slog.Level
+	handled int
+}
+
+func (h *countingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *countingHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.handled++
+	return nil
+}
+
+func (h *countingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h
+}
+
+func (h *countingHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// newLoggedConn creates an offline connection that logs everything to the returned buffer.
+func newLoggedConn() (*ConnImpl, *bytes.Buffer) {
+	c := newOfflineConn("tester")
+	var buf bytes.Buffer
+	c.SetLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: LevelTrace})))
+	return c, &buf
+}
+
+func TestLogLineRedacts(t *testing.T) {
+	c, buf := newLoggedConn()
+	c.logLine("-->", "PASS hunter2")
+	if strings.Contains(buf.String(), "hunter2") || !strings.Contains(buf.String(), redacted) {
+		t.Errorf("Password wasn't redacted: %s", buf.String())
+	} else if !strings.Contains(buf.String(), LogKeyCategory+"="+CategoryIO) {
+		t.Errorf("Line wasn't logged in the io category: %s", buf.String())
+	}
+}
+
+func TestLogSkipsDisabledLevels(t *testing.T) {
+	c := newOfflineConn("tester")
+	handler := &countingHandler{level: slog.LevelInfo}
+	c.SetLogger(slog.New(handler))
+	c.logLine("-->", "PRIVMSG #chan :hello")
+	c.log(slog.LevelDebug, CategoryIO, "debug")
+	if handler.handled != 0 {
+		t.Errorf("Expected records below the level to be skipped, %d were handled", handler.handled)
+	}
+	c.log(slog.LevelInfo, CategoryIO, "info")
+	if handler.handled != 1 {
+		t.Errorf("Expected an info record to be handled, %d were handled", handler.handled)
+	}
+}
+
+func TestLoggerCache(t *testing.T) {
+	c, buf := newLoggedConn()
+	logger := c.GetLogger()
+	if c.GetLogger() != logger {
+		t.Error("Logger wasn't cached")
+	}
+	feedLines(c, ":irc.example 005 tester NETWORK=ExampleNet :are supported by this server")
+	if c.GetLogger() == logger {
+		t.Error("Logger wasn't rebuilt after the network name changed")
+	}
+	c.log(slog.LevelInfo, CategoryReconnect, "hello")
+	if !strings.Contains(buf.String(), LogKeyNetwork+"=ExampleNet") {
+		t.Errorf("Record doesn't have the new network name: %s", buf.String())
+	}
+	c.SetLogger(slog.New(&countingHandler{}))
+	if c.GetLogger() == logger {
+		t.Error("Logger wasn't rebuilt after changing the logger")
+	}
+}
+
+func TestHandlerPanicLogged(t *testing.T) {
+	c, buf := newLoggedConn()
+	var ran bool
+	c.AddHandler("PRIVMSG", func(evt *Event) {
+		panic("broken handler")
+	})
+	c.AddHandler("PRIVMSG", func(evt *Event) {
+		ran = true
+	})
+	feedLines(c, ":someone!s@host.example PRIVMSG tester :hello")
+	if !ran {
+		t.Error("Handler after the panicking one didn't run")
+	} else if !strings.Contains(buf.String(), "Handler panicked") || !strings.Contains(buf.String(), "broken handler") {
+		t.Errorf("Panic wasn't logged: %s", buf.String())
+	} else if !strings.Contains(buf.String(), LogKeyCategory+"="+CategoryHandlers) {
+		t.Errorf("Panic wasn't logged in the handlers category: %s", buf.String())
+	}
+}
+
+func TestDroppedEventLogged(t *testing.T) {
+	c, buf := newLoggedConn()
+	c.Ignore("*!*@host.example", IgnorePrivmsg, 0)
+	var ran bool
+	c.AddHandler("PRIVMSG", func(evt *Event) {
+		ran = true
+	})
+	feedLines(c, ":someone!s@host.example PRIVMSG tester :hello")
+	if ran {
+		t.Error("Ignored message reached handlers")
+	} else if !strings.Contains(buf.String(), "Dropped ignored event") {
+		t.Errorf("Dropped event wasn't logged: %s", buf.String())
+	}
+}
@@ -0,0 +1,189 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Metrics contains functions to read the traffic and lag measurements of the connection.
+type Metrics interface {
+	// Stats returns a snapshot of the metrics of the connection.
+	Stats() Stats
+	// GetLag returns the round-trip time of the latest PING that got a PONG back, or zero if none have.
+	GetLag() time.Duration
+}
+
+// TrafficStats contains line and byte counters in both directions.
+type TrafficStats struct {
+	LinesIn  uint64
+	LinesOut uint64
+	BytesIn  uint64
+	BytesOut uint64
+}
+
+// LagSample is a single lag measurement.
+type LagSample struct {
+	Time time.Time
+	Lag  time.Duration
+}
+
+// LagStats contains the recent lag measurements and their minimum, average and maximum.
+type LagStats struct {
+	Last    time.Duration
+	Min     time.Duration
+	Avg     time.Duration
+	Max     time.Duration
+	Samples []LagSample
+}
+
+// Stats is a snapshot of the metrics of a connection. The counters are cumulative over reconnects.
+type Stats struct {
+	TrafficStats
+	// Commands contains the traffic counters of each command. Numerics are counted by their number.
+	Commands map[string]TrafficStats
+	// QueueDepth is the number of messages waiting to be sent.
+	QueueDepth int
+	// Reconnects is the number of times Loop has reconnected after a disconnection.
+	Reconnects uint64
+	// Connected is true if the connection is currently active.
+	Connected bool
+	// ConnectedSince is the time the current connection was made. It's zero if not connected.
+	ConnectedSince time.Time
+	// TimeConnected is the total time the connection has been active, including the current connection.
+	TimeConnected time.Duration
+	Lag           LagStats
+}
+
+// metrics contains the measurements behind Stats.
+type metrics struct {
+	traffic        TrafficStats
+	commands       map[string]*TrafficStats
+	reconnects     uint64
+	connectedSince time.Time
+	timeConnected  time.Duration
+	lag            []LagSample
+}
+
+// countLine adds a line sent or received to the traffic counters.
+func (c *ConnImpl) countLine(dir Direction, command string, bytes int) {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	if c.metrics.commands == nil {
+		c.metrics.commands = make(map[string]*TrafficStats)
+	}
+	cmdStats, ok := c.metrics.commands[command]
+	if !ok {
+		cmdStats = &TrafficStats{}
+		c.metrics.commands[command] = cmdStats
+	}
+	for _, stats := range []*TrafficStats{&c.metrics.traffic, cmdStats} {
+		if dir == DirectionIn {
+			stats.LinesIn++
+			stats.BytesIn += uint64(bytes)
+		} else {
+			stats.LinesOut++
+			stats.BytesOut += uint64(bytes)
+		}
+	}
+}
+
+// addLag adds a lag measurement to the lag history. Old measurements are removed when there are more than
+// LagHistorySize of them.
+func (c *ConnImpl) addLag(lag time.Duration) {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	c.metrics.lag = append(c.metrics.lag, LagSample{Time: time.Now(), Lag: lag})
+	if c.LagHistorySize > 0 && len(c.metrics.lag) > c.LagHistorySize {
+		c.metrics.lag = append(c.metrics.lag[:0:0], c.metrics.lag[len(c.metrics.lag)-c.LagHistorySize:]...)
+	}
+}
+
+// markConnected starts measuring the time connected.
+func (c *ConnImpl) markConnected() {
+	c.metricsLock.Lock()
+	c.metrics.connectedSince = time.Now()
+	c.metricsLock.Unlock()
+}
+
+// markDisconnected stops measuring the time connected.
+func (c *ConnImpl) markDisconnected() {
+	c.metricsLock.Lock()
+	if !c.metrics.connectedSince.IsZero() {
+		c.metrics.timeConnected += time.Since(c.metrics.connectedSince)
+		c.metrics.connectedSince = time.Time{}
+	}
+	c.metricsLock.Unlock()
+}
+
+// markReconnected counts a successful reconnect.
+func (c *ConnImpl) markReconnected() {
+	c.metricsLock.Lock()
+	c.metrics.reconnects++
+	c.metricsLock.Unlock()
+}
+
+// Stats - see Metrics interface docs
+func (c *ConnImpl) Stats() Stats {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	stats := Stats{
+		TrafficStats:   c.metrics.traffic,
+		Commands:       make(map[string]TrafficStats, len(c.metrics.commands)),
+		QueueDepth:     int(atomic.LoadInt64(&c.queued)),
+		Reconnects:     c.metrics.reconnects,
+		Connected:      !c.metrics.connectedSince.IsZero(),
+		ConnectedSince: c.metrics.connectedSince,
+		TimeConnected:  c.metrics.timeConnected,
+	}
+	for command, cmdStats := range c.metrics.commands {
+		stats.Commands[command] = *cmdStats
+	}
+	if stats.Connected {
+		stats.TimeConnected += time.Since(stats.ConnectedSince)
+	}
+	if len(c.metrics.lag) > 0 {
+		lag := &stats.Lag
+		lag.Samples = append([]LagSample(nil), c.metrics.lag...)
+		lag.Last = lag.Samples[len(lag.Samples)-1].Lag
+		lag.Min, lag.Max = lag.Last, lag.Last
+		var total time.Duration
+		for _, sample := range lag.Samples {
+			total += sample.Lag
+			if sample.Lag < lag.Min {
+				lag.Min = sample.Lag
+			}
+			if sample.Lag > lag.Max {
+				lag.Max = sample.Lag
+			}
+		}
+		lag.Avg = total / time.Duration(len(lag.Samples))
+	}
+	return stats
+}
+
+// GetLag - see Metrics interface docs
+func (c *ConnImpl) GetLag() time.Duration {
+	c.metricsLock.Lock()
+	defer c.metricsLock.Unlock()
+	if len(c.metrics.lag) == 0 {
+		return 0
+	}
+	return c.metrics.lag[len(c.metrics.lag)-1].Lag
+}
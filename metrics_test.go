@@ -0,0 +1,129 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsCounters(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.countLine(DirectionIn, "PRIVMSG", 40)
+	c.countLine(DirectionIn, "PRIVMSG", 60)
+	c.countLine(DirectionOut, "PRIVMSG", 30)
+	c.countLine(DirectionIn, "001", 50)
+	c.countLine(DirectionIn, "", 10)
+	stats := c.Stats()
+	expected := TrafficStats{LinesIn: 4, LinesOut: 1, BytesIn: 160, BytesOut: 30}
+	if stats.TrafficStats != expected {
+		t.Errorf("Expected totals %+v, got %+v", expected, stats.TrafficStats)
+	}
+	expectedCommands := map[string]TrafficStats{
+		"PRIVMSG": {LinesIn: 2, LinesOut: 1, BytesIn: 100, BytesOut: 30},
+		"001":     {LinesIn: 1, BytesIn: 50},
+		"":        {LinesIn: 1, BytesIn: 10},
+	}
+	if len(stats.Commands) != len(expectedCommands) {
+		t.Errorf("Expected %d commands, got %+v", len(expectedCommands), stats.Commands)
+	}
+	for command, expected := range expectedCommands {
+		if actual := stats.Commands[command]; actual != expected {
+			t.Errorf("%q: expected %+v, got %+v", command, expected, actual)
+		}
+	}
+	// The snapshot must not change when more lines are counted.
+	c.countLine(DirectionOut, "PRIVMSG", 30)
+	if stats.Commands["PRIVMSG"].LinesOut != 1 {
+		t.Error("Snapshot changed after counting another line")
+	}
+}
+
+func TestStatsConnection(t *testing.T) {
+	_, c, _ := startFake(t)
+	stats := c.Stats()
+	if !stats.Connected || stats.ConnectedSince.IsZero() || stats.TimeConnected <= 0 {
+		t.Errorf("Expected an active connection, got %+v", stats)
+	}
+	if nick := stats.Commands["NICK"]; nick.LinesOut != 1 || nick.BytesOut != uint64(len("NICK tester\r\n")) {
+		t.Errorf("Unexpected NICK counters %+v", nick)
+	}
+	if welcome := stats.Commands["001"]; welcome.LinesIn != 1 || welcome.BytesIn == 0 {
+		t.Errorf("Unexpected 001 counters %+v", welcome)
+	}
+	var sum TrafficStats
+	for _, cmdStats := range stats.Commands {
+		sum.LinesIn += cmdStats.LinesIn
+		sum.LinesOut += cmdStats.LinesOut
+		sum.BytesIn += cmdStats.BytesIn
+		sum.BytesOut += cmdStats.BytesOut
+	}
+	if sum != stats.TrafficStats {
+		t.Errorf("Command counters %+v don't add up to the totals %+v", sum, stats.TrafficStats)
+	}
+}
+
+func TestStatsTimeConnected(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.markConnected()
+	time.Sleep(10 * time.Millisecond)
+	c.markDisconnected()
+	c.markReconnected()
+	stats := c.Stats()
+	if stats.Connected || !stats.ConnectedSince.IsZero() {
+		t.Errorf("Expected a disconnected connection, got %+v", stats)
+	} else if stats.TimeConnected < 10*time.Millisecond {
+		t.Errorf("Expected at least 10ms connected, got %v", stats.TimeConnected)
+	} else if stats.Reconnects != 1 {
+		t.Errorf("Expected 1 reconnect, got %d", stats.Reconnects)
+	}
+	// Disconnecting again must not add more time.
+	c.markDisconnected()
+	if again := c.Stats().TimeConnected; again != stats.TimeConnected {
+		t.Errorf("Time connected changed from %v to %v while disconnected", stats.TimeConnected, again)
+	}
+}
+
+func TestStatsLag(t *testing.T) {
+	c := newOfflineConn("tester")
+	if lag := c.Stats().Lag; lag.Last != 0 || len(lag.Samples) != 0 || c.GetLag() != 0 {
+		t.Errorf("Expected no lag before measurements, got %+v", lag)
+	}
+	c.LagHistorySize = 3
+	for _, ms := range []time.Duration{100, 20, 50, 30} {
+		c.addLag(ms * time.Millisecond)
+	}
+	lag := c.Stats().Lag
+	// The first measurement must have been removed from the history.
+	expected := []time.Duration{20 * time.Millisecond, 50 * time.Millisecond, 30 * time.Millisecond}
+	if len(lag.Samples) != len(expected) {
+		t.Fatalf("Expected %d samples, got %+v", len(expected), lag.Samples)
+	}
+	for i, sample := range lag.Samples {
+		if sample.Lag != expected[i] || sample.Time.IsZero() {
+			t.Errorf("Sample #%d: expected %v, got %+v", i, expected[i], sample)
+		}
+	}
+	if lag.Last != 30*time.Millisecond || lag.Min != 20*time.Millisecond || lag.Max != 50*time.Millisecond ||
+		lag.Avg != time.Duration(100)*time.Millisecond/3 {
+		t.Errorf("Unexpected lag stats %+v", lag)
+	}
+	if c.GetLag() != 30*time.Millisecond {
+		t.Errorf("Expected GetLag to return the latest lag, got %v", c.GetLag())
+	}
+}
@@ -0,0 +1,435 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// rplChannelModeIs is the reply to a MODE request for a channel.
+const rplChannelModeIs = "324"
+
+// Modes contains functions to parse and change channel modes.
+type Modes interface {
+	// ChannelModes returns the channel mode types the server advertised in ISUPPORT.
+	ChannelModes() *ChannelModes
+	// SendModes sends the given mode changes, split into as many MODE commands as the MODES limit of the server requires.
+	SendModes(target string, changes ...ModeChange) error
+	// Op gives channel operator status to the given users
+	Op(ch string, nicks ...string) error
+	// Deop removes channel operator status from the given users
+	Deop(ch string, nicks ...string) error
+	// Voice gives voice to the given users
+	Voice(ch string, nicks ...string) error
+	// Devoice removes voice from the given users
+	Devoice(ch string, nicks ...string) error
+	// Ban adds the given masks to the ban list of the given channel
+	Ban(ch string, masks ...string) error
+	// Unban removes the given masks from the ban list of the given channel
+	Unban(ch string, masks ...string) error
+	// Quiet adds the given masks to the quiet list of the given channel.
+	// Depending on the server, this uses the +q list mode or a quiet extban.
+	Quiet(ch string, masks ...string) error
+	// Unquiet removes the given masks from the quiet list of the given channel.
+	Unquiet(ch string, masks ...string) error
+
+	// ListModeSync requests the entries of the given list mode (b, e, I or q) in the given channel and waits for the reply.
+	// If the state tracker is enabled, the list is then kept up to date from MODE changes. See GetModeList.
+	ListModeSync(ctx context.Context, ch string, mode byte) ([]*ListEntry, error)
+	// BanListSync requests the ban list of the given channel and waits for the reply.
+	BanListSync(ctx context.Context, ch string) ([]*ListEntry, error)
+	// ExceptListSync requests the ban exception list of the given channel and waits for the reply.
+	ExceptListSync(ctx context.Context, ch string) ([]*ListEntry, error)
+	// InviteListSync requests the invite exception list of the given channel and waits for the reply.
+	InviteListSync(ctx context.Context, ch string) ([]*ListEntry, error)
+	// QuietListSync requests the quiet list of the given channel and waits for the reply.
+	// If the server implements quiets as extbans, the extban prefix is removed from the masks.
+	QuietListSync(ctx context.Context, ch string) ([]*ListEntry, error)
+}
+
+// ModeType is the type of a channel mode as defined by the CHANMODES and PREFIX ISUPPORT tokens.
+type ModeType int
+
+// Channel mode types
+const (
+	// ModeTypeList modes add or remove an entry in a list and always take a parameter (CHANMODES type A).
+	ModeTypeList ModeType = iota
+	// ModeTypeParam modes always take a parameter (CHANMODES type B).
+	ModeTypeParam
+	// ModeTypeSetParam modes only take a parameter when set (CHANMODES type C).
+	ModeTypeSetParam
+	// ModeTypeFlag modes never take a parameter (CHANMODES type D).
+	ModeTypeFlag
+	// ModeTypePrefix modes give a membership prefix to the user given as the parameter.
+	ModeTypePrefix
+)
+
+// ModeChange is a single mode change.
+type ModeChange struct {
+	Add  bool
+	Mode byte
+	Arg  string
+}
+
+// String returns the mode change in the same format it would be in a MODE command, excluding the parameter.
+func (mc ModeChange) String() string {
+	if mc.Add {
+		return "+" + string(mc.Mode)
+	}
+	return "-" + string(mc.Mode)
+}
+
+// ChannelModes contains the channel mode types of a server.
+type ChannelModes struct {
+	List     string
+	Param    string
+	SetParam string
+	Flag     string
+	// PrefixModes are the mode letters that give membership prefixes, in order of rank.
+	PrefixModes string
+	// PrefixSymbols are the membership prefix symbols matching PrefixModes.
+	PrefixSymbols string
+}
+
+// ParseChannelModes parses the values of the CHANMODES and PREFIX ISUPPORT tokens.
+// The values defined in the RFCs are used for empty values.
+func ParseChannelModes(chanmodes, prefix string) *ChannelModes {
+	if len(chanmodes) == 0 {
+		chanmodes = "beI,k,l,imnpst"
+	}
+	if len(prefix) == 0 {
+		prefix = "(ov)@+"
+	}
+	modes := &ChannelModes{}
+	types := strings.Split(chanmodes, ",")
+	for i, target := range []*string{&modes.List, &modes.Param, &modes.SetParam, &modes.Flag} {
+		if i < len(types) {
+			*target = types[i]
+		}
+	}
+	if end := strings.IndexByte(prefix, ')'); strings.HasPrefix(prefix, "(") && end > 0 {
+		modes.PrefixModes = prefix[1:end]
+		modes.PrefixSymbols = prefix[end+1:]
+	}
+	return modes
+}
+
+// Type returns the type of the given mode. Unknown modes are assumed to not take a parameter.
+func (modes *ChannelModes) Type(mode byte) ModeType {
+	switch {
+	case strings.IndexByte(modes.PrefixModes, mode) >= 0:
+		return ModeTypePrefix
+	case strings.IndexByte(modes.List, mode) >= 0:
+		return ModeTypeList
+	case strings.IndexByte(modes.Param, mode) >= 0:
+		return ModeTypeParam
+	case strings.IndexByte(modes.SetParam, mode) >= 0:
+		return ModeTypeSetParam
+	default:
+		return ModeTypeFlag
+	}
+}
+
+// TakesParam checks if the given mode takes a parameter when it's added or removed.
+func (modes *ChannelModes) TakesParam(mode byte, add bool) bool {
+	switch modes.Type(mode) {
+	case ModeTypeFlag:
+		return false
+	case ModeTypeSetParam:
+		return add
+	default:
+		return true
+	}
+}
+
+// PrefixSymbol returns the membership prefix symbol given by the given prefix mode.
+func (modes *ChannelModes) PrefixSymbol(mode byte) (byte, bool) {
+	i := strings.IndexByte(modes.PrefixModes, mode)
+	if i < 0 || i >= len(modes.PrefixSymbols) {
+		return 0, false
+	}
+	return modes.PrefixSymbols[i], true
+}
+
+// Parse splits a mode string and its parameters into individual changes.
+// List modes without a parameter have an empty Arg, which is how list requests like "MODE #chan b" look.
+func (modes *ChannelModes) Parse(modestring string, args []string) []ModeChange {
+	var changes []ModeChange
+	add := true
+	for i := 0; i < len(modestring); i++ {
+		switch mode := modestring[i]; mode {
+		case '+':
+			add = true
+		case '-':
+			add = false
+		default:
+			change := ModeChange{Add: add, Mode: mode}
+			if modes.TakesParam(mode, add) && len(args) > 0 {
+				change.Arg, args = args[0], args[1:]
+			}
+			changes = append(changes, change)
+		}
+	}
+	return changes
+}
+
+// Format converts the given changes into MODE command parameters, with at most maxParams changes that have a
+// parameter per command. If maxParams is zero or negative, the parameter count is only limited by line length.
+func (modes *ChannelModes) Format(changes []ModeChange, maxParams int) [][]string {
+	var lines [][]string
+	var modestring strings.Builder
+	var args []string
+	length := 0
+	add := byte(0)
+	flush := func() {
+		if modestring.Len() > 0 {
+			lines = append(lines, append([]string{modestring.String()}, args...))
+		}
+		modestring.Reset()
+		args = nil
+		length = 0
+		add = 0
+	}
+	for _, change := range changes {
+		hasArg := len(change.Arg) > 0 && modes.TakesParam(change.Mode, change.Add)
+		if hasArg && ((maxParams > 0 && len(args) >= maxParams) || length+len(change.Arg)+1 > maxTargetLineLength) {
+			flush()
+		}
+		if sign := change.String()[0]; sign != add {
+			modestring.WriteByte(sign)
+			add = sign
+		}
+		modestring.WriteByte(change.Mode)
+		if hasArg {
+			args = append(args, change.Arg)
+			length += len(change.Arg) + 1
+		}
+	}
+	flush()
+	return lines
+}
+
+// ChannelModes - See Modes interface docs
+func (c *ConnImpl) ChannelModes() *ChannelModes {
+	chanmodes, _ := c.GetISupport("CHANMODES")
+	prefix, _ := c.GetISupport("PREFIX")
+	return ParseChannelModes(chanmodes, prefix)
+}
+
+// maxModeParams returns the maximum number of modes with parameters per MODE command.
+func (c *ConnImpl) maxModeParams() int {
+	value, ok := c.GetISupport("MODES")
+	if !ok {
+		return 3
+	} else if len(value) == 0 {
+		// MODES without a value means that there's no limit.
+		return 0
+	}
+	return c.getISupportInt("MODES", 3)
+}
+
+// SendModes - See Modes interface docs
+func (c *ConnImpl) SendModes(target string, changes ...ModeChange) error {
+	for _, params := range c.ChannelModes().Format(changes, c.maxModeParams()) {
+		err := c.Send(&irc.Message{
+			Command: irc.MODE,
+			Params:  append([]string{target}, params...),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendModeArgs sends the given mode once for each of the given parameters.
+func (c *ConnImpl) sendModeArgs(target string, add bool, mode byte, args []string) error {
+	changes := make([]ModeChange, len(args))
+	for i, arg := range args {
+		changes[i] = ModeChange{Add: add, Mode: mode, Arg: arg}
+	}
+	return c.SendModes(target, changes...)
+}
+
+// Op - See Modes interface docs
+func (c *ConnImpl) Op(ch string, nicks ...string) error {
+	return c.sendModeArgs(ch, true, 'o', nicks)
+}
+
+// Deop - See Modes interface docs
+func (c *ConnImpl) Deop(ch string, nicks ...string) error {
+	return c.sendModeArgs(ch, false, 'o', nicks)
+}
+
+// Voice - See Modes interface docs
+func (c *ConnImpl) Voice(ch string, nicks ...string) error {
+	return c.sendModeArgs(ch, true, 'v', nicks)
+}
+
+// Devoice - See Modes interface docs
+func (c *ConnImpl) Devoice(ch string, nicks ...string) error {
+	return c.sendModeArgs(ch, false, 'v', nicks)
+}
+
+// Ban - See Modes interface docs
+func (c *ConnImpl) Ban(ch string, masks ...string) error {
+	return c.sendModeArgs(ch, true, 'b', masks)
+}
+
+// Unban - See Modes interface docs
+func (c *ConnImpl) Unban(ch string, masks ...string) error {
+	return c.sendModeArgs(ch, false, 'b', masks)
+}
+
+// quietMode finds out how the server implements quiets. It returns the list mode to use and the prefix to add to the
+// masks when an extban is used.
+func (c *ConnImpl) quietMode() (mode byte, prefix string, err error) {
+	if modes := c.ChannelModes(); modes.Type('q') == ModeTypeList {
+		return 'q', "", nil
+	}
+	// EXTBAN=<prefix>,<types> where the prefix may be empty.
+	extban, _ := c.GetISupport("EXTBAN")
+	parts := strings.SplitN(extban, ",", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrModeNotSupported
+	} else if strings.IndexByte(parts[1], 'q') >= 0 {
+		return 'b', parts[0] + "q:", nil
+	} else if strings.IndexByte(parts[1], 'm') >= 0 {
+		return 'b', parts[0] + "m:", nil
+	}
+	return 0, "", ErrModeNotSupported
+}
+
+func (c *ConnImpl) setQuiet(ch string, add bool, masks []string) error {
+	mode, prefix, err := c.quietMode()
+	if err != nil {
+		return err
+	}
+	args := make([]string, len(masks))
+	for i, mask := range masks {
+		args[i] = prefix + mask
+	}
+	return c.sendModeArgs(ch, add, mode, args)
+}
+
+// Quiet - See Modes interface docs
+func (c *ConnImpl) Quiet(ch string, masks ...string) error {
+	return c.setQuiet(ch, true, masks)
+}
+
+// Unquiet - See Modes interface docs
+func (c *ConnImpl) Unquiet(ch string, masks ...string) error {
+	return c.setQuiet(ch, false, masks)
+}
+
+// isChannel checks if the given target is a channel name based on the CHANTYPES ISUPPORT token.
+func (c *ConnImpl) isChannel(target string) bool {
+	chantypes, ok := c.GetISupport("CHANTYPES")
+	if !ok {
+		chantypes = "#&"
+	}
+	return len(target) > 0 && strings.IndexByte(chantypes, target[0]) >= 0
+}
+
+// handleMode parses incoming channel MODE changes, updates the tracked channel state and emits a ModeEvent.
+func (c *ConnImpl) handleMode(evt *Event) {
+	params := evt.Args()
+	if len(params) < 2 || !c.isChannel(params[0]) {
+		return
+	}
+	var setter string
+	if evt.Prefix != nil {
+		setter = evt.Name
+	}
+	modes := c.ChannelModes()
+	changes := modes.Parse(params[1], params[2:])
+	if c.TrackState {
+		c.applyModes(modes, params[0], changes, setter, evt.Time)
+	}
+	c.emit(&ModeEvent{
+		eventSource: eventSource{evt},
+		Channel:     params[0],
+		Setter:      setter,
+		Changes:     changes,
+	})
+}
+
+// handleChannelModeIs sets the channel modes from the reply to a MODE request.
+func (c *ConnImpl) handleChannelModeIs(evt *Event) {
+	params := evt.Args()
+	if !c.TrackState || len(params) < 3 {
+		return
+	}
+	modes := c.ChannelModes()
+	c.stateLock.Lock()
+	if ch, ok := c.channels[c.foldName(params[1])]; ok {
+		ch.modes = make(map[byte]string)
+	}
+	c.stateLock.Unlock()
+	c.applyModes(modes, params[1], modes.Parse(params[2], params[3:]), "", time.Time{})
+}
+
+// applyModes applies the given mode changes to the tracked state of the given channel.
+// The setter and time are used for new entries in the tracked list modes.
+func (c *ConnImpl) applyModes(modes *ChannelModes, channel string, changes []ModeChange, setter string, at time.Time) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	ch, ok := c.channels[c.foldName(channel)]
+	if !ok {
+		return
+	}
+	for _, change := range changes {
+		switch modes.Type(change.Mode) {
+		case ModeTypePrefix:
+			key := c.foldName(change.Arg)
+			prefixes, ok := ch.members[key]
+			symbol, known := modes.PrefixSymbol(change.Mode)
+			if !ok || !known {
+				continue
+			}
+			prefixes = strings.Replace(prefixes, string(symbol), "", -1)
+			if change.Add {
+				prefixes += string(symbol)
+			}
+			ch.members[key] = sortPrefixes(prefixes, modes.PrefixSymbols)
+		case ModeTypeList:
+			c.updateModeList(ch, change, setter, at)
+		default:
+			if change.Add {
+				ch.modes[change.Mode] = change.Arg
+			} else {
+				delete(ch.modes, change.Mode)
+			}
+		}
+	}
+}
+
+// sortPrefixes sorts the given membership prefixes from the highest rank to the lowest.
+func sortPrefixes(prefixes, order string) string {
+	var sorted strings.Builder
+	for i := 0; i < len(order); i++ {
+		if strings.IndexByte(prefixes, order[i]) >= 0 {
+			sorted.WriteByte(order[i])
+		}
+	}
+	return sorted.String()
+}
@@ -0,0 +1,170 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChannelModes(t *testing.T) {
+	modes := ParseChannelModes("beI,k,l,imnpst", "(qaohv)~&@%+")
+	expected := map[byte]ModeType{
+		'b': ModeTypeList, 'k': ModeTypeParam, 'l': ModeTypeSetParam, 'm': ModeTypeFlag, 'o': ModeTypePrefix,
+		'X': ModeTypeFlag,
+	}
+	for mode, modeType := range expected {
+		if actual := modes.Type(mode); actual != modeType {
+			t.Errorf("%c: expected type %d, got %d", mode, modeType, actual)
+		}
+	}
+	if symbol, ok := modes.PrefixSymbol('h'); !ok || symbol != '%' {
+		t.Errorf("Expected %% for h, got %q", symbol)
+	}
+	if modes.TakesParam('l', false) || !modes.TakesParam('l', true) || !modes.TakesParam('k', false) {
+		t.Error("Parameters of set-only and always-parameter modes weren't detected correctly")
+	}
+
+	defaults := ParseChannelModes("", "")
+	if defaults.List != "beI" || defaults.PrefixModes != "ov" || defaults.PrefixSymbols != "@+" {
+		t.Errorf("Unexpected default modes: %+v", defaults)
+	}
+}
+
+func TestParseModeString(t *testing.T) {
+	modes := ParseChannelModes("beI,k,l,imnpst", "(ov)@+")
+	changes := modes.Parse("+ov-l+kb-m", []string{"alice", "bob", "secret", "*!*@spam"})
+	expected := []ModeChange{
+		{Add: true, Mode: 'o', Arg: "alice"},
+		{Add: true, Mode: 'v', Arg: "bob"},
+		{Add: false, Mode: 'l'},
+		{Add: true, Mode: 'k', Arg: "secret"},
+		{Add: true, Mode: 'b', Arg: "*!*@spam"},
+		{Add: false, Mode: 'm'},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, changes)
+	}
+	if list := modes.Parse("b", nil); len(list) != 1 || list[0].Arg != "" {
+		t.Errorf("Unexpected list request parse result: %+v", list)
+	}
+}
+
+func TestFormatModes(t *testing.T) {
+	modes := ParseChannelModes("", "")
+	changes := []ModeChange{
+		{Add: true, Mode: 'o', Arg: "alice"},
+		{Add: true, Mode: 'o', Arg: "bob"},
+		{Add: false, Mode: 'v', Arg: "carol"},
+		{Add: true, Mode: 'm'},
+		{Add: false, Mode: 'o', Arg: "dave"},
+	}
+	expected := [][]string{
+		{"+oo-v+m", "alice", "bob", "carol"},
+		{"-o", "dave"},
+	}
+	if lines := modes.Format(changes, 3); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %q, got %q", expected, lines)
+	}
+	if lines := modes.Format(changes, 0); len(lines) != 1 || len(lines[0]) != 5 {
+		t.Errorf("Expected a single line without a parameter limit, got %q", lines)
+	}
+	// Formatting and parsing again should give the same changes back.
+	var parsed []ModeChange
+	for _, line := range modes.Format(changes, 2) {
+		parsed = append(parsed, modes.Parse(line[0], line[1:])...)
+	}
+	if !reflect.DeepEqual(parsed, changes) {
+		t.Errorf("Round trip changed the modes: %+v", parsed)
+	}
+}
+
+func TestHandleMode(t *testing.T) {
+	c := newOfflineConn("tester")
+	feedLines(c,
+		":tester!t@me.example JOIN #chan",
+		":irc.example.com 353 tester = #chan :@tester alice",
+		":irc.example.com 324 tester #chan +nt",
+		":tester!t@me.example MODE #chan +vo-t+kl alice alice secret 10",
+		":tester!t@me.example MODE #chan -v+m alice")
+	ch := c.GetChannel("#chan")
+	if prefixes := ch.Members["alice"]; prefixes != "@" {
+		t.Errorf("Expected alice to have @, got %q", prefixes)
+	}
+	expected := map[byte]string{'n': "", 'k': "secret", 'l': "10", 'm': ""}
+	if !reflect.DeepEqual(ch.Modes, expected) {
+		t.Errorf("Expected modes %v, got %v", expected, ch.Modes)
+	}
+}
+
+func TestQuietMode(t *testing.T) {
+	tests := []struct {
+		isupport map[string]string
+		mode     byte
+		prefix   string
+		err      error
+	}{
+		{map[string]string{"CHANMODES": "bqeI,k,l,imnpst"}, 'q', "", nil},
+		{map[string]string{"EXTBAN": "$,qa"}, 'b', "$q:", nil},
+		{map[string]string{"EXTBAN": ",m"}, 'b', "m:", nil},
+		{map[string]string{"EXTBAN": "~,a"}, 0, "", ErrModeNotSupported},
+		{map[string]string{}, 0, "", ErrModeNotSupported},
+	}
+	for _, test := range tests {
+		c := newOfflineConn("tester")
+		c.isupport = test.isupport
+		mode, prefix, err := c.quietMode()
+		if mode != test.mode || prefix != test.prefix || err != test.err {
+			t.Errorf("%v: expected %q %q %v, got %q %q %v", test.isupport, test.mode, test.prefix, test.err, mode,
+				prefix, err)
+		}
+	}
+}
+
+func TestModeHelpers(t *testing.T) {
+	c := newOfflineConn("tester")
+	c.isupport["MODES"] = "2"
+	helpers := []func() error{
+		func() error { return c.Op("#chan", "alice", "bob", "carol") },
+		func() error { return c.Devoice("#chan", "alice") },
+		func() error { return c.Ban("#chan", "*!*@spam") },
+	}
+	for _, helper := range helpers {
+		if err := helper(); err != nil {
+			t.Fatal("Sending modes failed:", err)
+		}
+	}
+	expectSent(t, c, "MODE #chan +oo alice bob", "MODE #chan +o carol", "MODE #chan -v alice", "MODE #chan +b *!*@spam")
+
+	// The send errors must be returned when the client isn't connected.
+	c = Create("tester", "tester", nil).(*ConnImpl)
+	helpers = []func() error{
+		func() error { return c.SendModes("#chan", ModeChange{Add: true, Mode: 'm'}) },
+		func() error { return c.Op("#chan", "alice") },
+		func() error { return c.Deop("#chan", "alice") },
+		func() error { return c.Voice("#chan", "alice") },
+		func() error { return c.Devoice("#chan", "alice") },
+		func() error { return c.Ban("#chan", "*!*@spam") },
+		func() error { return c.Unban("#chan", "*!*@spam") },
+	}
+	for i, helper := range helpers {
+		if err := helper(); err != ErrDisconnected {
+			t.Errorf("Helper #%d: expected ErrDisconnected, got %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// Nick handling numerics
+const (
+	errErroneousNickname = "432"
+	rplLoggedIn          = "900"
+	rplLoggedOut         = "901"
+)
+
+// NickGenerator generates a fallback nick when the preferred nick and all the alternate nicks are taken.
+// The attempt number starts from 1. maxLength is the NICKLEN advertised by the server, or 0 if it's not known.
+type NickGenerator func(preferred string, attempt, maxLength int) string
+
+// DefaultNickGenerator appends underscores to the preferred nick, and a number after the second attempt.
+// The preferred nick is truncated so that the result fits in maxLength.
+func DefaultNickGenerator(preferred string, attempt, maxLength int) string {
+	suffix := strings.Repeat("_", attempt)
+	if attempt > 2 {
+		suffix = "_" + strconv.Itoa(attempt)
+	}
+	if maxLength > len(suffix) && len(preferred)+len(suffix) > maxLength {
+		preferred = preferred[:maxLength-len(suffix)]
+	}
+	return preferred + suffix
+}
+
+// NickRecovery is the NickServ command used to take the preferred nick back from another user.
+type NickRecovery int
+
+// Available NickServ nick recovery methods
+const (
+	NickRecoveryNone NickRecovery = iota
+	NickRecoveryRegain
+	NickRecoveryGhost
+)
+
+// SetAltNicks - See Data interface docs
+func (c *ConnImpl) SetAltNicks(nicks ...string) {
+	c.AltNicks = nicks
+}
+
+// SetNickGenerator - See Data interface docs
+func (c *ConnImpl) SetNickGenerator(generator NickGenerator) {
+	c.NickGenerator = generator
+}
+
+// sendNick sends a NICK command without changing the preferred nick.
+func (c *ConnImpl) sendNick(nick string) error {
+	return c.Send(&irc.Message{
+		Command: irc.NICK,
+		Params:  []string{nick},
+	})
+}
+
+// nextNick returns the next nick to try during registration, or false if there are no more nicks to try.
+func (c *ConnImpl) nextNick() (string, bool) {
+	c.nickAttempt++
+	if c.nickAttempt <= len(c.AltNicks) {
+		return c.AltNicks[c.nickAttempt-1], true
+	}
+	attempt := c.nickAttempt - len(c.AltNicks)
+	if attempt > c.MaxNickAttempts {
+		return "", false
+	}
+	generate := c.NickGenerator
+	if generate == nil {
+		generate = DefaultNickGenerator
+	}
+	return generate(c.PreferredNick, attempt, c.getISupportInt("NICKLEN", 0)), true
+}
+
+// handleNickUnavailable tries the next nick when the server rejects the nick sent during registration.
+// After registration, the rejection just means that the nick change failed and the current nick stays.
+func (c *ConnImpl) handleNickUnavailable(evt *Event) {
+	params := evt.Args()
+	if c.registered || (len(params) > 1 && !c.equalName(params[1], c.Nick)) {
+		return
+	}
+	nick, ok := c.nextNick()
+	if !ok {
+		select {
+		case c.errors <- ErrNoFreeNick:
+		default:
+		}
+		c.Quit()
+		return
+	}
+	c.Nick = nick
+	c.sendNick(nick)
+}
+
+// recoverNick tries to take the preferred nick back if registration completed with a different nick.
+func (c *ConnImpl) recoverNick() {
+	if !c.registered {
+		return
+	} else if c.isSelf(c.PreferredNick) {
+		if c.nickMonitored {
+			c.nickMonitored = false
+			c.Unmonitor(c.PreferredNick)
+		}
+		return
+	}
+
+	if c.identified && !c.nickRecoverySent {
+		switch c.NickRecovery {
+		case NickRecoveryRegain:
+			c.nickRecoverySent = true
+			c.Privmsg("NickServ", "REGAIN "+c.PreferredNick)
+		case NickRecoveryGhost:
+			// The nick is taken when NickServ replies, since GHOST only disconnects the other user.
+			c.nickRecoverySent = true
+			c.nickGhostSent = true
+			c.Privmsg("NickServ", "GHOST "+c.PreferredNick)
+		}
+	}
+	if c.MonitorPreferredNick && !c.nickMonitored {
+		c.nickMonitored = true
+		c.Monitor(c.PreferredNick)
+	}
+}
+
+// handleGhostReply takes the preferred nick after NickServ replies to a GHOST command. The NICK command is sent even
+// if the reply is an error, because a failed nick change after registration is harmless.
+func (c *ConnImpl) handleGhostReply(evt *Event) {
+	if !c.nickGhostSent || evt.Prefix == nil || !c.equalName(evt.Name, "NickServ") {
+		return
+	}
+	c.nickGhostSent = false
+	if !c.isSelf(c.PreferredNick) {
+		c.sendNick(c.PreferredNick)
+	}
+}
+
+// handleNickPresence takes the preferred nick when the monitored user using it goes offline.
+func (c *ConnImpl) handleNickPresence(evt TypedEvent) {
+	presence, ok := evt.(*PresenceEvent)
+	if !ok || presence.Online || !c.registered || !c.nickMonitored {
+		return
+	} else if c.foldName(presence.Nick) == c.foldName(c.PreferredNick) && !c.isSelf(c.PreferredNick) {
+		c.sendNick(c.PreferredNick)
+	}
+}
+
+// addNickHandlers adds the handlers for nick collisions and nick recovery.
+func (c *ConnImpl) addNickHandlers() {
+	c.AddHandler(irc.ERR_NICKNAMEINUSE, c.handleNickUnavailable)
+	c.AddHandler(irc.ERR_UNAVAILRESOURCE, c.handleNickUnavailable)
+	c.AddHandler(errErroneousNickname, c.handleNickUnavailable)
+
+	c.AddHandler(irc.NICK, func(evt *Event) {
+		if params := evt.Args(); evt.Prefix != nil && len(params) > 0 && c.isSelf(evt.Name) {
+			c.Nick = params[0]
+			c.recoverNick()
+		}
+	})
+
+	c.AddHandler(irc.NOTICE, c.handleGhostReply)
+
+	c.AddHandler(rplLoggedIn, func(evt *Event) {
+		c.identified = true
+		c.recoverNick()
+	})
+	c.AddHandler(rplLoggedOut, func(evt *Event) {
+		c.identified = false
+	})
+	c.AddHandler("ACCOUNT", func(evt *Event) {
+		if params := evt.Args(); evt.Prefix != nil && len(params) > 0 && c.isSelf(evt.Name) {
+			c.identified = params[0] != "*"
+			c.recoverNick()
+		}
+	})
+
+	c.AddTypedHandler(c.handleNickPresence)
+}
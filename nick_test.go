@@ -0,0 +1,101 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+)
+
+// newRegisteredConn creates an offline connection that registered with a fallback nick because the preferred nick was
+// taken.
+func newRegisteredConn() *ConnImpl {
+	c := newOfflineConn("tester")
+	c.presenceMethod = presenceMonitor
+	c.registered = true
+	c.Nick = "tester_"
+	return c
+}
+
+func expectSent(t *testing.T, c *ConnImpl, expected ...string) {
+	t.Helper()
+	sent := sentLines(c)
+	if len(sent) != len(expected) {
+		t.Fatalf("Expected %q to be sent, got %q", expected, sent)
+	}
+	for i := range expected {
+		if sent[i] != expected[i] {
+			t.Fatalf("Expected %q to be sent, got %q", expected, sent)
+		}
+	}
+}
+
+func TestNickRecoveryGhost(t *testing.T) {
+	c := newRegisteredConn()
+	c.NickRecovery = NickRecoveryGhost
+	c.MonitorPreferredNick = false
+	feedLines(c, ":irc.example.com 900 tester_ tester_!t@me.example tester :You are now logged in as tester")
+	expectSent(t, c, "PRIVMSG NickServ :GHOST tester")
+	feedLines(c, ":bob!b@b.example NOTICE tester_ :not from NickServ")
+	expectSent(t, c)
+	feedLines(c, ":NickServ!services@services.example NOTICE tester_ :tester has been ghosted.")
+	expectSent(t, c, "NICK tester")
+	feedLines(c, ":NickServ!services@services.example NOTICE tester_ :Another notice")
+	expectSent(t, c)
+}
+
+func TestSetNickUnmonitorsOldNick(t *testing.T) {
+	c := newRegisteredConn()
+	c.recoverNick()
+	expectSent(t, c, "MONITOR + tester")
+	if err := c.SetNick("other"); err != nil {
+		t.Fatal("SetNick failed:", err)
+	}
+	expectSent(t, c, "MONITOR - tester", "NICK other")
+	if c.nickMonitored {
+		t.Error("The preferred nick is still marked as monitored")
+	}
+}
+
+func TestDefaultNickGenerator(t *testing.T) {
+	tests := []struct {
+		attempt, maxLength int
+		expected           string
+	}{
+		{1, 0, "tester_"},
+		{2, 0, "tester__"},
+		{3, 0, "tester_3"},
+		{1, 6, "teste_"},
+		{12, 6, "tes_12"},
+	}
+	for _, test := range tests {
+		if actual := DefaultNickGenerator("tester", test.attempt, test.maxLength); actual != test.expected {
+			t.Errorf("Attempt %d with max length %d: expected %q, got %q", test.attempt, test.maxLength,
+				test.expected, actual)
+		}
+	}
+}
+
+func TestSetNickDisconnected(t *testing.T) {
+	c := Create("tester", "tester", nil).(*ConnImpl)
+	if err := c.SetNick("other"); err != ErrDisconnected {
+		t.Errorf("Expected ErrDisconnected, got %v", err)
+	}
+	if c.PreferredNick != "other" {
+		t.Errorf("Expected the preferred nick to change anyway, got %q", c.PreferredNick)
+	}
+}
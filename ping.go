@@ -0,0 +1,164 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// pendingPing is a PING that hasn't been answered yet.
+type pendingPing struct {
+	token string
+	sent  time.Time
+}
+
+// newPingToken registers a new pending PING and returns its token.
+func (c *ConnImpl) newPingToken() string {
+	ping := pendingPing{
+		token: "lmi" + strconv.FormatUint(atomic.AddUint64(&c.pingCounter, 1), 10),
+		sent:  time.Now(),
+	}
+	c.pingLock.Lock()
+	c.pendingPings = append(c.pendingPings, ping)
+	c.pingLock.Unlock()
+	return ping.token
+}
+
+// resetPings forgets all pending PINGs.
+func (c *ConnImpl) resetPings() {
+	c.pingLock.Lock()
+	c.pendingPings = nil
+	c.pingLock.Unlock()
+}
+
+// handlePong measures the lag from a PONG that answers one of our PINGs. PINGs sent before the answered one are
+// considered answered too, since the server answers in order.
+func (c *ConnImpl) handlePong(evt *Event) {
+	args := evt.Args()
+	if len(args) == 0 {
+		return
+	}
+	token := args[len(args)-1]
+	c.pingLock.Lock()
+	var ping pendingPing
+	for i, pending := range c.pendingPings {
+		if pending.token == token {
+			ping = pending
+			c.pendingPings = append(c.pendingPings[:0:0], c.pendingPings[i+1:]...)
+			break
+		}
+	}
+	c.pingLock.Unlock()
+	if len(ping.token) == 0 {
+		return
+	}
+	lag := time.Since(ping.sent)
+	c.log(slog.LevelDebug, CategoryHandlers, "Lag", slog.Duration("lag", lag))
+	c.addLag(lag)
+	c.emit(&PongEvent{
+		eventSource: eventSource{evt},
+		Token:       token,
+		Sent:        ping.sent,
+		Lag:         lag,
+	})
+}
+
+// pingPending checks if there are PINGs that haven't been answered yet.
+func (c *ConnImpl) pingPending() bool {
+	c.pingLock.Lock()
+	defer c.pingLock.Unlock()
+	return len(c.pendingPings) > 0
+}
+
+// pingCheckInterval returns how often the PONG deadline is checked.
+func (c *ConnImpl) pingCheckInterval() time.Duration {
+	interval := 1 * time.Minute
+	if c.PongDeadline > 0 && c.PongDeadline/4 < interval {
+		interval = c.PongDeadline / 4
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	return interval
+}
+
+// checkPongDeadline checks if the oldest pending PING has gone unanswered for longer than PongDeadline. If it has,
+// a PingTimeoutEvent is emitted and the connection is dropped if DisconnectOnPingTimeout is set, so that Loop
+// reconnects.
+func (c *ConnImpl) checkPongDeadline(end chan interface{}) {
+	now := time.Now()
+	c.pingLock.Lock()
+	if c.PongDeadline <= 0 {
+		// Without a deadline, unanswered PINGs are forgotten after the timeout so that keepalive PINGs continue.
+		for len(c.pendingPings) > 0 && now.Sub(c.pendingPings[0].sent) >= c.Timeout {
+			c.pendingPings = c.pendingPings[1:]
+		}
+		c.pingLock.Unlock()
+		return
+	}
+	if len(c.pendingPings) == 0 || now.Sub(c.pendingPings[0].sent) < c.PongDeadline {
+		c.pingLock.Unlock()
+		return
+	}
+	ping := c.pendingPings[0]
+	c.pendingPings = nil
+	c.pingLock.Unlock()
+
+	evt := &PingTimeoutEvent{
+		Token:      ping.token,
+		Sent:       ping.sent,
+		Deadline:   ping.sent.Add(c.PongDeadline),
+		Disconnect: c.DisconnectOnPingTimeout,
+	}
+	c.log(slog.LevelWarn, CategoryReconnect, "No PONG received before deadline", slog.String("token", ping.token),
+		slog.Duration("deadline", c.PongDeadline), slog.Bool("disconnect", evt.Disconnect))
+	c.dispatch(func() {
+		c.emit(evt)
+	})
+	if evt.Disconnect {
+		go c.disconnect(end)
+	}
+}
+
+func (c *ConnImpl) pingLoop() {
+	defer c.Done()
+	end := c.end
+	check := time.NewTicker(c.pingCheckInterval())
+	pingfreq := time.NewTicker(c.PingFreq)
+	defer check.Stop()
+	defer pingfreq.Stop()
+	for {
+		select {
+		case <-check.C:
+			c.checkPongDeadline(end)
+			c.Lock()
+			idle := time.Since(c.prevMsg) >= c.KeepAlive
+			c.Unlock()
+			if idle && !c.pingPending() {
+				c.Ping()
+			}
+		case <-pingfreq.C:
+			c.Ping()
+		case <-end:
+			return
+		}
+	}
+}
@@ -0,0 +1,385 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Presence tracking numerics
+const (
+	rplMonOnline    = "730"
+	rplMonOffline   = "731"
+	errMonListFull  = "734"
+	rplLogOn        = "600"
+	rplLogOff       = "601"
+	rplNowOn        = "604"
+	rplNowOff       = "605"
+	errTooManyWatch = "512"
+)
+
+// maxTargetLineLength is the maximum length of the target list in a single MONITOR, WATCH or ISON command.
+const maxTargetLineLength = 400
+
+// Presence contains functions to track whether users are online.
+// MONITOR is used if the server supports it, then WATCH, and finally periodic ISON polling.
+// Changes are emitted as PresenceEvents.
+type Presence interface {
+	// Monitor adds the given nicks to the list of tracked users.
+	Monitor(nicks ...string)
+	// Unmonitor removes the given nicks from the list of tracked users.
+	Unmonitor(nicks ...string)
+	// IsOnline returns whether or not the given tracked user is online and whether or not the status is known yet.
+	IsOnline(nick string) (online, known bool)
+	// GetMonitored returns the list of tracked nicks.
+	GetMonitored() []string
+}
+
+type presenceMethod int
+
+const (
+	presenceNone presenceMethod = iota
+	presenceMonitor
+	presenceWatch
+	presenceISON
+)
+
+// presenceTarget is a single tracked user.
+type presenceTarget struct {
+	nick   string
+	online bool
+	known  bool
+	// remote is true if the target is in the server-side MONITOR or WATCH list instead of being polled with ISON.
+	remote bool
+}
+
+// Monitor - See Presence interface docs
+func (c *ConnImpl) Monitor(nicks ...string) {
+	c.presenceLock.Lock()
+	var added []string
+	for _, nick := range nicks {
+		key := c.foldName(nick)
+		if _, ok := c.presence[key]; ok {
+			continue
+		}
+		target := &presenceTarget{nick: nick}
+		c.presence[key] = target
+		if c.presenceMethod != presenceNone && c.hasRemoteRoom() {
+			target.remote = true
+			added = append(added, nick)
+		}
+	}
+	method := c.presenceMethod
+	c.presenceLock.Unlock()
+	c.sendPresenceList(method, "+", added)
+}
+
+// Unmonitor - See Presence interface docs
+func (c *ConnImpl) Unmonitor(nicks ...string) {
+	c.presenceLock.Lock()
+	var removed []string
+	for _, nick := range nicks {
+		key := c.foldName(nick)
+		if target, ok := c.presence[key]; ok {
+			delete(c.presence, key)
+			if target.remote {
+				removed = append(removed, target.nick)
+			}
+		}
+	}
+	method := c.presenceMethod
+	c.presenceLock.Unlock()
+	c.sendPresenceList(method, "-", removed)
+}
+
+// IsOnline - See Presence interface docs
+func (c *ConnImpl) IsOnline(nick string) (online, known bool) {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+	if target, ok := c.presence[c.foldName(nick)]; ok {
+		return target.online, target.known
+	}
+	return false, false
+}
+
+// GetMonitored - See Presence interface docs
+func (c *ConnImpl) GetMonitored() []string {
+	c.presenceLock.Lock()
+	defer c.presenceLock.Unlock()
+	nicks := make([]string, 0, len(c.presence))
+	for _, target := range c.presence {
+		nicks = append(nicks, target.nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+// hasRemoteRoom checks if there's room for more targets in the server-side list.
+// The caller must hold the presence lock.
+func (c *ConnImpl) hasRemoteRoom() bool {
+	if c.presenceMethod != presenceMonitor && c.presenceMethod != presenceWatch {
+		return false
+	} else if c.presenceLimit <= 0 {
+		return true
+	}
+	count := 0
+	for _, target := range c.presence {
+		if target.remote {
+			count++
+		}
+	}
+	return count < c.presenceLimit
+}
+
+// chunkTargets splits the given nicks into groups that fit in a single command.
+func chunkTargets(nicks []string, sep string) (chunks [][]string) {
+	var chunk []string
+	length := 0
+	for _, nick := range nicks {
+		if length+len(nick)+len(sep) > maxTargetLineLength && len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+			chunk, length = nil, 0
+		}
+		chunk = append(chunk, nick)
+		length += len(nick) + len(sep)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return
+}
+
+// sendPresenceList adds (+) or removes (-) the given nicks from the server-side MONITOR or WATCH list.
+func (c *ConnImpl) sendPresenceList(method presenceMethod, op string, nicks []string) {
+	if len(nicks) == 0 {
+		return
+	}
+	switch method {
+	case presenceMonitor:
+		for _, chunk := range chunkTargets(nicks, ",") {
+			c.Send(&irc.Message{
+				Command: "MONITOR",
+				Params:  []string{op, strings.Join(chunk, ",")},
+			})
+		}
+	case presenceWatch:
+		for _, chunk := range chunkTargets(nicks, " +") {
+			params := make([]string, len(chunk))
+			for i, nick := range chunk {
+				params[i] = op + nick
+			}
+			c.Send(&irc.Message{
+				Command: "WATCH",
+				Params:  params,
+			})
+		}
+	}
+}
+
+// startPresence chooses the presence tracking method after registration and sends the tracked nicks to the server.
+// It's called at the end of the MOTD, so the targets are re-added after reconnecting. MOTDs requested later on the
+// same connection are ignored, since the method is only reset when the connection is dropped.
+func (c *ConnImpl) startPresence(evt *Event) {
+	c.presenceLock.Lock()
+	if c.presenceMethod != presenceNone {
+		c.presenceLock.Unlock()
+		return
+	} else if _, ok := c.GetISupport("MONITOR"); ok {
+		c.presenceMethod = presenceMonitor
+		c.presenceLimit = c.getISupportInt("MONITOR", 0)
+	} else if _, ok := c.GetISupport("WATCH"); ok {
+		c.presenceMethod = presenceWatch
+		c.presenceLimit = c.getISupportInt("WATCH", 0)
+	} else {
+		c.presenceMethod = presenceISON
+		c.presenceLimit = 0
+	}
+	keys := make([]string, 0, len(c.presence))
+	for key, target := range c.presence {
+		target.remote = false
+		target.known = false
+		target.online = false
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var nicks []string
+	for _, key := range keys {
+		if !c.hasRemoteRoom() {
+			break
+		}
+		c.presence[key].remote = true
+		nicks = append(nicks, c.presence[key].nick)
+	}
+	if c.presenceStop != nil {
+		close(c.presenceStop)
+	}
+	c.presenceStop = make(chan struct{})
+	stop := c.presenceStop
+	method := c.presenceMethod
+	c.presenceLock.Unlock()
+
+	c.sendPresenceList(method, "+", nicks)
+	go c.presenceLoop(stop)
+}
+
+// stopPresence stops the ISON polling loop.
+func (c *ConnImpl) stopPresence() {
+	c.presenceLock.Lock()
+	if c.presenceStop != nil {
+		close(c.presenceStop)
+		c.presenceStop = nil
+	}
+	c.presenceMethod = presenceNone
+	c.presenceLock.Unlock()
+}
+
+// setPresence updates the status of the given user and emits a PresenceEvent if the status changed.
+func (c *ConnImpl) setPresence(evt *Event, mask string, online bool) {
+	prefix := irc.ParsePrefix(mask)
+	c.presenceLock.Lock()
+	target, ok := c.presence[c.foldName(prefix.Name)]
+	changed := ok && (!target.known || target.online != online)
+	if ok {
+		target.known = true
+		target.online = online
+	}
+	c.presenceLock.Unlock()
+	if changed {
+		c.emit(&PresenceEvent{
+			eventSource: eventSource{evt},
+			Nick:        prefix.Name,
+			User:        prefix.User,
+			Host:        prefix.Host,
+			Online:      online,
+		})
+	}
+}
+
+// overflowTargets removes the given nicks from the server-side list so they'll be polled with ISON instead.
+func (c *ConnImpl) overflowTargets(nicks []string) {
+	c.presenceLock.Lock()
+	for _, nick := range nicks {
+		if target, ok := c.presence[c.foldName(nick)]; ok {
+			target.remote = false
+		}
+	}
+	c.presenceLock.Unlock()
+}
+
+// presenceLoop polls the status of targets that aren't in the server-side list.
+func (c *ConnImpl) presenceLoop(stop chan struct{}) {
+	ticker := time.NewTicker(c.PresencePollInterval)
+	defer ticker.Stop()
+	for {
+		c.pollPresence()
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// pollPresence sends ISON requests for the targets that aren't in the server-side list.
+func (c *ConnImpl) pollPresence() {
+	c.presenceLock.Lock()
+	var nicks []string
+	for _, target := range c.presence {
+		if !target.remote {
+			nicks = append(nicks, target.nick)
+		}
+	}
+	c.presenceLock.Unlock()
+	sort.Strings(nicks)
+
+	for _, chunk := range chunkTargets(nicks, " ") {
+		var online []string
+		q := &query{}
+		q.accept = func(evt *Event) (matched, done bool) {
+			if params := evt.Args(); evt.Command == irc.RPL_ISON && len(params) > 1 {
+				online = strings.Fields(params[1])
+				return true, true
+			}
+			return false, false
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+		err := c.runQuery(ctx, q, &irc.Message{
+			Command: irc.ISON,
+			Params:  chunk,
+		})
+		cancel()
+		if err != nil {
+			return
+		}
+
+		isOnline := make(map[string]bool, len(online))
+		for _, nick := range online {
+			isOnline[c.foldName(nick)] = true
+		}
+		c.dispatch(func() {
+			for _, nick := range chunk {
+				c.setPresence(nil, nick, isOnline[c.foldName(nick)])
+			}
+		})
+	}
+}
+
+// addPresenceHandlers adds the handlers for MONITOR and WATCH replies.
+func (c *ConnImpl) addPresenceHandlers() {
+	c.AddHandler(irc.RPL_ENDOFMOTD, c.startPresence)
+	c.AddHandler(irc.ERR_NOMOTD, c.startPresence)
+
+	monitorHandler := func(online bool) Handler {
+		return func(evt *Event) {
+			if params := evt.Args(); len(params) > 1 {
+				for _, mask := range strings.Split(params[1], ",") {
+					c.setPresence(evt, mask, online)
+				}
+			}
+		}
+	}
+	c.AddHandler(rplMonOnline, monitorHandler(true))
+	c.AddHandler(rplMonOffline, monitorHandler(false))
+	c.AddHandler(errMonListFull, func(evt *Event) {
+		if params := evt.Args(); len(params) > 2 {
+			c.overflowTargets(strings.Split(params[2], ","))
+		}
+	})
+
+	watchHandler := func(online bool) Handler {
+		return func(evt *Event) {
+			if params := evt.Args(); len(params) > 3 {
+				c.setPresence(evt, params[1]+"!"+params[2]+"@"+params[3], online)
+			}
+		}
+	}
+	c.AddHandler(rplLogOn, watchHandler(true))
+	c.AddHandler(rplNowOn, watchHandler(true))
+	c.AddHandler(rplLogOff, watchHandler(false))
+	c.AddHandler(rplNowOff, watchHandler(false))
+	c.AddHandler(errTooManyWatch, func(evt *Event) {
+		if params := evt.Args(); len(params) > 1 {
+			c.overflowTargets(params[1:2])
+		}
+	})
+}
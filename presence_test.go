@@ -0,0 +1,160 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+	"time"
+)
+
+// newPresenceConn creates an offline connection with the given ISUPPORT tokens that collects PresenceEvents.
+func newPresenceConn(t *testing.T, isupport map[string]string) (*ConnImpl, chan *PresenceEvent) {
+	c := newOfflineConn("tester")
+	c.MonitorPreferredNick = false
+	for key, value := range isupport {
+		c.isupport[key] = value
+	}
+	events := make(chan *PresenceEvent, 20)
+	c.AddTypedHandler(func(evt TypedEvent) {
+		if presenceEvt, ok := evt.(*PresenceEvent); ok {
+			events <- presenceEvt
+		}
+	})
+	t.Cleanup(c.stopPresence)
+	return c, events
+}
+
+// expectEvents waits for the given number of PresenceEvents and checks that there are no more.
+func expectEvents(t *testing.T, events chan *PresenceEvent, count int) []*PresenceEvent {
+	t.Helper()
+	received := make([]*PresenceEvent, 0, count)
+	for len(received) < count {
+		select {
+		case evt := <-events:
+			received = append(received, evt)
+		case <-time.After(testTimeout):
+			t.Fatalf("Expected %d presence events, got %d", count, len(received))
+		}
+	}
+	select {
+	case evt := <-events:
+		t.Fatalf("Unexpected presence event: %+v", evt)
+	default:
+	}
+	return received
+}
+
+// expectPresence checks the status of the given tracked nick.
+func expectPresence(t *testing.T, c *ConnImpl, nick string, online, known bool) {
+	t.Helper()
+	if isOnline, isKnown := c.IsOnline(nick); isOnline != online || isKnown != known {
+		t.Errorf("Expected %s to be online=%v known=%v, got online=%v known=%v", nick, online, known, isOnline, isKnown)
+	}
+}
+
+func TestPresenceMonitor(t *testing.T) {
+	c, events := newPresenceConn(t, map[string]string{"MONITOR": "100"})
+	c.Monitor("alice", "bob")
+	expectSent(t, c)
+	feedLines(c, ":irc.example.com 376 tester :End of MOTD")
+	expectSent(t, c, "MONITOR + alice,bob")
+	expectPresence(t, c, "alice", false, false)
+
+	feedLines(c,
+		":irc.example.com 730 tester :Alice!a@a.example",
+		":irc.example.com 731 tester :bob")
+	received := expectEvents(t, events, 2)
+	if evt := received[0]; evt.Nick != "Alice" || evt.Host != "a.example" || !evt.Online {
+		t.Errorf("Unexpected online event: %+v", evt)
+	} else if received[1].Nick != "bob" || received[1].Online {
+		t.Errorf("Unexpected offline event: %+v", received[1])
+	}
+	expectPresence(t, c, "ALICE", true, true)
+	expectPresence(t, c, "bob", false, true)
+
+	// A MOTD requested by the user doesn't restart tracking, so the repeated replies don't cause new events.
+	feedLines(c, ":irc.example.com 376 tester :End of MOTD")
+	expectSent(t, c)
+	feedLines(c, ":irc.example.com 730 tester :Alice!a@a.example")
+	expectEvents(t, events, 0)
+
+	c.Unmonitor("alice")
+	c.Monitor("carol")
+	expectSent(t, c, "MONITOR - alice", "MONITOR + carol")
+	if monitored := c.GetMonitored(); len(monitored) != 2 || monitored[0] != "bob" || monitored[1] != "carol" {
+		t.Errorf("Unexpected monitored nicks: %q", monitored)
+	}
+}
+
+func TestPresenceRestartsAfterReconnect(t *testing.T) {
+	c, _ := newPresenceConn(t, map[string]string{"MONITOR": ""})
+	c.Monitor("alice")
+	feedLines(c, ":irc.example.com 376 tester :End of MOTD", ":irc.example.com 730 tester :alice")
+	expectSent(t, c, "MONITOR + alice")
+	c.stopPresence()
+	feedLines(c, ":irc.example.com 422 tester :MOTD File is missing")
+	expectSent(t, c, "MONITOR + alice")
+	expectPresence(t, c, "alice", false, false)
+}
+
+func TestPresenceWatch(t *testing.T) {
+	c, events := newPresenceConn(t, map[string]string{"WATCH": "128"})
+	c.Monitor("alice", "bob")
+	feedLines(c, ":irc.example.com 376 tester :End of MOTD")
+	expectSent(t, c, "WATCH +alice +bob")
+	feedLines(c,
+		":irc.example.com 604 tester alice a a.example 1577836800 :is online",
+		":irc.example.com 605 tester bob * * 0 :is offline",
+		":irc.example.com 601 tester alice a a.example 1577836900 :logged offline")
+	if evt := expectEvents(t, events, 3)[0]; evt.Nick != "alice" || evt.User != "a" || !evt.Online {
+		t.Errorf("Unexpected online event: %+v", evt)
+	}
+	expectPresence(t, c, "alice", false, true)
+	expectPresence(t, c, "bob", false, true)
+	c.Unmonitor("bob")
+	expectSent(t, c, "WATCH -bob")
+}
+
+func TestPresenceISON(t *testing.T) {
+	c, events := newPresenceConn(t, nil)
+	c.Monitor("alice", "bob")
+	feedLines(c, ":irc.example.com 376 tester :End of MOTD")
+	if sent := waitSent(t, c); sent.Command != "ISON" || len(sent.Params) != 2 || sent.Params[0] != "alice" {
+		t.Fatalf("Unexpected request: %s", sent)
+	}
+	feedLines(c, ":irc.example.com 303 tester :alice")
+	expectEvents(t, events, 2)
+	expectPresence(t, c, "alice", true, true)
+	expectPresence(t, c, "bob", false, true)
+}
+
+func TestPresenceOverflow(t *testing.T) {
+	c, events := newPresenceConn(t, map[string]string{"MONITOR": "1"})
+	c.Monitor("alice", "bob")
+	feedLines(c, ":irc.example.com 376 tester :End of MOTD")
+	if sent := waitSent(t, c); sent.String() != "MONITOR + alice" {
+		t.Fatalf("Unexpected MONITOR request: %s", sent)
+	}
+	// The targets that don't fit in the MONITOR list are polled instead.
+	if sent := waitSent(t, c); sent.Command != "ISON" || len(sent.Params) != 1 || sent.Params[0] != "bob" {
+		t.Fatalf("Unexpected ISON request: %s", sent)
+	}
+	feedLines(c, ":irc.example.com 303 tester :bob")
+	expectEvents(t, events, 1)
+	expectPresence(t, c, "bob", true, true)
+}
@@ -0,0 +1,188 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package prometheus exports the metrics of libmauirc connections in the Prometheus text format.
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	irc "maunium.net/go/libmauirc"
+)
+
+// ContentType is the content type of the Prometheus text format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter collects the metrics of connections and writes them in the Prometheus text format. It implements
+// http.Handler, so it can be served directly, e.g. with http.Handle("/metrics", exporter).
+type Exporter struct {
+	conns map[string]irc.Metrics
+	lock  sync.RWMutex
+}
+
+// NewExporter creates an exporter with no connections.
+func NewExporter() *Exporter {
+	return &Exporter{conns: make(map[string]irc.Metrics)}
+}
+
+// Add adds a connection to the exporter. The name is used as the connection label of its metrics.
+func (e *Exporter) Add(name string, conn irc.Metrics) {
+	e.lock.Lock()
+	e.conns[name] = conn
+	e.lock.Unlock()
+}
+
+// Remove removes the connection with the given name from the exporter.
+func (e *Exporter) Remove(name string) {
+	e.lock.Lock()
+	delete(e.conns, name)
+	e.lock.Unlock()
+}
+
+// namedStats is the stats of a connection with its name.
+type namedStats struct {
+	name  string
+	stats irc.Stats
+}
+
+// collect returns the stats of all connections sorted by name.
+func (e *Exporter) collect() []namedStats {
+	e.lock.RLock()
+	all := make([]namedStats, 0, len(e.conns))
+	for name, conn := range e.conns {
+		all = append(all, namedStats{name: name, stats: conn.Stats()})
+	}
+	e.lock.RUnlock()
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].name < all[j].name
+	})
+	return all
+}
+
+// WriteTo writes the metrics of all connections to the given writer.
+func (e *Exporter) WriteTo(w io.Writer) (int64, error) {
+	all := e.collect()
+	var buf bytes.Buffer
+
+	family(&buf, "libmauirc_lines_total", "counter", "Lines sent and received by command.")
+	for _, conn := range all {
+		forEachCommand(conn.stats, func(command string, stats irc.TrafficStats) {
+			sample(&buf, "libmauirc_lines_total", float64(stats.LinesIn), "connection", conn.name,
+				"direction", "in", "command", command)
+			sample(&buf, "libmauirc_lines_total", float64(stats.LinesOut), "connection", conn.name,
+				"direction", "out", "command", command)
+		})
+	}
+	family(&buf, "libmauirc_bytes_total", "counter", "Bytes sent and received by command.")
+	for _, conn := range all {
+		forEachCommand(conn.stats, func(command string, stats irc.TrafficStats) {
+			sample(&buf, "libmauirc_bytes_total", float64(stats.BytesIn), "connection", conn.name,
+				"direction", "in", "command", command)
+			sample(&buf, "libmauirc_bytes_total", float64(stats.BytesOut), "connection", conn.name,
+				"direction", "out", "command", command)
+		})
+	}
+	family(&buf, "libmauirc_queue_depth", "gauge", "Messages waiting to be sent.")
+	for _, conn := range all {
+		sample(&buf, "libmauirc_queue_depth", float64(conn.stats.QueueDepth), "connection", conn.name)
+	}
+	family(&buf, "libmauirc_reconnects_total", "counter", "Reconnects after disconnections.")
+	for _, conn := range all {
+		sample(&buf, "libmauirc_reconnects_total", float64(conn.stats.Reconnects), "connection", conn.name)
+	}
+	family(&buf, "libmauirc_connected", "gauge", "Whether the connection is active.")
+	for _, conn := range all {
+		connected := 0.0
+		if conn.stats.Connected {
+			connected = 1
+		}
+		sample(&buf, "libmauirc_connected", connected, "connection", conn.name)
+	}
+	family(&buf, "libmauirc_connected_seconds_total", "counter", "Total time the connection has been active.")
+	for _, conn := range all {
+		sample(&buf, "libmauirc_connected_seconds_total", conn.stats.TimeConnected.Seconds(), "connection", conn.name)
+	}
+	family(&buf, "libmauirc_lag_seconds", "gauge", "Round-trip time of PINGs in the lag history.")
+	for _, conn := range all {
+		if len(conn.stats.Lag.Samples) == 0 {
+			continue
+		}
+		lag := conn.stats.Lag
+		sample(&buf, "libmauirc_lag_seconds", lag.Last.Seconds(), "connection", conn.name, "stat", "last")
+		sample(&buf, "libmauirc_lag_seconds", lag.Min.Seconds(), "connection", conn.name, "stat", "min")
+		sample(&buf, "libmauirc_lag_seconds", lag.Avg.Seconds(), "connection", conn.name, "stat", "avg")
+		sample(&buf, "libmauirc_lag_seconds", lag.Max.Seconds(), "connection", conn.name, "stat", "max")
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP writes the metrics as the response.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	e.WriteTo(w)
+}
+
+// forEachCommand calls the given function with the traffic stats of each command sorted by command.
+func forEachCommand(stats irc.Stats, fn func(command string, stats irc.TrafficStats)) {
+	commands := make([]string, 0, len(stats.Commands))
+	for command := range stats.Commands {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+	for _, command := range commands {
+		name := command
+		if len(name) == 0 {
+			name = "unknown"
+		}
+		fn(name, stats.Commands[command])
+	}
+}
+
+// family writes the HELP and TYPE lines of a metric family.
+func family(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelEscaper escapes label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sample writes a single sample. The labels are given as name-value pairs.
+func sample(buf *bytes.Buffer, name string, value float64, labels ...string) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(labels[i])
+			buf.WriteString(`="`)
+			buf.WriteString(labelEscaper.Replace(labels[i+1]))
+			buf.WriteByte('"')
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	buf.WriteByte('\n')
+}
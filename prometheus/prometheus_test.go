@@ -0,0 +1,122 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package prometheus exports the metrics of libmauirc connections in the Prometheus text format.
+package prometheus
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	irc "maunium.net/go/libmauirc"
+)
+
+// staticMetrics is a Metrics implementation that always returns the same stats.
+type staticMetrics irc.Stats
+
+func (m staticMetrics) Stats() irc.Stats {
+	return irc.Stats(m)
+}
+
+func (m staticMetrics) GetLag() time.Duration {
+	return m.Lag.Last
+}
+
+func TestWriteTo(t *testing.T) {
+	exporter := NewExporter()
+	exporter.Add("net", staticMetrics{
+		Commands: map[string]irc.TrafficStats{
+			"PRIVMSG": {LinesIn: 2, LinesOut: 1, BytesIn: 100, BytesOut: 30},
+			"":        {LinesIn: 1, BytesIn: 10},
+		},
+		QueueDepth:    3,
+		Reconnects:    2,
+		Connected:     true,
+		TimeConnected: 90 * time.Second,
+		Lag: irc.LagStats{
+			Last:    250 * time.Millisecond,
+			Min:     100 * time.Millisecond,
+			Avg:     200 * time.Millisecond,
+			Max:     250 * time.Millisecond,
+			Samples: []irc.LagSample{{Lag: 100 * time.Millisecond}, {Lag: 250 * time.Millisecond}},
+		},
+	})
+	exporter.Add("a\"b\\c\nd", staticMetrics{})
+	exporter.Add("removed", staticMetrics{})
+	exporter.Remove("removed")
+
+	var buf bytes.Buffer
+	n, err := exporter.WriteTo(&buf)
+	if err != nil {
+		t.Fatal("WriteTo failed:", err)
+	} else if n != int64(buf.Len()) {
+		t.Errorf("WriteTo returned %d, but wrote %d bytes", n, buf.Len())
+	}
+	expected := `# HELP libmauirc_lines_total Lines sent and received by command.
+# TYPE libmauirc_lines_total counter
+libmauirc_lines_total{connection="net",direction="in",command="unknown"} 1
+libmauirc_lines_total{connection="net",direction="out",command="unknown"} 0
+libmauirc_lines_total{connection="net",direction="in",command="PRIVMSG"} 2
+libmauirc_lines_total{connection="net",direction="out",command="PRIVMSG"} 1
+# HELP libmauirc_bytes_total Bytes sent and received by command.
+# TYPE libmauirc_bytes_total counter
+libmauirc_bytes_total{connection="net",direction="in",command="unknown"} 10
+libmauirc_bytes_total{connection="net",direction="out",command="unknown"} 0
+libmauirc_bytes_total{connection="net",direction="in",command="PRIVMSG"} 100
+libmauirc_bytes_total{connection="net",direction="out",command="PRIVMSG"} 30
+# HELP libmauirc_queue_depth Messages waiting to be sent.
+# TYPE libmauirc_queue_depth gauge
+libmauirc_queue_depth{connection="a\"b\\c\nd"} 0
+libmauirc_queue_depth{connection="net"} 3
+# HELP libmauirc_reconnects_total Reconnects after disconnections.
+# TYPE libmauirc_reconnects_total counter
+libmauirc_reconnects_total{connection="a\"b\\c\nd"} 0
+libmauirc_reconnects_total{connection="net"} 2
+# HELP libmauirc_connected Whether the connection is active.
+# TYPE libmauirc_connected gauge
+libmauirc_connected{connection="a\"b\\c\nd"} 0
+libmauirc_connected{connection="net"} 1
+# HELP libmauirc_connected_seconds_total Total time the connection has been active.
+# TYPE libmauirc_connected_seconds_total counter
+libmauirc_connected_seconds_total{connection="a\"b\\c\nd"} 0
+libmauirc_connected_seconds_total{connection="net"} 90
+# HELP libmauirc_lag_seconds Round-trip time of PINGs in the lag history.
+# TYPE libmauirc_lag_seconds gauge
+libmauirc_lag_seconds{connection="net",stat="last"} 0.25
+libmauirc_lag_seconds{connection="net",stat="min"} 0.1
+libmauirc_lag_seconds{connection="net",stat="avg"} 0.2
+libmauirc_lag_seconds{connection="net",stat="max"} 0.25
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	exporter := NewExporter()
+	exporter.Add("net", staticMetrics{Reconnects: 1})
+	recorder := httptest.NewRecorder()
+	exporter.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != ContentType {
+		t.Errorf("Expected content type %q, got %q", ContentType, contentType)
+	}
+	if !strings.Contains(recorder.Body.String(), "libmauirc_reconnects_total{connection=\"net\"} 1\n") {
+		t.Errorf("Metrics missing from response:\n%s", recorder.Body.String())
+	}
+}
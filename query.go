@@ -0,0 +1,466 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// Numerics that aren't in RFC 2812, but are sent by most modern servers.
+const (
+	rplWhoisAccount = "330"
+	rplWhoisSecure  = "671"
+)
+
+// Querier contains functions that send a request and wait for the server's reply.
+//
+// Replies are dispatched by the goroutine that runs the handlers, so the functions can't be called from a handler.
+// They return ErrCalledFromHandler instead of blocking. Start a goroutine in the handler to send a query. The same
+// applies to the other functions that wait for replies, such as CTCPRequest, the History functions, ZNCCommand,
+// BouncerClient.ListNetworks and the Wait functions of LabeledResponse and Delivery.
+type Querier interface {
+	// WhoisSync sends a WHOIS request on the given nick and waits for the reply.
+	WhoisSync(ctx context.Context, nick string) (*WhoisInfo, error)
+	// WhowasSync sends a WHOWAS request on the given nick and waits for the reply.
+	WhowasSync(ctx context.Context, nick string) ([]*WhoisInfo, error)
+	// WhoSync sends a WHO request with the given mask and waits for the reply.
+	WhoSync(ctx context.Context, mask string, op bool) ([]*WhoReply, error)
+	// ListSync requests the server for a list of channels and waits for the reply.
+	ListSync(ctx context.Context) ([]*ChannelListEntry, error)
+	// NamesSync requests the list of users in the given channel and waits for the reply.
+	NamesSync(ctx context.Context, ch string) ([]string, error)
+}
+
+// WhoisInfo contains the information received as a reply to a WHOIS or WHOWAS request.
+type WhoisInfo struct {
+	Nick       string
+	User       string
+	Host       string
+	RealName   string
+	Server     string
+	ServerInfo string
+	Account    string
+	AwayMsg    string
+	Channels   []string
+	Operator   bool
+	Secure     bool
+	Idle       time.Duration
+	SignOn     time.Time
+}
+
+// WhoReply is a single user in a reply to a WHO request.
+type WhoReply struct {
+	Channel  string
+	User     string
+	Host     string
+	Server   string
+	Nick     string
+	Flags    string
+	Away     bool
+	Operator bool
+	Hops     int
+	RealName string
+}
+
+// ChannelListEntry is a single channel in a reply to a LIST request.
+type ChannelListEntry struct {
+	Channel string
+	Users   int
+	Topic   string
+}
+
+// query is a pending request waiting for replies from the server.
+type query struct {
+	// accept is called with every incoming message. It returns whether or not the message was a part of the reply
+	// and whether or not the reply is complete.
+	accept func(evt *Event) (matched, done bool)
+	err    error
+	done   chan struct{}
+}
+
+// args returns all the parameters of the given message including the trailing parameter.
+func args(msg *irc.Message) []string {
+	if len(msg.Trailing) > 0 || msg.EmptyTrailing {
+		return append(msg.Params[:len(msg.Params):len(msg.Params)], msg.Trailing)
+	}
+	return msg.Params
+}
+
+// dispatchQueries passes the given message to the oldest pending query that accepts it.
+// Labeled messages are skipped, as they belong to the labeled request that caused them. The return value tells
+// whether or not a query accepted the message.
+func (c *ConnImpl) dispatchQueries(evt *Event) bool {
+	if len(evt.Label()) > 0 {
+		return false
+	}
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	for i, q := range c.queries {
+		matched, done := q.accept(evt)
+		if !matched {
+			continue
+		} else if done {
+			c.queries = append(c.queries[:i], c.queries[i+1:]...)
+			close(q.done)
+		}
+		return true
+	}
+	return false
+}
+
+// failQueries cancels all pending queries with the given error.
+func (c *ConnImpl) failQueries(err error) {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	for _, q := range c.queries {
+		q.err = err
+		close(q.done)
+	}
+	c.queries = nil
+}
+
+// runQuery registers the given query, sends the request and waits until the query is complete or the context is done.
+// If labeled-response is enabled, the request is labeled and the reply is matched using the label instead.
+func (c *ConnImpl) runQuery(ctx context.Context, q *query, request *irc.Message) error {
+	if c.inHandler() {
+		return ErrCalledFromHandler
+	}
+	if lr, err := c.SendLabeled(request); err == nil {
+		events, err := lr.Wait(ctx)
+		if err != nil {
+			return err
+		} else if lr.batchEvent != nil {
+			if _, done := q.accept(lr.batchEvent); done {
+				return q.err
+			}
+		}
+		for _, evt := range events {
+			if _, done := q.accept(evt); done {
+				break
+			}
+		}
+		return q.err
+	}
+	return c.waitQuery(ctx, q, request)
+}
+
+// waitQuery registers the given query, sends the request and waits until the query is complete or the context is
+// done without using labels.
+func (c *ConnImpl) waitQuery(ctx context.Context, q *query, request *irc.Message) error {
+	if c.inHandler() {
+		return ErrCalledFromHandler
+	} else if err := ValidateMessage(request); err != nil {
+		return err
+	}
+	q.done = make(chan struct{})
+	c.queryLock.Lock()
+	c.queries = append(c.queries, q)
+	c.queryLock.Unlock()
+
+	if err := c.Send(request); err != nil {
+		c.removeQuery(q)
+		return err
+	}
+
+	select {
+	case <-q.done:
+		return q.err
+	case <-ctx.Done():
+		if c.removeQuery(q) {
+			return ctx.Err()
+		}
+		// The query finished while we were acquiring the lock.
+		return q.err
+	}
+}
+
+// removeQuery removes the given query from the pending queries. The return value tells whether or not the query was
+// still pending.
+func (c *ConnImpl) removeQuery(q *query) bool {
+	c.queryLock.Lock()
+	defer c.queryLock.Unlock()
+	for i, pending := range c.queries {
+		if pending == q {
+			c.queries = append(c.queries[:i], c.queries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// queryError creates a QueryError from the given error numeric.
+func queryError(msg *irc.Message) error {
+	params := args(msg)
+	err := QueryError{Code: msg.Command}
+	if len(params) > 1 {
+		err.Target = params[1]
+	}
+	if len(params) > 2 {
+		err.Message = params[len(params)-1]
+	}
+	return err
+}
+
+// WhoisSync - See Querier interface docs
+func (c *ConnImpl) WhoisSync(ctx context.Context, nick string) (*WhoisInfo, error) {
+	info := &WhoisInfo{Nick: nick}
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		params := evt.Args()
+		if len(params) < 2 || !c.equalName(params[1], nick) {
+			return false, false
+		}
+		switch evt.Command {
+		case irc.RPL_WHOISUSER:
+			if len(params) > 5 {
+				info.Nick, info.User, info.Host, info.RealName = params[1], params[2], params[3], params[5]
+			}
+		case irc.RPL_WHOISSERVER:
+			if len(params) > 3 {
+				info.Server, info.ServerInfo = params[2], params[3]
+			}
+		case irc.RPL_WHOISOPERATOR:
+			info.Operator = true
+		case irc.RPL_WHOISIDLE:
+			if len(params) > 3 {
+				idle, _ := strconv.Atoi(params[2])
+				signon, _ := strconv.ParseInt(params[3], 10, 64)
+				info.Idle = time.Duration(idle) * time.Second
+				info.SignOn = time.Unix(signon, 0)
+			}
+		case irc.RPL_WHOISCHANNELS:
+			info.Channels = append(info.Channels, strings.Fields(params[len(params)-1])...)
+		case irc.RPL_AWAY:
+			info.AwayMsg = params[len(params)-1]
+		case rplWhoisAccount:
+			if len(params) > 2 {
+				info.Account = params[2]
+			}
+		case rplWhoisSecure:
+			info.Secure = true
+		case irc.ERR_NOSUCHNICK:
+			q.err = queryError(evt.Message)
+		case irc.ERR_NOSUCHSERVER:
+			// Servers don't send an end of whois after this error.
+			q.err = queryError(evt.Message)
+			return true, true
+		case irc.RPL_ENDOFWHOIS:
+			return true, true
+		default:
+			return false, false
+		}
+		return true, false
+	}
+	err := c.runQuery(ctx, q, &irc.Message{
+		Command: irc.WHOIS,
+		Params:  []string{nick},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// WhowasSync - See Querier interface docs
+func (c *ConnImpl) WhowasSync(ctx context.Context, nick string) ([]*WhoisInfo, error) {
+	var infos []*WhoisInfo
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		params := evt.Args()
+		if len(params) < 2 || !c.equalName(params[1], nick) {
+			return false, false
+		}
+		switch evt.Command {
+		case irc.RPL_WHOWASUSER:
+			if len(params) > 5 {
+				infos = append(infos, &WhoisInfo{Nick: params[1], User: params[2], Host: params[3], RealName: params[5]})
+			}
+		case irc.RPL_WHOISSERVER:
+			if len(infos) > 0 && len(params) > 3 {
+				infos[len(infos)-1].Server = params[2]
+				infos[len(infos)-1].ServerInfo = params[3]
+			}
+		case rplWhoisAccount:
+			if len(infos) > 0 && len(params) > 2 {
+				infos[len(infos)-1].Account = params[2]
+			}
+		case irc.ERR_WASNOSUCHNICK:
+			q.err = queryError(evt.Message)
+		case irc.RPL_ENDOFWHOWAS:
+			return true, true
+		default:
+			return false, false
+		}
+		return true, false
+	}
+	err := c.runQuery(ctx, q, &irc.Message{
+		Command: irc.WHOWAS,
+		Params:  []string{nick},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// WhoSync - See Querier interface docs
+func (c *ConnImpl) WhoSync(ctx context.Context, mask string, op bool) ([]*WhoReply, error) {
+	var replies []*WhoReply
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		params := evt.Args()
+		switch evt.Command {
+		case irc.RPL_WHOREPLY:
+			if len(params) < 8 {
+				return false, false
+			}
+			reply := &WhoReply{
+				Channel: params[1],
+				User:    params[2],
+				Host:    params[3],
+				Server:  params[4],
+				Nick:    params[5],
+				Flags:   params[6],
+			}
+			reply.Away = strings.HasPrefix(reply.Flags, "G")
+			reply.Operator = strings.ContainsRune(reply.Flags, '*')
+			parts := strings.SplitN(params[7], " ", 2)
+			reply.Hops, _ = strconv.Atoi(parts[0])
+			if len(parts) > 1 {
+				reply.RealName = parts[1]
+			}
+			if !c.whoReplyMatches(reply, mask) {
+				return false, false
+			}
+			replies = append(replies, reply)
+			return true, false
+		case irc.RPL_ENDOFWHO:
+			return len(params) > 1 && c.equalName(params[1], mask), true
+		case irc.ERR_NOSUCHSERVER:
+			if len(params) > 1 && c.equalName(params[1], mask) {
+				q.err = queryError(evt.Message)
+				return true, true
+			}
+		}
+		return false, false
+	}
+	request := &irc.Message{
+		Command: irc.WHO,
+		Params:  []string{mask},
+	}
+	if op {
+		request.Params = append(request.Params, "o")
+	}
+	err := c.runQuery(ctx, q, request)
+	if err != nil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// whoReplyMatches checks if the given WHO reply could be a part of the reply to a WHO request with the given mask, so
+// that replies to other WHO requests sent at the same time aren't mixed in.
+func (c *ConnImpl) whoReplyMatches(reply *WhoReply, mask string) bool {
+	if mask == "0" {
+		return true
+	} else if c.isChannel(mask) {
+		return c.equalName(reply.Channel, mask)
+	}
+	mapping := c.CaseMapping()
+	if strings.ContainsAny(mask, "!@") {
+		return Hostmask{Nick: reply.Nick, User: reply.User, Host: reply.Host}.Matches(mask, mapping)
+	}
+	// Servers match other masks against the nick, username, host, server and real name.
+	for _, field := range []string{reply.Nick, reply.User, reply.Host, reply.Server, reply.RealName} {
+		if mapping.Match(mask, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListSync - See Querier interface docs
+func (c *ConnImpl) ListSync(ctx context.Context) ([]*ChannelListEntry, error) {
+	var entries []*ChannelListEntry
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		params := evt.Args()
+		switch evt.Command {
+		case irc.RPL_LISTSTART:
+			return true, false
+		case irc.RPL_LIST:
+			if len(params) > 2 {
+				entry := &ChannelListEntry{Channel: params[1]}
+				entry.Users, _ = strconv.Atoi(params[2])
+				if len(params) > 3 {
+					entry.Topic = params[3]
+				}
+				entries = append(entries, entry)
+			}
+			return true, false
+		case irc.RPL_LISTEND:
+			return true, true
+		}
+		return false, false
+	}
+	err := c.runQuery(ctx, q, &irc.Message{
+		Command: irc.LIST,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// NamesSync - See Querier interface docs
+// The returned names include the channel membership prefixes (e.g. @ for operators).
+func (c *ConnImpl) NamesSync(ctx context.Context, ch string) ([]string, error) {
+	var names []string
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		params := evt.Args()
+		switch evt.Command {
+		case irc.RPL_NAMREPLY:
+			if len(params) > 3 && c.equalName(params[2], ch) {
+				names = append(names, strings.Fields(params[3])...)
+				return true, false
+			}
+		case irc.RPL_ENDOFNAMES:
+			return len(params) > 1 && c.equalName(params[1], ch), true
+		case irc.ERR_NOSUCHCHANNEL:
+			if len(params) > 1 && c.equalName(params[1], ch) {
+				q.err = queryError(evt.Message)
+				return true, true
+			}
+		}
+		return false, false
+	}
+	err := c.runQuery(ctx, q, &irc.Message{
+		Command: irc.NAMES,
+		Params:  []string{ch},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
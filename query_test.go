@@ -0,0 +1,141 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+	"maunium.net/go/libmauirc/fakeirc"
+)
+
+func TestWhoReplyMatches(t *testing.T) {
+	c := Create("tester", "tester", nil).(*ConnImpl)
+	reply := &WhoReply{
+		Channel:  "#Chan",
+		User:     "~bob",
+		Host:     "example.org",
+		Server:   "irc.example.com",
+		Nick:     "Bob",
+		RealName: "Bob Example",
+	}
+	tests := map[string]bool{
+		"#chan":              true,
+		"#other":             false,
+		"bob":                true,
+		"alice":              false,
+		"b*":                 true,
+		"*.org":              true,
+		"*.net":              false,
+		"bob!*@*":            true,
+		"*!~bob@example.org": true,
+		"*!*@example.net":    false,
+		"0":                  true,
+		"*":                  true,
+	}
+	for mask, expected := range tests {
+		if matched := c.whoReplyMatches(reply, mask); matched != expected {
+			t.Errorf("Mask %q: expected match to be %v, got %v", mask, expected, matched)
+		}
+	}
+}
+
+func TestWhoSyncConcurrent(t *testing.T) {
+	srv, c, _ := startFake(t)
+	var lock sync.Mutex
+	requests := 0
+	srv.On(irc.WHO, func(client *fakeirc.Client, msg *irc.Message) bool {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if requests == 2 {
+			// Interleave the replies to both requests.
+			client.Send(":irc.example.com 352 tester #a ~alice a.example alice.example alice H :0 Alice")
+			client.Send(":irc.example.com 352 tester #b ~bob b.example bob.example bob H@ :0 Bob")
+			client.Send(":irc.example.com 352 tester #a ~carol c.example c.example carol G :1 Carol")
+			client.Send(":irc.example.com 315 tester #b :End of WHO list")
+			client.Send(":irc.example.com 315 tester #a :End of WHO list")
+		}
+		return true
+	})
+
+	type result struct {
+		replies []*WhoReply
+		err     error
+	}
+	results := make(map[string]chan result)
+	for _, ch := range []string{"#a", "#b"} {
+		resultChan := make(chan result, 1)
+		results[ch] = resultChan
+		go func(ch string) {
+			replies, err := c.WhoSync(testContext(t), ch, false)
+			resultChan <- result{replies, err}
+		}(ch)
+	}
+
+	a := <-results["#a"]
+	if a.err != nil {
+		t.Fatal("WHO #a failed:", a.err)
+	} else if len(a.replies) != 2 || a.replies[0].Nick != "alice" || a.replies[1].Nick != "carol" {
+		t.Fatalf("Unexpected replies to WHO #a: %+v", a.replies)
+	} else if !a.replies[1].Away || a.replies[1].Hops != 1 || a.replies[1].RealName != "Carol" {
+		t.Errorf("Reply wasn't parsed correctly: %+v", a.replies[1])
+	}
+	b := <-results["#b"]
+	if b.err != nil {
+		t.Fatal("WHO #b failed:", b.err)
+	} else if len(b.replies) != 1 || b.replies[0].Nick != "bob" {
+		t.Fatalf("Unexpected replies to WHO #b: %+v", b.replies)
+	}
+}
+
+func TestQueryFromHandler(t *testing.T) {
+	srv := fakeirc.NewServer()
+	t.Cleanup(srv.Close)
+	srv.On(irc.WHO, func(client *fakeirc.Client, msg *irc.Message) bool {
+		client.Send(":irc.example.com 352 tester * ~bob b.example b.example bob H :0 Bob")
+		client.Send(":irc.example.com 315 tester " + msg.Params[0] + " :End of WHO list")
+		return true
+	})
+	c := newFakeConn(t, srv, "tester")
+	handlerErr := make(chan error, 1)
+	goroutineErr := make(chan error, 1)
+	c.AddHandler(irc.PRIVMSG, func(evt *Event) {
+		start := time.Now()
+		_, err := c.WhoSync(testContext(t), "bob", false)
+		if time.Since(start) > time.Second {
+			t.Error("WhoSync blocked in a handler")
+		}
+		handlerErr <- err
+		go func() {
+			_, err := c.WhoSync(testContext(t), "bob", false)
+			goroutineErr <- err
+		}()
+	})
+	client := connectFake(t, srv, c)
+	client.Send(":alice!a@a.example PRIVMSG tester :who is bob?")
+
+	if err := <-handlerErr; err != ErrCalledFromHandler {
+		t.Errorf("Expected ErrCalledFromHandler from a handler, got %v", err)
+	}
+	if err := <-goroutineErr; err != nil {
+		t.Errorf("Query from a goroutine started by a handler failed: %v", err)
+	}
+}
@@ -0,0 +1,326 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction is the direction of a recorded line.
+type Direction string
+
+// Directions of recorded lines
+const (
+	DirectionIn  Direction = "in"
+	DirectionOut Direction = "out"
+)
+
+// RecordEntry is a single line in a traffic recording.
+type RecordEntry struct {
+	Time time.Time `json:"time"`
+	// Conn is the ID of the connection the line was sent or received on. Each call to Connect gets a new ID, so
+	// reconnects and connections sharing a recorder can be told apart.
+	Conn      uint64    `json:"conn"`
+	Direction Direction `json:"dir"`
+	Line      string    `json:"line"`
+}
+
+// connectionCounter is used to give each connection a unique ID.
+var connectionCounter uint64
+
+// Recorder writes every line sent and received by connections to a writer as JSON lines. Secrets in the lines are
+// redacted with RedactLine before writing. A recorder can be shared by many connections.
+type Recorder struct {
+	encoder *json.Encoder
+	err     error
+	lock    sync.Mutex
+}
+
+// NewRecorder creates a recorder that writes to the given writer.
+func NewRecorder(writer io.Writer) *Recorder {
+	return &Recorder{encoder: json.NewEncoder(writer)}
+}
+
+// Record writes a line to the recording. Lines are dropped after the first write error.
+func (rec *Recorder) Record(conn uint64, dir Direction, line string) {
+	entry := RecordEntry{
+		Time:      time.Now(),
+		Conn:      conn,
+		Direction: dir,
+		Line:      RedactLine(line),
+	}
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if rec.err == nil {
+		rec.err = rec.encoder.Encode(&entry)
+	}
+}
+
+// Err returns the first error that happened while writing the recording.
+func (rec *Recorder) Err() error {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return rec.err
+}
+
+// ReadRecording reads all the entries of a recording written by a Recorder.
+func ReadRecording(reader io.Reader) ([]RecordEntry, error) {
+	var entries []RecordEntry
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		var entry RecordEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// redacted replaces secrets in redacted lines.
+const redacted = "<redacted>"
+
+// nickServSecrets maps NickServ commands that contain passwords to the number of words after the command that are
+// kept. The rest of the words are redacted.
+var nickServSecrets = map[string]int{
+	"IDENTIFY": 0,
+	"REGISTER": 0,
+	"GHOST":    1,
+	"RECOVER":  1,
+	"RELEASE":  1,
+	"REGAIN":   1,
+}
+
+// RedactLine replaces passwords and other secrets in a raw IRC line. PASS, OPER and AUTHENTICATE payloads and
+// passwords sent to NickServ are redacted. Other lines are returned as-is.
+func RedactLine(line string) string {
+	rest := line
+	var head string
+	// Skip the tags and the source.
+	for len(rest) > 0 && (rest[0] == '@' || rest[0] == ':') {
+		end := strings.IndexByte(rest, ' ')
+		if end < 0 {
+			return line
+		}
+		head += rest[:end+1]
+		rest = strings.TrimLeft(rest[end+1:], " ")
+	}
+	end := strings.IndexByte(rest, ' ')
+	if end < 0 {
+		return line
+	}
+	command, params := rest[:end+1], rest[end+1:]
+	switch strings.ToUpper(strings.TrimSpace(command)) {
+	case "PASS":
+		return head + command + redacted
+	case "OPER":
+		name := strings.SplitN(params, " ", 2)[0]
+		return head + command + name + " " + redacted
+	case "AUTHENTICATE":
+		payload := strings.TrimPrefix(params, ":")
+		if payload == "+" || payload == "*" || isSASLMechanism(payload) {
+			return line
+		}
+		return head + command + redacted
+	case "PRIVMSG", "NOTICE":
+		parts := strings.SplitN(params, " ", 2)
+		if len(parts) < 2 || !strings.HasPrefix(strings.ToLower(parts[0]), "nickserv") {
+			return line
+		}
+		text := strings.TrimPrefix(parts[1], ":")
+		prefix := head + command + parts[0] + " "
+		if strings.HasPrefix(parts[1], ":") {
+			prefix += ":"
+		}
+		if redactedText, ok := redactNickServ(text); ok {
+			return prefix + redactedText
+		}
+	case "NS", "NICKSERV":
+		if redactedParams, ok := redactNickServ(strings.TrimPrefix(params, ":")); ok {
+			if strings.HasPrefix(params, ":") {
+				redactedParams = ":" + redactedParams
+			}
+			return head + command + redactedParams
+		}
+	}
+	return line
+}
+
+// redactNickServ redacts the passwords in a NickServ command. ok is false if the command doesn't contain passwords.
+func redactNickServ(text string) (string, bool) {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return text, false
+	}
+	keep, ok := nickServSecrets[strings.ToUpper(words[0])]
+	if !ok && len(words) > 1 && strings.EqualFold(words[0], "SET") && strings.EqualFold(words[1], "PASSWORD") {
+		keep, ok = 1, true
+	}
+	if !ok || len(words) <= keep+1 {
+		return text, false
+	}
+	return strings.Join(words[:keep+1], " ") + " " + redacted, true
+}
+
+// isSASLMechanism checks if the given AUTHENTICATE parameter is the name of a known SASL mechanism rather than a base64
+// payload. Unknown names are treated as payloads, because a short payload can look like a mechanism name.
+func isSASLMechanism(param string) bool {
+	switch param {
+	case "PLAIN", "EXTERNAL":
+		return true
+	}
+	return strings.HasPrefix(param, "SCRAM-SHA-")
+}
+
+// record writes a line to the recorder of the connection, if there is one.
+func (c *ConnImpl) record(dir Direction, line string) {
+	if c.Recorder != nil {
+		c.Recorder.Record(c.connID, dir, line)
+	}
+}
+
+// SetRecorder - see Data interface docs
+func (c *ConnImpl) SetRecorder(recorder *Recorder) {
+	c.Recorder = recorder
+}
+
+// Replay is a transport that plays back a recording made with a Recorder. Its Dial function can be used as the
+// Dialer of a connection, so that the connection receives the same lines it received when the recording was made.
+//
+// Each call to Dial plays back the next recorded connection. Before each received line, the replay waits until the
+// client has sent as many lines as it did before that line in the recording, so that handlers see the lines in the
+// same order relative to the client's own messages.
+type Replay struct {
+	// Timeout is how long to wait for the client to send the lines it sent in the recording before playing back
+	// the next received line anyway.
+	Timeout time.Duration
+
+	sessions [][]RecordEntry
+	next     int
+	playing  int
+	done     chan struct{}
+	lock     sync.Mutex
+}
+
+// NewReplay creates a replay of the given recorded entries. The entries are grouped by connection ID in the order
+// the connections first appear.
+func NewReplay(entries []RecordEntry) *Replay {
+	replay := &Replay{
+		Timeout: 5 * time.Second,
+		done:    make(chan struct{}),
+	}
+	indexes := make(map[uint64]int)
+	for _, entry := range entries {
+		index, ok := indexes[entry.Conn]
+		if !ok {
+			index = len(replay.sessions)
+			indexes[entry.Conn] = index
+			replay.sessions = append(replay.sessions, nil)
+		}
+		replay.sessions[index] = append(replay.sessions[index], entry)
+	}
+	if len(replay.sessions) == 0 {
+		close(replay.done)
+	}
+	return replay
+}
+
+// Dial starts playing back the next recorded connection and returns the client end of it. The network and address
+// are ignored. io.EOF is returned if all the recorded connections have been played back.
+func (replay *Replay) Dial(network, address string) (net.Conn, error) {
+	replay.lock.Lock()
+	if replay.next >= len(replay.sessions) {
+		replay.lock.Unlock()
+		return nil, io.EOF
+	}
+	session := replay.sessions[replay.next]
+	replay.next++
+	replay.playing++
+	replay.lock.Unlock()
+
+	server, client := net.Pipe()
+	go replay.play(server, session)
+	return client, nil
+}
+
+// Done returns a channel that's closed when all the recorded connections have been played back.
+func (replay *Replay) Done() <-chan struct{} {
+	return replay.done
+}
+
+// play writes the received lines of a recorded connection to the given connection.
+func (replay *Replay) play(conn net.Conn, session []RecordEntry) {
+	var sent int64
+	signal := make(chan struct{}, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			atomic.AddInt64(&sent, 1)
+			select {
+			case signal <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	var expected int64
+Loop:
+	for _, entry := range session {
+		if entry.Direction == DirectionOut {
+			expected++
+			continue
+		}
+		timeout := time.After(replay.Timeout)
+		for atomic.LoadInt64(&sent) < expected {
+			select {
+			case <-signal:
+			case <-closed:
+				break Loop
+			case <-timeout:
+				expected = atomic.LoadInt64(&sent)
+			}
+		}
+		if _, err := conn.Write([]byte(entry.Line + "\r\n")); err != nil {
+			break
+		}
+	}
+
+	replay.lock.Lock()
+	replay.playing--
+	if replay.playing == 0 && replay.next >= len(replay.sessions) {
+		close(replay.done)
+	}
+	replay.lock.Unlock()
+	// Keep reading until the client disconnects so that its writes don't block.
+	<-closed
+	conn.Close()
+}
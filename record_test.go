@@ -0,0 +1,81 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedactLine(t *testing.T) {
+	tests := map[string]string{
+		"PASS hunter2":                                  "PASS <redacted>",
+		"PASS :with spaces":                             "PASS <redacted>",
+		"OPER admin hunter2":                            "OPER admin <redacted>",
+		"AUTHENTICATE PLAIN":                            "AUTHENTICATE PLAIN",
+		"AUTHENTICATE SCRAM-SHA-256":                    "AUTHENTICATE SCRAM-SHA-256",
+		"AUTHENTICATE QUJD":                             "AUTHENTICATE <redacted>",
+		"AUTHENTICATE AB12-CD":                          "AUTHENTICATE <redacted>",
+		"AUTHENTICATE +":                                "AUTHENTICATE +",
+		"AUTHENTICATE *":                                "AUTHENTICATE *",
+		"AUTHENTICATE dGVzdAB0ZXN0AGh1bnRlcjI=":         "AUTHENTICATE <redacted>",
+		"PRIVMSG NickServ :IDENTIFY hunter2":            "PRIVMSG NickServ :IDENTIFY <redacted>",
+		"PRIVMSG NickServ :identify tester hunter2":     "PRIVMSG NickServ :identify <redacted>",
+		"PRIVMSG nickserv@services. :GHOST tester pw":   "PRIVMSG nickserv@services. :GHOST tester <redacted>",
+		"PRIVMSG NickServ :SET PASSWORD newpass":        "PRIVMSG NickServ :SET PASSWORD <redacted>",
+		"PRIVMSG NickServ :INFO tester":                 "PRIVMSG NickServ :INFO tester",
+		"PRIVMSG NickServ :GHOST tester":                "PRIVMSG NickServ :GHOST tester",
+		"NS IDENTIFY hunter2":                           "NS IDENTIFY <redacted>",
+		"NICKSERV :REGISTER hunter2 tester@example.com": "NICKSERV :REGISTER <redacted>",
+		"PRIVMSG #chan :IDENTIFY hunter2":               "PRIVMSG #chan :IDENTIFY hunter2",
+		"@label=a PASS hunter2":                         "@label=a PASS <redacted>",
+		":nick!user@host PRIVMSG NickServ :IDENTIFY pw": ":nick!user@host PRIVMSG NickServ :IDENTIFY <redacted>",
+		"@time=x :srv OPER admin hunter2":               "@time=x :srv OPER admin <redacted>",
+		"QUIT":                                          "QUIT",
+		":server.example":                               ":server.example",
+		"":                                              "",
+	}
+	for line, expected := range tests {
+		if redactedLine := RedactLine(line); redactedLine != expected {
+			t.Errorf("RedactLine(%q) = %q, expected %q", line, redactedLine, expected)
+		}
+	}
+}
+
+func TestRecorderRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	rec := NewRecorder(&buf)
+	rec.Record(1, DirectionOut, "PASS hunter2")
+	rec.Record(1, DirectionIn, ":server 001 tester :Welcome")
+	rec.Record(2, DirectionOut, "NICK tester")
+	if err := rec.Err(); err != nil {
+		t.Fatal("Failed to record:", err)
+	}
+	entries, err := ReadRecording(&buf)
+	if err != nil {
+		t.Fatal("Failed to read recording:", err)
+	} else if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if entries[0].Line != "PASS <redacted>" || entries[0].Direction != DirectionOut || entries[0].Conn != 1 {
+		t.Errorf("Unexpected first entry %+v", entries[0])
+	}
+	if entries[1].Direction != DirectionIn || entries[2].Conn != 2 {
+		t.Errorf("Unexpected entries %+v", entries[1:])
+	}
+}
@@ -0,0 +1,461 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// StateTracker contains functions to access the users and channels tracked by the connection.
+// The functions return copies, so the returned values are safe to use after the state changes.
+type StateTracker interface {
+	// GetUser returns the tracked information about the given user, or nil if the user isn't known.
+	GetUser(nick string) *User
+	// GetChannel returns the tracked information about the given channel, or nil if we're not in the channel.
+	GetChannel(name string) *Channel
+	// GetChannels returns the names of the channels we're in.
+	GetChannels() []string
+	// GetModeList returns the tracked entries of the given list mode in the given channel.
+	// Lists are only tracked after they've been fetched with ListModeSync.
+	GetModeList(ch string, mode byte) ([]*ListEntry, bool)
+	// SetTrackState enables or disables state tracking.
+	SetTrackState(track bool)
+}
+
+// User contains the information the state tracker knows about a user.
+type User struct {
+	Nick     string
+	User     string
+	Host     string
+	RealName string
+	// Account is the name of the account the user is logged into, or an empty string if the user isn't logged in.
+	Account string
+	Away    bool
+	AwayMsg string
+	// Channels contains the names of the channels the user shares with us.
+	Channels []string
+}
+
+// Channel contains the information the state tracker knows about a channel.
+type Channel struct {
+	Name  string
+	Topic string
+	// Members maps the nicks of the users in the channel to their membership prefixes (e.g. @ for operators).
+	Members map[string]string
+	// Modes maps the channel modes that aren't list or prefix modes to their parameters.
+	Modes map[byte]string
+}
+
+// channelState is the internal mutable state of a channel.
+type channelState struct {
+	name    string
+	topic   string
+	members map[string]string
+	modes   map[byte]string
+	// lists contains the list modes that have been fetched with ListModeSync.
+	lists map[byte][]*ListEntry
+}
+
+// foldName folds the case of the given nick or channel name for use as a map key.
+func (c *ConnImpl) foldName(name string) string {
+	return c.CaseMapping().Fold(name)
+}
+
+// isSelf checks if the given nick is our nick.
+func (c *ConnImpl) isSelf(nick string) bool {
+	return c.foldName(nick) == c.foldName(c.Nick)
+}
+
+// resetState clears the tracked users and channels.
+func (c *ConnImpl) resetState() {
+	c.stateLock.Lock()
+	c.users = make(map[string]*User)
+	c.channels = make(map[string]*channelState)
+	c.stateLock.Unlock()
+}
+
+// GetUser - See StateTracker interface docs
+func (c *ConnImpl) GetUser(nick string) *User {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	user, ok := c.users[c.foldName(nick)]
+	if !ok {
+		return nil
+	}
+	cp := *user
+	cp.Channels = nil
+	key := c.foldName(nick)
+	for _, ch := range c.channels {
+		if _, ok := ch.members[key]; ok {
+			cp.Channels = append(cp.Channels, ch.name)
+		}
+	}
+	return &cp
+}
+
+// GetChannel - See StateTracker interface docs
+func (c *ConnImpl) GetChannel(name string) *Channel {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	ch, ok := c.channels[c.foldName(name)]
+	if !ok {
+		return nil
+	}
+	cp := &Channel{
+		Name:    ch.name,
+		Topic:   ch.topic,
+		Members: make(map[string]string, len(ch.members)),
+		Modes:   make(map[byte]string, len(ch.modes)),
+	}
+	for mode, arg := range ch.modes {
+		cp.Modes[mode] = arg
+	}
+	for key, prefixes := range ch.members {
+		if user, ok := c.users[key]; ok {
+			cp.Members[user.Nick] = prefixes
+		}
+	}
+	return cp
+}
+
+// GetChannels - See StateTracker interface docs
+func (c *ConnImpl) GetChannels() []string {
+	c.stateLock.RLock()
+	defer c.stateLock.RUnlock()
+	names := make([]string, 0, len(c.channels))
+	for _, ch := range c.channels {
+		names = append(names, ch.name)
+	}
+	return names
+}
+
+// SetTrackState - See StateTracker interface docs
+func (c *ConnImpl) SetTrackState(track bool) {
+	c.TrackState = track
+	if !track {
+		c.resetState()
+	}
+}
+
+// getOrAddUser returns the record of the given user and creates it if it doesn't exist.
+// The caller must hold the state lock.
+func (c *ConnImpl) getOrAddUser(nick string) *User {
+	key := c.foldName(nick)
+	user, ok := c.users[key]
+	if !ok {
+		user = &User{Nick: nick}
+		c.users[key] = user
+	}
+	return user
+}
+
+// updateUser runs the given function on the record of the given user if state tracking is enabled.
+func (c *ConnImpl) updateUser(nick string, fn func(user *User)) {
+	if !c.TrackState {
+		return
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	if user, ok := c.users[c.foldName(nick)]; ok {
+		fn(user)
+	}
+}
+
+// pruneUser removes the record of the given user if the user doesn't share any channels with us.
+// The caller must hold the state lock.
+func (c *ConnImpl) pruneUser(key string) {
+	if key == c.foldName(c.Nick) {
+		return
+	}
+	for _, ch := range c.channels {
+		if _, ok := ch.members[key]; ok {
+			return
+		}
+	}
+	delete(c.users, key)
+}
+
+// removeMember removes the given user from the given channel. If the user is us, the whole channel is forgotten.
+func (c *ConnImpl) removeMember(channel, nick string) {
+	if !c.TrackState {
+		return
+	}
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	chKey := c.foldName(channel)
+	ch, ok := c.channels[chKey]
+	if !ok {
+		return
+	}
+	if c.isSelf(nick) {
+		delete(c.channels, chKey)
+		for key := range ch.members {
+			c.pruneUser(key)
+		}
+		return
+	}
+	key := c.foldName(nick)
+	delete(ch.members, key)
+	c.pruneUser(key)
+}
+
+// addStateHandlers adds the handlers that keep the tracked state up to date and emit typed events.
+func (c *ConnImpl) addStateHandlers() {
+	c.AddHandler(irc.JOIN, c.handleJoin)
+
+	c.AddHandler(irc.PART, func(evt *Event) {
+		if params := evt.Args(); len(params) > 0 && evt.Prefix != nil {
+			c.removeMember(params[0], evt.Name)
+		}
+	})
+
+	c.AddHandler(irc.KICK, func(evt *Event) {
+		if params := evt.Args(); len(params) > 1 {
+			c.removeMember(params[0], params[1])
+		}
+	})
+
+	c.AddHandler(irc.QUIT, func(evt *Event) {
+		if !c.TrackState || evt.Prefix == nil {
+			return
+		}
+		c.stateLock.Lock()
+		key := c.foldName(evt.Name)
+		for _, ch := range c.channels {
+			delete(ch.members, key)
+		}
+		delete(c.users, key)
+		c.stateLock.Unlock()
+	})
+
+	c.AddHandler(irc.NICK, func(evt *Event) {
+		params := evt.Args()
+		if !c.TrackState || evt.Prefix == nil || len(params) == 0 {
+			return
+		}
+		c.stateLock.Lock()
+		oldKey, newKey := c.foldName(evt.Name), c.foldName(params[0])
+		if user, ok := c.users[oldKey]; ok {
+			delete(c.users, oldKey)
+			user.Nick = params[0]
+			c.users[newKey] = user
+		}
+		for _, ch := range c.channels {
+			if prefixes, ok := ch.members[oldKey]; ok {
+				delete(ch.members, oldKey)
+				ch.members[newKey] = prefixes
+			}
+		}
+		c.stateLock.Unlock()
+	})
+
+	c.AddHandler(irc.AWAY, func(evt *Event) {
+		if evt.Prefix == nil {
+			return
+		}
+		away := &AwayEvent{eventSource: eventSource{evt}, Nick: evt.Name}
+		if params := evt.Args(); len(params) > 0 {
+			away.Away = true
+			away.Message = params[0]
+		}
+		c.updateUser(evt.Name, func(user *User) {
+			user.Away = away.Away
+			user.AwayMsg = away.Message
+		})
+		c.emit(away)
+	})
+
+	c.AddHandler("ACCOUNT", func(evt *Event) {
+		params := evt.Args()
+		if evt.Prefix == nil || len(params) == 0 {
+			return
+		}
+		account := &AccountEvent{eventSource: eventSource{evt}, Nick: evt.Name, Account: params[0]}
+		if account.Account == "*" {
+			account.Account = ""
+		}
+		c.updateUser(evt.Name, func(user *User) {
+			account.OldAccount = user.Account
+			user.Account = account.Account
+		})
+		c.emit(account)
+	})
+
+	c.AddHandler("CHGHOST", func(evt *Event) {
+		params := evt.Args()
+		if evt.Prefix == nil || len(params) < 2 {
+			return
+		}
+		c.updateUser(evt.Name, func(user *User) {
+			user.User = params[0]
+			user.Host = params[1]
+		})
+		c.emit(&ChghostEvent{
+			eventSource: eventSource{evt},
+			Nick:        evt.Name,
+			OldUser:     evt.User,
+			OldHost:     evt.Host,
+			User:        params[0],
+			Host:        params[1],
+		})
+	})
+
+	c.AddHandler("SETNAME", func(evt *Event) {
+		params := evt.Args()
+		if evt.Prefix == nil || len(params) == 0 {
+			return
+		}
+		if c.isSelf(evt.Name) {
+			c.RealName = params[0]
+		}
+		c.updateUser(evt.Name, func(user *User) {
+			user.RealName = params[0]
+		})
+		c.emit(&SetnameEvent{eventSource: eventSource{evt}, Nick: evt.Name, RealName: params[0]})
+	})
+
+	c.AddHandler(irc.MODE, c.handleMode)
+	c.AddHandler(rplChannelModeIs, c.handleChannelModeIs)
+
+	c.AddHandler(irc.RPL_TOPIC, func(evt *Event) {
+		if params := evt.Args(); len(params) > 2 {
+			c.setTopic(params[1], params[2])
+		}
+	})
+
+	c.AddHandler(irc.TOPIC, func(evt *Event) {
+		if params := evt.Args(); len(params) > 1 {
+			c.setTopic(params[0], params[1])
+		}
+	})
+
+	c.AddHandler(irc.RPL_NAMREPLY, c.handleNames)
+
+	c.AddHandler(irc.RPL_WHOREPLY, func(evt *Event) {
+		params := evt.Args()
+		if len(params) < 8 {
+			return
+		}
+		c.updateUser(params[5], func(user *User) {
+			user.User = params[2]
+			user.Host = params[3]
+			user.Away = strings.HasPrefix(params[6], "G")
+			if parts := strings.SplitN(params[7], " ", 2); len(parts) > 1 {
+				user.RealName = parts[1]
+			}
+		})
+	})
+}
+
+// handleJoin handles both normal and extended JOIN messages.
+func (c *ConnImpl) handleJoin(evt *Event) {
+	params := evt.Args()
+	if evt.Prefix == nil || len(params) == 0 {
+		return
+	}
+	join := &JoinEvent{
+		eventSource: eventSource{evt},
+		Channel:     params[0],
+		Nick:        evt.Name,
+		User:        evt.User,
+		Host:        evt.Host,
+	}
+	// Extended JOINs have the account name and real name as the second and third parameters.
+	if len(params) > 2 {
+		join.Extended = true
+		join.RealName = params[2]
+		if params[1] != "*" {
+			join.Account = params[1]
+		}
+	}
+
+	if c.TrackState {
+		c.stateLock.Lock()
+		chKey := c.foldName(join.Channel)
+		ch, ok := c.channels[chKey]
+		if !ok && c.isSelf(join.Nick) {
+			ch = &channelState{
+				name:    join.Channel,
+				members: make(map[string]string),
+				modes:   make(map[byte]string),
+				lists:   make(map[byte][]*ListEntry),
+			}
+			c.channels[chKey] = ch
+		}
+		if ch != nil {
+			user := c.getOrAddUser(join.Nick)
+			user.User, user.Host = join.User, join.Host
+			if join.Extended {
+				user.Account, user.RealName = join.Account, join.RealName
+			}
+			ch.members[c.foldName(join.Nick)] = ""
+		}
+		c.stateLock.Unlock()
+	}
+	c.emit(join)
+}
+
+// setTopic updates the topic of the given channel.
+func (c *ConnImpl) setTopic(channel, topic string) {
+	if !c.TrackState {
+		return
+	}
+	c.stateLock.Lock()
+	if ch, ok := c.channels[c.foldName(channel)]; ok {
+		ch.topic = topic
+	}
+	c.stateLock.Unlock()
+}
+
+// membershipPrefixes returns the membership prefix symbols the server uses, such as @ and +.
+func (c *ConnImpl) membershipPrefixes() string {
+	value, ok := c.GetISupport("PREFIX")
+	if i := strings.IndexByte(value, ')'); ok && i >= 0 {
+		return value[i+1:]
+	}
+	return "@+"
+}
+
+// handleNames adds the users in a NAMES reply to the channel.
+func (c *ConnImpl) handleNames(evt *Event) {
+	params := evt.Args()
+	if !c.TrackState || len(params) < 4 {
+		return
+	}
+	symbols := c.membershipPrefixes()
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	ch, ok := c.channels[c.foldName(params[2])]
+	if !ok {
+		return
+	}
+	for _, entry := range strings.Fields(params[3]) {
+		// With multi-prefix there may be more than one prefix.
+		name := strings.TrimLeft(entry, symbols)
+		prefixes := entry[:len(entry)-len(name)]
+		// With userhost-in-names the entries are full hostmasks.
+		prefix := irc.ParsePrefix(name)
+		user := c.getOrAddUser(prefix.Name)
+		if len(prefix.User) > 0 {
+			user.User, user.Host = prefix.User, prefix.Host
+		}
+		ch.members[c.foldName(prefix.Name)] = prefixes
+	}
+}
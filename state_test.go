@@ -0,0 +1,99 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"sort"
+	"testing"
+)
+
+// feedLines passes the given raw lines to the given offline connection as if they were received from the server.
+func feedLines(c *ConnImpl, lines ...string) {
+	for _, line := range lines {
+		c.handleEvent(ParseEvent(line))
+	}
+}
+
+// members returns the sorted nicks of the members of the given channel.
+func members(t *testing.T, c *ConnImpl, channel string) []string {
+	t.Helper()
+	ch := c.GetChannel(channel)
+	if ch == nil {
+		t.Fatalf("Channel %s isn't tracked", channel)
+	}
+	nicks := make([]string, 0, len(ch.Members))
+	for nick := range ch.Members {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+	return nicks
+}
+
+func expectMembers(t *testing.T, c *ConnImpl, channel string, expected ...string) {
+	t.Helper()
+	actual := members(t, c, channel)
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected members %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("Expected members %v, got %v", expected, actual)
+		}
+	}
+}
+
+func TestStateMembership(t *testing.T) {
+	c := newOfflineConn("tester")
+	feedLines(c,
+		":tester!t@me.example JOIN #chan",
+		":irc.example.com 353 tester = #chan :@tester +alice bob",
+		":carol!c@c.example JOIN #chan",
+		":bob!b@b.example NICK robert",
+		":alice!a@a.example PART #chan :bye",
+		":tester!t@me.example KICK #chan carol :out")
+	expectMembers(t, c, "#chan", "robert", "tester")
+	if prefixes := c.GetChannel("#chan").Members["tester"]; prefixes != "@" {
+		t.Errorf("Expected @ prefix for tester, got %q", prefixes)
+	}
+	if user := c.GetUser("alice"); user != nil {
+		t.Errorf("User who left all shared channels is still tracked: %+v", user)
+	}
+}
+
+func TestStateNetsplit(t *testing.T) {
+	c := newOfflineConn("tester")
+	feedLines(c,
+		":tester!t@me.example JOIN #chan",
+		":irc.example.com 353 tester = #chan :tester alice bob carol",
+		"BATCH +split netsplit irc.hub other.host",
+		"@batch=split :alice!a@a.example QUIT :irc.hub other.host",
+		"@batch=split :bob!b@b.example QUIT :irc.hub other.host")
+	// The state is only updated when the batch ends.
+	expectMembers(t, c, "#chan", "alice", "bob", "carol", "tester")
+	feedLines(c, "BATCH -split")
+	expectMembers(t, c, "#chan", "carol", "tester")
+	if user := c.GetUser("alice"); user != nil {
+		t.Errorf("User who quit in a netsplit is still tracked: %+v", user)
+	}
+
+	feedLines(c,
+		"BATCH +join netjoin irc.hub other.host",
+		"@batch=join :alice!a@a.example JOIN #chan",
+		"BATCH -join")
+	expectMembers(t, c, "#chan", "alice", "carol", "tester")
+}
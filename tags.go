@@ -0,0 +1,103 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// Tags contains the IRCv3 message tags of a message.
+type Tags map[string]string
+
+var tagEscaper = strings.NewReplacer("\\", "\\\\", ";", "\\:", " ", "\\s", "\r", "\\r", "\n", "\\n")
+
+// ParseTags parses the tag part of a raw IRC message. The leading @ must not be included.
+func ParseTags(raw string) Tags {
+	tags := make(Tags)
+	for _, tag := range strings.Split(raw, ";") {
+		if len(tag) == 0 {
+			continue
+		}
+		parts := strings.SplitN(tag, "=", 2)
+		if len(parts) == 1 {
+			tags[parts[0]] = ""
+		} else {
+			tags[parts[0]] = unescapeTagValue(parts[1])
+		}
+	}
+	return tags
+}
+
+func unescapeTagValue(value string) string {
+	if strings.IndexByte(value, '\\') < 0 {
+		return value
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			buf.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i >= len(value) {
+			break
+		}
+		switch value[i] {
+		case ':':
+			buf.WriteByte(';')
+		case 's':
+			buf.WriteByte(' ')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'n':
+			buf.WriteByte('\n')
+		default:
+			buf.WriteByte(value[i])
+		}
+	}
+	return buf.String()
+}
+
+// Get returns the value of the given tag and whether or not the tag is set.
+func (tags Tags) Get(key string) (value string, ok bool) {
+	value, ok = tags[key]
+	return
+}
+
+// String turns the tags into the wire format without the leading @.
+func (tags Tags) String() string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+		buf.WriteString(key)
+		if value := tags[key]; len(value) > 0 {
+			buf.WriteByte('=')
+			buf.WriteString(tagEscaper.Replace(value))
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,209 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+)
+
+// TypedEvent is an event emitted by the higher level parts of the library, such as the state tracker.
+// Use a type switch to find out which kind of event it is.
+type TypedEvent interface {
+	// Source returns the IRC message that caused the event, or nil if the event wasn't caused by a message.
+	Source() *Event
+}
+
+// TypedHandler is a handler for TypedEvents. Panics in handlers are recovered and logged in the handlers category.
+type TypedHandler func(evt TypedEvent)
+
+// eventSource implements the Source function of TypedEvent.
+type eventSource struct {
+	source *Event
+}
+
+// Source - See TypedEvent interface docs
+func (src eventSource) Source() *Event {
+	return src.source
+}
+
+// AwayEvent is emitted when a user sets or removes their away status.
+// This requires the away-notify capability for users other than ourselves.
+type AwayEvent struct {
+	eventSource
+	Nick    string
+	Away    bool
+	Message string
+}
+
+// AccountEvent is emitted when a user logs in or out of their account.
+// The account is empty if the user logged out. This requires the account-notify capability.
+type AccountEvent struct {
+	eventSource
+	Nick       string
+	Account    string
+	OldAccount string
+}
+
+// ChghostEvent is emitted when the username or hostname of a user changes. This requires the chghost capability.
+type ChghostEvent struct {
+	eventSource
+	Nick    string
+	OldUser string
+	OldHost string
+	User    string
+	Host    string
+}
+
+// SetnameEvent is emitted when a user changes their real name. This requires the setname capability.
+type SetnameEvent struct {
+	eventSource
+	Nick     string
+	RealName string
+}
+
+// JoinEvent is emitted when a user joins a channel.
+// If the extended-join capability is enabled, Extended is true and the account and real name are filled.
+type JoinEvent struct {
+	eventSource
+	Channel  string
+	Nick     string
+	User     string
+	Host     string
+	Account  string
+	RealName string
+	Extended bool
+}
+
+// PresenceEvent is emitted when a user tracked with Monitor comes online or goes offline.
+// The username and hostname are only filled if the server sent them.
+type PresenceEvent struct {
+	eventSource
+	Nick   string
+	User   string
+	Host   string
+	Online bool
+}
+
+// ModeEvent is emitted when the modes of a channel change.
+type ModeEvent struct {
+	eventSource
+	Channel string
+	Setter  string
+	Changes []ModeChange
+}
+
+// AutoIgnoreEvent is emitted when a user is automatically ignored for flooding.
+type AutoIgnoreEvent struct {
+	eventSource
+	Mask     string
+	Sender   Hostmask
+	Types    IgnoreType
+	Duration time.Duration
+}
+
+// DCCChatEvent is emitted when an incoming DCC CHAT offer has been accepted and connected.
+// Add handlers to the chat and call Start to start receiving messages.
+type DCCChatEvent struct {
+	eventSource
+	Request *DCCRequest
+	Chat    *DCCChat
+}
+
+// DCCSendEvent is emitted when an incoming DCC SEND offer has been accepted and the local file has been chosen, after
+// a possible resume request. The transfer runs in the background; use Wait on the transfer to find out when it's done
+// or why it failed.
+type DCCSendEvent struct {
+	eventSource
+	Request  *DCCRequest
+	Transfer *DCCTransfer
+}
+
+// PongEvent is emitted when the server answers a PING sent with Ping.
+type PongEvent struct {
+	eventSource
+	Token string
+	Sent  time.Time
+	Lag   time.Duration
+}
+
+// PingTimeoutEvent is emitted when a PING hasn't been answered before the PONG deadline. If Disconnect is true, the
+// connection is dropped after the event so that Loop reconnects.
+type PingTimeoutEvent struct {
+	eventSource
+	Token      string
+	Sent       time.Time
+	Deadline   time.Time
+	Disconnect bool
+}
+
+// ZNCEvent is emitted when a ZNC module, such as *status, sends a message.
+type ZNCEvent struct {
+	eventSource
+	// Module is the name of the module without the prefix, e.g. status.
+	Module string
+	Text   string
+}
+
+// BouncerNetworkEvent is emitted on the control connection of a BouncerClient when the bouncer notifies about a
+// new, changed or deleted network. This requires the soju.im/bouncer-networks-notify capability.
+type BouncerNetworkEvent struct {
+	eventSource
+	ID string
+	// Changed contains the attributes that changed. Removed attributes have an empty value.
+	Changed Tags
+	// Network is the network after applying the changes, or nil if the network was deleted.
+	Network *BouncerNetwork
+	Deleted bool
+}
+
+// AddTypedHandler - See HandlerHandler interface docs
+func (c *ConnImpl) AddTypedHandler(handler TypedHandler) int {
+	c.typedHandlers = append(c.typedHandlers, handler)
+	return len(c.typedHandlers) - 1
+}
+
+// RemoveTypedHandler - See HandlerHandler interface docs
+func (c *ConnImpl) RemoveTypedHandler(index int) {
+	if index >= 0 && index < len(c.typedHandlers) {
+		// Keep the slot so that the indexes of other handlers don't change.
+		c.typedHandlers[index] = nil
+	}
+}
+
+// emit passes the given typed event to all typed handlers.
+func (c *ConnImpl) emit(evt TypedEvent) {
+	for _, handle := range c.typedHandlers {
+		if handle != nil {
+			c.callTypedHandler(evt, handle)
+		}
+	}
+}
+
+// callTypedHandler runs the given typed event handler. Panics are logged like in callHandler.
+func (c *ConnImpl) callTypedHandler(evt TypedEvent, handle TypedHandler) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.log(slog.LevelError, CategoryHandlers, "Typed handler panicked", slog.String("event", fmt.Sprintf("%T", evt)),
+				slog.Any("panic", err), slog.String("stack", string(debug.Stack())))
+		}
+	}()
+	handle(evt)
+}
@@ -0,0 +1,84 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"strings"
+
+	"github.com/sorcix/irc"
+)
+
+// ValidateMessage checks that the given message can be sent without being misinterpreted by the server.
+// Line breaks or NUL characters anywhere in the message would end the line early or corrupt it, and middle parameters
+// can't be empty, contain spaces or start with a colon, because that would change where the parameter ends. Only the
+// trailing parameter may be empty.
+func ValidateMessage(msg *irc.Message) error {
+	if msg == nil || len(msg.Command) == 0 {
+		return InvalidMessageError{Reason: InvalidCommand}
+	}
+	for _, char := range msg.Command {
+		if !(char >= 'A' && char <= 'Z') && !(char >= 'a' && char <= 'z') && !(char >= '0' && char <= '9') {
+			return InvalidMessageError{Command: msg.Command, Value: msg.Command, Reason: InvalidCommand}
+		}
+	}
+	for _, param := range msg.Params {
+		if err := validateText(msg.Command, param); err != nil {
+			return err
+		} else if len(param) == 0 {
+			return InvalidMessageError{Command: msg.Command, Reason: InvalidEmpty}
+		} else if strings.IndexByte(param, ' ') >= 0 {
+			return InvalidMessageError{Command: msg.Command, Value: param, Reason: InvalidSpace}
+		} else if strings.HasPrefix(param, ":") {
+			return InvalidMessageError{Command: msg.Command, Value: param, Reason: InvalidColon}
+		}
+	}
+	return validateText(msg.Command, msg.Trailing)
+}
+
+// validateTags checks that the keys of the given tags don't contain characters that would end the tag or the tag
+// section. The values are escaped when the tags are sent.
+func validateTags(command string, tags Tags) error {
+	for key := range tags {
+		if len(key) == 0 || strings.ContainsAny(key, " ;=\r\n\x00") {
+			return InvalidMessageError{Command: command, Value: key, Reason: InvalidTag}
+		}
+	}
+	return nil
+}
+
+// validateText checks that the given parameter doesn't contain line breaks or NUL characters.
+func validateText(command, text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return InvalidMessageError{Command: command, Value: text, Reason: InvalidLineBreak}
+	} else if strings.IndexByte(text, 0) >= 0 {
+		return InvalidMessageError{Command: command, Value: text, Reason: InvalidNUL}
+	}
+	return nil
+}
+
+// splitLines splits the given text into lines for sending as separate messages. Empty lines are dropped, since
+// messages can't be empty.
+func splitLines(text string) []string {
+	lines := strings.FieldsFunc(text, func(r rune) bool {
+		return r == '\r' || r == '\n'
+	})
+	if len(lines) == 0 {
+		return []string{text}
+	}
+	return lines
+}
@@ -0,0 +1,86 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"testing"
+
+	"github.com/sorcix/irc"
+)
+
+func TestValidateMessage(t *testing.T) {
+	tests := []struct {
+		msg    *irc.Message
+		reason InvalidReason
+	}{
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan"}, Trailing: "hello"}, ""},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan"}, Trailing: ""}, ""},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan"}, Trailing: ":leading colon is fine"}, ""},
+		{&irc.Message{Command: "001", Params: []string{"nick"}}, ""},
+		{nil, InvalidCommand},
+		{&irc.Message{Command: ""}, InvalidCommand},
+		{&irc.Message{Command: "PRIV MSG"}, InvalidCommand},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan"}, Trailing: "hi\r\nQUIT"}, InvalidLineBreak},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan\nQUIT"}, Trailing: "hi"}, InvalidLineBreak},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{"#chan"}, Trailing: "nul\x00"}, InvalidNUL},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{"#a #b"}, Trailing: "hi"}, InvalidSpace},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{":#chan"}, Trailing: "hi"}, InvalidColon},
+		{&irc.Message{Command: irc.KICK, Params: []string{"#chan", ""}, Trailing: "bye"}, InvalidEmpty},
+		{&irc.Message{Command: irc.PRIVMSG, Params: []string{""}, Trailing: "hi"}, InvalidEmpty},
+	}
+	for _, test := range tests {
+		err := ValidateMessage(test.msg)
+		if len(test.reason) == 0 {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", test.msg, err)
+			}
+		} else if invalid, ok := err.(InvalidMessageError); !ok || invalid.Reason != test.reason {
+			t.Errorf("%v: expected %s, got %v", test.msg, test.reason, err)
+		}
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	if err := validateTags(irc.PRIVMSG, Tags{"+draft/reply": "value with spaces; and semicolons"}); err != nil {
+		t.Error("Valid tags were refused:", err)
+	}
+	for _, key := range []string{"", "a b", "a;b", "a=b", "a\nb"} {
+		if err := validateTags(irc.PRIVMSG, Tags{key: "x"}); err == nil {
+			t.Errorf("Tag key %q was accepted", key)
+		}
+	}
+}
+
+func TestSendValidation(t *testing.T) {
+	c := newOfflineConn("tester")
+	if err := c.Kick("#chan", "", "bye"); err == nil {
+		t.Error("Kick with an empty nick was sent")
+	}
+	if err := c.Privmsg("#chan", "first\nsecond\r\n\nthird"); err != nil {
+		t.Fatal("Multi-line message was refused:", err)
+	}
+	expectSent(t, c, "PRIVMSG #chan :first", "PRIVMSG #chan :second", "PRIVMSG #chan :third")
+	if err := c.Privmsg("#chan", "fine\nnul\x00"); err == nil {
+		t.Error("Message with a NUL character was sent")
+	}
+	expectSent(t, c)
+	if err := c.Action("#chan", "waves\nsmiles"); err != nil {
+		t.Fatal("Multi-line action was refused:", err)
+	}
+	expectSent(t, c, "PRIVMSG #chan :\x01ACTION waves\x01", "PRIVMSG #chan :\x01ACTION smiles\x01")
+}
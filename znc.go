@@ -0,0 +1,264 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+// ZNC capabilities. They're requested by default if the server advertises them.
+//
+// With znc.in/playback, the buffers are played back since the last message seen instead of all at once when
+// connecting. With znc.in/self-message, messages sent by other clients of the same user are sent to this client and
+// handled as echoes. znc.in/server-time-iso is the old name of server-time used by ZNC.
+const (
+	CapZNCPlayback      = "znc.in/playback"
+	CapZNCSelfMessage   = "znc.in/self-message"
+	CapZNCServerTimeISO = "znc.in/server-time-iso"
+)
+
+// ZNCStatusPrefix is the prefix of the nicks of ZNC modules, such as *status and *playback.
+const ZNCStatusPrefix = "*"
+
+// ZNC contains functions for connections through the ZNC bouncer.
+type ZNC interface {
+	// ZNCCommand sends a command to *status and waits for the first line of the reply.
+	ZNCCommand(ctx context.Context, command string) (string, error)
+	// ZNCTableCommand sends a command to *status whose reply is a table and waits for the whole table.
+	ZNCTableCommand(ctx context.Context, command string) (*ZNCTable, error)
+	// ListNetworks lists the networks of the ZNC user.
+	ListNetworks(ctx context.Context) ([]*ZNCNetwork, error)
+	// JumpNetwork switches this client to another network of the ZNC user.
+	JumpNetwork(ctx context.Context, network string) (string, error)
+	// ClearBuffer clears the playback buffer of the given channel or query. Wildcards are allowed.
+	ClearBuffer(ctx context.Context, buffer string) (string, error)
+	// SetPlaybackTime sets the time of the last message seen, which is used when requesting playback. It can be used
+	// to continue from where a previous process left off.
+	SetPlaybackTime(t time.Time)
+	// GetPlaybackTime returns the time of the last message seen.
+	GetPlaybackTime() time.Time
+}
+
+// ZNCTable is a table sent by ZNC as a reply to a command.
+type ZNCTable struct {
+	Header []string
+	Rows   [][]string
+	// Message is set instead of the rows if ZNC replied with a message instead of a table, such as when the table
+	// would be empty.
+	Message string
+}
+
+// Get returns the value of the given column in the given row. Column names are matched case-insensitively and
+// ignoring spaces, so that differences between ZNC versions don't matter.
+func (table *ZNCTable) Get(row int, column string) string {
+	if row < 0 || row >= len(table.Rows) {
+		return ""
+	}
+	column = normalizeZNCColumn(column)
+	for i, name := range table.Header {
+		if normalizeZNCColumn(name) == column && i < len(table.Rows[row]) {
+			return table.Rows[row][i]
+		}
+	}
+	return ""
+}
+
+// normalizeZNCColumn removes spaces from the given column name and converts it to lowercase.
+func normalizeZNCColumn(name string) string {
+	return strings.ToLower(strings.Replace(name, " ", "", -1))
+}
+
+// ZNCNetwork is a network in the reply to ListNetworks.
+type ZNCNetwork struct {
+	Name     string
+	OnIRC    bool
+	Server   string
+	User     string
+	Channels int
+}
+
+// isZNC checks if any of the ZNC capabilities is enabled, i.e. if the connection is to a ZNC bouncer.
+func (c *ConnImpl) isZNC() bool {
+	return c.HasCap(CapZNCPlayback) || c.HasCap(CapZNCSelfMessage) || c.HasCap(CapZNCServerTimeISO)
+}
+
+// isZNCModule checks if the given event is a message from a ZNC module.
+func (c *ConnImpl) isZNCModule(evt *Event, module string) bool {
+	return (evt.Command == irc.PRIVMSG || evt.Command == irc.NOTICE) && evt.Prefix != nil &&
+		strings.EqualFold(evt.Name, ZNCStatusPrefix+module)
+}
+
+// isBufferedMessage checks if the given event is a message from a user that ZNC would store in its playback buffers.
+func (c *ConnImpl) isBufferedMessage(evt *Event) bool {
+	if evt.Prefix == nil || len(evt.User) == 0 || strings.HasPrefix(evt.Name, ZNCStatusPrefix) {
+		return false
+	}
+	return evt.Command == irc.PRIVMSG || evt.Command == irc.NOTICE || strings.HasPrefix(evt.Command, "CTCP_")
+}
+
+func (c *ConnImpl) addZNCHandlers() {
+	c.AddHandler(irc.RPL_WELCOME, c.requestPlayback)
+	c.AddHandler("*", func(evt *Event) {
+		if (evt.Command == irc.PRIVMSG || evt.Command == irc.NOTICE) && evt.Prefix != nil &&
+			strings.HasPrefix(evt.Name, ZNCStatusPrefix) && len(evt.Name) > len(ZNCStatusPrefix) {
+			c.emit(&ZNCEvent{
+				eventSource: eventSource{evt},
+				Module:      evt.Name[len(ZNCStatusPrefix):],
+				Text:        evt.Trailing,
+			})
+		}
+	})
+}
+
+// trackPlayback updates the time of the last message seen. It's called for every received line before batching and
+// ignore checks, because played back messages arrive in batches and ignored messages are buffered by ZNC too.
+func (c *ConnImpl) trackPlayback(evt *Event) {
+	// Only messages from users are buffered by ZNC, so other lines, which ZNC sends with the current time, are
+	// ignored when tracking the last message seen.
+	if _, ok := evt.Tags["time"]; !ok || !c.isBufferedMessage(evt) {
+		return
+	}
+	c.zncLock.Lock()
+	if evt.Time.After(c.playbackTime) {
+		c.playbackTime = evt.Time
+	}
+	c.zncLock.Unlock()
+}
+
+// requestPlayback asks the ZNC playback module to play back all buffers since the last message seen.
+func (c *ConnImpl) requestPlayback(evt *Event) {
+	if !c.HasCap(CapZNCPlayback) {
+		return
+	}
+	since := "0"
+	if t := c.GetPlaybackTime(); !t.IsZero() {
+		since = strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 3, 64)
+	}
+	c.Privmsg(ZNCStatusPrefix+"playback", "PLAY * "+since)
+}
+
+// SetPlaybackTime - See ZNC interface docs
+func (c *ConnImpl) SetPlaybackTime(t time.Time) {
+	c.zncLock.Lock()
+	c.playbackTime = t
+	c.zncLock.Unlock()
+}
+
+// GetPlaybackTime - See ZNC interface docs
+func (c *ConnImpl) GetPlaybackTime() time.Time {
+	c.zncLock.Lock()
+	defer c.zncLock.Unlock()
+	return c.playbackTime
+}
+
+// ZNCCommand - See ZNC interface docs
+func (c *ConnImpl) ZNCCommand(ctx context.Context, command string) (string, error) {
+	var reply string
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		if !c.isZNCModule(evt, "status") {
+			return false, false
+		}
+		reply = evt.Trailing
+		return true, true
+	}
+	err := c.waitQuery(ctx, q, &irc.Message{
+		Command:  irc.PRIVMSG,
+		Params:   []string{ZNCStatusPrefix + "status"},
+		Trailing: command,
+	})
+	return reply, err
+}
+
+// ZNCTableCommand - See ZNC interface docs
+func (c *ConnImpl) ZNCTableCommand(ctx context.Context, command string) (*ZNCTable, error) {
+	table := &ZNCTable{}
+	// A table is a separator, the header, another separator, the rows and a final separator.
+	separators := 0
+	q := &query{}
+	q.accept = func(evt *Event) (matched, done bool) {
+		if !c.isZNCModule(evt, "status") {
+			return false, false
+		}
+		line := strings.TrimSpace(evt.Trailing)
+		switch {
+		case strings.HasPrefix(line, "+") && strings.Trim(line, "+-=") == "":
+			separators++
+			return true, separators >= 3
+		case strings.HasPrefix(line, "|"):
+			cells := strings.Split(strings.Trim(line, "|"), "|")
+			for i := range cells {
+				cells[i] = strings.TrimSpace(cells[i])
+			}
+			if table.Header == nil {
+				table.Header = cells
+			} else {
+				table.Rows = append(table.Rows, cells)
+			}
+			return true, false
+		case separators == 0:
+			table.Message = evt.Trailing
+			return true, true
+		}
+		return true, false
+	}
+	err := c.waitQuery(ctx, q, &irc.Message{
+		Command:  irc.PRIVMSG,
+		Params:   []string{ZNCStatusPrefix + "status"},
+		Trailing: command,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// ListNetworks - See ZNC interface docs
+func (c *ConnImpl) ListNetworks(ctx context.Context) ([]*ZNCNetwork, error) {
+	table, err := c.ZNCTableCommand(ctx, "ListNetworks")
+	if err != nil {
+		return nil, err
+	}
+	networks := make([]*ZNCNetwork, len(table.Rows))
+	for i := range table.Rows {
+		channels, _ := strconv.Atoi(table.Get(i, "Channels"))
+		networks[i] = &ZNCNetwork{
+			Name:     table.Get(i, "Network"),
+			OnIRC:    strings.EqualFold(table.Get(i, "On IRC"), "Yes"),
+			Server:   table.Get(i, "IRC Server"),
+			User:     table.Get(i, "IRC User"),
+			Channels: channels,
+		}
+	}
+	return networks, nil
+}
+
+// JumpNetwork - See ZNC interface docs
+func (c *ConnImpl) JumpNetwork(ctx context.Context, network string) (string, error) {
+	return c.ZNCCommand(ctx, "JumpNetwork "+network)
+}
+
+// ClearBuffer - See ZNC interface docs
+func (c *ConnImpl) ClearBuffer(ctx context.Context, buffer string) (string, error) {
+	return c.ZNCCommand(ctx, "ClearBuffer "+buffer)
+}
@@ -0,0 +1,189 @@
+// libmauirc - An IRC connection library for mauIRCd
+// Copyright (C) 2016 Tulir Asokan
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package libmauirc is the main package of this library
+package libmauirc
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sorcix/irc"
+)
+
+func TestZNCPlaybackReconnect(t *testing.T) {
+	srv, c := newBatchFake(t, "server-time", CapZNCPlayback)
+	// Ignored users are buffered by ZNC too, so their messages must move the playback time forward.
+	c.Ignore("bob!*@*", IgnoreAll, 0)
+	srv.Reply("PRIVMSG *playback :PLAY * 0",
+		"BATCH +p chathistory #chan",
+		"@batch=p;time=2020-01-01T00:00:01.000Z :alice!a@a.example PRIVMSG #chan :one",
+		"@batch=p;time=2020-01-01T00:00:02.000Z :bob!b@b.example PRIVMSG #chan :two",
+		"BATCH -p")
+	client := connectFake(t, srv, c)
+	go c.Loop()
+
+	ctx := testContext(t)
+	if _, err := srv.Expect(ctx, "PRIVMSG *playback :PLAY * 0"); err != nil {
+		t.Fatal("Playback wasn't requested:", err)
+	}
+	client.Send("PING :sync")
+	if _, err := srv.Expect(ctx, "PONG"); err != nil {
+		t.Fatal("Didn't receive PONG:", err)
+	}
+	expected := time.Date(2020, 1, 1, 0, 0, 2, 0, time.UTC)
+	if playbackTime := c.GetPlaybackTime(); !playbackTime.Equal(expected) {
+		t.Errorf("Expected playback time %s, got %s", expected, playbackTime)
+	}
+
+	client.Close()
+	if _, err := srv.WaitRegistered(ctx); err != nil {
+		t.Fatal("Didn't reconnect:", err)
+	} else if _, err = srv.Expect(ctx, "PRIVMSG *playback :PLAY * 1577836802.000"); err != nil {
+		t.Fatal("Playback since the last message wasn't requested after reconnecting:", err)
+	}
+}
+
+// zncReply feeds the given lines to the given offline connection as messages from *status.
+func zncReply(c *ConnImpl, lines ...string) {
+	for _, line := range lines {
+		c.RunHandlers(ParseEvent(":*status!znc@znc.in PRIVMSG tester :" + line))
+	}
+}
+
+// waitSent waits until the given offline connection sends a line.
+func waitSent(t *testing.T, c *ConnImpl) *Event {
+	select {
+	case evt := <-c.output:
+		return evt
+	case <-time.After(testTimeout):
+		t.Fatal("Nothing was sent")
+		return nil
+	}
+}
+
+func TestListNetworks(t *testing.T) {
+	c := newOfflineConn("tester")
+	type result struct {
+		networks []*ZNCNetwork
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		networks, err := c.ListNetworks(context.Background())
+		done <- result{networks, err}
+	}()
+	if sent := waitSent(t, c); sent.Command != irc.PRIVMSG || sent.Trailing != "ListNetworks" {
+		t.Fatalf("Unexpected request: %s", sent)
+	}
+	zncReply(c,
+		"+---------+--------+--------------------+----------+----------+",
+		"| Network | On IRC | IRC Server         | IRC User | Channels |",
+		"+---------+--------+--------------------+----------+----------+",
+		"| libera  | Yes    | irc.libera.chat    | me       | 3        |",
+		"| oftc    | No     |                    |          | 0        |",
+		"+---------+--------+--------------------+----------+----------+")
+	res := <-done
+	if res.err != nil {
+		t.Fatal("ListNetworks failed:", res.err)
+	} else if len(res.networks) != 2 {
+		t.Fatalf("Expected 2 networks, got %d", len(res.networks))
+	}
+	libera, oftc := *res.networks[0], *res.networks[1]
+	if libera != (ZNCNetwork{Name: "libera", OnIRC: true, Server: "irc.libera.chat", User: "me", Channels: 3}) {
+		t.Errorf("Unexpected first network: %+v", libera)
+	}
+	if oftc != (ZNCNetwork{Name: "oftc"}) {
+		t.Errorf("Unexpected second network: %+v", oftc)
+	}
+}
+
+func TestZNCRepliesAreNotFlood(t *testing.T) {
+	for _, znc := range []bool{true, false} {
+		c := newOfflineConn("tester")
+		if znc {
+			c.enabledCaps[CapZNCSelfMessage] = ""
+		}
+		var replies int
+		var ignores []*AutoIgnoreEvent
+		c.AddTypedHandler(func(evt TypedEvent) {
+			switch evt := evt.(type) {
+			case *ZNCEvent:
+				replies++
+			case *AutoIgnoreEvent:
+				ignores = append(ignores, evt)
+			}
+		})
+		done := make(chan []*ZNCNetwork, 1)
+		go func() {
+			networks, _ := c.ListNetworks(context.Background())
+			done <- networks
+		}()
+		waitSent(t, c)
+		lines := []string{
+			"+---------+--------+------------+----------+----------+",
+			"| Network | On IRC | IRC Server | IRC User | Channels |",
+			"+---------+--------+------------+----------+----------+",
+		}
+		for i := 0; i < 25; i++ {
+			lines = append(lines, fmt.Sprintf("| net%-4d | Yes    | irc.test   | me       | 1        |", i))
+		}
+		lines = append(lines, "+---------+--------+------------+----------+----------+")
+		zncReply(c, lines...)
+		if networks := <-done; len(networks) != 25 {
+			t.Errorf("Expected 25 networks, got %d", len(networks))
+		}
+		if !znc {
+			// Without the ZNC capabilities, *status is an ordinary user.
+			if len(ignores) != 1 {
+				t.Errorf("Expected *status to be flood-ignored without ZNC capabilities, got %+v", ignores)
+			}
+		} else if len(ignores) > 0 || replies != len(lines) {
+			t.Errorf("ZNC reply was counted as a flood: %d/%d lines handled, ignores %+v", replies, len(lines),
+				ignores)
+		}
+	}
+}
+
+func TestZNCTableMessage(t *testing.T) {
+	c := newOfflineConn("tester")
+	done := make(chan *ZNCTable, 1)
+	go func() {
+		table, _ := c.ZNCTableCommand(context.Background(), "ListNetworks")
+		done <- table
+	}()
+	waitSent(t, c)
+	zncReply(c, "You have no networks")
+	if table := <-done; table == nil || table.Message != "You have no networks" || len(table.Rows) != 0 {
+		t.Errorf("Unexpected table: %+v", table)
+	}
+}
+
+func TestZNCTableGet(t *testing.T) {
+	table := &ZNCTable{
+		Header: []string{"Network", "On IRC"},
+		Rows:   [][]string{{"libera", "Yes"}, {"short"}},
+	}
+	if value := table.Get(0, "onirc"); value != "Yes" {
+		t.Errorf("Column names weren't normalized: got %q", value)
+	} else if value = table.Get(1, "On IRC"); value != "" {
+		t.Errorf("Expected an empty value for a missing cell, got %q", value)
+	} else if value = table.Get(2, "Network"); value != "" {
+		t.Errorf("Expected an empty value for a missing row, got %q", value)
+	}
+}